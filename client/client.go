@@ -0,0 +1,324 @@
+// Package client is a Go client of the HTTP API of kave-server.
+//
+//	c, err := client.New("https://kave.example.com", client.Options{
+//		TokenSource: &client.ClientCredentials{
+//			TokenURL:     "https://my-domain.auth0.com/oauth/token",
+//			ClientID:     "my-service",
+//			ClientSecret: os.Getenv("KAVE_CLIENT_SECRET"),
+//			Audience:     "https://kave.example.com",
+//		},
+//		MaxRetries: 2,
+//	})
+//
+//	value, err := c.Get(ctx, "team-a:foo")
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBasePath is the default router base path of kave-server
+	DefaultBasePath = "/redis"
+
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Options configures a Client, the zero value being a client without auth nor retries.
+type Options struct {
+	// BasePath is the router base path of the server, defaults to DefaultBasePath
+	BasePath string
+	// HTTPClient sends the requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// TokenSource authorizes requests with a bearer token, requests are not authorized if nil
+	TokenSource TokenSource
+	// MaxRetries of requests failing with a network error, 429, 502, 503 or 504
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubling on every retry,
+	// unless the server asks to wait longer. Defaults to 100ms.
+	RetryBackoff time.Duration
+}
+
+// Client gets and sets key values in a kave server. It is safe for concurrent use.
+type Client struct {
+	url          *url.URL
+	basePath     string
+	httpClient   *http.Client
+	tokenSource  TokenSource
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+// New creates a Client of the server at serverURL, such as "https://kave.example.com".
+func New(serverURL string, options Options) (*Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("server url must be http or https: %s", serverURL)
+	}
+
+	c := &Client{
+		url:          u,
+		basePath:     options.BasePath,
+		httpClient:   options.HTTPClient,
+		tokenSource:  options.TokenSource,
+		maxRetries:   options.MaxRetries,
+		retryBackoff: options.RetryBackoff,
+	}
+
+	if c.basePath == "" {
+		c.basePath = DefaultBasePath
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	if c.retryBackoff == 0 {
+		c.retryBackoff = defaultRetryBackoff
+	}
+
+	return c, nil
+}
+
+// URL returns the url of a path in the server, which may hold a query.
+func (c *Client) URL(path string) (*url.URL, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *c.url
+	u.Path = strings.TrimSuffix(c.url.Path, "/") + ref.Path
+	u.RawPath = strings.TrimSuffix(c.url.EscapedPath(), "/") + ref.EscapedPath()
+	u.RawQuery = ref.RawQuery
+
+	return &u, nil
+}
+
+// NewRequest creates a request to a path in the server, such as an admin
+// route not covered by the methods of Client, to be sent with Do.
+func (c *Client) NewRequest(ctx context.Context, method string, path string, body []byte) (*http.Request, error) {
+	u, err := c.URL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	return http.NewRequestWithContext(ctx, method, u.String(), reader)
+}
+
+// Do sends a request authorized by the token source, retrying it if allowed.
+// The response is returned whatever its status, failed responses can be
+// turned into errors with CheckResponse.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.tokenSource != nil {
+		token, err := c.tokenSource.Token(req.Context())
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain token: %w", err)
+		}
+
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.httpClient.Do(req)
+		if attempt >= c.maxRetries || !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		wait := backoff
+		if resp != nil {
+			if retryAfter := parseRetryAfter(resp); retryAfter > wait {
+				wait = retryAfter
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		backoff *= 2
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		// requests are sent again with a fresh body
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryable tells whether a request may succeed if sent again. Every request
+// of the API is idempotent, so any request is retried.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter returns the wait asked by the Retry-After header, in seconds, if any.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (c *Client) keyPath(key string) string {
+	return fmt.Sprintf("%s/%s", c.basePath, url.PathEscape(key))
+}
+
+// do sends a request and checks its response, which must be closed.
+func (c *Client) do(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Get returns the value of a key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.keyPath(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Set sets the value of a key. Values exceeding a quota fail with ErrQuotaExceeded.
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, c.keyPath(key), value)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete deletes a key, or returns ErrNotFound.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.keyPath(key), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// KeyInfo describes a listed key.
+type KeyInfo struct {
+	Key string `json:"key"`
+	// TTLMs is the time to live of the key in milliseconds, 0 if it does not expire
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+}
+
+// ListOptions selects the keys listed.
+type ListOptions struct {
+	Prefix string
+	// Cursor of the previous page, empty for the first page
+	Cursor string
+	// Limit of keys per page, the server default if 0
+	Limit int
+}
+
+// KeyPage is a page of listed keys.
+type KeyPage struct {
+	Keys []KeyInfo `json:"keys"`
+	// Cursor of the next page, empty on the last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// List returns a page of the keys the caller may read. Pages may hold fewer
+// keys than the limit, even none, before the last page.
+func (c *Client) List(ctx context.Context, options ListOptions) (*KeyPage, error) {
+	query := url.Values{"prefix": {options.Prefix}}
+	if options.Cursor != "" {
+		query.Set("cursor", options.Cursor)
+	}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, c.basePath+"/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	page := &KeyPage{}
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// ListAll returns every key starting with prefix the caller may read.
+func (c *Client) ListAll(ctx context.Context, prefix string) ([]KeyInfo, error) {
+	keys := []KeyInfo{}
+	options := ListOptions{Prefix: prefix}
+
+	for {
+		page, err := c.List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, page.Keys...)
+
+		if page.Cursor == "" {
+			return keys, nil
+		}
+		options.Cursor = page.Cursor
+	}
+}
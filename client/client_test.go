@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryServer is a stand-in of kave-server holding keys in memory
+type memoryServer struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/redis/" {
+		page := KeyPage{Keys: []KeyInfo{}}
+		for key := range s.values {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				page.Keys = append(page.Keys, KeyInfo{Key: key})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.EscapedPath(), "/redis/")
+	if strings.HasPrefix(key, "secret") {
+		http.Error(w, "missing permission", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := s.values[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(value)
+	case http.MethodPost:
+		value, _ := io.ReadAll(r.Body)
+		if len(value) > 8 {
+			http.Error(w, "quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.values[key] = value
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if _, ok := s.values[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.values, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	server := httptest.NewServer(&memoryServer{values: map[string][]byte{}})
+	defer server.Close()
+
+	c, err := New(server.URL, Options{TokenSource: StaticToken("secret")})
+	assert.NoError(t, err)
+
+	// set, get and delete a key
+	{
+		assert.NoError(t, c.Set(ctx, "foo", []byte("bar")))
+
+		value, err := c.Get(ctx, "foo")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bar"), value)
+
+		assert.NoError(t, c.Delete(ctx, "foo"))
+
+		_, err = c.Get(ctx, "foo")
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, c.Delete(ctx, "foo"), ErrNotFound)
+	}
+
+	// keys are escaped
+	{
+		assert.NoError(t, c.Set(ctx, "a/b c", []byte("baz")))
+
+		value, err := c.Get(ctx, "a/b c")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("baz"), value)
+	}
+
+	// list keys by prefix
+	{
+		assert.NoError(t, c.Set(ctx, "team:one", nil))
+		assert.NoError(t, c.Set(ctx, "team:two", nil))
+
+		keys, err := c.ListAll(ctx, "team:")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []KeyInfo{{Key: "team:one"}, {Key: "team:two"}}, keys)
+	}
+
+	// failed responses are typed errors
+	{
+		_, err := c.Get(ctx, "secret")
+		assert.ErrorIs(t, err, ErrForbidden)
+		assert.NotErrorIs(t, err, ErrNotFound)
+
+		var clientErr *Error
+		assert.True(t, errors.As(err, &clientErr))
+		assert.Equal(t, http.StatusForbidden, clientErr.StatusCode)
+		assert.Equal(t, "missing permission", clientErr.Message)
+
+		assert.ErrorIs(t, c.Set(ctx, "foo", []byte("too long value")), ErrQuotaExceeded)
+	}
+
+	// requests without token are unauthorized
+	{
+		c, err := New(server.URL, Options{})
+		assert.NoError(t, err)
+
+		_, err = c.Get(ctx, "foo")
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	}
+
+	// token source errors fail the request
+	{
+		c, err := New(server.URL, Options{TokenSource: TokenSourceFunc(func(ctx context.Context) (string, error) {
+			return "", errors.New("no token")
+		})})
+		assert.NoError(t, err)
+
+		_, err = c.Get(ctx, "foo")
+		assert.ErrorContains(t, err, "no token")
+	}
+
+	// servers under a path are supported
+	{
+		c, err := New(server.URL+"/", Options{TokenSource: StaticToken("secret")})
+		assert.NoError(t, err)
+
+		u, err := c.URL("/redis/a%2Fb?prefix=a")
+		assert.NoError(t, err)
+		assert.Equal(t, server.URL+"/redis/a%2Fb?prefix=a", u.String())
+	}
+
+	// server urls must be http
+	{
+		_, err := New("localhost:8001", Options{})
+		assert.Error(t, err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+
+	var attempts int
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// requests are retried with their body
+	{
+		c, err := New(server.URL, Options{MaxRetries: 2, RetryBackoff: time.Millisecond})
+		assert.NoError(t, err)
+
+		assert.NoError(t, c.Set(ctx, "foo", []byte("bar")))
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, []string{"bar", "bar", "bar"}, bodies)
+	}
+
+	// requests fail once retries are exhausted
+	{
+		attempts = 0
+
+		c, err := New(server.URL, Options{MaxRetries: 1, RetryBackoff: time.Millisecond})
+		assert.NoError(t, err)
+
+		var clientErr *Error
+		assert.True(t, errors.As(c.Set(ctx, "foo", []byte("bar")), &clientErr))
+		assert.Equal(t, http.StatusServiceUnavailable, clientErr.StatusCode)
+		assert.Equal(t, 2, attempts)
+	}
+
+	// requests are not retried by default
+	{
+		attempts = 0
+
+		c, err := New(server.URL, Options{})
+		assert.NoError(t, err)
+
+		assert.Error(t, c.Set(ctx, "foo", []byte("bar")))
+		assert.Equal(t, 1, attempts)
+	}
+
+	// retries stop when the context is done
+	{
+		attempts = 0
+
+		c, err := New(server.URL, Options{MaxRetries: 5, RetryBackoff: time.Hour})
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, c.Set(ctx, "foo", []byte("bar")), context.DeadlineExceeded)
+		assert.Equal(t, 1, attempts)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	var requests int
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, r.ParseForm())
+
+		if r.PostForm.Get("client_secret") != "s3cret" {
+			http.Error(w, `{"error":"access_denied"}`, http.StatusUnauthorized)
+			return
+		}
+
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "kave", r.PostForm.Get("audience"))
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer provider.Close()
+
+	// tokens are kept until they expire
+	{
+		source := &ClientCredentials{TokenURL: provider.URL, ClientID: "service", ClientSecret: "s3cret", Audience: "kave"}
+
+		for i := 0; i < 2; i++ {
+			token, err := source.Token(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, "token", token)
+		}
+		assert.Equal(t, 1, requests)
+	}
+
+	// failed token requests are errors
+	{
+		source := &ClientCredentials{TokenURL: provider.URL, ClientID: "service", ClientSecret: "wrong"}
+
+		_, err := source.Token(ctx)
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorMessage is the most read from the body of a failed response.
+const maxErrorMessage = 1024
+
+var (
+	// ErrNotFound is returned when the key does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized is returned when the token is missing, invalid or revoked
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned when the token does not allow the operation
+	ErrForbidden = errors.New("forbidden")
+	// ErrQuotaExceeded is returned when a value does not fit in a quota of the key
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrRateLimited is returned when the caller exceeded its rate limit, once retries are exhausted
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// Error is a failed response of the server. It matches the error variables
+// of this package with errors.Is.
+type Error struct {
+	StatusCode int
+	// Message is the body of the response, if any
+	Message string
+}
+
+func (e *Error) Error() string {
+	status := fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message == "" {
+		return status
+	}
+	return fmt.Sprintf("%s: %s", status, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrQuotaExceeded:
+		return e.StatusCode == http.StatusInsufficientStorage || e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	default:
+		return false
+	}
+}
+
+// CheckResponse returns an *Error for responses without a 2xx status.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(message)),
+	}
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	revocationsPath = "/_admin/revocations"
+
+	revocationKindJTI    = "jti"
+	revocationKindClient = "client"
+)
+
+var errRevocationDisabled = fmt.Errorf("revocation is not enabled in the kave server")
+
+// adminCmd groups the commands managing the kave server
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage the kave server, requires admin permissions",
+}
+
+var adminRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke tokens before they expire",
+}
+
+var adminRevokeTokenCmd = &cobra.Command{
+	Use:   "token <token>",
+	Short: "Revoke a single token, given as JWT",
+	Long:  "Revoke a single token, given as JWT. The token is decoded locally to find its jti and expiry.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		claims, err := decodeTokenClaims(args[0])
+		if err != nil {
+			return err
+		}
+
+		if claims.JTI == "" {
+			return fmt.Errorf("token has no jti, revoke its client instead")
+		}
+
+		return revoke(cmd, map[string]interface{}{
+			revocationKindJTI: claims.JTI,
+			"exp":             claims.Exp,
+		})
+	},
+}
+
+var adminRevokeJTICmd = &cobra.Command{
+	Use:   "jti <jti>",
+	Short: "Revoke a single token by its jti",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		exp, err := cmd.Flags().GetInt64("exp")
+		if err != nil {
+			return err
+		}
+
+		return revoke(cmd, map[string]interface{}{
+			revocationKindJTI: args[0],
+			"exp":             exp,
+		})
+	},
+}
+
+var adminRevokeClientCmd = &cobra.Command{
+	Use:   "client <client-id>",
+	Short: "Revoke every token issued to a client until now",
+	Long:  "Revoke every token issued to a client until now, matched against the azp (or client_id) and sub claims. Tokens issued afterwards, e.g. with a rotated secret, are valid.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return revoke(cmd, map[string]interface{}{
+			revocationKindClient: args[0],
+		})
+	},
+}
+
+var adminUnrevokeCmd = &cobra.Command{
+	Use:   "unrevoke jti|client <id>",
+	Short: "Remove a revocation",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if args[0] != revocationKindJTI && args[0] != revocationKindClient {
+			return fmt.Errorf("kind must be %s or %s", revocationKindJTI, revocationKindClient)
+		}
+
+		query := url.Values{args[0]: []string{args[1]}}.Encode()
+
+		resp, err := doAdminRequest(cmd, http.MethodDelete, revocationsPath+"?"+query, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// also returned when revocation is disabled
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s '%s' is not revoked", args[0], args[1])
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("failed to remove revocation: %s", resp.Status)
+		}
+
+		return nil
+	},
+}
+
+var adminRevocationsCmd = &cobra.Command{
+	Use:   "revocations",
+	Short: "List revoked tokens and clients",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SetOut(os.Stdout)
+
+		resp, err := doAdminRequest(cmd, http.MethodGet, revocationsPath, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return errRevocationDisabled
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to list revocations: %s", resp.Status)
+		}
+
+		var revocations []revocation
+		if err := json.NewDecoder(resp.Body).Decode(&revocations); err != nil {
+			return err
+		}
+
+		for _, r := range revocations {
+			printRevocation(cmd, r)
+		}
+
+		return nil
+	},
+}
+
+type revocation struct {
+	Kind      string    `json:"kind"`
+	ID        string    `json:"id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func printRevocation(cmd *cobra.Command, r revocation) {
+	cmd.Printf("%s\t%s\trevoked %s\texpires %s\n",
+		r.Kind,
+		r.ID,
+		r.RevokedAt.Local().Format(time.RFC3339),
+		r.ExpiresAt.Local().Format(time.RFC3339),
+	)
+}
+
+func revoke(cmd *cobra.Command, body map[string]interface{}) error {
+	cmd.SetOut(os.Stdout)
+
+	buf, _ := json.Marshal(body)
+
+	resp, err := doAdminRequest(cmd, http.MethodPost, revocationsPath, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errRevocationDisabled
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to revoke: %s", resp.Status)
+	}
+
+	var r revocation
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+
+	printRevocation(cmd, r)
+
+	return nil
+}
+
+// doAdminRequest sends an authorized request to an admin endpoint
+func doAdminRequest(cmd *cobra.Command, method string, path string, body []byte) (*http.Response, error) {
+	resp, err := doServerRequest(cmd, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, fmt.Errorf("token is not allowed to %s %s", method, resp.Request.URL.Path)
+	}
+
+	return resp, nil
+}
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+	adminCmd.AddCommand(adminRevokeCmd)
+	adminCmd.AddCommand(adminUnrevokeCmd)
+	adminCmd.AddCommand(adminRevocationsCmd)
+	adminRevokeCmd.AddCommand(adminRevokeTokenCmd)
+	adminRevokeCmd.AddCommand(adminRevokeJTICmd)
+	adminRevokeCmd.AddCommand(adminRevokeClientCmd)
+
+	adminCmd.PersistentFlags().String(kaveFlagToken, "", "token to use for authorization")
+	adminRevokeJTICmd.Flags().Int64("exp", 0, "expiry of the token in seconds since epoch, defaults to the longest token lifetime")
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const auditPath = "/_audit"
+
+var errAuditDisabled = fmt.Errorf("audit is not enabled in the kave server")
+
+// auditCmd queries the audit log of the server
+var auditCmd = &cobra.Command{
+	Use:   "audit [key]",
+	Short: "Show who read or wrote keys, or a key, and when",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SetOut(os.Stdout)
+
+		since, err := cmd.Flags().GetString("since")
+		if err != nil {
+			return err
+		}
+
+		limit, err := cmd.Flags().GetInt("limit")
+		if err != nil {
+			return err
+		}
+
+		query := url.Values{}
+		if len(args) == 1 {
+			query.Set("key", args[0])
+		}
+		if since != "" {
+			query.Set("since", since)
+		}
+		if limit > 0 {
+			query.Set("limit", strconv.Itoa(limit))
+		}
+		resp, err := doAdminRequest(cmd, http.MethodGet, auditPath+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return errAuditDisabled
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to query audit log: %s", resp.Status)
+		}
+
+		events := []struct {
+			Time      time.Time `json:"time"`
+			Subject   string    `json:"subject"`
+			Client    string    `json:"client"`
+			Presigned bool      `json:"presigned"`
+			Operation string    `json:"operation"`
+			Key       string    `json:"key"`
+			Status    int       `json:"status"`
+			Outcome   string    `json:"outcome"`
+		}{}
+
+		if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			who := e.Subject
+			if e.Client != "" && e.Client != e.Subject {
+				who += " (" + e.Client + ")"
+			}
+			if e.Presigned {
+				who += " (pre-signed)"
+			}
+			if who == "" {
+				who = "-"
+			}
+
+			cmd.Printf("%s\t%s\t%s\t%s\t%s %d\n",
+				e.Time.Local().Format(time.RFC3339),
+				who,
+				e.Operation,
+				e.Key,
+				e.Outcome, e.Status,
+			)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+
+	auditCmd.Flags().String(kaveFlagToken, "", "token to use for authorization")
+	auditCmd.Flags().String("since", "", "show events since a RFC3339 time or a duration ago, such as 1h")
+	auditCmd.Flags().Int("limit", 0, "maximum number of events, defaults to the server's")
+}
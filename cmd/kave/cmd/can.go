@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const authzCheckPath = "/_authz/check"
+
+// canCmd asks the kave server whether the current token may access a key
+var canCmd = &cobra.Command{
+	Use:   "can",
+	Short: "Check whether the current token may get or set a key",
+}
+
+var canGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Check whether the current token may get a key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return checkPermission(cmd, "read", args[0])
+	},
+}
+
+var canSetCmd = &cobra.Command{
+	Use:   "set <key>",
+	Short: "Check whether the current token may set a key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return checkPermission(cmd, "write", args[0])
+	},
+}
+
+func checkPermission(cmd *cobra.Command, operation string, key string) error {
+	cmd.SetOut(os.Stdout)
+
+	buf, _ := json.Marshal(map[string]string{
+		"key":       key,
+		"operation": operation,
+	})
+
+	resp, err := doServerRequest(cmd, http.MethodPost, authzCheckPath, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("authorization is not enabled in the kave server")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to check permission: %s", resp.Status)
+	}
+
+	check := struct {
+		Allowed     bool     `json:"allowed"`
+		Required    string   `json:"required"`
+		Permissions []string `json:"permissions"`
+		Reason      string   `json:"reason"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&check)
+	if err != nil {
+		return err
+	}
+
+	allowed := "no"
+	if check.Allowed {
+		allowed = "yes"
+	}
+
+	cmd.Printf("allowed:     %s\n", allowed)
+	cmd.Printf("required:    %s\n", check.Required)
+	cmd.Printf("reason:      %s\n", check.Reason)
+	cmd.Printf("permissions: %s\n", strings.Join(check.Permissions, " "))
+
+	if !check.Allowed {
+		return fmt.Errorf("%s is not allowed", check.Required)
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(canCmd)
+	canCmd.AddCommand(canGetCmd)
+	canCmd.AddCommand(canSetCmd)
+
+	canCmd.PersistentFlags().String(kaveFlagToken, "", "token to use for authorization")
+}
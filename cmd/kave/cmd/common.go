@@ -1,7 +1,8 @@
 package cmd
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -14,17 +15,66 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pdcalado/kave/client"
 )
 
-func createRequestUrl(cmd *cobra.Command, key string) (*url.URL, error) {
+// cliMaxRetries of requests failing with a network error or rate limited
+const cliMaxRetries = 2
+
+// newClient creates a client of the kave server, authorized with the token
+// of the command if auth is enabled
+func newClient(cmd *cobra.Command) (*client.Client, error) {
+	u, err := createServerUrl(cmd, "")
+	if err != nil {
+		return nil, err
+	}
+
+	options := client.Options{
+		BasePath:   cmd.Flag(kaveFlagRouterBasePath).Value.String(),
+		MaxRetries: cliMaxRetries,
+	}
+
+	if isAuthEnabled(cmd) {
+		options.TokenSource = client.TokenSourceFunc(func(ctx context.Context) (string, error) {
+			return obtainRefreshToken(cmd)
+		})
+	}
+
+	return client.New(u.String(), options)
+}
+
+// doServerRequest sends an authorized request to a path of the kave server,
+// which may hold a query. Bodies are sent as JSON.
+func doServerRequest(cmd *cobra.Command, method string, path string, body []byte) (*http.Response, error) {
+	c, err := newClient(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.NewRequest(cmd.Context(), method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return c.Do(req)
+}
+
+// createServerUrl creates the url of a path in the kave server
+func createServerUrl(cmd *cobra.Command, path string) (*url.URL, error) {
 	urlStr := cmd.Flag(kaveFlagUrl).Value.String()
-	basePath := cmd.Flag(kaveFlagRouterBasePath).Value.String()
 
 	if !strings.HasPrefix(urlStr, "http") && !strings.HasPrefix(urlStr, "https") {
 		urlStr = "http://" + urlStr
 	}
 
-	u, err := url.Parse(fmt.Sprintf("%s%s/%s", urlStr, basePath, url.PathEscape(key)))
+	u, err := url.Parse(urlStr + path)
 	if err != nil {
 		return nil, err
 	}
@@ -36,6 +86,60 @@ func createRequestUrl(cmd *cobra.Command, key string) (*url.URL, error) {
 	return u, nil
 }
 
+// traceCommand continues the trace of the TRACEPARENT env variable, or starts
+// one if tracing is requested, so the requests made carry a traceparent header.
+func traceCommand(cmd *cobra.Command) error {
+	traceRequested, err := cmd.Flags().GetBool(kaveFlagTrace)
+	if err != nil {
+		return err
+	}
+
+	traceparent, ok := os.LookupEnv(envTraceparent)
+	if !traceRequested && !ok {
+		return nil
+	}
+
+	ctx := propagation.TraceContext{}.Extract(cmd.Context(), propagation.MapCarrier{"traceparent": traceparent})
+	parent := trace.SpanContextFromContext(ctx)
+
+	config := trace.SpanContextConfig{
+		TraceID:    parent.TraceID(),
+		TraceFlags: parent.TraceFlags(),
+	}
+
+	if !parent.IsValid() {
+		if _, err := rand.Read(config.TraceID[:]); err != nil {
+			return err
+		}
+		config.TraceFlags = trace.FlagsSampled
+	}
+
+	if _, err := rand.Read(config.SpanID[:]); err != nil {
+		return err
+	}
+
+	cmd.SetContext(trace.ContextWithSpanContext(cmd.Context(), trace.NewSpanContext(config)))
+
+	if traceRequested {
+		cmd.PrintErrf("trace id: %s\n", config.TraceID)
+	}
+
+	http.DefaultClient.Transport = tracingTransport{next: http.DefaultTransport}
+
+	return nil
+}
+
+// tracingTransport sets the traceparent header from the context of requests.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	propagation.TraceContext{}.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	return t.next.RoundTrip(req)
+}
+
 // obtainRefreshToken reads token from cli, or from cache
 // If expired, obtains new token from provider and writes to cache
 func obtainRefreshToken(cmd *cobra.Command) (string, error) {
@@ -43,94 +147,85 @@ func obtainRefreshToken(cmd *cobra.Command) (string, error) {
 		return cmd.Flag(kaveFlagToken).Value.String(), nil
 	}
 
+	return obtainToken(cmd)
+}
+
+// obtainToken reads token from cache. If expired, it is refreshed with the
+// refresh token cached by 'kave login', or else obtained with the client
+// credentials, and written to cache.
+func obtainToken(cmd *cobra.Command) (string, error) {
 	token, ok := readTokenFromCache()
 	if ok {
 		return token, nil
 	}
 
-	token, err := obtainAccessToken(cmd)
+	refreshToken, ok := readCacheFile(kaveCacheRefreshTokenFile)
+	if ok {
+		response, err := refreshAccessToken(cmd, refreshToken)
+		if err == nil {
+			return response.AccessToken, writeTokensToCache(response)
+		}
+
+		if auth0ClientSecret == "" {
+			return "", fmt.Errorf("failed to refresh token, run 'kave login' again: %w", err)
+		}
+	}
+
+	if auth0ClientSecret == "" {
+		return "", fmt.Errorf("no client secret nor login, run 'kave login' first")
+	}
+
+	response, err := obtainAccessToken(cmd)
 	if err != nil {
 		return "", err
 	}
 
-	return token, writeTokenToCache(token)
+	return response.AccessToken, writeTokensToCache(response)
 }
 
 func isAuthEnabled(cmd *cobra.Command) bool {
 	return cmd.Flag(kaveFlagAuth0ClientID).Value.String() != ""
 }
 
-func setAuthorizationHeader(cmd *cobra.Command, req *http.Request) {
-	if !isAuthEnabled(cmd) {
-		return
-	}
-
-	token, err := obtainRefreshToken(cmd)
-	if err != nil {
-		panic("failed to obtain token: " + err.Error())
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-}
-
-func getTokenCachePath() (string, error) {
+func getCachePath(name string) (string, error) {
 	cacheDir, err := os.UserCacheDir()
 	if err != nil {
 		return "", err
 	}
 
-	return path.Join(cacheDir, kaveCacheDir, kaveCacheTokenFile), nil
+	return path.Join(cacheDir, kaveCacheDir, name), nil
 }
 
-// readTokenFromCache reads token from cache file and validates it.
-// 15 minutes to expiration considers the token invalid
-func readTokenFromCache() (string, bool) {
-	tokenCachePath, err := getTokenCachePath()
+// readCacheFile reads a file from the cache directory of kave, if it exists
+func readCacheFile(name string) (string, bool) {
+	cachePath, err := getCachePath(name)
 	if err != nil {
 		return "", false
 	}
 
-	file, err := os.Open(tokenCachePath)
+	buf, err := os.ReadFile(cachePath)
 	if err != nil {
 		return "", false
 	}
-	defer file.Close()
 
-	buf, err := io.ReadAll(file)
-	if err != nil {
-		return "", false
-	}
-
-	token := strings.TrimSpace(string(buf))
-
-	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		return "", false
-	}
+	content := strings.TrimSpace(string(buf))
 
-	jbuf, err := base64.RawStdEncoding.DecodeString(parts[1])
-	if err != nil {
-		return "", false
-	}
+	return content, content != ""
+}
 
-	tmp := struct {
-		Exp int64 `json:"exp"`
-	}{}
-	err = json.Unmarshal(jbuf, &tmp)
+// writeCacheFile writes a file readable only by the user to the cache
+// directory of kave, creating the directory if needed
+func writeCacheFile(name string, content string) error {
+	cachePath, err := getCachePath(name)
 	if err != nil {
-		return "", false
+		return err
 	}
 
-	return token, tmp.Exp > time.Now().Unix()+15*60
-}
-
-func writeTokenToCache(token string) error {
-	tokenCachePath, err := getTokenCachePath()
-	if err != nil {
+	if err := os.MkdirAll(path.Dir(cachePath), 0700); err != nil {
 		return err
 	}
 
-	file, err := os.Create(tokenCachePath)
+	file, err := os.Create(cachePath)
 	if err != nil {
 		return err
 	}
@@ -142,55 +237,62 @@ func writeTokenToCache(token string) error {
 		return err
 	}
 
-	_, err = io.WriteString(file, token)
+	_, err = io.WriteString(file, content)
 	return err
 }
 
-func obtainAccessToken(cmd *cobra.Command) (string, error) {
-	audience := cmd.Flag(kaveFlagAuth0Audience).Value.String()
-	domain := cmd.Flag(kaveFlagAuth0Domain).Value.String()
-	domain = strings.TrimPrefix(domain, "https://")
-	clientID := cmd.Flag(kaveFlagAuth0ClientID).Value.String()
+// readTokenFromCache reads token from cache file and validates it.
+// 15 minutes to expiration considers the token invalid
+func readTokenFromCache() (string, bool) {
+	token, ok := readCacheFile(kaveCacheTokenFile)
+	if !ok {
+		return "", false
+	}
 
-	secret := auth0ClientSecret
-	if secret == "" {
-		return "", fmt.Errorf("empty auth0 client secret")
+	claims, err := decodeTokenClaims(token)
+	if err != nil {
+		return "", false
 	}
 
-	urlStr := fmt.Sprintf("https://%s/oauth/token", domain)
+	return token, claims.Exp > time.Now().Unix()+15*60
+}
 
-	data := map[string]string{
-		"client_id":     clientID,
-		"client_secret": secret,
-		"audience":      audience,
-		"grant_type":    "client_credentials",
-	}
-	buf, _ := json.Marshal(data)
+type tokenClaims struct {
+	Subject     string   `json:"sub"`
+	Issuer      string   `json:"iss"`
+	Exp         int64    `json:"exp"`
+	JTI         string   `json:"jti"`
+	AzP         string   `json:"azp"`
+	ClientID    string   `json:"client_id"`
+	Permissions []string `json:"permissions"`
+}
 
-	req, err := http.NewRequest(http.MethodPost, urlStr, bytes.NewBuffer(buf))
-	if err != nil {
-		return "", err
+// decodeTokenClaims decodes the claims of a JWT without validating it
+func decodeTokenClaims(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT")
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req.WithContext(cmd.Context()))
+	jbuf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if resp.StatusCode/100 != 2 {
-		return "", fmt.Errorf("failed to obtain token: %s", resp.Status)
-	}
+	claims := &tokenClaims{}
+	return claims, json.Unmarshal(jbuf, claims)
+}
 
-	tokenResponse := struct {
-		AccessToken string `json:"access_token"`
-	}{}
+// writeTokensToCache writes the access token of a token response to cache,
+// and its refresh token if the provider issued (or rotated) one
+func writeTokensToCache(response *tokenResponse) error {
+	if err := writeCacheFile(kaveCacheTokenFile, response.AccessToken); err != nil {
+		return err
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
-	if err != nil {
-		return "", err
+	if response.RefreshToken == "" {
+		return nil
 	}
 
-	return tokenResponse.AccessToken, nil
+	return writeCacheFile(kaveCacheRefreshTokenFile, response.RefreshToken)
 }
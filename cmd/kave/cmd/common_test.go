@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObtainToken(t *testing.T) {
+	secret := auth0ClientSecret
+	t.Cleanup(func() { auth0ClientSecret = secret })
+
+	readCache := func(name string) string {
+		cachePath, err := getCachePath(name)
+		assert.NoError(t, err)
+		buf, err := os.ReadFile(cachePath)
+		assert.NoError(t, err)
+		return string(buf)
+	}
+
+	// tokens are refreshed, rotated refresh tokens being cached
+	{
+		useTestCache(t)
+		auth0ClientSecret = ""
+		assert.NoError(t, writeCacheFile(kaveCacheRefreshTokenFile, "refresh"))
+
+		provider := newTestProvider(t,
+			testTokenResponse{http.StatusOK, tokenResponse{AccessToken: "access", RefreshToken: "rotated"}},
+		)
+
+		token, err := obtainToken(newTestCommand(map[string]string{kaveFlagTokenURL: provider.URL}))
+		assert.NoError(t, err)
+		assert.Equal(t, "access", token)
+		assert.Equal(t, grantTypeRefreshToken, provider.forms[0]["grant_type"])
+		assert.Equal(t, "refresh", provider.forms[0]["refresh_token"])
+
+		assert.Equal(t, "access", readCache(kaveCacheTokenFile))
+		assert.Equal(t, "rotated", readCache(kaveCacheRefreshTokenFile))
+	}
+
+	// failed refreshes fall back to the client credentials when there is a secret
+	{
+		useTestCache(t)
+		auth0ClientSecret = "secret"
+		assert.NoError(t, writeCacheFile(kaveCacheRefreshTokenFile, "refresh"))
+
+		provider := newTestProvider(t,
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "invalid_grant"}},
+			testTokenResponse{http.StatusOK, tokenResponse{AccessToken: "access"}},
+		)
+
+		token, err := obtainToken(newTestCommand(map[string]string{
+			kaveFlagTokenURL:      provider.URL,
+			kaveFlagAuth0Audience: "kave",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, "access", token)
+
+		assert.Len(t, provider.forms, 2)
+		assert.Equal(t, grantTypeRefreshToken, provider.forms[0]["grant_type"])
+		assert.Equal(t, grantTypeClientCredentials, provider.forms[1]["grant_type"])
+		assert.Equal(t, "secret", provider.forms[1]["client_secret"])
+		assert.Equal(t, "kave", provider.forms[1]["audience"])
+	}
+
+	// or ask to login again when there is none
+	{
+		useTestCache(t)
+		auth0ClientSecret = ""
+		assert.NoError(t, writeCacheFile(kaveCacheRefreshTokenFile, "refresh"))
+
+		provider := newTestProvider(t,
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "invalid_grant"}},
+		)
+
+		_, err := obtainToken(newTestCommand(map[string]string{kaveFlagTokenURL: provider.URL}))
+		assert.EqualError(t, err, "failed to refresh token, run 'kave login' again: invalid_grant")
+
+		_, ok := readCacheFile(kaveCacheTokenFile)
+		assert.False(t, ok)
+	}
+}
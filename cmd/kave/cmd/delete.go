@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// deleteCmd deletes a key from a kave server
+var deleteCmd = &cobra.Command{
+	Use:   "delete <key>",
+	Short: "Delete a key from a kave server",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		if err := c.Delete(cmd.Context(), args[0]); err != nil {
+			return fmt.Errorf("failed to delete key: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+
+	deleteCmd.Flags().String(kaveFlagToken, "", "token to use for authorization")
+}
@@ -2,8 +2,6 @@ package cmd
 
 import (
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -15,30 +13,17 @@ var getCmd = &cobra.Command{
 	Short: "Get a key value from a kave server",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		key := args[0]
-
-		u, err := createRequestUrl(cmd, key)
+		c, err := newClient(cmd)
 		if err != nil {
 			return err
 		}
 
-		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		value, err := c.Get(cmd.Context(), args[0])
 		if err != nil {
-			return err
-		}
-
-		setAuthorizationHeader(cmd, req)
-
-		resp, err := http.DefaultClient.Do(req.WithContext(cmd.Context()))
-		if err != nil {
-			return err
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("failed to get key: %s", resp.Status)
+			return fmt.Errorf("failed to get key: %w", err)
 		}
 
-		_, err = io.Copy(os.Stdout, resp.Body)
+		_, err = os.Stdout.Write(value)
 		return err
 	},
 }
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// listCmd lists the keys the token may read
+var listCmd = &cobra.Command{
+	Use:   "list [prefix]",
+	Short: "List the keys, or the keys starting with a prefix, the token may read",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SetOut(os.Stdout)
+
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+
+		c, err := newClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		keys, err := c.ListAll(cmd.Context(), prefix)
+		if err != nil {
+			return fmt.Errorf("failed to list keys: %w", err)
+		}
+
+		for _, k := range keys {
+			if k.TTLMs == 0 {
+				cmd.Println(k.Key)
+				continue
+			}
+
+			ttl := time.Duration(k.TTLMs) * time.Millisecond
+			cmd.Printf("%s\texpires in %s\n", k.Key, ttl.Round(time.Second))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().String(kaveFlagToken, "", "token to use for authorization")
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	kaveFlagScopes = "scopes"
+
+	defaultDevicePollInterval = 5 * time.Second
+	defaultDevicePollSlowDown = 5 * time.Second
+)
+
+// offline_access asks the provider for a refresh token
+var defaultLoginScopes = []string{"openid", "profile", "offline_access"}
+
+// deviceAuthorization is the response of a device authorization endpoint (RFC 8628)
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// loginCmd signs a user in with the device authorization grant, so that no
+// client secret is needed on their machine
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Sign in to the auth provider from any browser",
+	Long: "Sign in to the auth provider with the OAuth2 device authorization grant. " +
+		"A code is printed to be entered in a browser, on this or any other device. " +
+		"The token obtained, and its refresh token if any, are cached for the other commands.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !isAuthEnabled(cmd) {
+			return fmt.Errorf("%s is not set", kaveFlagAuth0ClientID)
+		}
+
+		endpoints, err := resolveEndpoints(cmd)
+		if err != nil {
+			return err
+		}
+
+		if endpoints.DeviceAuthorizationURL == "" {
+			return fmt.Errorf("the auth provider does not support the device authorization grant, set %s", kaveFlagDeviceAuthorizationURL)
+		}
+
+		scopes, err := cmd.Flags().GetStringSlice(kaveFlagScopes)
+		if err != nil {
+			return err
+		}
+
+		form := url.Values{
+			"client_id": {cmd.Flag(kaveFlagAuth0ClientID).Value.String()},
+			"scope":     {strings.Join(scopes, " ")},
+		}
+		setAudience(cmd, form)
+
+		authorization := &deviceAuthorization{}
+		if err := postForm(cmd.Context(), endpoints.DeviceAuthorizationURL, form, authorization); err != nil {
+			return fmt.Errorf("failed to start login: %w", err)
+		}
+
+		if authorization.VerificationURIComplete != "" {
+			cmd.PrintErrf("Open %s and confirm the code %s\n", authorization.VerificationURIComplete, authorization.UserCode)
+		} else {
+			cmd.PrintErrf("Open %s and enter the code %s\n", authorization.VerificationURI, authorization.UserCode)
+		}
+
+		response, err := pollDeviceToken(cmd, endpoints.TokenURL, authorization, devicePolling{
+			interval: defaultDevicePollInterval,
+			slowDown: defaultDevicePollSlowDown,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := writeTokensToCache(response); err != nil {
+			return err
+		}
+
+		if response.RefreshToken == "" {
+			cmd.PrintErrln("Logged in. No refresh token was issued, run 'kave login' again once the token expires.")
+		} else {
+			cmd.PrintErrln("Logged in.")
+		}
+
+		return nil
+	},
+}
+
+// devicePolling tells how often the token endpoint is polled during a device login.
+type devicePolling struct {
+	// interval is used when the provider does not set one
+	interval time.Duration
+	// slowDown is added to the interval whenever the provider asks to slow down
+	slowDown time.Duration
+}
+
+// pollDeviceToken polls the token endpoint until the user completes the
+// login, denies it, or the device code expires.
+func pollDeviceToken(cmd *cobra.Command, tokenURL string, authorization *deviceAuthorization, polling devicePolling) (*tokenResponse, error) {
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval <= 0 {
+		interval = polling.interval
+	}
+
+	var expired <-chan time.Time
+	if authorization.ExpiresIn > 0 {
+		expired = time.After(time.Duration(authorization.ExpiresIn) * time.Second)
+	}
+
+	for {
+		select {
+		case <-cmd.Context().Done():
+			return nil, cmd.Context().Err()
+		case <-expired:
+			return nil, fmt.Errorf("login expired, run 'kave login' again")
+		case <-time.After(interval):
+		}
+
+		response := &tokenResponse{}
+		err := postForm(cmd.Context(), tokenURL, url.Values{
+			"grant_type":  {grantTypeDeviceCode},
+			"device_code": {authorization.DeviceCode},
+			"client_id":   {cmd.Flag(kaveFlagAuth0ClientID).Value.String()},
+		}, response)
+
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			switch oauthErr.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += polling.slowDown
+				continue
+			case "expired_token":
+				return nil, fmt.Errorf("login expired, run 'kave login' again")
+			case "access_denied":
+				return nil, fmt.Errorf("login denied")
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to login: %w", err)
+		}
+
+		if response.AccessToken == "" {
+			return nil, fmt.Errorf("failed to login: no access token in response")
+		}
+
+		return response, nil
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+
+	loginCmd.Flags().StringSlice(kaveFlagScopes, defaultLoginScopes, "scopes requested to the auth provider")
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollDeviceToken(t *testing.T) {
+	polling := devicePolling{interval: 10 * time.Millisecond, slowDown: 100 * time.Millisecond}
+
+	cmd := newTestCommand(map[string]string{kaveFlagAuth0ClientID: "cli"})
+	authorization := &deviceAuthorization{DeviceCode: "device-code"}
+
+	// tokens are polled until the login completes, slower when asked to
+	{
+		provider := newTestProvider(t,
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "authorization_pending"}},
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "slow_down"}},
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "authorization_pending"}},
+			testTokenResponse{http.StatusOK, tokenResponse{AccessToken: "access", RefreshToken: "refresh"}},
+		)
+
+		response, err := pollDeviceToken(cmd, provider.URL, authorization, polling)
+		assert.NoError(t, err)
+		assert.Equal(t, "access", response.AccessToken)
+		assert.Equal(t, "refresh", response.RefreshToken)
+
+		assert.Len(t, provider.forms, 4)
+		assert.Equal(t, map[string]string{
+			"grant_type":  grantTypeDeviceCode,
+			"device_code": "device-code",
+			"client_id":   "cli",
+		}, provider.forms[0])
+
+		assert.Less(t, provider.times[1].Sub(provider.times[0]), polling.slowDown)
+		assert.GreaterOrEqual(t, provider.times[2].Sub(provider.times[1]), polling.slowDown)
+		assert.GreaterOrEqual(t, provider.times[3].Sub(provider.times[2]), polling.slowDown)
+	}
+
+	// denied and expired logins fail
+	{
+		provider := newTestProvider(t,
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "access_denied"}},
+			testTokenResponse{http.StatusBadRequest, tokenResponse{Error: "expired_token"}},
+		)
+
+		_, err := pollDeviceToken(cmd, provider.URL, authorization, polling)
+		assert.EqualError(t, err, "login denied")
+
+		_, err = pollDeviceToken(cmd, provider.URL, authorization, polling)
+		assert.EqualError(t, err, "login expired, run 'kave login' again")
+	}
+
+	// responses without access token fail, rather than caching an empty token
+	{
+		provider := newTestProvider(t,
+			testTokenResponse{http.StatusOK, tokenResponse{RefreshToken: "refresh"}},
+		)
+
+		_, err := pollDeviceToken(cmd, provider.URL, authorization, polling)
+		assert.EqualError(t, err, "failed to login: no access token in response")
+	}
+}
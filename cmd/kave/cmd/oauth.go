@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeRefreshToken      = "refresh_token"
+	grantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// oauthEndpoints holds the endpoints of the auth provider used by the cli
+type oauthEndpoints struct {
+	TokenURL               string `json:"token_endpoint"`
+	DeviceAuthorizationURL string `json:"device_authorization_endpoint"`
+}
+
+// tokenResponse is the response of a token endpoint, successful or not
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oauthError is an error returned by the auth provider, such as
+// "authorization_pending" while a device login is not complete
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// resolveEndpoints finds the endpoints of the auth provider. Endpoints set
+// explicitly take precedence over those discovered from the OIDC issuer,
+// which in turn take precedence over those of the Auth0 domain.
+func resolveEndpoints(cmd *cobra.Command) (*oauthEndpoints, error) {
+	endpoints := &oauthEndpoints{
+		TokenURL:               cmd.Flag(kaveFlagTokenURL).Value.String(),
+		DeviceAuthorizationURL: cmd.Flag(kaveFlagDeviceAuthorizationURL).Value.String(),
+	}
+
+	issuer := cmd.Flag(kaveFlagIssuer).Value.String()
+	if issuer != "" && (endpoints.TokenURL == "" || endpoints.DeviceAuthorizationURL == "") {
+		discovered, err := discoverEndpoints(cmd.Context(), issuer)
+		if err != nil {
+			return nil, err
+		}
+
+		if endpoints.TokenURL == "" {
+			endpoints.TokenURL = discovered.TokenURL
+		}
+		if endpoints.DeviceAuthorizationURL == "" {
+			endpoints.DeviceAuthorizationURL = discovered.DeviceAuthorizationURL
+		}
+	}
+
+	domain := cmd.Flag(kaveFlagAuth0Domain).Value.String()
+	if domain != "" {
+		// an explicit scheme is kept, e.g. a self-hosted kave-server issuer over http
+		domain = strings.TrimSuffix(withHTTPSScheme(domain), "/")
+
+		if endpoints.TokenURL == "" {
+			endpoints.TokenURL = domain + "/oauth/token"
+		}
+		if endpoints.DeviceAuthorizationURL == "" {
+			endpoints.DeviceAuthorizationURL = domain + "/oauth/device/code"
+		}
+	}
+
+	if endpoints.TokenURL == "" {
+		return nil, fmt.Errorf("no token endpoint, set %s, %s or %s", kaveFlagIssuer, kaveFlagTokenURL, kaveFlagAuth0Domain)
+	}
+
+	return endpoints, nil
+}
+
+// discoverEndpoints reads the endpoints from the OIDC discovery document of an issuer
+func discoverEndpoints(ctx context.Context, issuer string) (*oauthEndpoints, error) {
+	urlStr := strings.TrimSuffix(withHTTPSScheme(issuer), "/") + oidcDiscoveryPath
+
+	req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover auth provider: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover auth provider: %s", resp.Status)
+	}
+
+	endpoints := &oauthEndpoints{}
+	if err := json.NewDecoder(resp.Body).Decode(endpoints); err != nil {
+		return nil, fmt.Errorf("failed to discover auth provider: %w", err)
+	}
+
+	return endpoints, nil
+}
+
+func withHTTPSScheme(urlStr string) string {
+	if strings.HasPrefix(urlStr, "http://") || strings.HasPrefix(urlStr, "https://") {
+		return urlStr
+	}
+	return "https://" + urlStr
+}
+
+// postForm posts a form to an endpoint of the auth provider, decoding the JSON response into v.
+// OAuth2 errors in the response are returned as *oauthError.
+func postForm(ctx context.Context, urlStr string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, urlStr, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		errResponse := tokenResponse{}
+		if json.NewDecoder(resp.Body).Decode(&errResponse) == nil && errResponse.Error != "" {
+			return &oauthError{Code: errResponse.Error, Description: errResponse.ErrorDescription}
+		}
+		return fmt.Errorf("unexpected response from %s: %s", urlStr, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// requestToken requests a token from the token endpoint of the auth provider
+func requestToken(cmd *cobra.Command, form url.Values) (*tokenResponse, error) {
+	endpoints, err := resolveEndpoints(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	form.Set("client_id", cmd.Flag(kaveFlagAuth0ClientID).Value.String())
+
+	response := &tokenResponse{}
+	if err := postForm(cmd.Context(), endpoints.TokenURL, form, response); err != nil {
+		return nil, err
+	}
+
+	if response.AccessToken == "" {
+		return nil, fmt.Errorf("failed to obtain token: no access token in response")
+	}
+
+	return response, nil
+}
+
+// obtainAccessToken obtains a token with the client credentials grant
+func obtainAccessToken(cmd *cobra.Command) (*tokenResponse, error) {
+	secret := auth0ClientSecret
+	if secret == "" {
+		return nil, fmt.Errorf("empty auth0 client secret")
+	}
+
+	form := url.Values{
+		"grant_type":    {grantTypeClientCredentials},
+		"client_secret": {secret},
+	}
+	setAudience(cmd, form)
+
+	return requestToken(cmd, form)
+}
+
+// refreshAccessToken obtains a token with a refresh token, the client secret
+// being sent along if set
+func refreshAccessToken(cmd *cobra.Command, refreshToken string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {grantTypeRefreshToken},
+		"refresh_token": {refreshToken},
+	}
+	if auth0ClientSecret != "" {
+		form.Set("client_secret", auth0ClientSecret)
+	}
+
+	return requestToken(cmd, form)
+}
+
+func setAudience(cmd *cobra.Command, form url.Values) {
+	audience := cmd.Flag(kaveFlagAuth0Audience).Value.String()
+	if audience != "" {
+		form.Set("audience", audience)
+	}
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// testProvider is an auth provider replying to token requests with the
+// responses queued, recording the forms posted.
+type testProvider struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []testTokenResponse
+	forms     []map[string]string
+	times     []time.Time
+}
+
+type testTokenResponse struct {
+	status int
+	body   tokenResponse
+}
+
+func newTestProvider(t *testing.T, responses ...testTokenResponse) *testProvider {
+	p := &testProvider{responses: responses}
+
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == oidcDiscoveryPath {
+			_ = json.NewEncoder(w).Encode(oauthEndpoints{
+				TokenURL:               p.URL + "/discovered/token",
+				DeviceAuthorizationURL: p.URL + "/discovered/device",
+			})
+			return
+		}
+
+		assert.NoError(t, r.ParseForm())
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		form := map[string]string{}
+		for name := range r.PostForm {
+			form[name] = r.PostForm.Get(name)
+		}
+		p.forms = append(p.forms, form)
+		p.times = append(p.times, time.Now())
+
+		if len(p.responses) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		response := p.responses[0]
+		p.responses = p.responses[1:]
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.status)
+		_ = json.NewEncoder(w).Encode(response.body)
+	}))
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// newTestCommand returns a command holding the auth flags set to values.
+func newTestCommand(values map[string]string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+
+	for _, name := range []string{
+		kaveFlagAuth0Audience,
+		kaveFlagAuth0Domain,
+		kaveFlagAuth0ClientID,
+		kaveFlagIssuer,
+		kaveFlagTokenURL,
+		kaveFlagDeviceAuthorizationURL,
+	} {
+		cmd.Flags().String(name, values[name], "")
+	}
+
+	return cmd
+}
+
+// useTestCache keeps the cache files of a test in a directory of its own.
+func useTestCache(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	provider := newTestProvider(t)
+
+	// endpoints set explicitly take precedence over discovered ones
+	{
+		endpoints, err := resolveEndpoints(newTestCommand(map[string]string{
+			kaveFlagIssuer:   provider.URL,
+			kaveFlagTokenURL: "https://example.com/token",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.com/token", endpoints.TokenURL)
+		assert.Equal(t, provider.URL+"/discovered/device", endpoints.DeviceAuthorizationURL)
+	}
+
+	// discovered endpoints take precedence over those of the Auth0 domain
+	{
+		endpoints, err := resolveEndpoints(newTestCommand(map[string]string{
+			kaveFlagIssuer:      provider.URL,
+			kaveFlagAuth0Domain: "tenant.auth0.com",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, provider.URL+"/discovered/token", endpoints.TokenURL)
+		assert.Equal(t, provider.URL+"/discovered/device", endpoints.DeviceAuthorizationURL)
+	}
+
+	// the Auth0 domain fills the endpoints left, over https unless a scheme is set
+	{
+		endpoints, err := resolveEndpoints(newTestCommand(map[string]string{
+			kaveFlagAuth0Domain:            "tenant.auth0.com/",
+			kaveFlagDeviceAuthorizationURL: "https://example.com/device",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, "https://tenant.auth0.com/oauth/token", endpoints.TokenURL)
+		assert.Equal(t, "https://example.com/device", endpoints.DeviceAuthorizationURL)
+
+		endpoints, err = resolveEndpoints(newTestCommand(map[string]string{
+			kaveFlagAuth0Domain: "http://localhost:8000",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8000/oauth/token", endpoints.TokenURL)
+	}
+
+	// a token endpoint is required
+	{
+		_, err := resolveEndpoints(newTestCommand(nil))
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	presignPath = "/_presign"
+
+	presignFlagExpires   = "expires"
+	presignFlagSingleUse = "single-use"
+)
+
+// presignCmd mints urls granting access to a key without a token
+var presignCmd = &cobra.Command{
+	Use:   "presign",
+	Short: "Create a time-limited url to get or set a key without a token",
+}
+
+var presignGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Create a time-limited url to get a key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return presignKey(cmd, "read", args[0])
+	},
+}
+
+var presignSetCmd = &cobra.Command{
+	Use:   "set <key>",
+	Short: "Create a time-limited url to set a key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return presignKey(cmd, "write", args[0])
+	},
+}
+
+func presignKey(cmd *cobra.Command, operation string, key string) error {
+	cmd.SetOut(os.Stdout)
+
+	expires, err := cmd.Flags().GetDuration(presignFlagExpires)
+	if err != nil {
+		return err
+	}
+
+	singleUse, err := cmd.Flags().GetBool(presignFlagSingleUse)
+	if err != nil {
+		return err
+	}
+
+	buf, _ := json.Marshal(map[string]interface{}{
+		"key":        key,
+		"operation":  operation,
+		"expires_in": expires.String(),
+		"single_use": singleUse,
+	})
+
+	resp, err := doServerRequest(cmd, http.MethodPost, presignPath, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("pre-signed urls are not enabled in the kave server")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to create url: %s", resp.Status)
+	}
+
+	presigned := struct {
+		Path      string    `json:"path"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&presigned)
+	if err != nil {
+		return err
+	}
+
+	// the server may be behind a proxy, build the url from the one we know
+	presignedUrl, err := createServerUrl(cmd, presigned.Path)
+	if err != nil {
+		return err
+	}
+
+	cmd.Println(presignedUrl.String())
+	cmd.PrintErrf("expires at %s\n", presigned.ExpiresAt.Local().Format(time.RFC3339))
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(presignCmd)
+	presignCmd.AddCommand(presignGetCmd)
+	presignCmd.AddCommand(presignSetCmd)
+
+	presignCmd.PersistentFlags().String(kaveFlagToken, "", "token to use for authorization")
+	presignCmd.PersistentFlags().Duration(presignFlagExpires, 10*time.Minute, "how long the url is valid")
+	presignCmd.PersistentFlags().Bool(presignFlagSingleUse, false, "url can only be used once")
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	quotaPath       = "/_quota"
+	adminQuotasPath = "/_admin/quotas"
+)
+
+var errQuotasDisabled = fmt.Errorf("quotas are not enabled in the kave server")
+
+// quotaCmd reports the usage of quotas
+var quotaCmd = &cobra.Command{
+	Use:   "quota [key]",
+	Short: "Show the usage of quotas, or of the quotas applying to a key",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SetOut(os.Stdout)
+
+		path := quotaPath
+		if len(args) == 1 {
+			path += "?" + url.Values{"key": []string{args[0]}}.Encode()
+		}
+
+		resp, err := doServerRequest(cmd, http.MethodGet, path, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return printQuotaUsage(cmd, resp)
+	},
+}
+
+var adminQuotasCmd = &cobra.Command{
+	Use:   "quotas",
+	Short: "List every quota and its usage",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SetOut(os.Stdout)
+
+		resp, err := doAdminRequest(cmd, http.MethodGet, adminQuotasPath, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return printQuotaUsage(cmd, resp)
+	},
+}
+
+var adminQuotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "Set or remove quotas",
+}
+
+var adminQuotaSetCmd = &cobra.Command{
+	Use:   "set <prefix>",
+	Short: "Set the quota of a key prefix, replacing the one in the server config",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		maxKeys, err := cmd.Flags().GetInt64("max-keys")
+		if err != nil {
+			return err
+		}
+
+		maxBytes, err := cmd.Flags().GetInt64("max-bytes")
+		if err != nil {
+			return err
+		}
+
+		buf, _ := json.Marshal(map[string]interface{}{
+			"prefix":    args[0],
+			"max_keys":  maxKeys,
+			"max_bytes": maxBytes,
+		})
+
+		resp, err := doAdminRequest(cmd, http.MethodPut, adminQuotasPath, buf)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return errQuotasDisabled
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("failed to set quota: %s", resp.Status)
+		}
+
+		return nil
+	},
+}
+
+var adminQuotaRmCmd = &cobra.Command{
+	Use:   "rm <prefix>",
+	Short: "Remove the quota of a key prefix set with 'kave admin quota set'",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		query := url.Values{"prefix": []string{args[0]}}.Encode()
+
+		resp, err := doAdminRequest(cmd, http.MethodDelete, adminQuotasPath+"?"+query, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// also returned when quotas are disabled
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("no quota was set for '%s'", args[0])
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("failed to remove quota: %s", resp.Status)
+		}
+
+		return nil
+	},
+}
+
+func printQuotaUsage(cmd *cobra.Command, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return errQuotasDisabled
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get quotas: %s", resp.Status)
+	}
+
+	usage := []struct {
+		Prefix   string `json:"prefix"`
+		MaxKeys  int64  `json:"max_keys"`
+		MaxBytes int64  `json:"max_bytes"`
+		Source   string `json:"source"`
+		Keys     int64  `json:"keys"`
+		Bytes    int64  `json:"bytes"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return err
+	}
+
+	limit := func(value int64) string {
+		if value == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(value)
+	}
+
+	for _, u := range usage {
+		cmd.Printf("%s\tkeys %d/%s\tbytes %d/%s\t(%s)\n",
+			u.Prefix,
+			u.Keys, limit(u.MaxKeys),
+			u.Bytes, limit(u.MaxBytes),
+			u.Source,
+		)
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(quotaCmd)
+	adminCmd.AddCommand(adminQuotasCmd)
+	adminCmd.AddCommand(adminQuotaCmd)
+	adminQuotaCmd.AddCommand(adminQuotaSetCmd)
+	adminQuotaCmd.AddCommand(adminQuotaRmCmd)
+
+	quotaCmd.Flags().String(kaveFlagToken, "", "token to use for authorization")
+	adminQuotaSetCmd.Flags().Int64("max-keys", 0, "maximum number of keys, 0 is unlimited")
+	adminQuotaSetCmd.Flags().Int64("max-bytes", 0, "maximum total bytes of the values, 0 is unlimited")
+}
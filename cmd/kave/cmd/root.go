@@ -18,23 +18,30 @@ const (
 	kaveCacheDir        = "kave"
 	kaveCredentialsFile = "credentials.toml"
 	kaveCacheTokenFile  = "token"
+	// refresh tokens of 'kave login' are kept apart, outliving access tokens
+	kaveCacheRefreshTokenFile = "refresh_token"
 
 	// flags
-	kaveFlagConfig            = "config"
-	kaveFlagCredentials       = "credentials"
-	kaveFlagUrl               = "url"
-	kaveFlagRouterBasePath    = "router-base-path"
-	kaveFlagToken             = "token"
-	kaveFlagAuth0Audience     = "auth0_audience"
-	kaveFlagAuth0Domain       = "auth0_domain"
-	kaveFlagAuth0ClientID     = "auth0_client_id"
-	kaveFlagAuth0ClientSecret = "auth0_client_secret"
+	kaveFlagConfig                 = "config"
+	kaveFlagCredentials            = "credentials"
+	kaveFlagUrl                    = "url"
+	kaveFlagRouterBasePath         = "router-base-path"
+	kaveFlagToken                  = "token"
+	kaveFlagAuth0Audience          = "auth0_audience"
+	kaveFlagAuth0Domain            = "auth0_domain"
+	kaveFlagAuth0ClientID          = "auth0_client_id"
+	kaveFlagAuth0ClientSecret      = "auth0_client_secret"
+	kaveFlagIssuer                 = "issuer"
+	kaveFlagTokenURL               = "token_url"
+	kaveFlagDeviceAuthorizationURL = "device_authorization_url"
+	kaveFlagTrace                  = "trace"
 
 	// env variables
 	envAuth0Audience     = "AUTH0_AUDIENCE"
 	envAuth0Domain       = "AUTH0_DOMAIN"
 	envAuth0ClientID     = "AUTH0_CLIENT_ID"
 	envAuth0ClientSecret = "AUTH0_CLIENT_SECRET"
+	envTraceparent       = "TRACEPARENT"
 )
 
 var auth0ClientSecret string = ""
@@ -46,6 +53,9 @@ var rootCmd = &cobra.Command{
 	Long:    "Make sure you run 'kave init' before using kave.",
 	Version: version.Version,
 	Run:     func(cmd *cobra.Command, args []string) {},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return traceCommand(cmd)
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -61,6 +71,10 @@ type profileAuth struct {
 	Domain   string `toml:"domain"`
 	ClientID string `toml:"client_id"`
 	Audience string `toml:"audience"`
+	// Issuer is an OIDC provider, its endpoints are discovered from it
+	Issuer                 string `toml:"issuer,omitempty"`
+	TokenURL               string `toml:"token_url,omitempty"`
+	DeviceAuthorizationURL string `toml:"device_authorization_url,omitempty"`
 }
 
 type profile struct {
@@ -115,6 +129,9 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&prof.Auth.Audience, kaveFlagAuth0Audience, defaultEnvIfSet(envAuth0Audience, prof.Auth.Audience), "Auth0 audience setting")
 	rootCmd.PersistentFlags().StringVar(&prof.Auth.Domain, kaveFlagAuth0Domain, defaultEnvIfSet(envAuth0Domain, prof.Auth.Domain), "Auth0 domain setting")
 	rootCmd.PersistentFlags().StringVar(&prof.Auth.ClientID, kaveFlagAuth0ClientID, defaultEnvIfSet(envAuth0ClientID, prof.Auth.ClientID), "Auth0 client ID setting")
+	rootCmd.PersistentFlags().StringVar(&prof.Auth.Issuer, kaveFlagIssuer, prof.Auth.Issuer, "OIDC issuer, to discover the endpoints of an auth provider other than Auth0")
+	rootCmd.PersistentFlags().StringVar(&prof.Auth.TokenURL, kaveFlagTokenURL, prof.Auth.TokenURL, "token endpoint of the auth provider, if not discovered")
+	rootCmd.PersistentFlags().StringVar(&prof.Auth.DeviceAuthorizationURL, kaveFlagDeviceAuthorizationURL, prof.Auth.DeviceAuthorizationURL, "device authorization endpoint of the auth provider, if not discovered")
 
 	// do not leak secret in usage
 	var clientSecret string
@@ -128,6 +145,8 @@ func init() {
 	}
 	auth0ClientSecret = clientSecret
 
+	rootCmd.PersistentFlags().Bool(kaveFlagTrace, false, "trace requests in the kave server, printing the trace id")
+
 	rootCmd.SilenceUsage = true
 
 	rootCmd.AddCommand(initCmd)
@@ -169,6 +188,9 @@ var initCmd = &cobra.Command{
 		auth0Domain, _ := cmd.Flags().GetString(kaveFlagAuth0Domain)
 		auth0ClientID, _ := cmd.Flags().GetString(kaveFlagAuth0ClientID)
 		auth0ClientSecret, _ := cmd.Flags().GetString(kaveFlagAuth0ClientSecret)
+		issuer, _ := cmd.Flags().GetString(kaveFlagIssuer)
+		tokenURL, _ := cmd.Flags().GetString(kaveFlagTokenURL)
+		deviceAuthorizationURL, _ := cmd.Flags().GetString(kaveFlagDeviceAuthorizationURL)
 
 		prof := &profile{
 			Url:            cmd.Flags().Lookup(kaveFlagUrl).Value.String(),
@@ -177,6 +199,10 @@ var initCmd = &cobra.Command{
 				Audience: auth0Audience,
 				Domain:   auth0Domain,
 				ClientID: auth0ClientID,
+
+				Issuer:                 issuer,
+				TokenURL:               tokenURL,
+				DeviceAuthorizationURL: deviceAuthorizationURL,
 			},
 		}
 
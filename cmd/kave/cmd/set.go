@@ -1,11 +1,7 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
 
 	"github.com/spf13/cobra"
 )
@@ -16,33 +12,17 @@ var setCmd = &cobra.Command{
 	Short: "Set a value for a key in a kave server",
 	Args:  cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		key := args[0]
-
-		u, err := createRequestUrl(cmd, key)
-		if err != nil {
-			return err
-		}
-
-		body := bytes.NewBuffer([]byte(args[1]))
-
-		req, err := http.NewRequest(http.MethodPost, u.String(), body)
-		if err != nil {
-			return err
-		}
-
-		setAuthorizationHeader(cmd, req)
-
-		resp, err := http.DefaultClient.Do(req.WithContext(cmd.Context()))
+		c, err := newClient(cmd)
 		if err != nil {
 			return err
 		}
 
-		if resp.StatusCode/100 != 2 {
-			return fmt.Errorf("failed to set key value: %s", resp.Status)
+		// quota errors explain which quota was exceeded
+		if err := c.Set(cmd.Context(), args[0], []byte(args[1])); err != nil {
+			return fmt.Errorf("failed to set key value: %w", err)
 		}
 
-		_, err = io.Copy(os.Stdout, resp.Body)
-		return err
+		return nil
 	},
 }
 
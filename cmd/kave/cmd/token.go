@@ -6,30 +6,24 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// tokenCmd tries to obtain a token from the Auth provider
-// Currently tailored for Auth0
+// tokenCmd tries to obtain a token from the Auth provider, with the refresh
+// token of 'kave login' or the client credentials
 var tokenCmd = &cobra.Command{
 	Use:   "token",
-	Short: "Obtain a token from Auth0",
+	Short: "Obtain a token from the auth provider",
 	Args:  cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 
 		cmd.SetOut(os.Stdout)
 
-		token, ok := readTokenFromCache()
-		if ok {
-			cmd.Println(token)
-			return nil
-		}
-
-		token, err := obtainAccessToken(cmd)
+		token, err := obtainToken(cmd)
 		if err != nil {
 			return err
 		}
 
 		cmd.Println(token)
 
-		return writeTokenToCache(token)
+		return nil
 	},
 }
 
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// whoamiCmd decodes the current token locally and prints who it identifies
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Show the identity and permissions of the current token",
+	Long:  "Show the identity and permissions of the current token. The token is decoded locally and not validated.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SetOut(os.Stdout)
+
+		token, err := obtainRefreshToken(cmd)
+		if err != nil {
+			return err
+		}
+
+		claims, err := decodeTokenClaims(token)
+		if err != nil {
+			return err
+		}
+
+		client := claims.AzP
+		if client == "" {
+			client = claims.ClientID
+		}
+
+		cmd.Printf("subject:     %s\n", claims.Subject)
+		cmd.Printf("client:      %s\n", client)
+		cmd.Printf("issuer:      %s\n", claims.Issuer)
+		cmd.Printf("expires:     %s\n", time.Unix(claims.Exp, 0).Format(time.RFC3339))
+		cmd.Printf("permissions: %s\n", strings.Join(claims.Permissions, " "))
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(whoamiCmd)
+
+	whoamiCmd.Flags().String(kaveFlagToken, "", "token to use for authorization")
+}
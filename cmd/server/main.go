@@ -2,46 +2,21 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
-	"github.com/MicahParks/keyfunc"
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/pdcalado/kave/internal/version"
-	"github.com/redis/go-redis/v9"
-)
 
-const (
-	envRedisPassword      = "REDIS_PASSWORD"
-	defaultRouterBasePath = "/redis"
-	defaultRedisKeyPrefix = "kave:"
-	jwksUrlFormat         = "https://%s/.well-known/jwks.json"
-	defaultHealthPath     = "/health"
+	"github.com/pdcalado/kave/internal/version"
+	"github.com/pdcalado/kave/server"
 )
 
-// Config holds application configuration
-type Config struct {
-	Address        string  `toml:"address"`
-	RedisAddress   string  `toml:"redis_address"`
-	RouterBasePath string  `toml:"router_base_path"`
-	RedisKeyPrefix *string `toml:"redis_key_prefix"`
-	TimeoutMs      int     `toml:"timeout_ms"`
-	RedisUsername  string  `toml:"redis_username"`
-	Auth           struct {
-		Enabled bool   `toml:"enabled"`
-		Domain  string `toml:"domain"`
-	} `toml:"auth"`
-}
-
 func main() {
 	var configFile string
 	flag.StringVar(&configFile, "c", "config.toml", "path to the config file")
@@ -49,6 +24,12 @@ func main() {
 	var printVersion bool
 	flag.BoolVar(&printVersion, "version", false, "print version and exit")
 
+	var hashSecret bool
+	flag.BoolVar(&hashSecret, "hash-secret", false, "read a client secret from stdin, print its hash for the token issuer and exit")
+
+	var verifyAudit string
+	flag.StringVar(&verifyAudit, "verify-audit", "", "verify the hash chain of an audit log file and exit")
+
 	flag.Parse()
 
 	if printVersion {
@@ -56,139 +37,64 @@ func main() {
 		return
 	}
 
-	run(configFile)
-}
-
-func run(configFile string) {
-	var config Config
-
-	// Read configuration from a TOML file
-	if _, err := toml.DecodeFile(configFile, &config); err != nil {
-		panic(err)
-	}
-
-	// Set base path
-	routerBasePath := config.RouterBasePath
-	if routerBasePath == "" {
-		routerBasePath = defaultRouterBasePath
-	}
-
-	// Set redis key prefix
-	redisKeyPrefix := defaultRedisKeyPrefix
-	if config.RedisKeyPrefix != nil {
-		redisKeyPrefix = *config.RedisKeyPrefix
-	}
-
-	// Get redis password from environment
-	redisPassword := os.Getenv(envRedisPassword)
-
-	// Set requests timeout
-	timeout := time.Duration(config.TimeoutMs) * time.Millisecond
-	if timeout == 0 {
-		timeout = 2 * time.Second
+	if hashSecret {
+		printSecretHash()
+		return
 	}
 
-	// create a default context
-	ctx := context.Background()
-
-	// Connect to Redis
-	client, err := NewRedisClient(ctx, &redis.Options{
-		Addr:     config.RedisAddress,
-		Username: config.RedisUsername,
-		Password: redisPassword,
-	})
-	if err != nil {
-		panic(err)
+	if verifyAudit != "" {
+		verifyAuditFile(verifyAudit)
+		return
 	}
 
-	// Create a new KeyValue kvHandler
-	kvHandler := NewKeyValueHandler(client, redisKeyPrefix, readKeyFromCtx)
+	var config server.Config
 
-	// Create a new router
-	router := chi.NewRouter()
-
-	// Add middleware
-	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
-	router.Use(middleware.Logger)
-
-	// add auth middleware if enabled
-	if config.Auth.Enabled {
-		authMiddleware := createAuthMiddleware(config.Auth.Domain)
-		router.Use(authMiddleware.Handler)
+	// Read configuration from a TOML file
+	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+		log.Fatal(err)
 	}
 
-	router.Use(middleware.Recoverer)
-	router.Use(middleware.Timeout(timeout))
+	log.Fatal(server.Run(context.Background(), config, server.WithPolicyReload(reloadOnHangup())))
+}
 
-	// Add health route
-	router.Get(defaultHealthPath, func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		_, err := w.Write([]byte(`{"status":"ok"}`))
-		if err != nil {
-			log.Printf("error writing response: %v\n", err)
-			return
-		}
-	})
-
-	// Add redis routes
-	router.Route(routerBasePath, func(r chi.Router) {
-		r.Route("/{key}", func(r chi.Router) {
-			// Add redis key to context
-			r.Use(injectKeyInCtx)
-
-			// Add permission check middleware
-			if config.Auth.Enabled {
-				permissionHandler := NewPermissionMiddleware(redisKeyPrefix, readKeyFromCtx, readPermissionsFromCtx)
-				r.Use(permissionHandler.Handler)
+// reloadOnHangup returns a channel receiving on every SIGHUP, dropping
+// signals received while a reload is pending.
+func reloadOnHangup() <-chan struct{} {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	reload := make(chan struct{}, 1)
+	go func() {
+		for range hangup {
+			select {
+			case reload <- struct{}{}:
+			default:
 			}
+		}
+	}()
 
-			r.Get("/", kvHandler.Get)
-			r.Post("/", kvHandler.Set)
-		})
-	})
-
-	// Start the server
-	if err := http.ListenAndServe(config.Address, router); err != nil {
-		log.Fatal(err)
-	}
+	return reload
 }
 
-func createAuthMiddleware(domain string) AuthMiddleware {
-	urlStr := fmt.Sprintf(jwksUrlFormat, domain)
-
-	resp, err := http.DefaultClient.Get(urlStr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	buf, err := io.ReadAll(resp.Body)
+func printSecretHash() {
+	secret, err := io.ReadAll(os.Stdin)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	jwks, err := keyfunc.NewJSON(json.RawMessage(buf))
+	hash, err := server.HashClientSecret(strings.TrimSpace(string(secret)))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	parse := func(token string) ([]string, error) {
-		options := jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()})
-
-		claims := &claimsWithPermissions{}
-		_, err := jwt.ParseWithClaims(token, claims, jwks.Keyfunc, options)
-		return claims.Permissions, err
-	}
-
-	return NewAuthMiddleware(parse, writePermissionsToCtx)
+	fmt.Println(hash)
 }
 
-func injectKeyInCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := chi.URLParam(r, "key")
-
-		newContext := writeKeyToCtx(r.Context(), key)
+func verifyAuditFile(path string) {
+	_, count, err := server.VerifyAuditLog(path)
+	if err != nil {
+		log.Fatalf("audit log %s failed verification: %v", path, err)
+	}
 
-		next.ServeHTTP(w, r.WithContext(newContext))
-	})
+	fmt.Printf("audit log %s is intact, %d events\n", path, count)
 }
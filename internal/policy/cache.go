@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// DefaultCacheSize is the number of compiled policies kept by a Cache by default.
+const DefaultCacheSize = 4096
+
+type cacheKey [sha256.Size]byte
+
+type cacheEntry struct {
+	key    cacheKey
+	policy *Policy
+}
+
+// Cache keeps recently compiled policies, keyed by a hash of the permission set
+// they were compiled from, so each caller's permissions are compiled once.
+// It is safe for concurrent use.
+type Cache struct {
+	syntax  Syntax
+	size    int
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	order   *list.List
+}
+
+func NewCache(syntax Syntax, size int) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+
+	return &Cache{
+		syntax:  syntax,
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the compiled policy for permissions and whether it was cached.
+func (c *Cache) Get(permissions []string) (*Policy, bool) {
+	key := hashPermissions(permissions)
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cacheEntry).policy, true
+	}
+	c.mu.Unlock()
+
+	// compile without holding the lock, racing callers compile the same policy
+	policy := Compile(c.syntax, permissions)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		return element.Value.(*cacheEntry).policy, true
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, policy: policy})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	return policy, false
+}
+
+// Len returns the number of cached policies.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func hashPermissions(permissions []string) cacheKey {
+	h := sha256.New()
+	length := make([]byte, binary.MaxVarintLen64)
+	for _, permission := range permissions {
+		n := binary.PutUvarint(length, uint64(len(permission)))
+		h.Write(length[:n])
+		h.Write([]byte(permission))
+	}
+
+	var key cacheKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
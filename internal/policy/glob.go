@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// globToRegexp converts a glob pattern into an anchored regular expression.
+// Any character other than '*' is matched literally.
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '*' {
+			j := i
+			for j < len(pattern) && pattern[j] != '*' {
+				j++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i:j]))
+			i = j - 1
+			continue
+		}
+
+		if i+1 < len(pattern) && pattern[i+1] == '*' {
+			b.WriteString(".*")
+			i++
+			continue
+		}
+
+		b.WriteString("[^" + Separator + "]*")
+	}
+
+	b.WriteString("$")
+	return b.String()
+}
+
+// matchSegment matches a single segment against a pattern where '*' matches
+// any sequence of characters. Neither holds a separator.
+func matchSegment(pattern, s string) bool {
+	// backtrack to the last star on mismatch
+	p, i := 0, 0
+	star, mark := -1, 0
+
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star != -1:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
@@ -0,0 +1,145 @@
+// Package policy compiles permission patterns into an immutable Policy
+// that can be evaluated concurrently against required permissions.
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Syntax selects how permission patterns are interpreted.
+type Syntax string
+
+const (
+	// SyntaxGlob matches permissions as anchored globs where
+	// '*' matches within a ':' separated segment and '**' matches across segments.
+	SyntaxGlob Syntax = "glob"
+	// SyntaxRegex matches permissions as unanchored regular expressions,
+	// kept for compatibility with existing scopes.
+	SyntaxRegex Syntax = "regex"
+
+	// DenyPrefix marks a permission revoking access, taking precedence over grants.
+	DenyPrefix = "deny:"
+
+	// Separator splits permissions into segments.
+	Separator = ":"
+)
+
+// ParseSyntax parses a syntax name, defaulting to SyntaxGlob when empty.
+func ParseSyntax(s string) (Syntax, error) {
+	switch Syntax(s) {
+	case "", SyntaxGlob:
+		return SyntaxGlob, nil
+	case SyntaxRegex:
+		return SyntaxRegex, nil
+	default:
+		return "", fmt.Errorf("unknown permission syntax '%s'", s)
+	}
+}
+
+// Decision is the outcome of evaluating a required permission against a Policy.
+type Decision struct {
+	Allowed bool
+	// Matched is the grant pattern matching the required permission, if any.
+	Matched string
+	// DeniedBy is the deny pattern matching the required permission, if any.
+	DeniedBy string
+}
+
+// matcher finds a pattern matching a permission.
+type matcher interface {
+	match(permission string) (string, bool)
+}
+
+// Policy is a compiled set of permissions. It is immutable and safe for concurrent use.
+type Policy struct {
+	syntax  Syntax
+	grants  matcher
+	denies  matcher
+	invalid []string
+}
+
+// Compile compiles permissions using the given syntax.
+// Permissions prefixed with DenyPrefix become deny rules.
+// Invalid patterns never match and are reported by Invalid.
+func Compile(syntax Syntax, permissions []string) *Policy {
+	var grants, denies []string
+	for _, permission := range permissions {
+		if strings.HasPrefix(permission, DenyPrefix) {
+			denies = append(denies, strings.TrimPrefix(permission, DenyPrefix))
+			continue
+		}
+		grants = append(grants, permission)
+	}
+
+	p := &Policy{syntax: syntax}
+
+	if syntax == SyntaxRegex {
+		p.grants = p.compileRegexps(grants)
+		p.denies = p.compileRegexps(denies)
+	} else {
+		p.grants = p.compileTrie(grants)
+		p.denies = p.compileTrie(denies)
+	}
+
+	return p
+}
+
+// Evaluate decides whether required is granted by the policy.
+func (p *Policy) Evaluate(required string) Decision {
+	if pattern, ok := p.denies.match(required); ok {
+		return Decision{DeniedBy: pattern}
+	}
+
+	pattern, ok := p.grants.match(required)
+	return Decision{Allowed: ok, Matched: pattern}
+}
+
+// Allowed is a shorthand for Evaluate(required).Allowed.
+func (p *Policy) Allowed(required string) bool {
+	return p.Evaluate(required).Allowed
+}
+
+// Invalid returns the patterns that failed to compile.
+func (p *Policy) Invalid() []string {
+	return p.invalid
+}
+
+type regexpMatcher struct {
+	patterns []string
+	regexps  []*regexp.Regexp
+}
+
+func (p *Policy) compileRegexps(patterns []string) *regexpMatcher {
+	m := &regexpMatcher{}
+	for _, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			p.invalid = append(p.invalid, pattern)
+			continue
+		}
+		m.patterns = append(m.patterns, pattern)
+		m.regexps = append(m.regexps, r)
+	}
+	return m
+}
+
+func (m *regexpMatcher) match(permission string) (string, bool) {
+	for i, r := range m.regexps {
+		if r.MatchString(permission) {
+			return m.patterns[i], true
+		}
+	}
+	return "", false
+}
+
+func (p *Policy) compileTrie(patterns []string) *trie {
+	t := newTrie()
+	for _, pattern := range patterns {
+		if err := t.insert(pattern); err != nil {
+			p.invalid = append(p.invalid, pattern)
+		}
+	}
+	return t
+}
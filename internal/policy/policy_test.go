@@ -0,0 +1,218 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyntax(t *testing.T) {
+	syntax, err := ParseSyntax("")
+	assert.NoError(t, err)
+	assert.Equal(t, SyntaxGlob, syntax)
+
+	syntax, err = ParseSyntax("regex")
+	assert.NoError(t, err)
+	assert.Equal(t, SyntaxRegex, syntax)
+
+	_, err = ParseSyntax("wildcard")
+	assert.Error(t, err)
+}
+
+func TestEvaluate(t *testing.T) {
+	permissions := []string{
+		"read:kave:foo",
+		"read:kave:team:*",
+		"write:kave:team:**",
+		"deny:write:kave:team:locked:**",
+		"read:kave:logs**",
+		"*:kave:shared",
+	}
+
+	p := Compile(SyntaxGlob, permissions)
+
+	tests := []struct {
+		required string
+		decision Decision
+	}{
+		{"read:kave:foo", Decision{Allowed: true, Matched: "read:kave:foo"}},
+		{"read:kave:foobar", Decision{}},
+		{"read:kave:team:a", Decision{Allowed: true, Matched: "read:kave:team:*"}},
+		{"read:kave:team:a:b", Decision{}},
+		{"write:kave:team:a:b", Decision{Allowed: true, Matched: "write:kave:team:**"}},
+		{"write:kave:team:locked:a", Decision{DeniedBy: "write:kave:team:locked:**"}},
+		{"read:kave:logs", Decision{Allowed: true, Matched: "read:kave:logs**"}},
+		{"read:kave:logs:2023:01", Decision{Allowed: true, Matched: "read:kave:logs**"}},
+		{"write:kave:shared", Decision{Allowed: true, Matched: "*:kave:shared"}},
+		{"write:kave:foo", Decision{}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.decision, p.Evaluate(test.required), test.required)
+	}
+}
+
+func TestEvaluateRegex(t *testing.T) {
+	p := Compile(SyntaxRegex, []string{"read:kave:fo+", "deny:read:kave:fooo", "read:kave:(bad"})
+
+	assert.True(t, p.Allowed("read:kave:foo"))
+	assert.True(t, p.Allowed("read:kave:foobar"))
+	assert.False(t, p.Allowed("read:kave:fooo"))
+	assert.False(t, p.Allowed("read:kave:bar"))
+	assert.Equal(t, []string{"read:kave:(bad"}, p.Invalid())
+}
+
+// TestTrieMatchesGlobRegexp checks the trie against the reference regexp translation.
+func TestTrieMatchesGlobRegexp(t *testing.T) {
+	patterns := []string{
+		"a", "a:b", "a:*", "a:**", "*:b", "**", "*", "a:*:c", "a:**:c", "a:b*", "a:*b",
+		"a:b**", "a:**b", "a:b**c", "a:*:**", "**:c", "a::b", "a:", ":a", "a*c:b",
+		"a.b", "a+", "a:b:c:d", "*:*:*", "a:**:**",
+	}
+
+	permissions := []string{
+		"", "a", "b", "a:", ":a", "a:b", "a:c", "a:bc", "a:cb", "a:b:c", "a:x:c", "a:x:y:c",
+		"a::b", "a:b:c:d", "abc:b", "ac:b", "a.b", "aXb", "a+", "aa", "a:bxc", "a:b:xc", "x:y:z",
+		"a:b:c:d:e",
+	}
+
+	for _, pattern := range patterns {
+		reference := regexp.MustCompile(globToRegexp(pattern))
+		p := Compile(SyntaxGlob, []string{pattern})
+
+		for _, permission := range permissions {
+			assert.Equal(
+				t,
+				reference.MatchString(permission),
+				p.Allowed(permission),
+				fmt.Sprintf("pattern '%s' permission '%s'", pattern, permission),
+			)
+		}
+	}
+}
+
+func TestMatchSegment(t *testing.T) {
+	assert.True(t, matchSegment("*", ""))
+	assert.True(t, matchSegment("*", "abc"))
+	assert.True(t, matchSegment("a*", "abc"))
+	assert.True(t, matchSegment("*c", "abc"))
+	assert.True(t, matchSegment("a*c", "abbbc"))
+	assert.True(t, matchSegment("a*b*c", "aXbYbZc"))
+	assert.False(t, matchSegment("a*c", "abcd"))
+	assert.False(t, matchSegment("a*b*c", "acb"))
+	assert.False(t, matchSegment("abc", "ab"))
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(SyntaxGlob, 2)
+
+	first, cached := c.Get([]string{"read:a"})
+	assert.False(t, cached)
+
+	again, cached := c.Get([]string{"read:a"})
+	assert.True(t, cached)
+	assert.Same(t, first, again)
+
+	// permission sets are not confused by concatenation
+	_, cached = c.Get([]string{"read:", "a"})
+	assert.False(t, cached)
+	assert.Equal(t, 2, c.Len())
+
+	// least recently used entry is evicted
+	_, cached = c.Get([]string{"read:b"})
+	assert.False(t, cached)
+	assert.Equal(t, 2, c.Len())
+
+	_, cached = c.Get([]string{"read:a"})
+	assert.False(t, cached)
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache(SyntaxGlob, 8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				permissions := []string{fmt.Sprintf("read:kave:%d:*", (i+j)%12)}
+				p, _ := c.Get(permissions)
+				assert.True(t, p.Allowed(fmt.Sprintf("read:kave:%d:x", (i+j)%12)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8, c.Len())
+}
+
+// benchmarkPermissions mimics a token carrying many scopes.
+func benchmarkPermissions(n int) []string {
+	permissions := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			permissions = append(permissions, fmt.Sprintf("read:kave:team%d:config", i))
+		case 1:
+			permissions = append(permissions, fmt.Sprintf("read:kave:team%d:*", i))
+		case 2:
+			permissions = append(permissions, fmt.Sprintf("write:kave:team%d:**", i))
+		case 3:
+			permissions = append(permissions, fmt.Sprintf("deny:write:kave:team%d:locked:*", i-1))
+		}
+	}
+	return permissions
+}
+
+func BenchmarkCompile(b *testing.B) {
+	permissions := benchmarkPermissions(200)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Compile(SyntaxGlob, permissions)
+	}
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+	p := Compile(SyntaxGlob, benchmarkPermissions(200))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Evaluate("write:kave:team198:a:b")
+	}
+}
+
+func BenchmarkEvaluateMiss(b *testing.B) {
+	p := Compile(SyntaxGlob, benchmarkPermissions(200))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Evaluate("read:kave:unknown:key")
+	}
+}
+
+func BenchmarkEvaluateRegex(b *testing.B) {
+	p := Compile(SyntaxRegex, benchmarkPermissions(200))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Evaluate("write:kave:team198:a:b")
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	c := NewCache(SyntaxGlob, DefaultCacheSize)
+	permissions := benchmarkPermissions(200)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p, _ := c.Get(permissions)
+			p.Evaluate("write:kave:team198:a:b")
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package policy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// trie indexes glob patterns by segment, so evaluating a permission only
+// visits the patterns sharing its segments instead of every pattern.
+type trie struct {
+	root *node
+}
+
+type node struct {
+	literals map[string]*node
+	// wildcards hold segments with '*', matching exactly one segment
+	wildcards []wildcardEdge
+	// deep holds a '**' segment, matching one or more segments
+	deep *node
+	// tails hold the remainder of patterns with '**' inside a segment
+	tails []tail
+	// pattern ending at this node, empty if none
+	pattern  string
+	terminal bool
+}
+
+type wildcardEdge struct {
+	segment string
+	next    *node
+}
+
+type tail struct {
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+func newTrie() *trie {
+	return &trie{root: newNode()}
+}
+
+func newNode() *node {
+	return &node{literals: make(map[string]*node)}
+}
+
+func (t *trie) insert(pattern string) error {
+	segments := strings.Split(pattern, Separator)
+
+	n := t.root
+	for i, segment := range segments {
+		switch {
+		case segment == "**":
+			if n.deep == nil {
+				n.deep = newNode()
+			}
+			n = n.deep
+		case strings.Contains(segment, "**"):
+			r, err := regexp.Compile(globToRegexp(strings.Join(segments[i:], Separator)))
+			if err != nil {
+				return err
+			}
+			n.tails = append(n.tails, tail{pattern: pattern, regexp: r})
+			return nil
+		case strings.Contains(segment, "*"):
+			n = n.wildcard(segment)
+		default:
+			next, ok := n.literals[segment]
+			if !ok {
+				next = newNode()
+				n.literals[segment] = next
+			}
+			n = next
+		}
+	}
+
+	if !n.terminal {
+		n.terminal = true
+		n.pattern = pattern
+	}
+
+	return nil
+}
+
+func (n *node) wildcard(segment string) *node {
+	for _, edge := range n.wildcards {
+		if edge.segment == segment {
+			return edge.next
+		}
+	}
+
+	next := newNode()
+	n.wildcards = append(n.wildcards, wildcardEdge{segment: segment, next: next})
+	return next
+}
+
+type query struct {
+	permission string
+	segments   []string
+	// offsets of each segment in permission
+	offsets []int
+}
+
+func (t *trie) match(permission string) (string, bool) {
+	segments := strings.Split(permission, Separator)
+
+	offsets := make([]int, len(segments))
+	offset := 0
+	for i, segment := range segments {
+		offsets[i] = offset
+		offset += len(segment) + len(Separator)
+	}
+
+	return t.root.match(&query{
+		permission: permission,
+		segments:   segments,
+		offsets:    offsets,
+	}, 0)
+}
+
+func (n *node) match(q *query, i int) (string, bool) {
+	if i == len(q.segments) {
+		return n.pattern, n.terminal
+	}
+
+	segment := q.segments[i]
+
+	if next, ok := n.literals[segment]; ok {
+		if pattern, ok := next.match(q, i+1); ok {
+			return pattern, true
+		}
+	}
+
+	for _, edge := range n.wildcards {
+		if !matchSegment(edge.segment, segment) {
+			continue
+		}
+		if pattern, ok := edge.next.match(q, i+1); ok {
+			return pattern, true
+		}
+	}
+
+	if n.deep != nil {
+		for j := i + 1; j <= len(q.segments); j++ {
+			if pattern, ok := n.deep.match(q, j); ok {
+				return pattern, true
+			}
+		}
+	}
+
+	for _, t := range n.tails {
+		if t.regexp.MatchString(q.permission[q.offsets[i]:]) {
+			return t.pattern, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,338 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: kave/v1/kave.proto
+
+package kavev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	KaveService_Get_FullMethodName    = "/kave.v1.KaveService/Get"
+	KaveService_Set_FullMethodName    = "/kave.v1.KaveService/Set"
+	KaveService_Delete_FullMethodName = "/kave.v1.KaveService/Delete"
+	KaveService_List_FullMethodName   = "/kave.v1.KaveService/List"
+	KaveService_Watch_FullMethodName  = "/kave.v1.KaveService/Watch"
+	KaveService_Batch_FullMethodName  = "/kave.v1.KaveService/Batch"
+)
+
+// KaveServiceClient is the client API for KaveService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KaveServiceClient interface {
+	// Get returns the value of a key, requires read:<key>.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Set sets the value of a key, requires write:<key>.
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
+	// Delete deletes a key, requires write:<key>.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// List returns a page of the keys starting with a prefix the caller may read.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Watch streams the changes of the keys starting with a prefix the caller
+	// may read, made from the time the response headers are sent.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KaveService_WatchClient, error)
+	// Batch runs operations in order, each checked and answered on its own.
+	// Operations are not atomic, those before a failed one are kept.
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+}
+
+type kaveServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKaveServiceClient(cc grpc.ClientConnInterface) KaveServiceClient {
+	return &kaveServiceClient{cc}
+}
+
+func (c *kaveServiceClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, KaveService_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kaveServiceClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
+	err := c.cc.Invoke(ctx, KaveService_Set_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kaveServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, KaveService_Delete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kaveServiceClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, KaveService_List_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kaveServiceClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KaveService_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KaveService_ServiceDesc.Streams[0], KaveService_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kaveServiceWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KaveService_WatchClient interface {
+	Recv() (*WatchResponse, error)
+	grpc.ClientStream
+}
+
+type kaveServiceWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *kaveServiceWatchClient) Recv() (*WatchResponse, error) {
+	m := new(WatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kaveServiceClient) Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, KaveService_Batch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KaveServiceServer is the server API for KaveService service.
+// All implementations must embed UnimplementedKaveServiceServer
+// for forward compatibility
+type KaveServiceServer interface {
+	// Get returns the value of a key, requires read:<key>.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Set sets the value of a key, requires write:<key>.
+	Set(context.Context, *SetRequest) (*SetResponse, error)
+	// Delete deletes a key, requires write:<key>.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// List returns a page of the keys starting with a prefix the caller may read.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Watch streams the changes of the keys starting with a prefix the caller
+	// may read, made from the time the response headers are sent.
+	Watch(*WatchRequest, KaveService_WatchServer) error
+	// Batch runs operations in order, each checked and answered on its own.
+	// Operations are not atomic, those before a failed one are kept.
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+	mustEmbedUnimplementedKaveServiceServer()
+}
+
+// UnimplementedKaveServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedKaveServiceServer struct {
+}
+
+func (UnimplementedKaveServiceServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedKaveServiceServer) Set(context.Context, *SetRequest) (*SetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+func (UnimplementedKaveServiceServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedKaveServiceServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedKaveServiceServer) Watch(*WatchRequest, KaveService_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedKaveServiceServer) Batch(context.Context, *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+func (UnimplementedKaveServiceServer) mustEmbedUnimplementedKaveServiceServer() {}
+
+// UnsafeKaveServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KaveServiceServer will
+// result in compilation errors.
+type UnsafeKaveServiceServer interface {
+	mustEmbedUnimplementedKaveServiceServer()
+}
+
+func RegisterKaveServiceServer(s grpc.ServiceRegistrar, srv KaveServiceServer) {
+	s.RegisterService(&KaveService_ServiceDesc, srv)
+}
+
+func _KaveService_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KaveServiceServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KaveService_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KaveServiceServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KaveService_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KaveServiceServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KaveService_Set_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KaveServiceServer).Set(ctx, req.(*SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KaveService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KaveServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KaveService_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KaveServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KaveService_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KaveServiceServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KaveService_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KaveServiceServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KaveService_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KaveServiceServer).Watch(m, &kaveServiceWatchServer{stream})
+}
+
+type KaveService_WatchServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type kaveServiceWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *kaveServiceWatchServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KaveService_Batch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KaveServiceServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KaveService_Batch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KaveServiceServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// KaveService_ServiceDesc is the grpc.ServiceDesc for KaveService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KaveService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kave.v1.KaveService",
+	HandlerType: (*KaveServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _KaveService_Get_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _KaveService_Set_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _KaveService_Delete_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _KaveService_List_Handler,
+		},
+		{
+			MethodName: "Batch",
+			Handler:    _KaveService_Batch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _KaveService_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "kave/v1/kave.proto",
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	auditPath            = "/_audit"
+	permissionAdminAudit = "admin:audit"
+
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+
+	auditOutcomeSuccess  = "success"
+	auditOutcomeDenied   = "denied"
+	auditOutcomeNotFound = "not_found"
+	auditOutcomeRejected = "rejected"
+	auditOutcomeError    = "error"
+)
+
+// AuditEvent records an operation on a key.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Presigned bool      `json:"presigned,omitempty"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+	// ValueHash is the sha256 of the value read or written
+	ValueHash string `json:"value_hash,omitempty"`
+
+	// Prev and Hash chain the events of an audit log file
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// auditOutcome summarizes a response status.
+func auditOutcome(status int) string {
+	switch {
+	case status/100 == 2:
+		return auditOutcomeSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditOutcomeDenied
+	case status == http.StatusNotFound:
+		return auditOutcomeNotFound
+	case status/100 == 4:
+		return auditOutcomeRejected
+	default:
+		return auditOutcomeError
+	}
+}
+
+// AuditQuery selects audit events. Without Since, the latest Limit events are selected.
+type AuditQuery struct {
+	Key   string
+	Since time.Time
+	Limit int
+}
+
+func (q AuditQuery) matches(event AuditEvent) bool {
+	return (q.Key == "" || event.Key == q.Key) && !event.Time.Before(q.Since)
+}
+
+// auditSink records audit events.
+type auditSink interface {
+	Write(ctx context.Context, event AuditEvent) error
+}
+
+// auditQuerier reads back audit events, in chronological order.
+type auditQuerier interface {
+	Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error)
+}
+
+// Auditor records every operation on keys to its sinks.
+type Auditor struct {
+	sinks         []auditSink
+	keyFromCtx    func(context.Context) string
+	claimsFromCtx func(context.Context) *Claims
+	now           func() time.Time
+}
+
+func NewAuditor(
+	sinks []auditSink,
+	keyFromCtx func(context.Context) string,
+	claimsFromCtx func(context.Context) *Claims,
+) *Auditor {
+	return &Auditor{
+		sinks:         sinks,
+		keyFromCtx:    keyFromCtx,
+		claimsFromCtx: claimsFromCtx,
+		now:           time.Now,
+	}
+}
+
+// hashingReadCloser hashes a request body as it is read.
+type hashingReadCloser struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (r *hashingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// auditOperation returns the operation of a request recorded, deletes
+// require the write permission but are recorded apart.
+func auditOperation(method string) string {
+	operation, ok := operationForMethod(method)
+	if !ok || method == http.MethodDelete {
+		operation = strings.ToLower(method)
+	}
+	return operation
+}
+
+// auditAttempt tracks whether a request on a key reached Handler.
+type auditAttempt struct {
+	recorded bool
+}
+
+type auditAttemptKey struct{}
+
+// Attempts records the requests on keys rejected before reaching Handler,
+// such as those failing auth, without subject. It must be placed before auth,
+// keyFromPath returning the key of requests on keys before they are routed.
+func (a *Auditor) Attempts(keyFromPath func(r *http.Request) (string, bool)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := keyFromPath(r)
+			if _, known := operationForMethod(r.Method); !ok || !known {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			attempt := &auditAttempt{}
+			ctx := context.WithValue(r.Context(), auditAttemptKey{}, attempt)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if attempt.recorded {
+				return
+			}
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			a.record(r.Context(), auditOperation(r.Method), key, status, sha256.New())
+		})
+	}
+}
+
+// Handler records the operation of each request once served, it must be
+// placed before the permission check so denied requests are recorded.
+func (a *Auditor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempt, ok := r.Context().Value(auditAttemptKey{}).(*auditAttempt); ok {
+			attempt.recorded = true
+		}
+
+		operation := auditOperation(r.Method)
+
+		// hash the value written, or the value read
+		valueHash := sha256.New()
+		if operation == operationWrite && r.Body != nil {
+			r.Body = &hashingReadCloser{ReadCloser: r.Body, hash: valueHash}
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		if operation == operationRead {
+			ww.Tee(valueHash)
+		}
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		a.record(r.Context(), operation, a.keyFromCtx(r.Context()), status, valueHash)
+	})
+}
+
+// recordValue records an operation outside the HTTP API, such as a gRPC
+// call, with the value read or written and the HTTP status matching its result.
+func (a *Auditor) recordValue(ctx context.Context, operation string, key string, status int, value []byte) {
+	valueHash := sha256.New()
+	valueHash.Write(value)
+
+	a.record(ctx, operation, key, status, valueHash)
+}
+
+// record writes the operation of the caller in ctx on key to every sink.
+// valueHash holds the value read or written, it is recorded on success.
+func (a *Auditor) record(ctx context.Context, operation string, key string, status int, valueHash hash.Hash) {
+	claims := a.claimsFromCtx(ctx)
+	_, presigned := readPresignedGrantFromCtx(ctx)
+
+	event := AuditEvent{
+		Time:      a.now().UTC(),
+		RequestID: middleware.GetReqID(ctx),
+		Subject:   claims.Subject,
+		Client:    claims.Client(),
+		Presigned: presigned,
+		Operation: operation,
+		Key:       key,
+		Status:    status,
+		Outcome:   auditOutcome(status),
+	}
+
+	if event.Outcome == auditOutcomeSuccess && (operation == operationRead || operation == operationWrite) {
+		event.ValueHash = hex.EncodeToString(valueHash.Sum(nil))
+	}
+
+	for _, sink := range a.sinks {
+		if err := sink.Write(ctx, event); err != nil {
+			loggerFromCtx(ctx).Error("error writing audit event", err)
+		}
+	}
+}
+
+// AuditHandler serves audit events.
+type AuditHandler struct {
+	querier auditQuerier
+}
+
+func NewAuditHandler(querier auditQuerier) *AuditHandler {
+	return &AuditHandler{
+		querier: querier,
+	}
+}
+
+// parseAuditSince parses a time, or a duration before now such as "1h".
+func parseAuditSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// Query responds with the audit events selected by the key, since and limit query parameters.
+func (h *AuditHandler) Query(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	since, err := parseAuditSince(params.Get("since"), time.Now())
+	if err != nil {
+		http.Error(w, "since must be a RFC3339 time or a duration", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultAuditQueryLimit
+	if params.Get("limit") != "" {
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > maxAuditQueryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditQueryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := h.querier.Query(r.Context(), AuditQuery{
+		Key:   params.Get("key"),
+		Since: since,
+		Limit: limit,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error querying audit events", err)
+		return
+	}
+
+	if events == nil {
+		events = []AuditEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(events)
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+// FileAuditLog appends audit events to a JSON lines file, each event
+// chained to the previous one by its hash so tampering can be detected.
+type FileAuditLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	last string
+}
+
+// OpenFileAuditLog opens an audit log file, continuing its hash chain.
+func OpenFileAuditLog(path string) (*FileAuditLog, error) {
+	last, _, err := VerifyAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAuditLog{
+		path: path,
+		file: file,
+		last: last,
+	}, nil
+}
+
+// chainAuditEvent returns the hash of an event chained after prev.
+func chainAuditEvent(event AuditEvent, prev string) (string, error) {
+	event.Prev = prev
+	event.Hash = ""
+
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (l *FileAuditLog) Write(ctx context.Context, event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hash, err := chainAuditEvent(event, l.last)
+	if err != nil {
+		return err
+	}
+
+	event.Prev = l.last
+	event.Hash = hash
+
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+
+	l.last = hash
+
+	return nil
+}
+
+// Query scans the whole file.
+func (l *FileAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+
+		if !query.matches(event) {
+			continue
+		}
+
+		events = append(events, event)
+
+		if !query.Since.IsZero() && len(events) == query.Limit {
+			break
+		}
+
+		// only the latest events are kept without since
+		if len(events) >= 2*query.Limit {
+			events = events[:copy(events, events[len(events)-query.Limit:])]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// keep the latest events
+	if len(events) > query.Limit {
+		events = events[len(events)-query.Limit:]
+	}
+
+	return events, nil
+}
+
+func (l *FileAuditLog) Close() error {
+	return l.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of an audit log file, returning the
+// hash of its last event and the number of events.
+func VerifyAuditLog(path string) (string, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	var last string
+	var count int
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		count++
+
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return "", count, fmt.Errorf("line %d: %w", count, err)
+		}
+
+		if event.Prev != last {
+			return "", count, fmt.Errorf("line %d: chain is broken, previous hash does not match", count)
+		}
+
+		hash, err := chainAuditEvent(event, last)
+		if err != nil {
+			return "", count, err
+		}
+
+		if hash != event.Hash {
+			return "", count, fmt.Errorf("line %d: event was modified, hash does not match", count)
+		}
+
+		last = hash
+	}
+
+	return last, count, scanner.Err()
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryAuditLog keeps audit events in memory.
+type memoryAuditLog struct {
+	mu      sync.Mutex
+	events  []AuditEvent
+	queries []AuditQuery
+}
+
+func (l *memoryAuditLog) Write(ctx context.Context, event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	return nil
+}
+
+func (l *memoryAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, query)
+	return l.events, nil
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuditor(t *testing.T) {
+	sink := &memoryAuditLog{}
+	kv := &memoryKeyValue{values: map[string][]byte{}}
+
+	auditor := NewAuditor([]auditSink{sink}, readKeyFromCtx, readClaimsFromCtx)
+	auditor.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	claims := &Claims{}
+	claims.Subject = "alice"
+	claims.ClientID = "cli"
+
+	kvHandler := NewKeyValueHandler(kv, "", readKeyFromCtx)
+
+	serve := func(method string, body string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/redis/foo", strings.NewReader(body))
+		ctx := writeClaimsToCtx(request.Context(), claims)
+		ctx = context.WithValue(ctx, redisKey{}, "foo")
+		ctx = context.WithValue(ctx, middleware.RequestIDKey, "req-1")
+
+		recorder := httptest.NewRecorder()
+		auditor.Handler(handler).ServeHTTP(recorder, request.WithContext(ctx))
+		return recorder
+	}
+
+	// writes are recorded with the hash of the value written
+	{
+		recorder := serve(http.MethodPost, "bar", kvHandler.Set)
+		assert.Equal(t, 2, recorder.Code/100)
+
+		assert.Len(t, sink.events, 1)
+		event := sink.events[0]
+		assert.Equal(t, time.Unix(1700000000, 0).UTC(), event.Time)
+		assert.Equal(t, "req-1", event.RequestID)
+		assert.Equal(t, "alice", event.Subject)
+		assert.Equal(t, "cli", event.Client)
+		assert.Equal(t, operationWrite, event.Operation)
+		assert.Equal(t, "foo", event.Key)
+		assert.Equal(t, auditOutcomeSuccess, event.Outcome)
+		assert.Equal(t, sha256Hex("bar"), event.ValueHash)
+	}
+
+	// reads are recorded with the hash of the value read
+	{
+		recorder := serve(http.MethodGet, "", kvHandler.Get)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "bar", recorder.Body.String())
+
+		event := sink.events[1]
+		assert.Equal(t, operationRead, event.Operation)
+		assert.Equal(t, http.StatusOK, event.Status)
+		assert.Equal(t, auditOutcomeSuccess, event.Outcome)
+		assert.Equal(t, sha256Hex("bar"), event.ValueHash)
+	}
+
+	// denied requests are recorded without a value hash
+	{
+		serve(http.MethodPost, "baz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+
+		event := sink.events[2]
+		assert.Equal(t, http.StatusForbidden, event.Status)
+		assert.Equal(t, auditOutcomeDenied, event.Outcome)
+		assert.Empty(t, event.ValueHash)
+	}
+
+	// missing keys are recorded as not found
+	{
+		delete(kv.values, "foo")
+		serve(http.MethodGet, "", kvHandler.Get)
+
+		event := sink.events[3]
+		assert.Equal(t, http.StatusNotFound, event.Status)
+		assert.Equal(t, auditOutcomeNotFound, event.Outcome)
+	}
+
+	// deletes are recorded apart from writes, without a value hash
+	{
+		kv.values["foo"] = []byte("bar")
+		recorder := serve(http.MethodDelete, "", kvHandler.Delete)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		event := sink.events[4]
+		assert.Equal(t, "delete", event.Operation)
+		assert.Equal(t, auditOutcomeSuccess, event.Outcome)
+		assert.Empty(t, event.ValueHash)
+	}
+}
+
+func TestAuditAttempts(t *testing.T) {
+	sink := &memoryAuditLog{}
+
+	auditor := NewAuditor([]auditSink{sink}, readKeyFromCtx, readClaimsFromCtx)
+
+	// requests with a token pass auth, reaching the key route
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			claims := &Claims{}
+			claims.Subject = "alice"
+			next.ServeHTTP(w, r.WithContext(writeClaimsToCtx(r.Context(), claims)))
+		})
+	}
+	keyRoute := injectKeyInCtx(auditor.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	router := chi.NewRouter()
+	router.Use(auditor.Attempts(keyFromPath(defaultRouterBasePath)))
+	router.Use(auth)
+	router.Get(defaultRouterBasePath+"/", func(w http.ResponseWriter, r *http.Request) {})
+	router.Handle(defaultRouterBasePath+"/{key}", keyRoute)
+
+	serve := func(method string, path string, token string) {
+		request := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// failed attempts are recorded without subject
+	{
+		serve(http.MethodDelete, defaultRouterBasePath+"/foo", "")
+
+		assert.Len(t, sink.events, 1)
+		event := sink.events[0]
+		assert.Empty(t, event.Subject)
+		assert.Equal(t, "delete", event.Operation)
+		assert.Equal(t, "foo", event.Key)
+		assert.Equal(t, http.StatusUnauthorized, event.Status)
+		assert.Equal(t, auditOutcomeDenied, event.Outcome)
+	}
+
+	// requests passing auth are recorded once, with their subject
+	{
+		serve(http.MethodGet, defaultRouterBasePath+"/foo", "alice")
+
+		assert.Len(t, sink.events, 2)
+		assert.Equal(t, "alice", sink.events[1].Subject)
+		assert.Equal(t, http.StatusOK, sink.events[1].Status)
+	}
+
+	// requests on other routes are not recorded
+	{
+		serve(http.MethodGet, defaultRouterBasePath+"/", "")
+		serve(http.MethodGet, "/health", "")
+		serve(http.MethodPut, defaultRouterBasePath+"/foo", "")
+
+		assert.Len(t, sink.events, 2)
+	}
+}
+
+func TestAuditOutcome(t *testing.T) {
+	assert.Equal(t, auditOutcomeSuccess, auditOutcome(http.StatusCreated))
+	assert.Equal(t, auditOutcomeDenied, auditOutcome(http.StatusUnauthorized))
+	assert.Equal(t, auditOutcomeDenied, auditOutcome(http.StatusForbidden))
+	assert.Equal(t, auditOutcomeNotFound, auditOutcome(http.StatusNotFound))
+	assert.Equal(t, auditOutcomeRejected, auditOutcome(http.StatusBadRequest))
+	assert.Equal(t, auditOutcomeRejected, auditOutcome(http.StatusTooManyRequests))
+	assert.Equal(t, auditOutcomeError, auditOutcome(http.StatusInsufficientStorage))
+	assert.Equal(t, auditOutcomeError, auditOutcome(http.StatusInternalServerError))
+}
+
+func TestFileAuditLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(i int, key string) AuditEvent {
+		return AuditEvent{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Operation: operationWrite,
+			Key:       key,
+			Status:    http.StatusOK,
+			Outcome:   auditOutcomeSuccess,
+		}
+	}
+
+	// events are chained
+	{
+		auditLog, err := OpenFileAuditLog(path)
+		assert.NoError(t, err)
+
+		assert.NoError(t, auditLog.Write(ctx, event(0, "foo")))
+		assert.NoError(t, auditLog.Write(ctx, event(1, "bar")))
+		assert.NoError(t, auditLog.Close())
+
+		last, count, err := VerifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+		assert.NotEmpty(t, last)
+	}
+
+	// reopening continues the chain
+	{
+		auditLog, err := OpenFileAuditLog(path)
+		assert.NoError(t, err)
+
+		assert.NoError(t, auditLog.Write(ctx, event(2, "foo")))
+		assert.NoError(t, auditLog.Write(ctx, event(3, "foo")))
+
+		_, count, err := VerifyAuditLog(path)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, count)
+
+		// latest events first selected, in chronological order
+		events, err := auditLog.Query(ctx, AuditQuery{Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, events, 2)
+		assert.Equal(t, start.Add(2*time.Minute), events[0].Time)
+		assert.Equal(t, start.Add(3*time.Minute), events[1].Time)
+
+		// filtered by key
+		events, err = auditLog.Query(ctx, AuditQuery{Key: "foo", Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, events, 3)
+
+		// earliest events after since are selected
+		events, err = auditLog.Query(ctx, AuditQuery{Since: start.Add(time.Minute), Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, events, 2)
+		assert.Equal(t, "bar", events[0].Key)
+		assert.Equal(t, start.Add(2*time.Minute), events[1].Time)
+
+		assert.NoError(t, auditLog.Close())
+	}
+
+	// modified events are detected
+	{
+		buf, err := os.ReadFile(path)
+		assert.NoError(t, err)
+
+		tampered := bytes.Replace(buf, []byte(`"key":"bar"`), []byte(`"key":"baz"`), 1)
+		assert.NoError(t, os.WriteFile(path, tampered, 0600))
+
+		_, _, err = VerifyAuditLog(path)
+		assert.ErrorContains(t, err, "line 2")
+
+		_, err = OpenFileAuditLog(path)
+		assert.Error(t, err)
+	}
+
+	// removed events are detected
+	{
+		buf, err := os.ReadFile(path)
+		assert.NoError(t, err)
+
+		lines := strings.SplitAfter(string(buf), "\n")
+		assert.NoError(t, os.WriteFile(path, []byte(lines[0]+lines[2]), 0600))
+
+		_, _, err = VerifyAuditLog(path)
+		assert.ErrorContains(t, err, "chain is broken")
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	auditLog := &memoryAuditLog{
+		events: []AuditEvent{{Key: "foo", Operation: operationRead, Outcome: auditOutcomeSuccess}},
+	}
+	handler := NewAuditHandler(auditLog)
+
+	query := func(rawQuery string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.Query(recorder, httptest.NewRequest(http.MethodGet, auditPath+"?"+rawQuery, nil))
+		return recorder
+	}
+
+	// events are queried with the defaults
+	{
+		recorder := query("")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var events []AuditEvent
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&events))
+		assert.Equal(t, auditLog.events, events)
+		assert.Equal(t, AuditQuery{Limit: defaultAuditQueryLimit}, auditLog.queries[0])
+	}
+
+	// key, since and limit are parsed
+	{
+		recorder := query("key=foo&since=2023-01-01T00:00:00Z&limit=5")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, AuditQuery{
+			Key:   "foo",
+			Since: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			Limit: 5,
+		}, auditLog.queries[1])
+	}
+
+	// since may be a duration
+	{
+		recorder := query("since=1h")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.WithinDuration(t, time.Now().Add(-time.Hour), auditLog.queries[2].Since, time.Minute)
+	}
+
+	// invalid since and limit are rejected
+	{
+		assert.Equal(t, http.StatusBadRequest, query("since=yesterday").Code)
+		assert.Equal(t, http.StatusBadRequest, query("limit=0").Code)
+		assert.Equal(t, http.StatusBadRequest, query(fmt.Sprintf("limit=%d", maxAuditQueryLimit+1)).Code)
+	}
+}
+
+func TestRedisAuditStream(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer client.Close()
+
+	// isolate runs of the test
+	prefix := fmt.Sprintf("test-audit-%d:", time.Now().UnixNano())
+	stream := newRedisAuditStream(client, prefix, 1000)
+	defer client.Del(ctx, stream.key)
+
+	// write more events than a page
+	start := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < auditStreamPageSize+50; i++ {
+		key := "foo"
+		if i%2 == 1 {
+			key = "bar"
+		}
+
+		assert.NoError(t, stream.Write(ctx, AuditEvent{
+			Time:      start.Add(time.Duration(i) * time.Second),
+			Operation: operationRead,
+			Key:       key,
+		}))
+	}
+
+	// latest events are selected, in chronological order
+	{
+		events, err := stream.Query(ctx, AuditQuery{Key: "foo", Limit: 60})
+		assert.NoError(t, err)
+		assert.Len(t, events, 60)
+		assert.Equal(t, start.Add(time.Duration(auditStreamPageSize+48)*time.Second), events[59].Time)
+		assert.True(t, events[0].Time.Before(events[59].Time))
+	}
+
+	// every event is found across pages
+	{
+		events, err := stream.Query(ctx, AuditQuery{Limit: maxAuditQueryLimit})
+		assert.NoError(t, err)
+		assert.Len(t, events, auditStreamPageSize+50)
+	}
+
+	// events after since are selected
+	{
+		events, err := stream.Query(ctx, AuditQuery{Since: start, Limit: 3})
+		assert.NoError(t, err)
+		assert.Len(t, events, 3)
+		assert.Equal(t, start, events[0].Time)
+	}
+}
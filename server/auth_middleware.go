@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+type AuthMiddleware struct {
+	parseToken   ParseTokenFunc
+	claimsToCtx  func(ctx context.Context, claims *Claims) context.Context
+	isRevoked    revokedFunc
+	sessionToken sessionTokenFunc
+}
+
+// ParseTokenFunc parses the Authorization token and returns its claims.
+type ParseTokenFunc func(string) (*Claims, error)
+
+// sessionTokenFunc returns the token of the session of a request, reporting whether it has one.
+type sessionTokenFunc func(context.Context, *http.Request) (string, bool, error)
+
+// revokedFunc reports whether a valid token has been revoked.
+type revokedFunc func(context.Context, *Claims) (bool, error)
+
+// NewAuthMiddleware creates an AuthMiddleware, isRevoked may be nil.
+func NewAuthMiddleware(
+	parseToken ParseTokenFunc,
+	claimsToCtx func(ctx context.Context, claims *Claims) context.Context,
+	isRevoked revokedFunc,
+) AuthMiddleware {
+	return AuthMiddleware{
+		parseToken:  parseToken,
+		claimsToCtx: claimsToCtx,
+		isRevoked:   isRevoked,
+	}
+}
+
+// AcceptSessions accepts the token of the session of requests without an
+// Authorization header. It must be called before the middleware is used.
+func (m *AuthMiddleware) AcceptSessions(sessionToken sessionTokenFunc) {
+	m.sessionToken = sessionToken
+}
+
+// Claims of the token of a request, holding the permissions granted by it.
+type Claims struct {
+	jwt.RegisteredClaims
+	Permissions     []string `json:"permissions"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	ClientID        string   `json:"client_id,omitempty"`
+
+	// extra holds every claim of the token, including the ones above
+	extra map[string]interface{}
+}
+
+func (c *Claims) UnmarshalJSON(buf []byte) error {
+	type registered Claims
+	if err := json.Unmarshal(buf, (*registered)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, &c.extra)
+}
+
+// Claim returns a claim by name.
+func (c *Claims) Claim(name string) (interface{}, bool) {
+	value, ok := c.extra[name]
+	return value, ok
+}
+
+// Client returns the ID of the client the token was issued to.
+func (c *Claims) Client() string {
+	if c.AuthorizedParty != "" {
+		return c.AuthorizedParty
+	}
+	return c.ClientID
+}
+
+func (m AuthMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer().Start(r.Context(), "AuthMiddleware")
+		claims, status := m.authenticate(ctx, r)
+		if status != 0 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+			span.End()
+
+			w.WriteHeader(status)
+			return
+		}
+
+		span.SetAttributes(semconv.EnduserIDKey.String(claims.Subject))
+		span.End()
+
+		newContext := m.claimsToCtx(r.Context(), claims)
+
+		next.ServeHTTP(w, r.WithContext(newContext))
+	})
+}
+
+// authenticate returns the claims of the request token,
+// or the status to respond with when it is not accepted.
+func (m AuthMiddleware) authenticate(ctx context.Context, r *http.Request) (*Claims, int) {
+	token, ok := extractTokenFromHeaders(r)
+	if !ok && r.Header.Get("Authorization") == "" && m.sessionToken != nil {
+		var err error
+		token, ok, err = m.sessionToken(ctx, r)
+		if err != nil {
+			loggerFromCtx(ctx).Error("error loading session", err)
+			return nil, http.StatusServiceUnavailable
+		}
+	}
+	if !ok {
+		return nil, http.StatusUnauthorized
+	}
+
+	return m.authenticateToken(ctx, token)
+}
+
+// authenticateToken returns the claims of a token,
+// or the status to respond with when it is not accepted.
+func (m AuthMiddleware) authenticateToken(ctx context.Context, token string) (*Claims, int) {
+	claims, err := m.parseToken(token)
+	if err != nil {
+		return nil, http.StatusUnauthorized
+	}
+
+	if m.isRevoked != nil {
+		revoked, err := m.isRevoked(ctx, claims)
+		if err != nil {
+			loggerFromCtx(ctx).Error("error checking token revocation", err)
+			return nil, http.StatusServiceUnavailable
+		}
+		if revoked {
+			return nil, http.StatusUnauthorized
+		}
+	}
+
+	return claims, 0
+}
+
+// extractTokenFromHeaders looks for authorization header and gets token
+func extractTokenFromHeaders(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", false
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if !strings.EqualFold(parts[0], "bearer") {
+		return "", false
+	}
+
+	return parts[1], true
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"context"
@@ -17,17 +17,18 @@ func TestAuthMiddleware(t *testing.T) {
 		token := "token"
 		permissions := []string{"read:nothing"}
 
-		parser := func(tkn string) ([]string, error) {
+		parser := func(tkn string) (*Claims, error) {
 			assert.Equal(t, token, tkn)
-			return permissions, nil
+			return &Claims{Permissions: permissions}, nil
 		}
 
 		am := NewAuthMiddleware(
 			parser,
-			func(ctx context.Context, perms []string) context.Context {
-				assert.Equal(t, permissions, perms)
+			func(ctx context.Context, claims *Claims) context.Context {
+				assert.Equal(t, permissions, claims.Permissions)
 				return ctx
 			},
+			nil,
 		)
 
 		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost:8080", nil)
@@ -48,17 +49,18 @@ func TestAuthMiddleware(t *testing.T) {
 		token := "token"
 		permissions := []string{"read:nothing"}
 
-		parser := func(tkn string) ([]string, error) {
+		parser := func(tkn string) (*Claims, error) {
 			assert.Equal(t, token, tkn)
 			return nil, fmt.Errorf("failed to parse token")
 		}
 
 		am := NewAuthMiddleware(
 			parser,
-			func(ctx context.Context, perms []string) context.Context {
-				assert.Equal(t, permissions, perms)
+			func(ctx context.Context, claims *Claims) context.Context {
+				assert.Equal(t, permissions, claims.Permissions)
 				return ctx
 			},
+			nil,
 		)
 
 		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost:8080", nil)
@@ -80,19 +82,20 @@ func TestAuthMiddleware(t *testing.T) {
 		token := "token"
 		permissions := []string{"read:nothing"}
 
-		parser := func(tkn string) ([]string, error) {
+		parser := func(tkn string) (*Claims, error) {
 			assert.Equal(t, token, tkn)
-			return permissions, nil
+			return &Claims{Permissions: permissions}, nil
 		}
 
 		type foo struct{}
 
 		am := NewAuthMiddleware(
 			parser,
-			func(ctx context.Context, perms []string) context.Context {
-				assert.Equal(t, permissions, perms)
+			func(ctx context.Context, claims *Claims) context.Context {
+				assert.Equal(t, permissions, claims.Permissions)
 				return context.WithValue(ctx, foo{}, "bar")
 			},
+			nil,
 		)
 
 		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost:8080", nil)
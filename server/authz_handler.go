@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const authzCheckPath = "/_authz/check"
+
+// AuthzHandler explains authorization decisions to the caller, to help debug
+// requests denied by the PermissionMiddleware.
+type AuthzHandler struct {
+	permissions   PermissionMiddleware
+	claimsFromCtx func(context.Context) *Claims
+}
+
+func NewAuthzHandler(
+	permissions PermissionMiddleware,
+	claimsFromCtx func(context.Context) *Claims,
+) *AuthzHandler {
+	return &AuthzHandler{
+		permissions:   permissions,
+		claimsFromCtx: claimsFromCtx,
+	}
+}
+
+type authzCheckRequest struct {
+	Key       string `json:"key"`
+	Operation string `json:"operation"`
+}
+
+type authzCheckResponse struct {
+	Subject string `json:"subject,omitempty"`
+	Client  string `json:"client,omitempty"`
+	PermissionCheck
+}
+
+// Check responds with the decision for an operation on a key, made with the
+// caller's effective permissions. It does not access the key.
+func (h *AuthzHandler) Check(w http.ResponseWriter, r *http.Request) {
+	var req authzCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Operation != operationRead && req.Operation != operationWrite {
+		http.Error(w, "operation must be read or write", http.StatusBadRequest)
+		return
+	}
+
+	claims := h.claimsFromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(authzCheckResponse{
+		Subject:         claims.Subject,
+		Client:          claims.Client(),
+		PermissionCheck: h.permissions.Check(r.Context(), req.Operation, req.Key),
+	})
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
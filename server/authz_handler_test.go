@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+func TestAuthzHandlerCheck(t *testing.T) {
+	claims := parseTestClaims(t, `{"sub":"auth0|alice","azp":"ci","org_id":"acme"}`)
+
+	pm := NewPermissionMiddleware(
+		"kave:",
+		policy.SyntaxGlob,
+		readKeyFromCtx,
+		func(ctx context.Context) []string {
+			return []string{"read:kave:tenants:{claims.org_id}:**", "deny:read:kave:tenants:*:secret"}
+		},
+		func(ctx context.Context) *Claims {
+			return claims
+		},
+	)
+
+	handler := NewAuthzHandler(pm, func(ctx context.Context) *Claims {
+		return claims
+	})
+
+	check := func(body string) (int, authzCheckResponse) {
+		request := httptest.NewRequest(http.MethodPost, authzCheckPath, bytes.NewBufferString(body))
+		recorder := httptest.NewRecorder()
+
+		handler.Check(recorder, request)
+
+		var response authzCheckResponse
+		if recorder.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+		}
+		return recorder.Code, response
+	}
+
+	// allowed read
+	{
+		code, response := check(`{"key":"tenants:acme:config","operation":"read"}`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, response.Allowed)
+		assert.Equal(t, "auth0|alice", response.Subject)
+		assert.Equal(t, "ci", response.Client)
+		assert.Equal(t, "read:kave:tenants:acme:config", response.Required)
+		assert.Equal(t, []string{"read:kave:tenants:acme:**", "deny:read:kave:tenants:*:secret"}, response.Permissions)
+		assert.Equal(t, "read:kave:tenants:acme:**", response.Matched)
+	}
+
+	// denied by a deny rule
+	{
+		code, response := check(`{"key":"tenants:acme:secret","operation":"read"}`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.False(t, response.Allowed)
+		assert.Equal(t, "read:kave:tenants:*:secret", response.DeniedBy)
+		assert.Equal(t, "denied by 'deny:read:kave:tenants:*:secret'", response.Reason)
+	}
+
+	// no permission matches
+	{
+		code, response := check(`{"key":"tenants:acme:config","operation":"write"}`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.False(t, response.Allowed)
+		assert.Equal(t, "no permission matches", response.Reason)
+	}
+
+	// unknown operation
+	{
+		code, _ := check(`{"key":"foo","operation":"delete"}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+
+	// invalid body
+	{
+		code, _ := check(`{`)
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type redisKey struct{}
+
+type authClaims struct{}
+
+type requestLogFields struct{}
+
+func readKeyFromCtx(ctx context.Context) string {
+	key, ok := ctx.Value(redisKey{}).(string)
+	if !ok {
+		return ""
+	}
+	return key
+}
+
+func writeKeyToCtx(ctx context.Context, key string) context.Context {
+	if fields := readLogFieldsFromCtx(ctx); fields != nil {
+		fields.key = key
+	}
+	return context.WithValue(ctx, redisKey{}, key)
+}
+
+func readClaimsFromCtx(ctx context.Context) *Claims {
+	claims, ok := ctx.Value(authClaims{}).(*Claims)
+	if !ok {
+		return &Claims{}
+	}
+	return claims
+}
+
+// ClaimsFromContext returns the claims of the token of a request, empty
+// when auth is disabled. Middleware and routes added with WithMiddleware and
+// WithRoutes run after auth, so the claims are set by then.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	return readClaimsFromCtx(ctx)
+}
+
+func writeClaimsToCtx(ctx context.Context, claims *Claims) context.Context {
+	if fields := readLogFieldsFromCtx(ctx); fields != nil {
+		fields.subject = claims.Subject
+	}
+	return context.WithValue(ctx, authClaims{}, claims)
+}
+
+// readLogFieldsFromCtx returns the fields of the request log, they are
+// updated as the key and claims of the request are written to its context.
+func readLogFieldsFromCtx(ctx context.Context) *logFields {
+	fields, ok := ctx.Value(requestLogFields{}).(*logFields)
+	if !ok {
+		return nil
+	}
+	return fields
+}
+
+func writeLogFieldsToCtx(ctx context.Context, fields *logFields) context.Context {
+	return context.WithValue(ctx, requestLogFields{}, fields)
+}
+
+func readPermissionsFromCtx(ctx context.Context) []string {
+	permissions := readClaimsFromCtx(ctx).Permissions
+	if permissions == nil {
+		return []string{}
+	}
+	return permissions
+}
+
+// readRoutePatternFromCtx returns the pattern of the route matched so far.
+// Subrouters only add their trailing "/" once a handler is reached, it is
+// trimmed so requests rejected by a middleware share the pattern.
+func readRoutePatternFromCtx(ctx context.Context) string {
+	rctx := chi.RouteContext(ctx)
+	if rctx == nil {
+		return ""
+	}
+
+	pattern := rctx.RoutePattern()
+	if len(pattern) > 1 {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	return pattern
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const corsAllowAnyOrigin = "*"
+
+var (
+	defaultCORSAllowedMethods = []string{http.MethodGet, http.MethodPost}
+	defaultCORSAllowedHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORSOptions configures which browser origins may call the server.
+type CORSOptions struct {
+	Enabled bool `toml:"enabled"`
+	// AllowedOrigins are exact origins, globs such as "https://*.example.com" or "*" for any
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// AllowedMethods defaults to GET and POST
+	AllowedMethods []string `toml:"allowed_methods"`
+	// AllowedHeaders defaults to Authorization and Content-Type
+	AllowedHeaders []string `toml:"allowed_headers"`
+	// ExposedHeaders are response headers readable by scripts, such as RateLimit-Remaining
+	ExposedHeaders   []string `toml:"exposed_headers"`
+	AllowCredentials bool     `toml:"allow_credentials"`
+	// MaxAgeMs is how long browsers may cache a preflight response, left to browsers when 0
+	MaxAgeMs int `toml:"max_age_ms"`
+}
+
+// CORS answers preflight requests and adds the CORS headers to requests of allowed origins.
+type CORS struct {
+	origins        []string
+	methods        map[string]bool
+	headers        map[string]bool
+	allowMethods   string
+	allowHeaders   string
+	exposeHeaders  string
+	credentials    bool
+	maxAgeSeconds  int
+	allowAnyOrigin bool
+}
+
+func NewCORS(options CORSOptions) (*CORS, error) {
+	if len(options.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("cors requires allowed origins")
+	}
+
+	c := &CORS{
+		methods:       map[string]bool{},
+		headers:       map[string]bool{},
+		credentials:   options.AllowCredentials,
+		maxAgeSeconds: int(time.Duration(options.MaxAgeMs) * time.Millisecond / time.Second),
+		exposeHeaders: strings.Join(options.ExposedHeaders, ", "),
+	}
+
+	for _, origin := range options.AllowedOrigins {
+		if origin == corsAllowAnyOrigin {
+			c.allowAnyOrigin = true
+			continue
+		}
+		if _, err := path.Match(origin, ""); err != nil {
+			return nil, fmt.Errorf("invalid allowed origin '%s': %w", origin, err)
+		}
+		c.origins = append(c.origins, origin)
+	}
+
+	// browsers do not send credentials to a wildcard origin
+	if c.allowAnyOrigin && c.credentials {
+		return nil, fmt.Errorf("allowed origin '%s' cannot be used with credentials", corsAllowAnyOrigin)
+	}
+
+	methods := options.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSAllowedMethods
+	}
+	for _, method := range methods {
+		c.methods[strings.ToUpper(method)] = true
+	}
+	c.allowMethods = strings.ToUpper(strings.Join(methods, ", "))
+
+	headers := options.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSAllowedHeaders
+	}
+	for _, header := range headers {
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	c.allowHeaders = strings.Join(headers, ", ")
+
+	return c, nil
+}
+
+func (c *CORS) originAllowed(origin string) bool {
+	if c.allowAnyOrigin {
+		return true
+	}
+	for _, pattern := range c.origins {
+		if matched, _ := path.Match(pattern, origin); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// preflightAllowed tells whether the method and headers of a preflight request are allowed.
+func (c *CORS) preflightAllowed(r *http.Request) bool {
+	if !c.methods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+		return false
+	}
+
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !c.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *CORS) setAllowOrigin(w http.ResponseWriter, origin string) {
+	if c.allowAnyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", corsAllowAnyOrigin)
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Handler answers preflight requests before they reach auth or permission
+// checks, browsers send them without credentials. It must be used before the
+// auth middleware.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// responses differ by origin, caches must not share them
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if c.originAllowed(origin) {
+				c.setAllowOrigin(w, origin)
+				if c.exposeHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", c.exposeHeaders)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		// browsers reject the request when the allow headers are missing
+		if c.originAllowed(origin) && c.preflightAllowed(r) {
+			c.setAllowOrigin(w, origin)
+			w.Header().Set("Access-Control-Allow-Methods", c.allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", c.allowHeaders)
+			if c.maxAgeSeconds > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.maxAgeSeconds))
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
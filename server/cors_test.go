@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+func TestCORS(t *testing.T) {
+	cors, err := NewCORS(CORSOptions{
+		AllowedOrigins:   []string{"https://tools.example.com", "https://*.internal.example.com"},
+		ExposedHeaders:   []string{"RateLimit-Remaining"},
+		AllowCredentials: true,
+		MaxAgeMs:         600000,
+	})
+	assert.NoError(t, err)
+
+	authMiddleware := NewAuthMiddleware(
+		func(token string) (*Claims, error) {
+			if token != "alice" {
+				return nil, fmt.Errorf("invalid token")
+			}
+			return &Claims{Permissions: []string{"read:foo"}}, nil
+		},
+		writeClaimsToCtx,
+		nil,
+	)
+
+	permissionMiddleware := NewPermissionMiddleware("", policy.SyntaxGlob, readKeyFromCtx, readPermissionsFromCtx, readClaimsFromCtx)
+
+	router := chi.NewRouter()
+	router.Use(cors.Handler)
+	router.Use(authMiddleware.Handler)
+	router.Route("/redis/{key}", func(r chi.Router) {
+		r.Use(injectKeyInCtx)
+		r.Use(permissionMiddleware.Handler)
+
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	})
+
+	preflight := func(origin string, method string, headers string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodOptions, "/redis/foo", nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			request.Header.Set("Access-Control-Request-Headers", headers)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// preflight requests are answered without a token
+	{
+		recorder := preflight("https://tools.example.com", http.MethodGet, "authorization, content-type")
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "https://tools.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, POST", recorder.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Authorization, Content-Type", recorder.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "true", recorder.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "600", recorder.Header().Get("Access-Control-Max-Age"))
+		assert.Contains(t, recorder.Header().Values("Vary"), "Origin")
+	}
+
+	// origins are matched as globs
+	{
+		recorder := preflight("https://flags.internal.example.com", http.MethodPost, "")
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "https://flags.internal.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// other origins, methods and headers are not allowed
+	{
+		recorder := preflight("https://evil.example.com", http.MethodGet, "")
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+
+		recorder = preflight("https://tools.example.com", http.MethodDelete, "")
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+
+		recorder = preflight("https://tools.example.com", http.MethodGet, "X-Custom")
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	serve := func(origin string, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/redis/foo", nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Authorization", "Bearer "+token)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// requests are still authenticated, errors readable by the allowed origins
+	{
+		recorder := serve("https://tools.example.com", "alice")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "https://tools.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "RateLimit-Remaining", recorder.Header().Get("Access-Control-Expose-Headers"))
+
+		recorder = serve("https://tools.example.com", "mallory")
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Equal(t, "https://tools.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+
+		recorder = serve("https://evil.example.com", "alice")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// OPTIONS requests which are not preflights are checked as usual
+	{
+		request := httptest.NewRequest(http.MethodOptions, "/redis/foo", nil)
+		request.Header.Set("Origin", "https://tools.example.com")
+		request.Header.Set("Authorization", "Bearer alice")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		assert.NotEqual(t, http.StatusNoContent, recorder.Code)
+	}
+}
+
+func TestNewCORS(t *testing.T) {
+	// any origin
+	{
+		cors, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"get"}})
+		assert.NoError(t, err)
+
+		request := httptest.NewRequest(http.MethodOptions, "/redis/foo", nil)
+		request.Header.Set("Origin", "https://anything.example.com")
+		request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+		recorder := httptest.NewRecorder()
+		cors.Handler(http.NotFoundHandler()).ServeHTTP(recorder, request)
+		assert.Equal(t, "*", recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET", recorder.Header().Get("Access-Control-Allow-Methods"))
+		assert.Empty(t, recorder.Header().Get("Access-Control-Max-Age"))
+	}
+
+	// credentials are never sent to any origin
+	{
+		_, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+		assert.Error(t, err)
+	}
+
+	// origins are required
+	{
+		_, err := NewCORS(CORSOptions{})
+		assert.Error(t, err)
+	}
+
+	// invalid globs are rejected
+	{
+		_, err := NewCORS(CORSOptions{AllowedOrigins: []string{"https://[.example.com"}})
+		assert.Error(t, err)
+	}
+}
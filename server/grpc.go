@@ -0,0 +1,586 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/pdcalado/kave/internal/policy"
+	kavev1 "github.com/pdcalado/kave/proto/kave/v1"
+)
+
+const (
+	maxBatchOperations = 1000
+
+	// how often the token of a watching caller is checked again without events
+	watchRecheckInterval = 30 * time.Second
+
+	// deletes require the write permission, but are recorded apart as Auditor.Handler does
+	auditDelete = "delete"
+)
+
+// GRPCOptions configures the gRPC API, served apart from the HTTP API.
+type GRPCOptions struct {
+	Enabled bool   `toml:"enabled"`
+	Address string `toml:"address"`
+}
+
+// grpcKeyOperations holds the operation on their key required by the
+// methods on a single key, other methods check each key they touch.
+var grpcKeyOperations = map[string]string{
+	kavev1.KaveService_Get_FullMethodName:    operationRead,
+	kavev1.KaveService_Set_FullMethodName:    operationWrite,
+	kavev1.KaveService_Delete_FullMethodName: operationWrite,
+}
+
+var errGRPCInternalKey = status.Error(codes.InvalidArgument, "key is reserved")
+
+// grpcService serves the gRPC API from the same backend as the HTTP API.
+type grpcService struct {
+	kavev1.UnimplementedKaveServiceServer
+
+	keyValue          KeyValue
+	keyPrefix         string
+	internalKeyPrefix string
+	keys              *KeyListHandler
+	events            keyEventBus
+	auth              *AuthMiddleware
+	permissions       *PermissionMiddleware
+	auditor           *Auditor
+}
+
+// newGRPCServer creates the server of the gRPC API. Calls are authenticated
+// and rate limited as HTTP requests are, unless auth or rateLimiter is nil.
+func newGRPCServer(service *grpcService, auth *AuthMiddleware, rateLimiter *RateLimiter) *grpc.Server {
+	unary := []grpc.UnaryServerInterceptor{grpcLogUnaryInterceptor}
+	stream := []grpc.StreamServerInterceptor{grpcLogStreamInterceptor}
+
+	if auth != nil {
+		authenticate := func(ctx context.Context) (context.Context, error) {
+			return grpcAuthenticate(ctx, *auth)
+		}
+
+		// limit callers failing auth by address, as the HTTP API does
+		if rateLimiter != nil {
+			authenticate = grpcLimitFailures(authenticate, rateLimiter)
+		}
+
+		unary = append(unary, grpcUnaryInterceptor(authenticate))
+		stream = append(stream, grpcStreamInterceptor(authenticate))
+	}
+
+	if rateLimiter != nil {
+		rateLimit := func(ctx context.Context) (context.Context, error) {
+			return ctx, grpcRateLimit(ctx, rateLimiter)
+		}
+
+		unary = append(unary, grpcUnaryInterceptor(rateLimit))
+		stream = append(stream, grpcStreamInterceptor(rateLimit))
+	}
+
+	unary = append(unary, grpcKeyInterceptor)
+
+	// record operations, including denied ones
+	if service.auditor != nil {
+		unary = append(unary, grpcAuditInterceptor(service.auditor))
+	}
+
+	if service.permissions != nil {
+		unary = append(unary, grpcPermissionInterceptor(*service.permissions))
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
+	kavev1.RegisterKaveServiceServer(server, service)
+
+	return server
+}
+
+func (s *grpcService) Get(ctx context.Context, req *kavev1.GetRequest) (*kavev1.GetResponse, error) {
+	if isInternalKey(s.keyPrefix, s.internalKeyPrefix, req.GetKey()) {
+		return nil, errGRPCInternalKey
+	}
+
+	value, err := s.keyValue.Get(ctx, s.keyPrefix+req.GetKey())
+	if err != nil {
+		return nil, grpcKeyValueError(ctx, "error getting key", err)
+	}
+
+	return &kavev1.GetResponse{Value: []byte(value)}, nil
+}
+
+func (s *grpcService) Set(ctx context.Context, req *kavev1.SetRequest) (*kavev1.SetResponse, error) {
+	if isInternalKey(s.keyPrefix, s.internalKeyPrefix, req.GetKey()) {
+		return nil, errGRPCInternalKey
+	}
+
+	if err := s.keyValue.Set(ctx, s.keyPrefix+req.GetKey(), req.GetValue()); err != nil {
+		return nil, grpcKeyValueError(ctx, "error setting key", err)
+	}
+
+	return &kavev1.SetResponse{}, nil
+}
+
+func (s *grpcService) Delete(ctx context.Context, req *kavev1.DeleteRequest) (*kavev1.DeleteResponse, error) {
+	if isInternalKey(s.keyPrefix, s.internalKeyPrefix, req.GetKey()) {
+		return nil, errGRPCInternalKey
+	}
+
+	if err := s.keyValue.Delete(ctx, s.keyPrefix+req.GetKey()); err != nil {
+		return nil, grpcKeyValueError(ctx, "error deleting key", err)
+	}
+
+	return &kavev1.DeleteResponse{}, nil
+}
+
+func (s *grpcService) List(ctx context.Context, req *kavev1.ListRequest) (*kavev1.ListResponse, error) {
+	if s.keys == nil {
+		return nil, status.Error(codes.Unimplemented, "keys cannot be listed")
+	}
+
+	var cursor uint64
+	if req.GetCursor() != "" {
+		var err error
+		cursor, err = strconv.ParseUint(req.GetCursor(), 10, 64)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid cursor")
+		}
+	}
+
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = defaultKeyListLimit
+	}
+	if limit < 1 || limit > maxKeyListLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", maxKeyListLimit)
+	}
+
+	page, err := s.keys.list(ctx, req.GetPrefix(), cursor, limit)
+	if err != nil {
+		return nil, grpcKeyValueError(ctx, "error listing keys", err)
+	}
+
+	response := &kavev1.ListResponse{Cursor: page.Cursor}
+	for _, info := range page.Keys {
+		response.Keys = append(response.Keys, &kavev1.KeyInfo{Key: info.Key, TtlMs: info.TTLMs})
+	}
+
+	return response, nil
+}
+
+func (s *grpcService) Watch(req *kavev1.WatchRequest, stream kavev1.KaveService_WatchServer) error {
+	ctx := stream.Context()
+
+	events, err := s.events.Subscribe(ctx)
+	if err != nil {
+		loggerFromCtx(ctx).Error("error subscribing to key events", err)
+		return status.Error(codes.Unavailable, "failed to watch keys")
+	}
+
+	// tell the caller changes are watched from now on
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	// the claims of the caller are the same for every event
+	var compiled *policy.Policy
+	if s.permissions != nil {
+		compiled, _ = s.permissions.callerPolicy(ctx)
+	}
+
+	// the stream ends when the token of the caller expires, or once it is
+	// found revoked by the checks on every event and tick
+	var expired, recheck <-chan time.Time
+	if s.auth != nil {
+		if expiresAt := readClaimsFromCtx(ctx).ExpiresAt; expiresAt != nil {
+			timer := time.NewTimer(time.Until(expiresAt.Time))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		ticker := time.NewTicker(watchRecheckInterval)
+		defer ticker.Stop()
+		recheck = ticker.C
+	}
+
+	for {
+		var event KeyEvent
+		var ok bool
+		select {
+		case event, ok = <-events:
+		case <-expired:
+			return status.Error(codes.Unauthenticated, "token expired")
+		case <-recheck:
+			if _, err := grpcAuthenticate(ctx, *s.auth); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !ok {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+
+		if !strings.HasPrefix(event.Key, s.keyPrefix+req.GetPrefix()) {
+			continue
+		}
+
+		key := strings.TrimPrefix(event.Key, s.keyPrefix)
+		if s.permissions != nil && !s.permissions.allowed(compiled, operationRead, key) {
+			continue
+		}
+
+		if s.auth != nil {
+			if _, err := grpcAuthenticate(ctx, *s.auth); err != nil {
+				return err
+			}
+		}
+
+		response := &kavev1.WatchResponse{Type: kavev1.EventType_EVENT_TYPE_SET, Key: key, Value: event.Value}
+		if event.Type == keyEventDelete {
+			response.Type = kavev1.EventType_EVENT_TYPE_DELETE
+		}
+
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *grpcService) Batch(ctx context.Context, req *kavev1.BatchRequest) (*kavev1.BatchResponse, error) {
+	if len(req.GetOperations()) > maxBatchOperations {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d operations are allowed", maxBatchOperations)
+	}
+
+	var compiled *policy.Policy
+	if s.permissions != nil {
+		compiled, _ = s.permissions.callerPolicy(ctx)
+	}
+
+	response := &kavev1.BatchResponse{}
+	for _, operation := range req.GetOperations() {
+		response.Results = append(response.Results, s.batchOperation(ctx, compiled, operation))
+	}
+
+	return response, nil
+}
+
+// batchOperation runs an operation of a batch, checking it against compiled,
+// the policy of the caller, and recording it as a call of its own.
+func (s *grpcService) batchOperation(ctx context.Context, compiled *policy.Policy, operation *kavev1.BatchOperation) *kavev1.BatchResult {
+	var call func(ctx context.Context) ([]byte, error)
+	var key, audited string
+	var written []byte
+
+	switch op := operation.GetOperation().(type) {
+	case *kavev1.BatchOperation_Get:
+		key, audited = op.Get.GetKey(), operationRead
+		call = func(ctx context.Context) ([]byte, error) {
+			response, err := s.Get(ctx, op.Get)
+			return response.GetValue(), err
+		}
+	case *kavev1.BatchOperation_Set:
+		key, audited, written = op.Set.GetKey(), operationWrite, op.Set.GetValue()
+		call = func(ctx context.Context) ([]byte, error) {
+			_, err := s.Set(ctx, op.Set)
+			return nil, err
+		}
+	case *kavev1.BatchOperation_Delete:
+		key, audited = op.Delete.GetKey(), auditDelete
+		call = func(ctx context.Context) ([]byte, error) {
+			_, err := s.Delete(ctx, op.Delete)
+			return nil, err
+		}
+	default:
+		return &kavev1.BatchResult{Code: int32(codes.InvalidArgument), Message: "operation must be set"}
+	}
+
+	value, err := func() ([]byte, error) {
+		if key == "" {
+			return nil, status.Error(codes.InvalidArgument, "key must be set")
+		}
+
+		// deletes require the write permission, but are recorded apart
+		required := audited
+		if audited == auditDelete {
+			required = operationWrite
+		}
+
+		if s.permissions != nil && !s.permissions.decide(ctx, compiled, required, s.permissions.requiredPermission(required, key)) {
+			return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed", s.permissions.requiredPermission(required, key))
+		}
+
+		return call(ctx)
+	}()
+
+	if s.auditor != nil {
+		if audited == operationRead {
+			written = value
+		}
+		grpcAudit(ctx, s.auditor, audited, key, err, written)
+	}
+
+	st := status.Convert(err)
+	return &kavev1.BatchResult{Code: int32(st.Code()), Message: st.Message(), Value: value}
+}
+
+// grpcKeyValueError turns an error of the backend into a status.
+func grpcKeyValueError(ctx context.Context, msg string, err error) error {
+	if (ErrorKeyNotFound{}).Is(err) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return status.Error(codes.ResourceExhausted, quotaErr.Error())
+	}
+
+	loggerFromCtx(ctx).Error(msg, err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// grpcUnaryInterceptor turns a check of the context of calls into a unary interceptor.
+func grpcUnaryInterceptor(check func(ctx context.Context) (context.Context, error)) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := check(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcStreamInterceptor turns a check of the context of calls into a stream interceptor.
+func grpcStreamInterceptor(check func(ctx context.Context) (context.Context, error)) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := check(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &grpcServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// grpcServerStream replaces the context of a stream.
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcAuthenticate accepts the bearer tokens of the "authorization" metadata
+// accepted by auth, writing their claims to the context.
+func grpcAuthenticate(ctx context.Context, auth AuthMiddleware) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+
+	parts := strings.SplitN(values[0], " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return nil, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+	}
+
+	claims, code := auth.authenticateToken(ctx, parts[1])
+	switch code {
+	case 0:
+		return auth.claimsToCtx(ctx, claims), nil
+	case http.StatusServiceUnavailable:
+		return nil, status.Error(codes.Unavailable, "failed to check token")
+	default:
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+}
+
+// grpcRateLimit limits callers as the HTTP API does, sharing their buckets.
+func grpcRateLimit(ctx context.Context, l *RateLimiter) error {
+	if result, limit, _ := l.allow(ctx, grpcRemoteAddr(ctx)); !result.Allowed {
+		return grpcRateLimited(ctx, result, limit)
+	}
+
+	return nil
+}
+
+// grpcLimitFailures limits by address the callers failing authenticate, as
+// RateLimiter.Failures does for HTTP requests.
+func grpcLimitFailures(
+	authenticate func(ctx context.Context) (context.Context, error),
+	l *RateLimiter,
+) func(ctx context.Context) (context.Context, error) {
+	return func(ctx context.Context) (context.Context, error) {
+		remoteAddr := grpcRemoteAddr(ctx)
+
+		if result, limit, limited := l.peekAddress(ctx, remoteAddr); limited && !result.Allowed {
+			return nil, grpcRateLimited(ctx, result, limit)
+		}
+
+		authenticated, err := authenticate(ctx)
+		if status.Code(err) == codes.Unauthenticated {
+			l.failed(ctx, remoteAddr)
+		}
+
+		return authenticated, err
+	}
+}
+
+// grpcRateLimited returns the error of a call denied by limit.
+func grpcRateLimited(ctx context.Context, result rateLimitResult, limit RateLimit) error {
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfter(result, limit))))
+	return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+}
+
+func grpcRemoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// keyRequest is a request on a single key.
+type keyRequest interface {
+	GetKey() string
+}
+
+// grpcKeyInterceptor writes the key of calls on a single key to their context.
+func grpcKeyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := grpcKeyOperations[info.FullMethod]; !ok {
+		return handler(ctx, req)
+	}
+
+	key := req.(keyRequest).GetKey()
+	if key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key must be set")
+	}
+
+	return handler(writeKeyToCtx(ctx, key), req)
+}
+
+// grpcPermissionInterceptor checks the permission of calls on a single key,
+// as PermissionMiddleware does for HTTP requests.
+func grpcPermissionInterceptor(p PermissionMiddleware) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		operation, ok := grpcKeyOperations[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		required := p.requiredPermission(operation, p.keyFromCtx(ctx))
+		compiled, _ := p.callerPolicy(ctx)
+		if !p.decide(ctx, compiled, operation, required) {
+			return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed", required)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// grpcAuditInterceptor records calls on a single key once served.
+func grpcAuditInterceptor(a *Auditor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, ok := grpcKeyOperations[info.FullMethod]; !ok {
+			return handler(ctx, req)
+		}
+
+		resp, err := handler(ctx, req)
+
+		switch r := req.(type) {
+		case *kavev1.GetRequest:
+			response, _ := resp.(*kavev1.GetResponse)
+			grpcAudit(ctx, a, operationRead, r.GetKey(), err, response.GetValue())
+		case *kavev1.SetRequest:
+			grpcAudit(ctx, a, operationWrite, r.GetKey(), err, r.GetValue())
+		case *kavev1.DeleteRequest:
+			grpcAudit(ctx, a, auditDelete, r.GetKey(), err, nil)
+		}
+
+		return resp, err
+	}
+}
+
+// grpcAudit records an operation with the HTTP status matching its result.
+func grpcAudit(ctx context.Context, a *Auditor, operation string, key string, err error, value []byte) {
+	a.recordValue(ctx, operation, key, httpStatusFromCode(status.Code(err)), value)
+}
+
+// httpStatusFromCode returns the HTTP status the HTTP API responds with for a gRPC status code.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.ResourceExhausted:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func grpcLogUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	fields := &logFields{}
+	ctx = writeLogFieldsToCtx(ctx, fields)
+
+	resp, err := handler(ctx, req)
+
+	logCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func grpcLogStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+
+	fields := &logFields{}
+	ctx := writeLogFieldsToCtx(ss.Context(), fields)
+
+	err := handler(srv, &grpcServerStream{ServerStream: ss, ctx: ctx})
+
+	logCall(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// logCall logs a gRPC call once served, as requestLogger does for HTTP requests.
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+
+	level := slog.LevelInfo
+	if httpStatusFromCode(code) >= http.StatusInternalServerError && code != codes.Canceled {
+		level = slog.LevelError
+	}
+
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	loggerFromCtx(ctx).Log(level, "call",
+		"method", method,
+		"code", code.String(),
+		"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		"remote_addr", remoteAddr,
+	)
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	kavev1 "github.com/pdcalado/kave/proto/kave/v1"
+)
+
+func TestGRPC(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer rdb.Close()
+
+	// tokens are the subject of the caller, holding the permissions below
+	permissions := map[string][]string{
+		"alice": {"read:kave:team-a:*", "write:kave:team-a:*"},
+		"bob":   {"read:kave:team-a:*"},
+	}
+	parse := func(token string) (*Claims, error) {
+		if _, ok := permissions[token]; !ok {
+			return nil, assert.AnError
+		}
+
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: token},
+			Permissions:      permissions[token],
+		}, nil
+	}
+
+	newTestClient := func(configStr string, opts ...Option) kavev1.KaveServiceClient {
+		var config Config
+		_, err := toml.Decode(configStr, &config)
+		assert.NoError(t, err)
+
+		s, err := New(ctx, config, append([]Option{WithRedisClient(rdb), WithTokenParser(parse)}, opts...)...)
+		assert.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+
+		listener := bufconn.Listen(1 << 20)
+		go func() { _ = s.GRPCServer().Serve(listener) }()
+
+		conn, err := grpc.DialContext(ctx, "bufconn",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		return kavev1.NewKaveServiceClient(conn)
+	}
+
+	withToken := func(ctx context.Context, token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	// the gRPC API is only served when enabled
+	{
+		var config Config
+		s, err := New(ctx, config, WithRedisClient(rdb), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+		assert.NoError(t, err)
+		assert.Nil(t, s.GRPCServer())
+		s.Close()
+	}
+
+	client := newTestClient(`
+[auth]
+enabled = true
+
+[grpc]
+enabled = true
+`, WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+	// calls require a valid token
+	{
+		_, err := client.Get(ctx, &kavev1.GetRequest{Key: "team-a:foo"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		_, err = client.Get(withToken(ctx, "mallory"), &kavev1.GetRequest{Key: "team-a:foo"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	// keys are set, got and deleted with the permissions of the caller
+	{
+		alice := withToken(ctx, "alice")
+		bob := withToken(ctx, "bob")
+
+		_, err := client.Set(alice, &kavev1.SetRequest{Key: "team-a:foo", Value: []byte("bar")})
+		assert.NoError(t, err)
+
+		response, err := client.Get(bob, &kavev1.GetRequest{Key: "team-a:foo"})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bar"), response.GetValue())
+
+		_, err = client.Set(bob, &kavev1.SetRequest{Key: "team-a:foo", Value: []byte("baz")})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, err = client.Get(alice, &kavev1.GetRequest{Key: "team-b:foo"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, err = client.Get(alice, &kavev1.GetRequest{Key: ""})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = client.Delete(bob, &kavev1.DeleteRequest{Key: "team-a:foo"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, err = client.Delete(alice, &kavev1.DeleteRequest{Key: "team-a:foo"})
+		assert.NoError(t, err)
+
+		_, err = client.Get(alice, &kavev1.GetRequest{Key: "team-a:foo"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	}
+
+	// the backend cannot list keys
+	{
+		_, err := client.List(withToken(ctx, "alice"), &kavev1.ListRequest{})
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	}
+
+	// operations of a batch are checked one by one
+	{
+		response, err := client.Batch(withToken(ctx, "bob"), &kavev1.BatchRequest{Operations: []*kavev1.BatchOperation{
+			{Operation: &kavev1.BatchOperation_Set{Set: &kavev1.SetRequest{Key: "team-a:foo", Value: []byte("bar")}}},
+			{Operation: &kavev1.BatchOperation_Get{Get: &kavev1.GetRequest{Key: "team-a:foo"}}},
+		}})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(codes.PermissionDenied), response.GetResults()[0].GetCode())
+		assert.Equal(t, int32(codes.NotFound), response.GetResults()[1].GetCode())
+
+		response, err = client.Batch(withToken(ctx, "alice"), &kavev1.BatchRequest{Operations: []*kavev1.BatchOperation{
+			{Operation: &kavev1.BatchOperation_Set{Set: &kavev1.SetRequest{Key: "team-a:foo", Value: []byte("bar")}}},
+			{Operation: &kavev1.BatchOperation_Get{Get: &kavev1.GetRequest{Key: "team-a:foo"}}},
+			{Operation: &kavev1.BatchOperation_Delete{Delete: &kavev1.DeleteRequest{Key: "team-a:foo"}}},
+			{Operation: &kavev1.BatchOperation_Get{Get: &kavev1.GetRequest{Key: ""}}},
+			{},
+		}})
+		assert.NoError(t, err)
+		assert.Len(t, response.GetResults(), 5)
+		assert.Equal(t, int32(codes.OK), response.GetResults()[0].GetCode())
+		assert.Equal(t, int32(codes.OK), response.GetResults()[1].GetCode())
+		assert.Equal(t, []byte("bar"), response.GetResults()[1].GetValue())
+		assert.Equal(t, int32(codes.OK), response.GetResults()[2].GetCode())
+		assert.Equal(t, int32(codes.InvalidArgument), response.GetResults()[3].GetCode())
+		assert.Equal(t, int32(codes.InvalidArgument), response.GetResults()[4].GetCode())
+	}
+
+	// changes are watched under a prefix, only on keys the caller may read
+	{
+		watchCtx, cancel := context.WithTimeout(withToken(ctx, "bob"), 5*time.Second)
+		defer cancel()
+
+		stream, err := client.Watch(watchCtx, &kavev1.WatchRequest{Prefix: "team-"})
+		assert.NoError(t, err)
+
+		// wait for the watch to start
+		_, err = stream.Header()
+		assert.NoError(t, err)
+
+		alice := withToken(ctx, "alice")
+		_, err = client.Set(alice, &kavev1.SetRequest{Key: "team-a:watched", Value: []byte("bar")})
+		assert.NoError(t, err)
+		_, err = client.Delete(alice, &kavev1.DeleteRequest{Key: "team-a:watched"})
+		assert.NoError(t, err)
+
+		event, err := stream.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, kavev1.EventType_EVENT_TYPE_SET, event.GetType())
+		assert.Equal(t, "team-a:watched", event.GetKey())
+		assert.Equal(t, []byte("bar"), event.GetValue())
+
+		event, err = stream.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, kavev1.EventType_EVENT_TYPE_DELETE, event.GetType())
+		assert.Equal(t, "team-a:watched", event.GetKey())
+	}
+
+	// watch streams end once the token of the caller is revoked or expires
+	{
+		internalKeyPrefix := fmt.Sprintf("kave-grpc-test:%d:", time.Now().UnixNano())
+		client := newTestClient(fmt.Sprintf(`
+internal_key_prefix = "%s"
+
+[auth]
+enabled = true
+
+[auth.revocation]
+enabled = true
+cache_ms = 1
+
+[grpc]
+enabled = true
+`, internalKeyPrefix), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+		watchCtx, cancel := context.WithTimeout(withToken(ctx, "bob"), 5*time.Second)
+		defer cancel()
+
+		stream, err := client.Watch(watchCtx, &kavev1.WatchRequest{Prefix: "team-"})
+		assert.NoError(t, err)
+		_, err = stream.Header()
+		assert.NoError(t, err)
+
+		revocations := NewRevocations(newRedisRevocationStore(rdb, internalKeyPrefix), time.Millisecond, time.Minute)
+		_, err = revocations.Revoke(ctx, revocationKindClient, "bob", time.Time{})
+		assert.NoError(t, err)
+
+		// let the lookup cached when the watch started go stale
+		time.Sleep(10 * time.Millisecond)
+
+		// the token is checked again before the next event is sent
+		_, err = client.Set(withToken(ctx, "alice"), &kavev1.SetRequest{Key: "team-a:watched", Value: []byte("bar")})
+		assert.NoError(t, err)
+
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		expiring := newTestClient(`
+[auth]
+enabled = true
+
+[grpc]
+enabled = true
+`, WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}), WithTokenParser(func(token string) (*Claims, error) {
+			return &Claims{
+				RegisteredClaims: jwt.RegisteredClaims{Subject: token, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Second))},
+				Permissions:      permissions["bob"],
+			}, nil
+		}))
+
+		stream, err = expiring.Watch(watchCtx, &kavev1.WatchRequest{Prefix: "team-"})
+		assert.NoError(t, err)
+
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	// failed attempts are rate limited before auth
+	{
+		// buckets are kept in Redis, under a prefix unique to each run
+		client := newTestClient(fmt.Sprintf(`
+internal_key_prefix = "kave-grpc-test:%d:"
+
+[auth]
+enabled = true
+
+[grpc]
+enabled = true
+
+[rate_limit]
+enabled = true
+rate = 1
+burst = 2
+`, time.Now().UnixNano()), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+		mallory := withToken(ctx, "mallory")
+		for i := 0; i < 2; i++ {
+			_, err := client.Get(mallory, &kavev1.GetRequest{Key: "team-a:foo"})
+			assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		}
+
+		_, err := client.Get(mallory, &kavev1.GetRequest{Key: "team-a:foo"})
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	}
+
+	// authenticated callers are limited by subject only, beyond the limit of their address
+	{
+		client := newTestClient(fmt.Sprintf(`
+internal_key_prefix = "kave-grpc-test:%d:"
+
+[auth]
+enabled = true
+
+[grpc]
+enabled = true
+
+[rate_limit]
+enabled = true
+rate = 1
+burst = 2
+
+[[rate_limit.overrides]]
+pattern = "sub:alice"
+rate = 1
+burst = 4
+`, time.Now().UnixNano()), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+		alice := withToken(ctx, "alice")
+		for i := 0; i < 4; i++ {
+			_, err := client.Get(alice, &kavev1.GetRequest{Key: "team-a:foo"})
+			assert.Equal(t, codes.NotFound, status.Code(err))
+		}
+
+		_, err := client.Get(alice, &kavev1.GetRequest{Key: "team-a:foo"})
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	}
+
+	// exceeded quotas are reported as exhausted resources
+	{
+		keyPrefix := "kave-grpc-test:"
+		assert.NoError(t, rdb.Del(ctx, keyPrefix+"team-a:quota").Err())
+
+		client := newTestClient(`
+redis_key_prefix = "kave-grpc-test:"
+
+[grpc]
+enabled = true
+
+[quotas]
+enabled = true
+
+[[quotas.limits]]
+prefix = "team-a:"
+max_bytes = 3
+`)
+
+		_, err := client.Set(ctx, &kavev1.SetRequest{Key: "team-a:quota", Value: []byte("toolarge")})
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+		_, err = client.Set(ctx, &kavev1.SetRequest{Key: "team-a:quota", Value: []byte("ok")})
+		assert.NoError(t, err)
+
+		response, err := client.List(ctx, &kavev1.ListRequest{Prefix: "team-a:"})
+		assert.NoError(t, err)
+		assert.Len(t, response.GetKeys(), 1)
+		assert.Equal(t, "team-a:quota", response.GetKeys()[0].GetKey())
+
+		_, err = client.List(ctx, &kavev1.ListRequest{Limit: maxKeyListLimit + 1})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		assert.NoError(t, rdb.Del(ctx, keyPrefix+"team-a:quota").Err())
+	}
+}
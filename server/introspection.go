@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	envIntrospectionClientSecret = "KAVE_INTROSPECTION_CLIENT_SECRET"
+	defaultIntrospectionTimeout  = 5 * time.Second
+	introspectionCacheSize       = 10000
+)
+
+var errTokenInactive = errors.New("token is not active")
+
+type introspectionEntry struct {
+	claims  *Claims
+	expires time.Time
+}
+
+// Introspector validates opaque tokens with an OAuth2 introspection
+// endpoint (RFC 7662), caching active tokens until they expire.
+type Introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	maxCacheTTL  time.Duration
+	client       *http.Client
+	now          func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionEntry
+}
+
+// NewIntrospector creates an Introspector authenticating to endpoint with
+// client credentials. A zero maxCacheTTL caches tokens until they expire.
+func NewIntrospector(
+	endpoint string,
+	clientID string,
+	clientSecret string,
+	maxCacheTTL time.Duration,
+	client *http.Client,
+) (*Introspector, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("introspection url must be http or https: %s", endpoint)
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: defaultIntrospectionTimeout}
+	}
+
+	return &Introspector{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		maxCacheTTL:  maxCacheTTL,
+		client:       client,
+		now:          time.Now,
+		cache:        make(map[[sha256.Size]byte]introspectionEntry),
+	}, nil
+}
+
+// Parse returns the claims of an active token, it can be used as a ParseTokenFunc.
+func (i *Introspector) Parse(token string) (*Claims, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	if claims, ok := i.cached(hash); ok {
+		return claims, nil
+	}
+
+	claims, err := i.introspect(token)
+	if err != nil {
+		if !errors.Is(err, errTokenInactive) {
+			slog.Error("error introspecting token", err)
+		}
+		return nil, err
+	}
+
+	i.store(hash, claims)
+
+	return claims, nil
+}
+
+func (i *Introspector) cached(hash [sha256.Size]byte) (*Claims, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entry, ok := i.cache[hash]
+	if !ok {
+		return nil, false
+	}
+
+	if !i.now().Before(entry.expires) {
+		delete(i.cache, hash)
+		return nil, false
+	}
+
+	return entry.claims, true
+}
+
+// store caches claims until the token expires, tokens without expiry are not cached.
+func (i *Introspector) store(hash [sha256.Size]byte, claims *Claims) {
+	if claims.ExpiresAt == nil {
+		return
+	}
+
+	now := i.now()
+
+	expires := claims.ExpiresAt.Time
+	if i.maxCacheTTL > 0 && now.Add(i.maxCacheTTL).Before(expires) {
+		expires = now.Add(i.maxCacheTTL)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.cache) >= introspectionCacheSize {
+		for h, entry := range i.cache {
+			if !now.Before(entry.expires) {
+				delete(i.cache, h)
+			}
+		}
+	}
+
+	// skip caching rather than growing unbounded
+	if len(i.cache) >= introspectionCacheSize {
+		return
+	}
+
+	i.cache[hash] = introspectionEntry{claims: claims, expires: expires}
+}
+
+// introspectionResponse holds the fields of RFC 7662 read besides the token claims.
+type introspectionResponse struct {
+	Active bool   `json:"active"`
+	Scope  string `json:"scope"`
+}
+
+func (i *Introspector) introspect(token string) (*Claims, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequest(http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection failed: %s", resp.Status)
+	}
+
+	var buf json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&buf); err != nil {
+		return nil, err
+	}
+
+	var status introspectionResponse
+	if err := json.Unmarshal(buf, &status); err != nil {
+		return nil, err
+	}
+
+	if !status.Active {
+		return nil, errTokenInactive
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(buf, claims); err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt != nil && !i.now().Before(claims.ExpiresAt.Time) {
+		return nil, errTokenInactive
+	}
+
+	// scopes of the token are its permissions
+	claims.Permissions = append(claims.Permissions, strings.Fields(status.Scope)...)
+
+	return claims, nil
+}
+
+// isJWT reports whether token has the shape of a JWS compact serialization.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
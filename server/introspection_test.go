@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestIntrospectionServer stands in for an authorization server, knowing
+// the token "good" which expires at exp.
+func newTestIntrospectionServer(t *testing.T, exp time.Time, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		clientID, secret, ok := r.BasicAuth()
+		if !ok || clientID != "kave" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "access_token", r.PostFormValue("token_type_hint"))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.PostFormValue("token") {
+		case "good":
+			fmt.Fprintf(w, `{"active":true,"scope":"read:kave:foo write:kave:foo","sub":"alice","client_id":"gateway","exp":%d,"org_id":"acme"}`, exp.Unix())
+		case "no-exp":
+			fmt.Fprint(w, `{"active":true,"scope":"read:kave:foo","sub":"bob"}`)
+		case "stale":
+			fmt.Fprintf(w, `{"active":true,"scope":"read:kave:foo","exp":%d}`, time.Now().Add(-time.Minute).Unix())
+		default:
+			fmt.Fprint(w, `{"active":false}`)
+		}
+	}))
+}
+
+func TestIntrospector(t *testing.T) {
+	var calls int32
+
+	exp := time.Now().Add(time.Hour)
+	server := newTestIntrospectionServer(t, exp, &calls)
+	defer server.Close()
+
+	introspector, err := NewIntrospector(server.URL, "kave", "s3cret", 0, nil)
+	assert.NoError(t, err)
+
+	// active token
+	{
+		claims, err := introspector.Parse("good")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"read:kave:foo", "write:kave:foo"}, claims.Permissions)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.Equal(t, "gateway", claims.Client())
+
+		orgID, ok := claims.Claim("org_id")
+		assert.True(t, ok)
+		assert.Equal(t, "acme", orgID)
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	}
+
+	// active token is cached
+	{
+		_, err := introspector.Parse("good")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	}
+
+	// cache expires with the token
+	{
+		introspector.now = func() time.Time { return exp.Add(time.Second) }
+		_, err := introspector.Parse("good")
+		assert.Error(t, err)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		introspector.now = time.Now
+	}
+
+	// inactive tokens are not cached
+	{
+		_, err := introspector.Parse("bad")
+		assert.ErrorIs(t, err, errTokenInactive)
+		_, err = introspector.Parse("bad")
+		assert.ErrorIs(t, err, errTokenInactive)
+		assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	}
+
+	// tokens without expiry are not cached
+	{
+		_, err := introspector.Parse("no-exp")
+		assert.NoError(t, err)
+		_, err = introspector.Parse("no-exp")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+	}
+
+	// expired tokens reported active are rejected
+	{
+		_, err := introspector.Parse("stale")
+		assert.ErrorIs(t, err, errTokenInactive)
+	}
+}
+
+func TestIntrospectorMaxCacheTTL(t *testing.T) {
+	var calls int32
+
+	server := newTestIntrospectionServer(t, time.Now().Add(time.Hour), &calls)
+	defer server.Close()
+
+	introspector, err := NewIntrospector(server.URL, "kave", "s3cret", time.Minute, nil)
+	assert.NoError(t, err)
+
+	_, err = introspector.Parse("good")
+	assert.NoError(t, err)
+
+	introspector.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	_, err = introspector.Parse("good")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestIntrospectorBadCredentials(t *testing.T) {
+	var calls int32
+
+	server := newTestIntrospectionServer(t, time.Now().Add(time.Hour), &calls)
+	defer server.Close()
+
+	introspector, err := NewIntrospector(server.URL, "kave", "wrong", 0, nil)
+	assert.NoError(t, err)
+
+	_, err = introspector.Parse("good")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errTokenInactive)
+
+	_, err = NewIntrospector("localhost:8000/introspect", "kave", "s3cret", 0, nil)
+	assert.Error(t, err)
+}
+
+func TestAuthMiddlewareIntrospection(t *testing.T) {
+	var calls int32
+
+	server := newTestIntrospectionServer(t, time.Now().Add(time.Hour), &calls)
+	defer server.Close()
+
+	introspector, err := NewIntrospector(server.URL, "kave", "s3cret", 0, nil)
+	assert.NoError(t, err)
+
+	authMiddleware := createAuthMiddleware(createTokenParser(nil, introspector), nil)
+
+	var permissions []string
+	handler := authMiddleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		permissions = readPermissionsFromCtx(r.Context())
+	}))
+
+	serve := func(token string) int {
+		request := httptest.NewRequest(http.MethodGet, "/redis/foo", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// opaque token is introspected
+	{
+		assert.Equal(t, http.StatusOK, serve("good"))
+		assert.Equal(t, []string{"read:kave:foo", "write:kave:foo"}, permissions)
+	}
+
+	// inactive token
+	{
+		assert.Equal(t, http.StatusUnauthorized, serve("bad"))
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+const (
+	defaultKeyListLimit = 100
+	maxKeyListLimit     = 1000
+)
+
+// KeyInfo describes a key without its value.
+type KeyInfo struct {
+	Key string `json:"key"`
+	// TTLMs is the time left before the key expires, 0 if it does not expire
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+}
+
+// KeyLister pages through the keys starting with a prefix. Pages may hold
+// fewer or more keys than count, the cursor returned is 0 after the last page.
+type KeyLister interface {
+	List(ctx context.Context, prefix string, cursor uint64, count int64) ([]KeyInfo, uint64, error)
+}
+
+type keyListResponse struct {
+	Keys []KeyInfo `json:"keys"`
+	// Cursor of the next page, empty after the last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// KeyListHandler lists keys by prefix.
+type KeyListHandler struct {
+	lister       KeyLister
+	prefix       string
+	hiddenPrefix string
+	permissions  *PermissionMiddleware
+}
+
+// NewKeyListHandler creates a KeyListHandler listing the keys under prefix,
+// except those of hiddenPrefix. Only the keys the caller may read are listed
+// when permissions is not nil.
+func NewKeyListHandler(
+	lister KeyLister,
+	prefix string,
+	hiddenPrefix string,
+	permissions *PermissionMiddleware,
+) *KeyListHandler {
+	return &KeyListHandler{
+		lister:       lister,
+		prefix:       prefix,
+		hiddenPrefix: hiddenPrefix,
+		permissions:  permissions,
+	}
+}
+
+// List responds with a page of the keys starting with the prefix query parameter.
+func (h *KeyListHandler) List(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	var cursor uint64
+	if params.Get("cursor") != "" {
+		var err error
+		cursor, err = strconv.ParseUint(params.Get("cursor"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultKeyListLimit
+	if params.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > maxKeyListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxKeyListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, err := h.list(r.Context(), params.Get("prefix"), cursor, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error listing keys", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+// list returns a page of the keys starting with prefix the caller in ctx may read.
+func (h *KeyListHandler) list(ctx context.Context, prefix string, cursor uint64, limit int) (*keyListResponse, error) {
+	keys, next, err := h.lister.List(ctx, h.prefix+prefix, cursor, int64(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	var compiled *policy.Policy
+	if h.permissions != nil {
+		compiled, _ = h.permissions.callerPolicy(ctx)
+	}
+
+	response := &keyListResponse{Keys: []KeyInfo{}}
+	if next != 0 {
+		response.Cursor = strconv.FormatUint(next, 10)
+	}
+
+	for _, info := range keys {
+		if h.hiddenPrefix != "" && strings.HasPrefix(info.Key, h.hiddenPrefix) {
+			continue
+		}
+
+		info.Key = strings.TrimPrefix(info.Key, h.prefix)
+		if h.permissions != nil && !h.permissions.allowed(compiled, operationRead, info.Key) {
+			continue
+		}
+
+		response.Keys = append(response.Keys, info)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+// memoryKeyLister lists keys in pages of at most count keys, the cursor being an offset.
+type memoryKeyLister struct {
+	keys     []KeyInfo
+	prefixes []string
+}
+
+func (l *memoryKeyLister) List(ctx context.Context, prefix string, cursor uint64, count int64) ([]KeyInfo, uint64, error) {
+	l.prefixes = append(l.prefixes, prefix)
+
+	var matched []KeyInfo
+	for _, info := range l.keys {
+		if strings.HasPrefix(info.Key, prefix) {
+			matched = append(matched, info)
+		}
+	}
+
+	end := cursor + uint64(count)
+	if end >= uint64(len(matched)) {
+		return matched[cursor:], 0, nil
+	}
+	return matched[cursor:end], end, nil
+}
+
+func TestKeyListHandler(t *testing.T) {
+	lister := &memoryKeyLister{keys: []KeyInfo{
+		{Key: "kave:team-a:bar"},
+		{Key: "kave:team-a:foo", TTLMs: 60000},
+		{Key: "kave:team-b:foo"},
+		{Key: "kave:internal:nonce"},
+	}}
+
+	list := func(handler *KeyListHandler, query string, permissions ...string) (*httptest.ResponseRecorder, keyListResponse) {
+		request := httptest.NewRequest(http.MethodGet, "/redis/?"+query, nil)
+		claims := &Claims{Permissions: permissions}
+		request = request.WithContext(writeClaimsToCtx(request.Context(), claims))
+
+		recorder := httptest.NewRecorder()
+		handler.List(recorder, request)
+
+		var response keyListResponse
+		if recorder.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		}
+		return recorder, response
+	}
+
+	// keys are listed by prefix, without the prefix of the server
+	{
+		handler := NewKeyListHandler(lister, "kave:", "kave:internal:", nil)
+
+		_, response := list(handler, "prefix=team-a:")
+		assert.Equal(t, "kave:team-a:", lister.prefixes[len(lister.prefixes)-1])
+		assert.Equal(t, []KeyInfo{{Key: "team-a:bar"}, {Key: "team-a:foo", TTLMs: 60000}}, response.Keys)
+		assert.Empty(t, response.Cursor)
+	}
+
+	// keys kept by the server are never listed
+	{
+		handler := NewKeyListHandler(lister, "kave:", "kave:internal:", nil)
+
+		_, response := list(handler, "")
+		assert.Len(t, response.Keys, 3)
+		for _, info := range response.Keys {
+			assert.NotContains(t, info.Key, "nonce")
+		}
+	}
+
+	// only the keys the caller may read are listed
+	{
+		permissionMiddleware := NewPermissionMiddleware("kave:", policy.SyntaxGlob, readKeyFromCtx, readPermissionsFromCtx, readClaimsFromCtx)
+		handler := NewKeyListHandler(lister, "kave:", "kave:internal:", &permissionMiddleware)
+
+		_, response := list(handler, "", "read:kave:*:foo", "write:kave:team-a:bar")
+		assert.Equal(t, []KeyInfo{{Key: "team-a:foo", TTLMs: 60000}, {Key: "team-b:foo"}}, response.Keys)
+
+		_, response = list(handler, "")
+		assert.Empty(t, response.Keys)
+		assert.NotNil(t, response.Keys)
+	}
+
+	// keys are paged
+	{
+		handler := NewKeyListHandler(lister, "kave:", "", nil)
+
+		_, response := list(handler, "limit=3")
+		assert.Len(t, response.Keys, 3)
+		assert.Equal(t, "3", response.Cursor)
+
+		_, response = list(handler, "limit=3&cursor="+response.Cursor)
+		assert.Equal(t, []KeyInfo{{Key: "internal:nonce"}}, response.Keys)
+		assert.Empty(t, response.Cursor)
+	}
+
+	// invalid pages are rejected
+	{
+		handler := NewKeyListHandler(lister, "kave:", "", nil)
+
+		recorder, _ := list(handler, "cursor=abc")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		recorder, _ = list(handler, "limit=0")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		recorder, _ = list(handler, fmt.Sprintf("limit=%d", maxKeyListLimit+1))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestRedisClientList(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	client, err := NewRedisClient(ctx, &redis.Options{Addr: redisHost + ":6379"})
+	assert.NoError(t, err)
+	defer client.inner.Close()
+
+	prefix := fmt.Sprintf("test-list-%d:", time.Now().UnixNano())
+	defer func() {
+		keys, _ := client.inner.Keys(ctx, escapeGlob(prefix)+"*").Result()
+		client.inner.Del(ctx, keys...)
+	}()
+
+	assert.NoError(t, client.Set(ctx, prefix+"a", []byte("1")))
+	assert.NoError(t, client.inner.Set(ctx, prefix+"b", "2", time.Hour).Err())
+	// glob characters in the prefix are matched literally
+	assert.NoError(t, client.Set(ctx, prefix+"[c]", []byte("3")))
+
+	listAll := func(prefix string) []KeyInfo {
+		var keys []KeyInfo
+		var cursor uint64
+		for {
+			page, next, err := client.List(ctx, prefix, cursor, 100)
+			assert.NoError(t, err)
+			keys = append(keys, page...)
+
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+		return keys
+	}
+
+	keys := listAll(prefix)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, KeyInfo{Key: prefix + "[c]"}, keys[0])
+	assert.Equal(t, KeyInfo{Key: prefix + "a"}, keys[1])
+	assert.Equal(t, prefix+"b", keys[2].Key)
+	assert.InDelta(t, time.Hour.Milliseconds(), keys[2].TTLMs, 5000)
+
+	assert.Equal(t, []KeyInfo{{Key: prefix + "[c]"}}, listAll(prefix+"["))
+}
@@ -1,15 +1,16 @@
-package main
+package server
 
 import (
 	"context"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 )
 
 type KeyValue interface {
 	Get(context.Context, string) (string, error)
 	Set(context.Context, string, []byte) error
+	Delete(context.Context, string) error
 }
 
 // create a test function for this struct
@@ -56,13 +57,13 @@ func (kv *KeyValueHandler) Get(w http.ResponseWriter, r *http.Request) {
 	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("error getting key %s: %v\n", key, err)
+		loggerFromCtx(r.Context()).Error("error getting key", err)
 		return
 	}
 
 	_, err = w.Write([]byte(value))
 	if err != nil {
-		log.Printf("error writing response: %v\n", err)
+		loggerFromCtx(r.Context()).Error("error writing response", err)
 		return
 	}
 }
@@ -73,16 +74,40 @@ func (kv *KeyValueHandler) Set(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("error reading body: %v", err)
+		loggerFromCtx(r.Context()).Error("error reading body", err)
 		return
 	}
 
 	err = kv.client.Set(r.Context(), key, body)
+
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		http.Error(w, quotaErr.Error(), quotaErr.StatusCode())
+		return
+	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("error getting key %s: %v", key, err)
+		loggerFromCtx(r.Context()).Error("error setting key", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
+
+func (kv *KeyValueHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	key := kv.formatKey(kv.keyFromContext(r.Context()))
+
+	err := kv.client.Delete(r.Context(), key)
+	if (ErrorKeyNotFound{}).Is(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error deleting key", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
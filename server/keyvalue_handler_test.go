@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"bytes"
@@ -10,7 +10,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
-	mocks "github.com/pdcalado/kave/cmd/server/mocks"
+	mocks "github.com/pdcalado/kave/server/mocks"
 )
 
 type mockResponseWriter struct {
@@ -198,3 +198,80 @@ func TestKeyValueHandlerSet(t *testing.T) {
 		)
 	}
 }
+
+func TestKeyValueHandlerDelete(t *testing.T) {
+	// delete a key that exists
+	{
+		ctx := context.Background()
+
+		testKey := "foo"
+
+		kv := mocks.NewMockKeyValue(gomock.NewController(t))
+
+		handler := NewKeyValueHandler(kv, "prefix:", func(ctx context.Context) string {
+			return testKey
+		})
+
+		kv.EXPECT().Delete(gomock.Any(), "prefix:"+testKey).Return(nil)
+
+		request, _ := http.NewRequestWithContext(context.WithValue(ctx, redisKey{}, testKey), http.MethodDelete, "http://localhost:8080", nil)
+
+		handler.Delete(
+			&mockResponseWriter{
+				t:            t,
+				expectedCode: http.StatusNoContent,
+			},
+			request,
+		)
+	}
+
+	// delete a key that does not exist
+	{
+		ctx := context.Background()
+
+		testKey := "foo"
+
+		kv := mocks.NewMockKeyValue(gomock.NewController(t))
+
+		handler := NewKeyValueHandler(kv, "prefix:", func(ctx context.Context) string {
+			return testKey
+		})
+
+		kv.EXPECT().Delete(gomock.Any(), "prefix:"+testKey).Return(ErrorKeyNotFound{})
+
+		request, _ := http.NewRequestWithContext(context.WithValue(ctx, redisKey{}, testKey), http.MethodDelete, "http://localhost:8080", nil)
+
+		handler.Delete(
+			&mockResponseWriter{
+				t:            t,
+				expectedCode: http.StatusNotFound,
+			},
+			request,
+		)
+	}
+
+	// delete a key and fail on backend client
+	{
+		ctx := context.Background()
+
+		testKey := "foo"
+
+		kv := mocks.NewMockKeyValue(gomock.NewController(t))
+
+		handler := NewKeyValueHandler(kv, "prefix:", func(ctx context.Context) string {
+			return testKey
+		})
+
+		kv.EXPECT().Delete(gomock.Any(), "prefix:"+testKey).Return(fmt.Errorf("something went wrong"))
+
+		request, _ := http.NewRequestWithContext(context.WithValue(ctx, redisKey{}, testKey), http.MethodDelete, "http://localhost:8080", nil)
+
+		handler.Delete(
+			&mockResponseWriter{
+				t:            t,
+				expectedCode: http.StatusInternalServerError,
+			},
+			request,
+		)
+	}
+}
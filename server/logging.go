@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+
+	redactedLogValue = "[REDACTED]"
+)
+
+// redactedLogKeys are never logged, whatever logs them.
+var redactedLogKeys = map[string]bool{
+	"value":         true,
+	"body":          true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"authorization": true,
+	"cookie":        true,
+	"secret":        true,
+	"client_secret": true,
+	"password":      true,
+	"signature":     true,
+}
+
+// NewLogger creates a logger writing to w at the given level, "info" if empty,
+// in the given format, "json" if empty.
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if level != "" {
+		if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+	}
+
+	options := slog.HandlerOptions{
+		Level:       minLevel,
+		ReplaceAttr: redactLogAttr,
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "", logFormatJSON:
+		handler = options.NewJSONHandler(w)
+	case logFormatText:
+		handler = options.NewTextHandler(w)
+	default:
+		return nil, fmt.Errorf("unknown log format '%s'", format)
+	}
+
+	return slog.New(contextLogHandler{inner: handler}), nil
+}
+
+func redactLogAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactedLogKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redactedLogValue)
+	}
+	return a
+}
+
+// loggerFromCtx returns the default logger, tagging lines with the request of ctx.
+func loggerFromCtx(ctx context.Context) *slog.Logger {
+	return slog.Default().WithContext(ctx)
+}
+
+// contextLogHandler tags records with the request ID, subject and key of their context.
+type contextLogHandler struct {
+	inner slog.Handler
+}
+
+func (h contextLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h contextLogHandler) Handle(r slog.Record) error {
+	if r.Context != nil {
+		if id := middleware.GetReqID(r.Context); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+
+		subject, key := readClaimsFromCtx(r.Context).Subject, readKeyFromCtx(r.Context)
+
+		// set after the record's context was derived, such as for the request log
+		if fields := readLogFieldsFromCtx(r.Context); fields != nil {
+			if subject == "" {
+				subject = fields.subject
+			}
+			if key == "" {
+				key = fields.key
+			}
+		}
+
+		if subject != "" {
+			r.AddAttrs(slog.String("subject", subject))
+		}
+		if key != "" {
+			r.AddAttrs(slog.String("key", key))
+		}
+	}
+
+	return h.inner.Handle(r)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{inner: h.inner.WithGroup(name)}
+}
+
+// logFields collects what is known of a request as it is served.
+type logFields struct {
+	subject string
+	key     string
+}
+
+// requestLogger logs each request once served. It must be used after the
+// request ID middleware. The query is not logged, it may hold the signature
+// of a pre-signed url.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		fields := &logFields{}
+		ctx := writeLogFieldsToCtx(r.Context(), fields)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		loggerFromCtx(ctx).Log(level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+// useLogger sets the default logger to write JSON lines to the returned
+// buffer until the test ends.
+func useLogger(t *testing.T, level string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+
+	logger, err := NewLogger(buf, level, logFormatJSON)
+	assert.NoError(t, err)
+
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return buf
+}
+
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestLoggerFromCtx(t *testing.T) {
+	buf := useLogger(t, "")
+
+	claims := &Claims{}
+	claims.Subject = "alice"
+
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "req-1")
+	ctx = writeClaimsToCtx(ctx, claims)
+	ctx = writeKeyToCtx(ctx, "foo")
+
+	// lines are tagged with the request ID, subject and key
+	{
+		loggerFromCtx(ctx).Error("error getting key", fmt.Errorf("boom"))
+
+		lines := logLines(t, buf)
+		assert.Len(t, lines, 1)
+		assert.Equal(t, "ERROR", lines[0]["level"])
+		assert.Equal(t, "error getting key", lines[0]["msg"])
+		assert.Equal(t, "boom", lines[0]["err"])
+		assert.Equal(t, "req-1", lines[0]["request_id"])
+		assert.Equal(t, "alice", lines[0]["subject"])
+		assert.Equal(t, "foo", lines[0]["key"])
+	}
+
+	// lines without a request are not tagged
+	{
+		buf.Reset()
+		slog.Info("reloaded policy file", "path", "policy.toml")
+
+		lines := logLines(t, buf)
+		assert.Len(t, lines, 1)
+		assert.NotContains(t, lines[0], "request_id")
+		assert.NotContains(t, lines[0], "subject")
+		assert.NotContains(t, lines[0], "key")
+	}
+
+	// values and tokens are redacted, whatever logs them
+	{
+		buf.Reset()
+		loggerFromCtx(ctx).Info("oops", "value", "bar", "Authorization", "Bearer xyz", "token", "xyz")
+
+		assert.NotContains(t, buf.String(), "bar")
+		assert.NotContains(t, buf.String(), "xyz")
+
+		lines := logLines(t, buf)
+		assert.Equal(t, redactedLogValue, lines[0]["value"])
+		assert.Equal(t, redactedLogValue, lines[0]["Authorization"])
+		assert.Equal(t, redactedLogValue, lines[0]["token"])
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	buf := useLogger(t, "")
+
+	authMiddleware := NewAuthMiddleware(
+		func(token string) (*Claims, error) {
+			claims := &Claims{}
+			claims.Subject = token
+			return claims, nil
+		},
+		writeClaimsToCtx,
+		nil,
+	)
+
+	kv := &memoryKeyValue{values: map[string][]byte{}}
+	kvHandler := NewKeyValueHandler(kv, "", readKeyFromCtx)
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(requestLogger)
+	router.Use(authMiddleware.Handler)
+	router.Route("/redis/{key}", func(r chi.Router) {
+		r.Use(injectKeyInCtx)
+
+		r.Get("/", kvHandler.Get)
+		r.Post("/", kvHandler.Set)
+		r.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+			loggerFromCtx(r.Context()).Error("error deleting key", fmt.Errorf("boom"))
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+	})
+
+	// requests are logged with the subject and key known once served
+	{
+		request := httptest.NewRequest(http.MethodPost, "/redis/foo?signature=abc", strings.NewReader("s3cret-value"))
+		request.Header.Set("Authorization", "Bearer alice")
+		router.ServeHTTP(httptest.NewRecorder(), request)
+
+		lines := logLines(t, buf)
+		assert.Len(t, lines, 1)
+
+		entry := lines[0]
+		assert.Equal(t, "INFO", entry["level"])
+		assert.Equal(t, "request", entry["msg"])
+		assert.Equal(t, http.MethodPost, entry["method"])
+		assert.Equal(t, "/redis/foo", entry["path"])
+		assert.Equal(t, float64(http.StatusCreated), entry["status"])
+		assert.NotEmpty(t, entry["request_id"])
+		assert.Equal(t, "alice", entry["subject"])
+		assert.Equal(t, "foo", entry["key"])
+
+		// neither the value, the token nor the query are logged
+		assert.NotContains(t, buf.String(), "s3cret-value")
+		assert.NotContains(t, buf.String(), "Bearer")
+		assert.NotContains(t, buf.String(), "abc")
+	}
+
+	// failed requests are logged as errors
+	{
+		buf.Reset()
+
+		request := httptest.NewRequest(http.MethodDelete, "/redis/foo", nil)
+		request.Header.Set("Authorization", "Bearer alice")
+		router.ServeHTTP(httptest.NewRecorder(), request)
+
+		lines := logLines(t, buf)
+		assert.Len(t, lines, 2)
+		assert.Equal(t, "error deleting key", lines[0]["msg"])
+		assert.Equal(t, "alice", lines[0]["subject"])
+		assert.Equal(t, lines[0]["request_id"], lines[1]["request_id"])
+		assert.Equal(t, "ERROR", lines[1]["level"])
+		assert.Equal(t, float64(http.StatusInternalServerError), lines[1]["status"])
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	// lines below the level are dropped
+	{
+		buf := &bytes.Buffer{}
+		logger, err := NewLogger(buf, "warn", "")
+		assert.NoError(t, err)
+
+		logger.Info("set quota")
+		assert.Empty(t, buf.String())
+
+		logger.Warn("rejected pre-signed url")
+		assert.Contains(t, buf.String(), `"msg":"rejected pre-signed url"`)
+	}
+
+	// lines are written as text
+	{
+		buf := &bytes.Buffer{}
+		logger, err := NewLogger(buf, "", logFormatText)
+		assert.NoError(t, err)
+
+		logger.Info("set quota", "prefix", "team-a:", "value", "bar")
+		assert.Contains(t, buf.String(), "msg=\"set quota\" prefix=team-a:")
+		assert.Contains(t, buf.String(), "value="+redactedLogValue)
+	}
+
+	// unknown levels and formats are rejected
+	{
+		_, err := NewLogger(&bytes.Buffer{}, "loud", "")
+		assert.Error(t, err)
+
+		_, err = NewLogger(&bytes.Buffer{}, "", "xml")
+		assert.Error(t, err)
+	}
+}
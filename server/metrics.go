@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "kave"
+
+	// unmatchedRoute labels requests not matching any route, so unknown paths do not add series
+	unmatchedRoute = "unmatched"
+)
+
+// Metrics collects the metrics of the server in its own registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	redisDuration   *prometheus.HistogramVec
+	redisErrors     *prometheus.CounterVec
+	authzDecisions  *prometheus.CounterVec
+	jwksRefreshes   *prometheus.CounterVec
+	jwksLastRefresh prometheus.Gauge
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests, by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		redisDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "redis_command_duration_seconds",
+			Help:      "Latency of Redis commands, by command.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"command"}),
+		redisErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "redis_command_errors_total",
+			Help:      "Redis commands which failed, by command. Missing keys are not errors.",
+		}, []string{"command"}),
+		authzDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "authz_decisions_total",
+			Help:      "Permission checks of requests, by operation and decision.",
+		}, []string{"operation", "decision"}),
+		jwksRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "jwks_refreshes_total",
+			Help:      "Fetches of the JSON Web Key Set of the auth domain, by result.",
+		}, []string{"result"}),
+		jwksLastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "jwks_last_refresh_success_timestamp_seconds",
+			Help:      "Time of the last successful fetch of the JSON Web Key Set.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.redisDuration,
+		m.redisErrors,
+		m.authzDecisions,
+		m.jwksRefreshes,
+		m.jwksLastRefresh,
+	)
+
+	return m
+}
+
+// Expose serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Expose() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Handler records requests by their route pattern, it must be used on the
+// root router for the pattern to be complete.
+func (m *Metrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		route := readRoutePatternFromCtx(r.Context())
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(status),
+		}
+
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveAuthz counts a permission check.
+func (m *Metrics) ObserveAuthz(operation string, allowed bool) {
+	decision := "deny"
+	if allowed {
+		decision = "allow"
+	}
+
+	m.authzDecisions.WithLabelValues(operation, decision).Inc()
+}
+
+// ObserveJWKSRefresh records the result of fetching the JSON Web Key Set.
+func (m *Metrics) ObserveJWKSRefresh(err error) {
+	if err != nil {
+		m.jwksRefreshes.WithLabelValues("error").Inc()
+		return
+	}
+
+	m.jwksRefreshes.WithLabelValues("success").Inc()
+	m.jwksLastRefresh.SetToCurrentTime()
+}
+
+// RedisHook returns a go-redis hook recording the latency and errors of commands.
+func (m *Metrics) RedisHook() redis.Hook {
+	return redisMetricsHook{metrics: m}
+}
+
+type redisMetricsHook struct {
+	metrics *Metrics
+}
+
+func (h redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			h.metrics.redisErrors.WithLabelValues("dial").Inc()
+		}
+		return conn, err
+	}
+}
+
+func (h redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.observe(cmd.Name(), time.Since(start), err)
+		return err
+	}
+}
+
+func (h redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.observe("pipeline", time.Since(start), err)
+		return err
+	}
+}
+
+func (h redisMetricsHook) observe(command string, duration time.Duration, err error) {
+	h.metrics.redisDuration.WithLabelValues(command).Observe(duration.Seconds())
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.metrics.redisErrors.WithLabelValues(command).Inc()
+	}
+}
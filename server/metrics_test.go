@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := NewMetrics()
+
+	router := chi.NewRouter()
+	router.Use(metrics.Handler)
+	router.Route("/redis/{key}", func(r chi.Router) {
+		// rejects requests before a handler is reached
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodDelete {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+	})
+
+	serve := func(method string, path string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	}
+
+	// requests are counted by route pattern rather than path
+	{
+		serve(http.MethodGet, "/redis/foo")
+		serve(http.MethodGet, "/redis/bar")
+		serve(http.MethodPost, "/redis/foo")
+		serve(http.MethodDelete, "/redis/foo")
+
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.requests.WithLabelValues("/redis/{key}", http.MethodGet, "200")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.requests.WithLabelValues("/redis/{key}", http.MethodPost, "403")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.requests.WithLabelValues("/redis/{key}", http.MethodDelete, "403")))
+		assert.Equal(t, 3, testutil.CollectAndCount(metrics.requestDuration))
+	}
+
+	// unknown paths share a single series
+	{
+		serve(http.MethodGet, "/nope")
+		serve(http.MethodGet, "/nope/either")
+
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.requests.WithLabelValues(unmatchedRoute, http.MethodGet, "404")))
+	}
+}
+
+func TestMetricsAuthz(t *testing.T) {
+	metrics := NewMetrics()
+
+	permissionMiddleware := NewPermissionMiddleware(
+		"prefix:",
+		policy.SyntaxGlob,
+		func(ctx context.Context) string { return "foo" },
+		func(ctx context.Context) []string { return []string{"read:prefix:foo"} },
+		readClaimsFromCtx,
+	)
+	permissionMiddleware.ObserveDecisions(metrics.ObserveAuthz)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	permissionMiddleware.Handler(ok).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	permissionMiddleware.Handler(ok).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	permissionMiddleware.Require(permissionAdminAudit)(ok).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.authzDecisions.WithLabelValues(operationRead, "allow")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.authzDecisions.WithLabelValues(operationWrite, "deny")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.authzDecisions.WithLabelValues("admin", "deny")))
+}
+
+func TestMetricsJWKSRefresh(t *testing.T) {
+	metrics := NewMetrics()
+
+	metrics.ObserveJWKSRefresh(fmt.Errorf("unreachable"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.jwksRefreshes.WithLabelValues("error")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.jwksLastRefresh))
+
+	metrics.ObserveJWKSRefresh(nil)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.jwksRefreshes.WithLabelValues("success")))
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(metrics.jwksLastRefresh), 5)
+}
+
+func TestMetricsRedisHook(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	metrics := NewMetrics()
+
+	client := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	client.AddHook(metrics.RedisHook())
+	defer client.Close()
+
+	key := fmt.Sprintf("test-metrics-%d", time.Now().UnixNano())
+	defer client.Del(ctx, key)
+
+	// missing keys are not errors
+	assert.Equal(t, redis.Nil, client.Get(ctx, key).Err())
+	assert.NoError(t, client.Set(ctx, key, "value", 0).Err())
+	assert.Error(t, client.Incr(ctx, key).Err())
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.redisErrors.WithLabelValues("get")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.redisErrors.WithLabelValues("incr")))
+	assert.Equal(t, 3, testutil.CollectAndCount(metrics.redisDuration))
+}
+
+func TestMetricsExpose(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.ObserveAuthz(operationRead, true)
+
+	recorder := httptest.NewRecorder()
+	metrics.Expose().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	body, _ := io.ReadAll(recorder.Body)
+	assert.True(t, strings.Contains(string(body), `kave_authz_decisions_total{decision="allow",operation="read"} 1`))
+	assert.True(t, strings.Contains(string(body), "go_goroutines"))
+}
@@ -1,8 +1,8 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: cmd/server/keyvalue_handler.go
+// Source: server/keyvalue_handler.go
 
-// Package mock_main is a generated GoMock package.
-package mock_main
+// Package mock_server is a generated GoMock package.
+package mock_server
 
 import (
 	context "context"
@@ -34,6 +34,20 @@ func (m *MockKeyValue) EXPECT() *MockKeyValueMockRecorder {
 	return m.recorder
 }
 
+// Delete mocks base method.
+func (m *MockKeyValue) Delete(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockKeyValueMockRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockKeyValue)(nil).Delete), arg0, arg1)
+}
+
 // Get mocks base method.
 func (m *MockKeyValue) Get(arg0 context.Context, arg1 string) (string, error) {
 	m.ctrl.T.Helper()
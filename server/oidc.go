@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	oidcLoginPath    = "/login"
+	oidcCallbackPath = "/callback"
+	oidcLogoutPath   = "/logout"
+
+	envOIDCClientSecret = "KAVE_OIDC_CLIENT_SECRET"
+	oidcDiscoveryPath   = "/.well-known/openid-configuration"
+	defaultOIDCTimeout  = 5 * time.Second
+	defaultSessionTTL   = 8 * time.Hour
+	// oidcLoginTTL is how long users have to sign in with the provider
+	oidcLoginTTL = 10 * time.Minute
+
+	sessionCookieName = "kave_session"
+	loginCookieName   = "kave_login"
+)
+
+var defaultOIDCScopes = []string{"openid", "profile", "email"}
+
+// OIDCOptions configures browser logins with an OpenID Connect provider.
+type OIDCOptions struct {
+	Enabled bool `toml:"enabled"`
+	// Issuer is the URL of the provider, its endpoints are discovered from it
+	Issuer   string `toml:"issuer"`
+	ClientID string `toml:"client_id"`
+	// RedirectURL is the URL of the callback route, as registered with the provider
+	RedirectURL string `toml:"redirect_url"`
+	// Audience is requested for the access token, as some providers require
+	Audience     string   `toml:"audience"`
+	Scopes       []string `toml:"scopes"`
+	SessionTTLMs int      `toml:"session_ttl_ms"`
+}
+
+// oidcProvider holds the endpoints of a provider, from its discovery document.
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// pendingLogin is kept from the login until the callback of the provider.
+type pendingLogin struct {
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+// sessionStore keeps pending logins and the sessions of logged in users,
+// shared by every server.
+type sessionStore interface {
+	SaveLogin(ctx context.Context, state string, login pendingLogin, ttl time.Duration) error
+	// TakeLogin removes a pending login, reporting whether it existed
+	TakeLogin(ctx context.Context, state string) (pendingLogin, bool, error)
+	SaveSession(ctx context.Context, id string, token string, ttl time.Duration) error
+	LoadSession(ctx context.Context, id string) (string, bool, error)
+	DeleteSession(ctx context.Context, id string) error
+}
+
+// OIDC logs users in with the authorization code flow and PKCE. Sessions hold
+// the access token issued by the provider, which is validated on every
+// request as if it were sent as a bearer token.
+type OIDC struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	callbackPath string
+	audience     string
+	scopes       []string
+	sessionTTL   time.Duration
+	secure       bool
+	provider     oidcProvider
+	sessions     sessionStore
+	parseToken   ParseTokenFunc
+	client       *http.Client
+}
+
+// NewOIDC creates an OIDC, discovering the endpoints of the provider.
+// clientSecret may be empty for public clients.
+func NewOIDC(
+	ctx context.Context,
+	options OIDCOptions,
+	clientSecret string,
+	sessions sessionStore,
+	parseToken ParseTokenFunc,
+	client *http.Client,
+) (*OIDC, error) {
+	if options.Issuer == "" || options.ClientID == "" || options.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc requires an issuer, a client id and a redirect url")
+	}
+
+	redirectURL, err := url.Parse(options.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: defaultOIDCTimeout}
+	}
+
+	scopes := options.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOIDCScopes
+	}
+
+	sessionTTL := time.Duration(options.SessionTTLMs) * time.Millisecond
+	if sessionTTL == 0 {
+		sessionTTL = defaultSessionTTL
+	}
+
+	o := &OIDC{
+		clientID:     options.ClientID,
+		clientSecret: clientSecret,
+		redirectURL:  options.RedirectURL,
+		callbackPath: redirectURL.Path,
+		audience:     options.Audience,
+		scopes:       scopes,
+		sessionTTL:   sessionTTL,
+		// browsers only send secure cookies over https, or to localhost
+		secure:     redirectURL.Scheme == "https",
+		sessions:   sessions,
+		parseToken: parseToken,
+		client:     client,
+	}
+
+	o.provider, err = o.discover(ctx, options.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (o *OIDC) discover(ctx context.Context, issuer string) (oidcProvider, error) {
+	var provider oidcProvider
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+oidcDiscoveryPath, nil)
+	if err != nil {
+		return provider, err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return provider, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return provider, fmt.Errorf("oidc discovery failed: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return provider, err
+	}
+
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return provider, fmt.Errorf("oidc discovery document lacks the authorization or token endpoint")
+	}
+
+	return provider, nil
+}
+
+func randomURLToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// localReturnTo returns the path to send users to after they log in,
+// only paths on this server are accepted.
+func localReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	return returnTo
+}
+
+// Login redirects to the provider, to return to the return_to query parameter once logged in.
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	state, err := randomURLToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error generating state", err)
+		return
+	}
+
+	verifier, err := randomURLToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error generating code verifier", err)
+		return
+	}
+
+	login := pendingLogin{
+		Verifier: verifier,
+		ReturnTo: localReturnTo(r.URL.Query().Get("return_to")),
+	}
+
+	if err := o.sessions.SaveLogin(r.Context(), state, login, oidcLoginTTL); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error saving login", err)
+		return
+	}
+
+	// binds the login to this browser, the provider redirects back cross-site
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    state,
+		Path:     o.callbackPath,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", o.clientID)
+	params.Set("redirect_uri", o.redirectURL)
+	params.Set("scope", strings.Join(o.scopes, " "))
+	params.Set("state", state)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	if o.audience != "" {
+		params.Set("audience", o.audience)
+	}
+
+	separator := "?"
+	if strings.Contains(o.provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	http.Redirect(w, r, o.provider.AuthorizationEndpoint+separator+params.Encode(), http.StatusFound)
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// exchange redeems an authorization code for an access token.
+func (o *OIDC) exchange(ctx context.Context, code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL)
+	form.Set("client_id", o.clientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("code exchange failed: %s", resp.Status)
+	}
+
+	var token oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("code exchange returned no access token")
+	}
+
+	return token.AccessToken, nil
+}
+
+// Callback completes a login started by Login, starting a session.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	// the login cookie is only needed once
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Path:     o.callbackPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if reason := params.Get("error"); reason != "" {
+		http.Error(w, "login failed: "+reason, http.StatusUnauthorized)
+		return
+	}
+
+	state := params.Get("state")
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "login was not started by this browser", http.StatusBadRequest)
+		return
+	}
+
+	login, ok, err := o.sessions.TakeLogin(r.Context(), state)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error taking login", err)
+		return
+	}
+	if !ok {
+		http.Error(w, "login expired", http.StatusBadRequest)
+		return
+	}
+
+	token, err := o.exchange(r.Context(), params.Get("code"), login.Verifier)
+	if err != nil {
+		loggerFromCtx(r.Context()).Warn("rejected login", "reason", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	// the token must be accepted as a bearer token would be
+	claims, err := o.parseToken(token)
+	if err != nil {
+		loggerFromCtx(r.Context()).Warn("rejected login", "reason", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	ttl := o.sessionTTL
+	if claims.ExpiresAt != nil && time.Until(claims.ExpiresAt.Time) < ttl {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+
+	id, err := randomURLToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error generating session", err)
+		return
+	}
+
+	if err := o.sessions.SaveSession(r.Context(), id, token, ttl); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error saving session", err)
+		return
+	}
+
+	loggerFromCtx(r.Context()).Info("logged in", "subject", claims.Subject)
+
+	// strict, so other sites cannot make requests with the session
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.Redirect(w, r, login.ReturnTo, http.StatusFound)
+}
+
+// Logout ends the session of the request.
+func (o *OIDC) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := o.sessions.DeleteSession(r.Context(), cookie.Value); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			loggerFromCtx(r.Context()).Error("error deleting session", err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionToken returns the access token of the session of the request, if any.
+// It can be used as a sessionTokenFunc.
+func (o *OIDC) SessionToken(ctx context.Context, r *http.Request) (string, bool, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false, nil
+	}
+
+	return o.sessions.LoadSession(ctx, cookie.Value)
+}
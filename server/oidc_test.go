@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// memorySessionStore keeps logins and sessions in memory, without expiring them.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	logins   map[string]pendingLogin
+	sessions map[string]string
+	ttls     map[string]time.Duration
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		logins:   map[string]pendingLogin{},
+		sessions: map[string]string{},
+		ttls:     map[string]time.Duration{},
+	}
+}
+
+func (s *memorySessionStore) SaveLogin(ctx context.Context, state string, login pendingLogin, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins[state] = login
+	return nil
+}
+
+func (s *memorySessionStore) TakeLogin(ctx context.Context, state string) (pendingLogin, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.logins[state]
+	delete(s.logins, state)
+	return login, ok, nil
+}
+
+func (s *memorySessionStore) SaveSession(ctx context.Context, id string, token string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = token
+	s.ttls[id] = ttl
+	return nil
+}
+
+func (s *memorySessionStore) LoadSession(ctx context.Context, id string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.sessions[id]
+	return token, ok, nil
+}
+
+func (s *memorySessionStore) DeleteSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// testOIDCProvider stands in for an OIDC provider, logging in every user as
+// alice and issuing the access token "alice-token".
+type testOIDCProvider struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	challenges map[string]string
+	requests   []url.Values
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	p := &testOIDCProvider{challenges: map[string]string{}}
+
+	router := chi.NewRouter()
+	router.Get(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcProvider{
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+		})
+	})
+
+	// users are logged in right away
+	router.Get("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		p.mu.Lock()
+		p.requests = append(p.requests, params)
+		code := fmt.Sprintf("code-%d", len(p.requests))
+		p.challenges[code] = params.Get("code_challenge")
+		p.mu.Unlock()
+
+		callback := params.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {params.Get("state")}}.Encode()
+		http.Redirect(w, r, callback, http.StatusFound)
+	})
+
+	router.Post("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+
+		p.mu.Lock()
+		challenge, ok := p.challenges[r.PostForm.Get("code")]
+		delete(p.challenges, r.PostForm.Get("code"))
+		p.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(oidcTokenResponse{AccessToken: "alice-token", TokenType: "Bearer"})
+	})
+
+	p.Server = httptest.NewServer(router)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	sessions := newMemorySessionStore()
+
+	parse := func(token string) (*Claims, error) {
+		if token != "alice-token" {
+			return nil, fmt.Errorf("invalid token")
+		}
+		claims := &Claims{Permissions: []string{"read:foo"}}
+		claims.Subject = "alice"
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+		return claims, nil
+	}
+
+	// the redirect url is only known once the server is started
+	router := chi.NewRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	oidc, err := NewOIDC(context.Background(), OIDCOptions{
+		Issuer:      provider.URL,
+		ClientID:    "kave-ui",
+		RedirectURL: server.URL + oidcCallbackPath,
+		Audience:    "https://kave.example.com",
+	}, "", sessions, parse, nil)
+	assert.NoError(t, err)
+
+	authMiddleware := NewAuthMiddleware(parse, writeClaimsToCtx, nil)
+	authMiddleware.AcceptSessions(oidc.SessionToken)
+
+	router.Get(oidcLoginPath, oidc.Login)
+	router.Get(oidcCallbackPath, oidc.Callback)
+	router.Post(oidcLogoutPath, oidc.Logout)
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware.Handler)
+		r.Get("/whoami", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(readClaimsFromCtx(r.Context()).Subject))
+		})
+	})
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// startLogin returns the redirect to the provider and the cookies set by the server
+	startLogin := func(returnTo string) (*http.Response, []*http.Cookie) {
+		res, err := noRedirects.Get(server.URL + oidcLoginPath + "?" + url.Values{"return_to": {returnTo}}.Encode())
+		assert.NoError(t, err)
+		return res, res.Cookies()
+	}
+
+	// callback signs in with the provider and returns its callback url
+	callback := func(res *http.Response) string {
+		res, err := noRedirects.Get(res.Header.Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		return res.Header.Get("Location")
+	}
+
+	completeLogin := func(callbackURL string, cookies []*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, callbackURL, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		res, err := noRedirects.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	whoami := func(cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/whoami", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	sessionCookie := func(res *http.Response) *http.Cookie {
+		for _, cookie := range res.Cookies() {
+			if cookie.Name == sessionCookieName {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	// the login redirects to the provider with a PKCE challenge
+	{
+		res, cookies := startLogin("/ui/")
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+
+		location, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, provider.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+
+		params := location.Query()
+		assert.Equal(t, "code", params.Get("response_type"))
+		assert.Equal(t, "kave-ui", params.Get("client_id"))
+		assert.Equal(t, server.URL+oidcCallbackPath, params.Get("redirect_uri"))
+		assert.Equal(t, "openid profile email", params.Get("scope"))
+		assert.Equal(t, "S256", params.Get("code_challenge_method"))
+		assert.Equal(t, "https://kave.example.com", params.Get("audience"))
+		assert.NotEmpty(t, params.Get("code_challenge"))
+
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, loginCookieName, cookies[0].Name)
+		assert.Equal(t, params.Get("state"), cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+	}
+
+	// the callback starts a session accepted instead of a bearer token
+	{
+		res, cookies := startLogin("/ui/")
+
+		res = completeLogin(callback(res), cookies)
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		assert.Equal(t, "/ui/", res.Header.Get("Location"))
+
+		session := sessionCookie(res)
+		assert.NotNil(t, session)
+		assert.True(t, session.HttpOnly)
+		assert.Equal(t, http.SameSiteStrictMode, session.SameSite)
+		// the session ends with the token
+		assert.InDelta(t, time.Hour.Seconds(), float64(session.MaxAge), 5)
+
+		res = whoami(session)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		buf := make([]byte, 16)
+		n, _ := res.Body.Read(buf)
+		assert.Equal(t, "alice", string(buf[:n]))
+
+		// sessions are not known to other browsers
+		res = whoami(&http.Cookie{Name: sessionCookieName, Value: "guess"})
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		// sessions end on logout
+		req, _ := http.NewRequest(http.MethodPost, server.URL+oidcLogoutPath, nil)
+		req.AddCookie(session)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+		res = whoami(session)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+
+	// logins must be completed by the browser which started them
+	{
+		res, _ := startLogin("/ui/")
+
+		res = completeLogin(callback(res), nil)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Nil(t, sessionCookie(res))
+	}
+
+	// logins are completed once
+	{
+		res, cookies := startLogin("/ui/")
+		callbackURL := callback(res)
+
+		res = completeLogin(callbackURL, cookies)
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+
+		res = completeLogin(callbackURL, cookies)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Nil(t, sessionCookie(res))
+	}
+
+	// users are only sent back to this server
+	{
+		res, cookies := startLogin("https://evil.example.com")
+
+		res = completeLogin(callback(res), cookies)
+		assert.Equal(t, "/", res.Header.Get("Location"))
+
+		for _, returnTo := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com", ""} {
+			assert.Equal(t, "/", localReturnTo(returnTo))
+		}
+		assert.Equal(t, "/ui/?prefix=team-a", localReturnTo("/ui/?prefix=team-a"))
+	}
+
+	// providers may deny logins
+	{
+		res, err := http.Get(server.URL + oidcCallbackPath + "?error=access_denied")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+
+	// bearer tokens are still accepted, and preferred over sessions
+	{
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/whoami", nil)
+		req.Header.Set("Authorization", "Bearer alice-token")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		req.Header.Set("Authorization", "Bearer wrong")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "guess"})
+		res, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func TestNewOIDC(t *testing.T) {
+	ctx := context.Background()
+	sessions := newMemorySessionStore()
+	parse := func(string) (*Claims, error) { return nil, fmt.Errorf("invalid token") }
+
+	// an issuer, a client and a redirect url are required
+	{
+		_, err := NewOIDC(ctx, OIDCOptions{ClientID: "kave-ui", RedirectURL: "http://localhost/callback"}, "", sessions, parse, nil)
+		assert.Error(t, err)
+	}
+
+	// the provider must be discovered
+	{
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		_, err := NewOIDC(ctx, OIDCOptions{Issuer: server.URL, ClientID: "kave-ui", RedirectURL: "http://localhost/callback"}, "", sessions, parse, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer client.Close()
+
+	prefix := fmt.Sprintf("test-sessions-%d:", time.Now().UnixNano())
+	store := newRedisSessionStore(client, prefix)
+
+	// logins are taken once
+	{
+		assert.NoError(t, store.SaveLogin(ctx, "state", pendingLogin{Verifier: "verifier", ReturnTo: "/ui/"}, time.Minute))
+
+		login, ok, err := store.TakeLogin(ctx, "state")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, pendingLogin{Verifier: "verifier", ReturnTo: "/ui/"}, login)
+
+		_, ok, err = store.TakeLogin(ctx, "state")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	// sessions are kept by the hash of their ID
+	{
+		assert.NoError(t, store.SaveSession(ctx, "session-id", "alice-token", time.Minute))
+		defer store.DeleteSession(ctx, "session-id")
+
+		token, ok, err := store.LoadSession(ctx, "session-id")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "alice-token", token)
+
+		keys, err := client.Keys(ctx, escapeGlob(prefix)+"*").Result()
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+		assert.NotContains(t, keys[0], "session-id")
+
+		ttl, err := client.TTL(ctx, keys[0]).Result()
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Minute.Seconds(), ttl.Seconds(), 5)
+
+		assert.NoError(t, store.DeleteSession(ctx, "session-id"))
+		_, ok, err = store.LoadSession(ctx, "session-id")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,669 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/pdcalado/kave/internal/version"
+)
+
+const (
+	openAPIPath    = "/openapi.json"
+	openAPIVersion = "3.0.3"
+
+	openAPISecurityBearer  = "bearer"
+	openAPISecuritySession = "session"
+)
+
+// undocumentedRoutes are served but not part of the API, such as the files of the web UI.
+var undocumentedRoutes = map[string]bool{
+	uiPath + "/*": true,
+}
+
+// openAPIConfig selects what the document describes besides the routes of the server.
+type openAPIConfig struct {
+	BasePath string
+	Auth     bool
+	// Sessions are accepted instead of bearer tokens, see OIDC
+	Sessions  bool
+	Presign   bool
+	RateLimit bool
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security,omitempty"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas,omitempty"`
+	Responses       map[string]*openAPIResponse      `json:"responses,omitempty"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	// Security is set empty for public routes, overriding the security of the document
+	Security *[]map[string][]string `json:"security,omitempty"`
+
+	// public routes are reachable without a token
+	public bool
+	// limitedByAddress public routes are rate limited by the address of callers
+	limitedByAddress bool
+	// permission required by the route, on top of a valid token
+	permission string
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema,omitempty"`
+}
+
+type openAPIResponse struct {
+	Ref         string                      `json:"$ref,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Headers     map[string]openAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIHeader struct {
+	Description string         `json:"description,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Format      string                    `json:"format,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Enum        []string                  `json:"enum,omitempty"`
+	Items       *openAPISchema            `json:"items,omitempty"`
+	Properties  map[string]*openAPISchema `json:"properties,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+}
+
+func schemaOf(typ string, description string) *openAPISchema {
+	return &openAPISchema{Type: typ, Description: description}
+}
+
+func arrayOf(items *openAPISchema) *openAPISchema {
+	return &openAPISchema{Type: "array", Items: items}
+}
+
+func schemaRef(name string) *openAPISchema {
+	return &openAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func responseRef(name string) *openAPIResponse {
+	return &openAPIResponse{Ref: "#/components/responses/" + name}
+}
+
+func jsonContent(schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{"application/json": {Schema: schema}}
+}
+
+func jsonResponse(description string, schema *openAPISchema) *openAPIResponse {
+	return &openAPIResponse{Description: description, Content: jsonContent(schema)}
+}
+
+func queryParameter(name string, typ string, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: description, Schema: schemaOf(typ, "")}
+}
+
+// openAPISchemas are the bodies of requests and responses of the API.
+func openAPISchemas() map[string]*openAPISchema {
+	return map[string]*openAPISchema{
+		"KeyList": {Type: "object", Required: []string{"keys"}, Properties: map[string]*openAPISchema{
+			"keys":   arrayOf(schemaRef("KeyInfo")),
+			"cursor": schemaOf("string", "passed back to get the next page, absent on the last page"),
+		}},
+		"KeyInfo": {Type: "object", Required: []string{"key"}, Properties: map[string]*openAPISchema{
+			"key":    schemaOf("string", "key without the key prefix of the server"),
+			"ttl_ms": schemaOf("integer", "time to live in milliseconds, absent if the key does not expire"),
+		}},
+		"AuthzCheckRequest": {Type: "object", Required: []string{"key", "operation"}, Properties: map[string]*openAPISchema{
+			"key":       schemaOf("string", ""),
+			"operation": {Type: "string", Enum: []string{operationRead, operationWrite}},
+		}},
+		"AuthzCheckResponse": {Type: "object", Properties: map[string]*openAPISchema{
+			"subject":     schemaOf("string", ""),
+			"client":      schemaOf("string", ""),
+			"allowed":     schemaOf("boolean", ""),
+			"required":    schemaOf("string", "permission required by the operation"),
+			"permissions": arrayOf(schemaOf("string", "")),
+			"matched":     schemaOf("string", "permission granting the operation"),
+			"denied_by":   schemaOf("string", "permission denying the operation"),
+			"invalid":     arrayOf(schemaOf("string", "")),
+			"reason":      schemaOf("string", ""),
+		}},
+		"Revocation": {Type: "object", Properties: map[string]*openAPISchema{
+			"kind":       {Type: "string", Enum: []string{revocationKindJTI, revocationKindClient}},
+			"id":         schemaOf("string", ""),
+			"revoked_at": {Type: "string", Format: "date-time"},
+			"expires_at": {Type: "string", Format: "date-time"},
+		}},
+		"RevokeRequest": {Type: "object", Description: "exactly one of jti and client", Properties: map[string]*openAPISchema{
+			"jti":    schemaOf("string", ""),
+			"client": schemaOf("string", ""),
+			"exp":    schemaOf("integer", "expiry of the revoked token, in seconds since epoch"),
+		}},
+		"Quota": {Type: "object", Required: []string{"prefix"}, Properties: map[string]*openAPISchema{
+			"prefix":    schemaOf("string", ""),
+			"max_keys":  schemaOf("integer", "0 is unlimited"),
+			"max_bytes": schemaOf("integer", "0 is unlimited"),
+		}},
+		"QuotaUsage": {Type: "object", Properties: map[string]*openAPISchema{
+			"prefix":    schemaOf("string", ""),
+			"max_keys":  schemaOf("integer", ""),
+			"max_bytes": schemaOf("integer", ""),
+			"source":    schemaOf("string", ""),
+			"keys":      schemaOf("integer", ""),
+			"bytes":     schemaOf("integer", ""),
+		}},
+		"AuditEvent": {Type: "object", Properties: map[string]*openAPISchema{
+			"time":       {Type: "string", Format: "date-time"},
+			"request_id": schemaOf("string", ""),
+			"subject":    schemaOf("string", ""),
+			"client":     schemaOf("string", ""),
+			"presigned":  schemaOf("boolean", ""),
+			"operation":  schemaOf("string", ""),
+			"key":        schemaOf("string", ""),
+			"status":     schemaOf("integer", ""),
+			"outcome":    schemaOf("string", ""),
+			"value_hash": schemaOf("string", ""),
+			"prev":       schemaOf("string", ""),
+			"hash":       schemaOf("string", ""),
+		}},
+		"PresignRequest": {Type: "object", Required: []string{"key", "operation", "expires_in"}, Properties: map[string]*openAPISchema{
+			"key":        schemaOf("string", ""),
+			"operation":  {Type: "string", Enum: []string{operationRead, operationWrite}},
+			"expires_in": schemaOf("string", "duration such as 10m"),
+			"single_use": schemaOf("boolean", ""),
+		}},
+		"PresignResponse": {Type: "object", Properties: map[string]*openAPISchema{
+			"url":        schemaOf("string", ""),
+			"path":       schemaOf("string", ""),
+			"expires_at": {Type: "string", Format: "date-time"},
+		}},
+		"TokenRequest": {Type: "object", Required: []string{"grant_type"}, Properties: map[string]*openAPISchema{
+			"grant_type":    {Type: "string", Enum: []string{"client_credentials"}},
+			"client_id":     schemaOf("string", "or basic auth"),
+			"client_secret": schemaOf("string", "or basic auth"),
+			"audience":      schemaOf("string", ""),
+		}},
+		"TokenResponse": {Type: "object", Properties: map[string]*openAPISchema{
+			"access_token": schemaOf("string", ""),
+			"token_type":   schemaOf("string", ""),
+			"expires_in":   schemaOf("integer", ""),
+			"scope":        schemaOf("string", ""),
+		}},
+		"OAuthError": {Type: "object", Properties: map[string]*openAPISchema{
+			"error": schemaOf("string", ""),
+		}},
+		"JWKS": {Type: "object", Properties: map[string]*openAPISchema{
+			"keys": arrayOf(schemaOf("object", "")),
+		}},
+	}
+}
+
+// openAPIResponses are the error responses shared by routes, their bodies being plain text if any.
+func openAPIResponses() map[string]*openAPIResponse {
+	text := map[string]openAPIMediaType{"text/plain": {Schema: schemaOf("string", "")}}
+
+	return map[string]*openAPIResponse{
+		"BadRequest":   {Description: "The request is invalid.", Content: text},
+		"Unauthorized": {Description: "The token is missing, invalid or revoked."},
+		"Forbidden":    {Description: "The permissions of the caller do not allow the operation."},
+		"NotFound":     {Description: "The resource does not exist."},
+		"TooManyRequests": {Description: "The caller exceeded its rate limit.", Headers: map[string]openAPIHeader{
+			"Retry-After": {Description: "seconds until the next request is allowed", Schema: schemaOf("integer", "")},
+		}},
+		"InternalServerError": {Description: "The request failed, see the logs of the server."},
+	}
+}
+
+// openAPIOperations documents every route the server may serve, by path and lower case method.
+// Paths are written without trailing slash, with the router base path.
+func openAPIOperations(basePath string) map[string]map[string]*openAPIOperation {
+	keyParameter := openAPIParameter{Name: "key", In: "path", Required: true, Description: "key without the key prefix of the server", Schema: schemaOf("string", "")}
+	binary := map[string]openAPIMediaType{"application/octet-stream": {Schema: &openAPISchema{Type: "string", Format: "binary"}}}
+
+	return map[string]map[string]*openAPIOperation{
+		basePath: {
+			"get": {
+				OperationID: "listKeys",
+				Summary:     "List keys by prefix",
+				Description: "Only the keys the caller may read are listed, pages may hold fewer keys than the limit.",
+				Tags:        []string{"keys"},
+				Parameters: []openAPIParameter{
+					queryParameter("prefix", "string", "prefix of the keys, without the key prefix of the server"),
+					queryParameter("cursor", "string", "cursor of the previous page"),
+					queryParameter("limit", "integer", fmt.Sprintf("keys per page, defaults to %d, at most %d", defaultKeyListLimit, maxKeyListLimit)),
+				},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("A page of keys.", schemaRef("KeyList")),
+					"400": responseRef("BadRequest"),
+					"500": responseRef("InternalServerError"),
+				},
+			},
+		},
+		basePath + "/{key}": {
+			"get": {
+				OperationID: "getKey",
+				Summary:     "Get the value of a key",
+				Tags:        []string{"keys"},
+				Parameters:  []openAPIParameter{keyParameter},
+				Responses: map[string]*openAPIResponse{
+					"200": {Description: "The value of the key.", Content: binary},
+					"404": responseRef("NotFound"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: "read:<key>",
+			},
+			"post": {
+				OperationID: "setKey",
+				Summary:     "Set the value of a key",
+				Tags:        []string{"keys"},
+				Parameters:  []openAPIParameter{keyParameter},
+				RequestBody: &openAPIRequestBody{Required: true, Content: binary},
+				Responses: map[string]*openAPIResponse{
+					"201": {Description: "The value is set."},
+					"413": {Description: "The value can never fit in the quota of the key."},
+					"500": responseRef("InternalServerError"),
+					"507": {Description: "The quota of the key is exceeded."},
+				},
+				permission: "write:<key>",
+			},
+			"delete": {
+				OperationID: "deleteKey",
+				Summary:     "Delete a key",
+				Tags:        []string{"keys"},
+				Parameters:  []openAPIParameter{keyParameter},
+				Responses: map[string]*openAPIResponse{
+					"204": {Description: "The key is deleted."},
+					"404": responseRef("NotFound"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: "write:<key>",
+			},
+		},
+		defaultHealthPath: {
+			"get": {
+				OperationID: "health",
+				Summary:     "Check the server is up",
+				Tags:        []string{"server"},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The server is up.", &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{"status": schemaOf("string", "")}}),
+				},
+			},
+		},
+		openAPIPath: {
+			"get": {
+				OperationID: "openAPI",
+				Summary:     "Get this document",
+				Tags:        []string{"server"},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The OpenAPI document of the server.", schemaOf("object", "")),
+				},
+				public: true,
+			},
+		},
+		authzCheckPath: {
+			"post": {
+				OperationID: "checkPermission",
+				Summary:     "Explain whether the caller may operate on a key",
+				Description: "The decision is made with the effective permissions of the caller, without accessing the key.",
+				Tags:        []string{"auth"},
+				RequestBody: &openAPIRequestBody{Required: true, Content: jsonContent(schemaRef("AuthzCheckRequest"))},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The decision.", schemaRef("AuthzCheckResponse")),
+					"400": responseRef("BadRequest"),
+				},
+			},
+		},
+		revocationsPath: {
+			"get": {
+				OperationID: "listRevocations",
+				Summary:     "List revoked tokens and clients",
+				Tags:        []string{"admin"},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The revocations.", arrayOf(schemaRef("Revocation"))),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminRevocations,
+			},
+			"post": {
+				OperationID: "revoke",
+				Summary:     "Revoke a token by its jti, or every token issued to a client until now",
+				Tags:        []string{"admin"},
+				RequestBody: &openAPIRequestBody{Required: true, Content: jsonContent(schemaRef("RevokeRequest"))},
+				Responses: map[string]*openAPIResponse{
+					"201": {Description: "The token or client is revoked."},
+					"400": responseRef("BadRequest"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminRevocations,
+			},
+			"delete": {
+				OperationID: "unrevoke",
+				Summary:     "Remove a revocation",
+				Tags:        []string{"admin"},
+				Parameters: []openAPIParameter{
+					queryParameter(revocationKindJTI, "string", "jti of the revoked token"),
+					queryParameter(revocationKindClient, "string", "revoked client"),
+				},
+				Responses: map[string]*openAPIResponse{
+					"204": {Description: "The revocation is removed."},
+					"400": responseRef("BadRequest"),
+					"404": responseRef("NotFound"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminRevocations,
+			},
+		},
+		quotaPath: {
+			"get": {
+				OperationID: "quotaUsage",
+				Summary:     "Get the usage of the quotas the caller may read",
+				Tags:        []string{"quotas"},
+				Parameters:  []openAPIParameter{queryParameter("key", "string", "only the quotas applying to this key")},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The usage of the quotas.", arrayOf(schemaRef("QuotaUsage"))),
+					"500": responseRef("InternalServerError"),
+				},
+			},
+		},
+		adminQuotasPath: {
+			"get": {
+				OperationID: "listQuotas",
+				Summary:     "List the quotas and their usage",
+				Tags:        []string{"admin"},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The quotas.", arrayOf(schemaRef("QuotaUsage"))),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminQuota,
+			},
+			"put": {
+				OperationID: "saveQuota",
+				Summary:     "Set the quota of a prefix",
+				Tags:        []string{"admin"},
+				RequestBody: &openAPIRequestBody{Required: true, Content: jsonContent(schemaRef("Quota"))},
+				Responses: map[string]*openAPIResponse{
+					"204": {Description: "The quota is set."},
+					"400": responseRef("BadRequest"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminQuota,
+			},
+			"delete": {
+				OperationID: "deleteQuota",
+				Summary:     "Remove the quota of a prefix set through this API",
+				Tags:        []string{"admin"},
+				Parameters:  []openAPIParameter{queryParameter("prefix", "string", "prefix of the quota")},
+				Responses: map[string]*openAPIResponse{
+					"204": {Description: "The quota is removed."},
+					"400": responseRef("BadRequest"),
+					"404": responseRef("NotFound"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminQuota,
+			},
+		},
+		auditPath: {
+			"get": {
+				OperationID: "queryAudit",
+				Summary:     "Query the audit log",
+				Tags:        []string{"admin"},
+				Parameters: []openAPIParameter{
+					queryParameter("key", "string", "only the events of this key"),
+					queryParameter("since", "string", "RFC3339 time, or a duration before now such as 1h"),
+					queryParameter("limit", "integer", fmt.Sprintf("at most %d", maxAuditQueryLimit)),
+				},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The events, oldest first.", arrayOf(schemaRef("AuditEvent"))),
+					"400": responseRef("BadRequest"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: permissionAdminAudit,
+			},
+		},
+		presignPath: {
+			"post": {
+				OperationID: "presign",
+				Summary:     "Create a pre-signed url for an operation on a key",
+				Description: "The caller must be allowed the operation on the key.",
+				Tags:        []string{"keys"},
+				RequestBody: &openAPIRequestBody{Required: true, Content: jsonContent(schemaRef("PresignRequest"))},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The pre-signed url.", schemaRef("PresignResponse")),
+					"400": responseRef("BadRequest"),
+					"500": responseRef("InternalServerError"),
+				},
+				permission: "read:<key> or write:<key>",
+			},
+		},
+		issuerTokenPath: {
+			"post": {
+				OperationID: "issueToken",
+				Summary:     "Issue a token with the client credentials grant",
+				Tags:        []string{"auth"},
+				RequestBody: &openAPIRequestBody{Required: true, Content: map[string]openAPIMediaType{
+					"application/x-www-form-urlencoded": {Schema: schemaRef("TokenRequest")},
+					"application/json":                  {Schema: schemaRef("TokenRequest")},
+				}},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The token.", schemaRef("TokenResponse")),
+					"400": jsonResponse("The request is invalid.", schemaRef("OAuthError")),
+					"401": jsonResponse("The client credentials are invalid.", schemaRef("OAuthError")),
+				},
+				public:           true,
+				limitedByAddress: true,
+			},
+		},
+		issuerJWKSPath: {
+			"get": {
+				OperationID: "jwks",
+				Summary:     "Get the keys validating issued tokens",
+				Tags:        []string{"auth"},
+				Responses: map[string]*openAPIResponse{
+					"200": jsonResponse("The key set.", schemaRef("JWKS")),
+				},
+				public:           true,
+				limitedByAddress: true,
+			},
+		},
+		oidcLoginPath: {
+			"get": {
+				OperationID: "login",
+				Summary:     "Redirect the browser to the OIDC provider to log in",
+				Tags:        []string{"auth"},
+				Parameters:  []openAPIParameter{queryParameter("return_to", "string", "local path the browser is sent back to")},
+				Responses: map[string]*openAPIResponse{
+					"302": {Description: "Redirect to the provider."},
+				},
+				public:           true,
+				limitedByAddress: true,
+			},
+		},
+		oidcCallbackPath: {
+			"get": {
+				OperationID: "loginCallback",
+				Summary:     "Complete the login, starting a session",
+				Tags:        []string{"auth"},
+				Parameters: []openAPIParameter{
+					queryParameter("code", "string", ""),
+					queryParameter("state", "string", ""),
+				},
+				Responses: map[string]*openAPIResponse{
+					"302": {Description: "Redirect to the page the login started from, with the session cookie set."},
+					"400": responseRef("BadRequest"),
+					"401": responseRef("Unauthorized"),
+				},
+				public:           true,
+				limitedByAddress: true,
+			},
+		},
+		oidcLogoutPath: {
+			"post": {
+				OperationID: "logout",
+				Summary:     "End the session",
+				Tags:        []string{"auth"},
+				Responses: map[string]*openAPIResponse{
+					"204": {Description: "The session ended."},
+				},
+				public:           true,
+				limitedByAddress: true,
+			},
+		},
+	}
+}
+
+// openAPIRoutePath returns the path of a route as documented, without trailing slash.
+func openAPIRoutePath(route string) string {
+	if route == "/" {
+		return route
+	}
+	return strings.TrimSuffix(route, "/")
+}
+
+// NewOpenAPIDocument describes the routes of a router, and of the document itself.
+// Routes missing from the operations above are left out.
+func NewOpenAPIDocument(routes chi.Routes, config openAPIConfig) (*openAPIDocument, error) {
+	operations := openAPIOperations(config.BasePath)
+
+	document := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:       "kave",
+			Description: "Get and set key values in Redis, with auth.",
+			Version:     version.Version,
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas:         openAPISchemas(),
+			Responses:       openAPIResponses(),
+			SecuritySchemes: map[string]openAPISecurityScheme{},
+		},
+	}
+
+	if config.Auth {
+		document.Components.SecuritySchemes[openAPISecurityBearer] = openAPISecurityScheme{Type: "http", Scheme: "bearer"}
+		document.Security = append(document.Security, map[string][]string{openAPISecurityBearer: {}})
+	}
+	if config.Auth && config.Sessions {
+		document.Components.SecuritySchemes[openAPISecuritySession] = openAPISecurityScheme{Type: "apiKey", In: "cookie", Name: sessionCookieName}
+		document.Security = append(document.Security, map[string][]string{openAPISecuritySession: {}})
+	}
+
+	add := func(method string, path string) {
+		operation, ok := operations[path][method]
+		if !ok {
+			return
+		}
+
+		if operation.public && config.Auth {
+			operation.Security = &[]map[string][]string{}
+		}
+
+		if !operation.public && config.Auth {
+			operation.Responses["401"] = responseRef("Unauthorized")
+			if operation.permission != "" {
+				operation.Responses["403"] = responseRef("Forbidden")
+				operation.Description = strings.TrimSpace(fmt.Sprintf("%s Requires the %s permission.", operation.Description, operation.permission))
+			}
+		}
+
+		if (!operation.public || operation.limitedByAddress) && config.RateLimit {
+			operation.Responses["429"] = responseRef("TooManyRequests")
+		}
+
+		// pre-signed urls replace the token of operations on keys
+		if config.Presign && path == config.BasePath+"/{key}" {
+			operation.Security = &[]map[string][]string{{}}
+			*operation.Security = append(*operation.Security, document.Security...)
+			for _, param := range []string{presignParamOperation, presignParamExpires, presignParamNonce, presignParamSignature} {
+				operation.Parameters = append(operation.Parameters, queryParameter(param, "string", "set by pre-signed urls"))
+			}
+		}
+
+		if document.Paths[path] == nil {
+			document.Paths[path] = map[string]*openAPIOperation{}
+		}
+		document.Paths[path][method] = operation
+	}
+
+	err := chi.Walk(routes, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !undocumentedRoutes[route] {
+			add(strings.ToLower(method), openAPIRoutePath(route))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	add("get", openAPIPath)
+
+	return document, nil
+}
+
+// NewOpenAPIHandler serves the document describing the routes of a router,
+// to be added to the router after every other route.
+func NewOpenAPIHandler(routes chi.Routes, config openAPIConfig) (http.Handler, error) {
+	document, err := NewOpenAPIDocument(routes, config)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write(buf)
+		if err != nil {
+			loggerFromCtx(r.Context()).Error("error writing response", err)
+		}
+	}), nil
+}
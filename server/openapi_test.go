@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	client, err := NewRedisClient(ctx, &redis.Options{Addr: redisHost + ":6379"})
+	assert.NoError(t, err)
+	defer client.inner.Close()
+
+	provider := newTestOIDCProvider(t)
+	t.Setenv(envPresignSecret, "0123456789abcdef0123456789abcdef")
+
+	prefix := fmt.Sprintf("test-openapi-%d:", time.Now().UnixNano())
+	defer func() {
+		keys, _ := client.inner.Keys(ctx, escapeGlob(prefix)+"*").Result()
+		client.inner.Del(ctx, keys...)
+	}()
+
+	newTestRouter := func(configStr string) *chi.Mux {
+		var config Config
+		_, err := toml.Decode(configStr, &config)
+		assert.NoError(t, err)
+
+		redisKeyPrefix := prefix + "keys:"
+		config.RedisKeyPrefix = &redisKeyPrefix
+		internalKeyPrefix := prefix + "internal:"
+		config.InternalKeyPrefix = &internalKeyPrefix
+
+		routers, err := newRouter(ctx, config, client, options{})
+		assert.NoError(t, err)
+		t.Cleanup(routers.close)
+		return routers.http
+	}
+
+	getDocument := func(router http.Handler) *openAPIDocument {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, openAPIPath, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+		document := &openAPIDocument{}
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), document))
+		return document
+	}
+
+	// every route of the server is documented, fails when adding a route to openAPIOperations is forgotten
+	{
+		router := newTestRouter(fmt.Sprintf(`
+router_base_path = "/kv"
+
+[auth]
+enabled = true
+
+[auth.issuer]
+enabled = true
+key_file = "%s"
+
+[auth.oidc]
+enabled = true
+issuer = "%s"
+client_id = "kave-ui"
+redirect_url = "http://localhost/callback"
+
+[auth.introspection]
+enabled = true
+url = "http://localhost/introspect"
+
+[auth.revocation]
+enabled = true
+
+[rate_limit]
+enabled = true
+rate = 10
+burst = 10
+
+[quotas]
+enabled = true
+
+[presign]
+enabled = true
+
+[audit]
+enabled = true
+redis_stream = true
+
+[ui]
+enabled = true
+`, path.Join(t.TempDir(), "issuer.pem"), provider.URL))
+
+		document := getDocument(router)
+
+		err := chi.Walk(router, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+			if undocumentedRoutes[route] {
+				return nil
+			}
+
+			_, ok := document.Paths[openAPIRoutePath(route)][strings.ToLower(method)]
+			assert.True(t, ok, "route %s %s is not documented", method, route)
+			return nil
+		})
+		assert.NoError(t, err)
+
+		// routes are documented under the base path
+		assert.Contains(t, document.Paths, "/kv")
+		assert.Contains(t, document.Paths, "/kv/{key}")
+		assert.NotContains(t, document.Paths, uiPath+"/*")
+
+		// tokens and sessions are accepted
+		assert.Contains(t, document.Components.SecuritySchemes, openAPISecurityBearer)
+		assert.Equal(t, sessionCookieName, document.Components.SecuritySchemes[openAPISecuritySession].Name)
+		assert.Len(t, document.Security, 2)
+
+		// public routes need no token
+		assert.NotNil(t, document.Paths[issuerTokenPath]["post"].Security)
+		assert.Empty(t, *document.Paths[issuerTokenPath]["post"].Security)
+		assert.NotContains(t, document.Paths[openAPIPath]["get"].Responses, "429")
+
+		// but token requests are limited by address
+		assert.Contains(t, document.Paths[issuerTokenPath]["post"].Responses, "429")
+
+		// error responses of the auth, rate limits and permissions are documented
+		get := document.Paths["/kv/{key}"]["get"]
+		for _, status := range []string{"401", "403", "404", "429", "500"} {
+			assert.Contains(t, get.Responses, status)
+		}
+		assert.Contains(t, get.Description, "read:<key>")
+
+		// pre-signed urls replace the token
+		assert.Contains(t, *get.Security, map[string][]string{})
+	}
+
+	// only the routes served are documented
+	{
+		document := getDocument(newTestRouter(""))
+
+		assert.Contains(t, document.Paths, defaultRouterBasePath)
+		assert.Contains(t, document.Paths, defaultRouterBasePath+"/{key}")
+		assert.Contains(t, document.Paths, openAPIPath)
+		assert.NotContains(t, document.Paths, revocationsPath)
+		assert.NotContains(t, document.Paths, issuerTokenPath)
+
+		assert.Empty(t, document.Security)
+		assert.Empty(t, document.Components.SecuritySchemes)
+		assert.NotContains(t, document.Paths[defaultRouterBasePath+"/{key}"]["get"].Responses, "401")
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	opsHealthPath  = "/health"
+	opsReadyPath   = "/ready"
+	opsConfigPath  = "/config"
+	opsProfilePath = "/debug"
+
+	// readinessTimeout bounds how long a readiness check waits on Redis
+	readinessTimeout = 2 * time.Second
+
+	redactedConfigValue = "[REDACTED]"
+)
+
+// OpsOptions configures the diagnostics served on the ops listener, besides
+// health, readiness and metrics.
+type OpsOptions struct {
+	// Pprof serves the net/http/pprof profiles under /debug/pprof
+	Pprof bool `toml:"pprof"`
+	// ConfigDump serves the running configuration, secrets redacted, at /config
+	ConfigDump bool `toml:"config_dump"`
+}
+
+// NewOpsRouter creates the router of the ops listener. It is meant to be served
+// apart from the API, without its auth, for operators to firewall it independently.
+// ready is called on each readiness check, config is dumped when enabled.
+func NewOpsRouter(options OpsOptions, metrics *Metrics, ready func(context.Context) error, config interface{}) (http.Handler, error) {
+	router := chi.NewRouter()
+	router.Use(middleware.Recoverer)
+
+	router.Get(opsHealthPath, func(w http.ResponseWriter, r *http.Request) {
+		writeOpsStatus(w, r, http.StatusOK, "ok")
+	})
+
+	router.Get(opsReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		if err := ready(ctx); err != nil {
+			loggerFromCtx(r.Context()).Warn("not ready", "reason", err)
+			writeOpsStatus(w, r, http.StatusServiceUnavailable, "unavailable")
+			return
+		}
+
+		writeOpsStatus(w, r, http.StatusOK, "ok")
+	})
+
+	if metrics != nil {
+		router.Handle(metricsPath, metrics.Expose())
+	}
+
+	if options.Pprof {
+		router.Mount(opsProfilePath, middleware.Profiler())
+	}
+
+	if options.ConfigDump {
+		// the config does not change once running
+		dump, err := redactConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		router.Get(opsConfigPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, err := w.Write(dump)
+			if err != nil {
+				loggerFromCtx(r.Context()).Error("error writing response", err)
+				return
+			}
+		})
+	}
+
+	return router, nil
+}
+
+func writeOpsStatus(w http.ResponseWriter, r *http.Request, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(map[string]string{"status": status})
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+// redactConfig encodes config as JSON, keyed as in the config file, with the
+// values of secrets and passwords redacted.
+func redactConfig(config interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		return nil, err
+	}
+
+	var tree map[string]interface{}
+	if _, err := toml.Decode(buf.String(), &tree); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(redactConfigTree(tree), "", "  ")
+}
+
+func redactConfigTree(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			if isSecretConfigKey(k) {
+				value[k] = redactedConfigValue
+				continue
+			}
+			value[k] = redactConfigTree(v)
+		}
+	case []map[string]interface{}:
+		for _, v := range value {
+			redactConfigTree(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = redactConfigTree(v)
+		}
+	}
+	return value
+}
+
+func isSecretConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "secret") || strings.Contains(key, "password") || redactedLogKeys[key]
+}
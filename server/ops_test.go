@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpsRouter(t *testing.T) {
+	var config Config
+	config.Address = ":8000"
+	config.Auth.Enabled = true
+	config.Auth.Issuer.Clients = []IssuerClient{
+		{ClientID: "ci", SecretHash: "$2a$10$abcdef", Permissions: []string{"read:kave:foo"}},
+	}
+	config.Ops.ConfigDump = true
+
+	var readyErr error
+	ready := func(ctx context.Context) error { return readyErr }
+
+	router, err := NewOpsRouter(config.Ops, NewMetrics(), ready, config)
+	assert.NoError(t, err)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	// health does not depend on Redis
+	{
+		readyErr = fmt.Errorf("connection refused")
+
+		recorder := serve(opsHealthPath)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.JSONEq(t, `{"status":"ok"}`, recorder.Body.String())
+	}
+
+	// not ready while Redis is unreachable
+	{
+		recorder := serve(opsReadyPath)
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		assert.JSONEq(t, `{"status":"unavailable"}`, recorder.Body.String())
+
+		readyErr = nil
+
+		recorder = serve(opsReadyPath)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+
+	// metrics are served
+	{
+		recorder := serve(metricsPath)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "go_goroutines")
+	}
+
+	// profiles are not served unless enabled
+	{
+		recorder := serve("/debug/pprof/")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+
+	// the config is dumped as in the config file, secrets redacted
+	{
+		recorder := serve(opsConfigPath)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.NotContains(t, recorder.Body.String(), "$2a$10$abcdef")
+
+		var dump map[string]interface{}
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &dump))
+		assert.Equal(t, ":8000", dump["address"])
+
+		auth := dump["auth"].(map[string]interface{})
+		assert.Equal(t, true, auth["enabled"])
+
+		client := auth["issuer"].(map[string]interface{})["clients"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, "ci", client["client_id"])
+		assert.Equal(t, redactedConfigValue, client["secret_hash"])
+	}
+}
+
+func TestOpsRouterOptions(t *testing.T) {
+	ready := func(ctx context.Context) error { return nil }
+
+	router, err := NewOpsRouter(OpsOptions{Pprof: true}, nil, ready, Config{})
+	assert.NoError(t, err)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	// profiles are served when enabled
+	{
+		recorder := serve("/debug/pprof/")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "goroutine")
+	}
+
+	// the config is not dumped unless enabled
+	{
+		recorder := serve(opsConfigPath)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Option customizes a Server created with New.
+type Option func(*options)
+
+type options struct {
+	redis       *redis.Client
+	keyValue    KeyValue
+	parseToken  ParseTokenFunc
+	middlewares []func(http.Handler) http.Handler
+	routes      []func(chi.Router)
+	metrics     *Metrics
+	reload      <-chan struct{}
+}
+
+// WithRedisClient keeps the state of the server, and the keys unless
+// WithKeyValue is given, in client instead of connecting to the
+// redis_address of the config. The client is not closed with the server.
+func WithRedisClient(client *redis.Client) Option {
+	return func(o *options) {
+		o.redis = client
+	}
+}
+
+// WithKeyValue gets, sets and deletes keys in keyValue instead of Redis.
+// Keys are listed if keyValue is also a KeyLister. Quotas are tracked in
+// Redis along with the keys, so they cannot be enabled with a KeyValue.
+func WithKeyValue(keyValue KeyValue) Option {
+	return func(o *options) {
+		o.keyValue = keyValue
+	}
+}
+
+// WithTokenParser validates tokens with parse instead of the keys of the
+// auth domain, the token issuer or the introspection endpoint of the config.
+// It is used when auth is enabled.
+func WithTokenParser(parse ParseTokenFunc) Option {
+	return func(o *options) {
+		o.parseToken = parse
+	}
+}
+
+// WithMiddleware adds middleware to the routes requiring a token, after auth
+// and rate limiting, so ClaimsFromContext tells who the caller is. The token
+// issuer, login and UI routes are not wrapped.
+func WithMiddleware(middlewares ...func(http.Handler) http.Handler) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithRoutes adds routes alongside the API, requiring a token when auth is
+// enabled and wrapped by the middleware of WithMiddleware. Permissions are
+// not checked, routes can check the permissions of ClaimsFromContext.
+func WithRoutes(routes func(r chi.Router)) Option {
+	return func(o *options) {
+		o.routes = append(o.routes, routes)
+	}
+}
+
+// WithMetrics collects the metrics of requests and authorization decisions,
+// to be served with NewOpsRouter.
+func WithMetrics(metrics *Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithPolicyReload reloads the role policy file of the config whenever
+// reload receives, such as on SIGHUP, besides when the file changes.
+func WithPolicyReload(reload <-chan struct{}) Option {
+	return func(o *options) {
+		o.reload = reload
+	}
+}
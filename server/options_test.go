@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer rdb.Close()
+
+	newTestServer := func(configStr string, opts ...Option) (*Server, error) {
+		var config Config
+		_, err := toml.Decode(configStr, &config)
+		assert.NoError(t, err)
+
+		return New(ctx, config, append([]Option{WithRedisClient(rdb)}, opts...)...)
+	}
+
+	serve := func(s *Server, method string, path string, body []byte, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// keys are kept in the given backend
+	{
+		kv := &memoryKeyValue{values: map[string][]byte{}}
+
+		s, err := newTestServer("", WithKeyValue(kv))
+		assert.NoError(t, err)
+		defer s.Close()
+
+		recorder := serve(s, http.MethodPost, "/redis/foo", []byte("bar"), "")
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		assert.Equal(t, []byte("bar"), kv.values["kave:foo"])
+
+		recorder = serve(s, http.MethodGet, "/redis/foo", nil, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "bar", recorder.Body.String())
+
+		// the backend cannot list keys
+		recorder = serve(s, http.MethodGet, "/redis/", nil, "")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+
+	// quotas are tracked along keys in Redis
+	{
+		_, err := newTestServer(`
+[quotas]
+enabled = true
+`, WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+		assert.Error(t, err)
+	}
+
+	// tokens are validated by the given parser
+	{
+		parse := func(token string) (*Claims, error) {
+			if token != "good" {
+				return nil, errors.New("invalid token")
+			}
+
+			return &Claims{
+				RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"},
+				Permissions:      []string{"read:kave:foo"},
+			}, nil
+		}
+
+		s, err := newTestServer(`
+[auth]
+enabled = true
+`, WithTokenParser(parse), WithKeyValue(&memoryKeyValue{values: map[string][]byte{"kave:foo": []byte("bar")}}))
+		assert.NoError(t, err)
+		defer s.Close()
+
+		recorder := serve(s, http.MethodGet, "/redis/foo", nil, "good")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = serve(s, http.MethodGet, "/redis/foo", nil, "bad")
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		recorder = serve(s, http.MethodPost, "/redis/foo", []byte("baz"), "good")
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	}
+
+	// routes and middleware are added after auth
+	{
+		parse := func(token string) (*Claims, error) {
+			return &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: token}}, nil
+		}
+
+		middleware := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Caller", ClaimsFromContext(r.Context()).Subject)
+				next.ServeHTTP(w, r)
+			})
+		}
+
+		routes := func(r chi.Router) {
+			r.Get("/whoami", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(ClaimsFromContext(r.Context()).Subject))
+			})
+		}
+
+		s, err := newTestServer(`
+[auth]
+enabled = true
+`, WithTokenParser(parse), WithMiddleware(middleware), WithRoutes(routes))
+		assert.NoError(t, err)
+		defer s.Close()
+
+		recorder := serve(s, http.MethodGet, "/whoami", nil, "alice")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "alice", recorder.Body.String())
+		assert.Equal(t, "alice", recorder.Header().Get("X-Caller"))
+
+		// the API goes through the middleware too
+		recorder = serve(s, http.MethodGet, "/health", nil, "bob")
+		assert.Equal(t, "bob", recorder.Header().Get("X-Caller"))
+
+		// routes require a token
+		recorder = serve(s, http.MethodGet, "/whoami", nil, "")
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+}
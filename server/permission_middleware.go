@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/exp/slog"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+type PermissionMiddleware struct {
+	keyPrefix          string
+	syntax             policy.Syntax
+	policies           *policy.Cache
+	keyFromCtx         func(context.Context) string
+	permissionsFromCtx func(context.Context) []string
+	claimsFromCtx      func(context.Context) *Claims
+	observeDecision    func(operation string, allowed bool)
+}
+
+func NewPermissionMiddleware(
+	keyPrefix string,
+	syntax policy.Syntax,
+	keyFromCtx func(context.Context) string,
+	permissionsFromCtx func(context.Context) []string,
+	claimsFromCtx func(context.Context) *Claims,
+) PermissionMiddleware {
+	return PermissionMiddleware{
+		keyPrefix:          keyPrefix,
+		syntax:             syntax,
+		policies:           policy.NewCache(syntax, policy.DefaultCacheSize),
+		keyFromCtx:         keyFromCtx,
+		permissionsFromCtx: permissionsFromCtx,
+		claimsFromCtx:      claimsFromCtx,
+	}
+}
+
+const (
+	operationRead  = "read"
+	operationWrite = "write"
+)
+
+// operationForMethod returns the operation required by an HTTP method.
+func operationForMethod(method string) (string, bool) {
+	switch method {
+	case http.MethodGet:
+		return operationRead, true
+	case http.MethodPost, http.MethodDelete:
+		return operationWrite, true
+	default:
+		return "", false
+	}
+}
+
+// PermissionCheck explains how access to a key was decided.
+type PermissionCheck struct {
+	Allowed     bool     `json:"allowed"`
+	Required    string   `json:"required"`
+	Permissions []string `json:"permissions"`
+	Matched     string   `json:"matched,omitempty"`
+	DeniedBy    string   `json:"denied_by,omitempty"`
+	Invalid     []string `json:"invalid,omitempty"`
+	Reason      string   `json:"reason"`
+}
+
+// policyFor returns the compiled policy for a caller's permissions.
+func (p PermissionMiddleware) policyFor(permissions []string) *policy.Policy {
+	compiled, cached := p.policies.Get(permissions)
+	if !cached {
+		for _, pattern := range compiled.Invalid() {
+			slog.Warn("failed to compile pattern", "pattern", pattern)
+		}
+	}
+	return compiled
+}
+
+// callerPolicy returns the compiled policy of the caller in ctx, and its
+// permissions once templates are expanded with its claims. Callers checking
+// many keys, such as listed keys, resolve it once and evaluate each key on it.
+func (p PermissionMiddleware) callerPolicy(ctx context.Context) (*policy.Policy, []string) {
+	permissions := expandPermissionTemplates(
+		p.permissionsFromCtx(ctx),
+		p.claimsFromCtx(ctx),
+		p.syntax,
+	)
+
+	return p.policyFor(permissions), permissions
+}
+
+// requiredPermission returns the permission required to perform operation on key.
+func (p PermissionMiddleware) requiredPermission(operation string, key string) string {
+	return operation + ":" + p.keyPrefix + key
+}
+
+// allowed returns whether compiled, the policy of a caller, allows operation on key.
+func (p PermissionMiddleware) allowed(compiled *policy.Policy, operation string, key string) bool {
+	return compiled.Allowed(p.requiredPermission(operation, key))
+}
+
+// Allowed returns whether the caller in ctx may perform operation on key,
+// without explaining the decision as Check does.
+func (p PermissionMiddleware) Allowed(ctx context.Context, operation string, key string) bool {
+	compiled, _ := p.callerPolicy(ctx)
+	return p.allowed(compiled, operation, key)
+}
+
+// Check decides whether the caller in ctx may perform operation on key,
+// explaining the decision.
+func (p PermissionMiddleware) Check(ctx context.Context, operation string, key string) PermissionCheck {
+	return p.CheckPermission(ctx, p.requiredPermission(operation, key))
+}
+
+// CheckPermission decides whether the caller in ctx holds the required
+// permission, explaining the decision.
+func (p PermissionMiddleware) CheckPermission(ctx context.Context, required string) PermissionCheck {
+	compiled, permissions := p.callerPolicy(ctx)
+	decision := compiled.Evaluate(required)
+
+	check := PermissionCheck{
+		Allowed:     decision.Allowed,
+		Required:    required,
+		Permissions: permissions,
+		Matched:     decision.Matched,
+		DeniedBy:    decision.DeniedBy,
+		Invalid:     compiled.Invalid(),
+	}
+
+	switch {
+	case decision.Allowed:
+		check.Reason = fmt.Sprintf("granted by '%s'", decision.Matched)
+	case decision.DeniedBy != "":
+		check.Reason = fmt.Sprintf("denied by '%s%s'", policy.DenyPrefix, decision.DeniedBy)
+	case len(permissions) == 0:
+		check.Reason = "caller has no permissions"
+	default:
+		check.Reason = "no permission matches"
+	}
+
+	return check
+}
+
+// ObserveDecisions calls observe with the operation of every request checked,
+// such as "read" or "admin", and whether it was allowed.
+// It must be called before the middleware is used.
+func (p *PermissionMiddleware) ObserveDecisions(observe func(operation string, allowed bool)) {
+	p.observeDecision = observe
+}
+
+// decide checks whether compiled, the policy of the caller in ctx, holds the
+// required permission to perform operation, tracing and observing the decision.
+func (p PermissionMiddleware) decide(ctx context.Context, compiled *policy.Policy, operation string, required string) bool {
+	_, span := tracer().Start(ctx, "PermissionMiddleware")
+	defer span.End()
+
+	allowed := compiled.Allowed(required)
+
+	span.SetAttributes(
+		attribute.String("kave.operation", operation),
+		attribute.String("kave.permission", required),
+		attribute.Bool("kave.allowed", allowed),
+	)
+
+	if p.observeDecision != nil {
+		p.observeDecision(operation, allowed)
+	}
+
+	return allowed
+}
+
+func (p PermissionMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// get key from context
+		key := p.keyFromCtx(r.Context())
+
+		operation, ok := operationForMethod(r.Method)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		compiled, _ := p.callerPolicy(r.Context())
+		if !p.decide(r.Context(), compiled, operation, p.requiredPermission(operation, key)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require only lets through callers holding the required permission,
+// such as an admin permission not tied to a key.
+func (p PermissionMiddleware) Require(required string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			compiled, _ := p.callerPolicy(r.Context())
+			if !p.decide(r.Context(), compiled, strings.SplitN(required, ":", 2)[0], required) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+func TestPermissionMiddleware(t *testing.T) {
+	// test a forbidden request
+	{
+		ctx := context.Background()
+
+		pm := NewPermissionMiddleware(
+			"prefix:",
+			policy.SyntaxRegex,
+			func(ctx context.Context) string {
+				return "foo"
+			},
+			func(ctx context.Context) []string {
+				return []string{"read:nothing"}
+			},
+			readClaimsFromCtx,
+		)
+
+		handler := pm.Handler(nil)
+
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost:8080", nil)
+
+		handler.ServeHTTP(
+			&mockResponseWriter{
+				t:            t,
+				expectedCode: http.StatusForbidden,
+			},
+			request,
+		)
+	}
+
+	// test a request with unhandled method
+	{
+		ctx := context.Background()
+
+		pm := NewPermissionMiddleware(
+			"prefix:",
+			policy.SyntaxRegex,
+			func(ctx context.Context) string {
+				return "foo"
+			},
+			func(ctx context.Context) []string {
+				return []string{"read:nothing"}
+			},
+			readClaimsFromCtx,
+		)
+
+		handler := pm.Handler(nil)
+
+		request, _ := http.NewRequestWithContext(ctx, http.MethodDelete, "http://localhost:8080", nil)
+
+		handler.ServeHTTP(
+			&mockResponseWriter{
+				t:            t,
+				expectedCode: http.StatusForbidden,
+			},
+			request,
+		)
+	}
+
+	// test a request with allowed permissions
+	{
+		ctx := context.Background()
+
+		pm := NewPermissionMiddleware(
+			"prefix:",
+			policy.SyntaxRegex,
+			func(ctx context.Context) string {
+				return "foo"
+			},
+			func(ctx context.Context) []string {
+				return []string{"read:*"}
+			},
+			readClaimsFromCtx,
+		)
+
+		wasCalled := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wasCalled = true
+		})
+
+		handler := pm.Handler(next)
+
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost:8080", nil)
+
+		handler.ServeHTTP(
+			&mockResponseWriter{
+				t:            t,
+				expectedCode: http.StatusForbidden,
+			},
+			request,
+		)
+
+		assert.True(t, wasCalled)
+	}
+}
+
+func TestPermissionMiddlewarePatterns(t *testing.T) {
+	tests := []struct {
+		name        string
+		syntax      policy.Syntax
+		method      string
+		key         string
+		permissions []string
+		allowed     bool
+	}{
+		{"exact read", policy.SyntaxGlob, http.MethodGet, "foo", []string{"read:kave:foo"}, true},
+		{"exact write", policy.SyntaxGlob, http.MethodPost, "foo", []string{"write:kave:foo"}, true},
+		{"read does not grant write", policy.SyntaxGlob, http.MethodPost, "foo", []string{"read:kave:foo"}, false},
+		{"anchored at the end", policy.SyntaxGlob, http.MethodGet, "foobar", []string{"read:kave:foo"}, false},
+		{"anchored at the start", policy.SyntaxGlob, http.MethodGet, "foo", []string{"kave:foo"}, false},
+		{"no partial prefix match", policy.SyntaxGlob, http.MethodGet, "foo", []string{"ead:kave:foo"}, false},
+		{"metacharacters are literal", policy.SyntaxGlob, http.MethodGet, "fooo", []string{"read:kave:fo+"}, false},
+		{"metacharacters match themselves", policy.SyntaxGlob, http.MethodGet, "fo+", []string{"read:kave:fo+"}, true},
+		{"dot is literal", policy.SyntaxGlob, http.MethodGet, "aXb", []string{"read:kave:a.b"}, false},
+		{"star matches one segment", policy.SyntaxGlob, http.MethodGet, "team:foo", []string{"read:kave:team:*"}, true},
+		{"star does not cross segments", policy.SyntaxGlob, http.MethodGet, "team:foo:bar", []string{"read:kave:team:*"}, false},
+		{"star within a segment", policy.SyntaxGlob, http.MethodGet, "team:foo-1", []string{"read:kave:team:foo-*"}, true},
+		{"double star crosses segments", policy.SyntaxGlob, http.MethodGet, "team:foo:bar", []string{"read:kave:team:**"}, true},
+		{"double star in the middle", policy.SyntaxGlob, http.MethodGet, "team:a:b:public", []string{"read:kave:team:**:public"}, true},
+		{"star as operation", policy.SyntaxGlob, http.MethodPost, "foo", []string{"*:kave:foo"}, true},
+		{"star does not match other prefix", policy.SyntaxGlob, http.MethodGet, "foo", []string{"read:xkave:*"}, false},
+		{"deny takes precedence", policy.SyntaxGlob, http.MethodGet, "team:secret", []string{"read:kave:team:*", "deny:read:kave:team:secret"}, false},
+		{"deny before grant", policy.SyntaxGlob, http.MethodGet, "team:secret", []string{"deny:read:kave:team:secret", "read:kave:**"}, false},
+		{"deny other key", policy.SyntaxGlob, http.MethodGet, "team:public", []string{"read:kave:team:*", "deny:read:kave:team:secret"}, true},
+		{"deny with glob", policy.SyntaxGlob, http.MethodPost, "team:a:b", []string{"write:kave:**", "deny:write:kave:team:**"}, false},
+		{"deny alone grants nothing", policy.SyntaxGlob, http.MethodGet, "foo", []string{"deny:read:kave:bar"}, false},
+		{"regex is unanchored", policy.SyntaxRegex, http.MethodGet, "foobar", []string{"read:kave:foo"}, true},
+		{"regex metacharacters", policy.SyntaxRegex, http.MethodGet, "fooo", []string{"read:kave:fo+$"}, true},
+		{"regex deny", policy.SyntaxRegex, http.MethodGet, "secret", []string{"read:.*", "deny:read:kave:secret"}, false},
+		{"invalid regex", policy.SyntaxRegex, http.MethodGet, "foo", []string{"read:kave:(foo"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm := NewPermissionMiddleware(
+				"kave:",
+				test.syntax,
+				func(ctx context.Context) string {
+					return test.key
+				},
+				func(ctx context.Context) []string {
+					return test.permissions
+				},
+				readClaimsFromCtx,
+			)
+
+			wasCalled := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wasCalled = true
+			})
+
+			request := httptest.NewRequest(test.method, "http://localhost:8080", nil)
+			recorder := httptest.NewRecorder()
+
+			pm.Handler(next).ServeHTTP(recorder, request)
+
+			assert.Equal(t, test.allowed, wasCalled)
+			if !test.allowed {
+				assert.Equal(t, http.StatusForbidden, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestPermissionMiddlewareTemplates(t *testing.T) {
+	claims := `{"sub":"auth0|alice","azp":"ci","org_id":"acme","seats":42,"bad":"a:*","roles":["x"]}`
+
+	tests := []struct {
+		name        string
+		syntax      policy.Syntax
+		key         string
+		permissions []string
+		allowed     bool
+	}{
+		{"subject", policy.SyntaxGlob, "users:auth0|alice:notes", []string{"read:kave:users:{sub}:*"}, true},
+		{"other subject", policy.SyntaxGlob, "users:auth0|bob:notes", []string{"read:kave:users:{sub}:*"}, false},
+		{"client", policy.SyntaxGlob, "clients:ci", []string{"read:kave:clients:{client}"}, true},
+		{"claim", policy.SyntaxGlob, "tenants:acme:config", []string{"read:kave:tenants:{claims.org_id}:*"}, true},
+		{"claim other tenant", policy.SyntaxGlob, "tenants:other:config", []string{"read:kave:tenants:{claims.org_id}:*"}, false},
+		{"numeric claim", policy.SyntaxGlob, "seats:42", []string{"read:kave:seats:{claims.seats}"}, true},
+		{"missing claim", policy.SyntaxGlob, "tenants::config", []string{"read:kave:tenants:{claims.missing}:*"}, false},
+		{"claim with wildcard", policy.SyntaxGlob, "tenants:a:x:config", []string{"read:kave:tenants:{claims.bad}:**"}, false},
+		{"non string claim", policy.SyntaxGlob, "roles:x", []string{"read:kave:roles:{claims.roles}"}, false},
+		{"deny template", policy.SyntaxGlob, "tenants:acme:secret", []string{"read:kave:tenants:**", "deny:read:kave:tenants:{claims.org_id}:secret"}, false},
+		{"unresolved deny matches any value", policy.SyntaxGlob, "tenants:acme:secret", []string{"read:kave:tenants:**", "deny:read:kave:tenants:{claims.missing}:secret"}, false},
+		{"regex claim is quoted", policy.SyntaxRegex, "tenants:acme:config", []string{"read:kave:tenants:{claims.org_id}:.*"}, true},
+		{"regex quantifier is kept", policy.SyntaxRegex, "aa", []string{"read:kave:a{2}$"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm := NewPermissionMiddleware(
+				"kave:",
+				test.syntax,
+				func(ctx context.Context) string {
+					return test.key
+				},
+				func(ctx context.Context) []string {
+					return test.permissions
+				},
+				func(ctx context.Context) *Claims {
+					return parseTestClaims(t, claims)
+				},
+			)
+
+			wasCalled := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wasCalled = true
+			})
+
+			request := httptest.NewRequest(http.MethodGet, "http://localhost:8080", nil)
+			recorder := httptest.NewRecorder()
+
+			pm.Handler(next).ServeHTTP(recorder, request)
+
+			assert.Equal(t, test.allowed, wasCalled)
+
+			// keys are decided alike without explaining the decision
+			assert.Equal(t, test.allowed, pm.Allowed(request.Context(), operationRead, test.key))
+			assert.Equal(t, test.allowed, pm.Check(request.Context(), operationRead, test.key).Allowed)
+		})
+	}
+}
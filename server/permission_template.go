@@ -0,0 +1,156 @@
+package server
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+const (
+	templateClaimPrefix = "claims."
+	templateSubject     = "sub"
+	templateClient      = "client"
+)
+
+// isPermissionTemplate reports whether a permission holds placeholders.
+func isPermissionTemplate(permission string) bool {
+	return strings.Contains(permission, "{")
+}
+
+// expandPermissionTemplates replaces placeholders in permissions with values
+// from the token claims:
+//
+//   - {sub} is the token subject
+//   - {client} is the client the token was issued to
+//   - {claims.<name>} is any string or numeric claim
+//
+// Values holding separators, wildcards or braces are rejected, so a claim can
+// never widen a permission beyond a single segment. A grant whose placeholders
+// cannot be resolved is dropped, while such a deny matches any value instead.
+func expandPermissionTemplates(
+	permissions []string,
+	claims *Claims,
+	syntax policy.Syntax,
+) []string {
+	expanded := permissions
+	copied := false
+
+	for i, permission := range permissions {
+		if !isPermissionTemplate(permission) {
+			if copied {
+				expanded = append(expanded, permission)
+			}
+			continue
+		}
+
+		if !copied {
+			expanded = make([]string, i, len(permissions))
+			copy(expanded, permissions[:i])
+			copied = true
+		}
+
+		deny := strings.HasPrefix(permission, policy.DenyPrefix)
+
+		result, ok := expandPermissionTemplate(permission, claims, syntax, deny)
+		if !ok {
+			continue
+		}
+
+		expanded = append(expanded, result)
+	}
+
+	return expanded
+}
+
+func expandPermissionTemplate(
+	permission string,
+	claims *Claims,
+	syntax policy.Syntax,
+	deny bool,
+) (string, bool) {
+	var b strings.Builder
+
+	rest := permission
+	for {
+		start := strings.Index(rest, "{")
+		if start == -1 {
+			b.WriteString(rest)
+			return b.String(), true
+		}
+
+		end := strings.Index(rest[start:], "}")
+		if end == -1 {
+			b.WriteString(rest)
+			return b.String(), true
+		}
+		end += start
+
+		// braces not holding a placeholder are kept, e.g. regexp quantifiers
+		name := rest[start+1 : end]
+		if !isTemplateName(name) {
+			b.WriteString(rest[:end+1])
+			rest = rest[end+1:]
+			continue
+		}
+
+		b.WriteString(rest[:start])
+
+		value, ok := templateValue(name, claims)
+		switch {
+		case ok && syntax == policy.SyntaxRegex:
+			b.WriteString(regexp.QuoteMeta(value))
+		case ok:
+			b.WriteString(value)
+		case deny && syntax == policy.SyntaxRegex:
+			b.WriteString("[^" + policy.Separator + "]*")
+		case deny:
+			b.WriteString("*")
+		default:
+			return "", false
+		}
+
+		rest = rest[end+1:]
+	}
+}
+
+func isTemplateName(name string) bool {
+	return name == templateSubject ||
+		name == templateClient ||
+		strings.HasPrefix(name, templateClaimPrefix)
+}
+
+// templateValue resolves a placeholder name into a single segment value.
+func templateValue(name string, claims *Claims) (string, bool) {
+	var value string
+
+	switch {
+	case name == templateSubject:
+		value = claims.Subject
+	case name == templateClient:
+		value = claims.Client()
+	case strings.HasPrefix(name, templateClaimPrefix):
+		claim, ok := claims.Claim(strings.TrimPrefix(name, templateClaimPrefix))
+		if !ok {
+			return "", false
+		}
+
+		switch v := claim.(type) {
+		case string:
+			value = v
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	if value == "" || strings.ContainsAny(value, policy.Separator+"*{}") {
+		return "", false
+	}
+
+	return value, true
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+func TestExpandPermissionTemplates(t *testing.T) {
+	claims := parseTestClaims(t, `{"sub":"auth0|alice","org_id":"acme.io"}`)
+
+	// permissions without templates are returned as is
+	{
+		permissions := []string{"read:kave:foo", "write:kave:bar"}
+		assert.Equal(t, permissions, expandPermissionTemplates(permissions, claims, policy.SyntaxGlob))
+	}
+
+	// templates are expanded in place and unresolved grants dropped
+	{
+		permissions := []string{"read:kave:foo", "read:kave:{claims.missing}", "read:kave:{sub}:{claims.org_id}", "write:kave:bar"}
+		assert.Equal(
+			t,
+			[]string{"read:kave:foo", "read:kave:auth0|alice:acme.io", "write:kave:bar"},
+			expandPermissionTemplates(permissions, claims, policy.SyntaxGlob),
+		)
+		// input is not modified
+		assert.Equal(t, "read:kave:{claims.missing}", permissions[1])
+	}
+
+	// unresolved denies match any value of the segment
+	{
+		permissions := []string{"deny:read:kave:{claims.missing}:secret"}
+		assert.Equal(t, []string{"deny:read:kave:*:secret"}, expandPermissionTemplates(permissions, claims, policy.SyntaxGlob))
+		assert.Equal(t, []string{"deny:read:kave:[^:]*:secret"}, expandPermissionTemplates(permissions, claims, policy.SyntaxRegex))
+	}
+
+	// values are quoted for regex syntax
+	{
+		permissions := []string{"read:kave:{claims.org_id}:.*"}
+		assert.Equal(t, []string{`read:kave:acme\.io:.*`}, expandPermissionTemplates(permissions, claims, policy.SyntaxRegex))
+	}
+
+	// unknown placeholders and unterminated braces are kept
+	{
+		permissions := []string{"read:kave:{other}", "read:kave:{sub"}
+		assert.Equal(t, permissions, expandPermissionTemplates(permissions, claims, policy.SyntaxGlob))
+	}
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	presignPath             = "/_presign"
+	defaultPresignMaxExpiry = time.Hour
+	minPresignSecretLength  = 32
+
+	presignParamOperation = "kave_op"
+	presignParamExpires   = "kave_exp"
+	presignParamNonce     = "kave_nonce"
+	presignParamSignature = "kave_sig"
+)
+
+// nonceStore keeps the nonces of single-use urls.
+type nonceStore interface {
+	Add(ctx context.Context, nonce string, ttl time.Duration) error
+	Consume(ctx context.Context, nonce string) (bool, error)
+}
+
+// presignMethods holds the only method allowed by the urls of each operation.
+// Deletes require the write permission but cannot be pre-signed, so that a
+// url letting a job upload a key does not also let it delete the key.
+var presignMethods = map[string]string{
+	operationRead:  http.MethodGet,
+	operationWrite: http.MethodPost,
+}
+
+// presignedGrant is the access granted by a verified pre-signed url.
+type presignedGrant struct {
+	operation string
+	key       string
+}
+
+type presignedGrantKey struct{}
+
+func readPresignedGrantFromCtx(ctx context.Context) (presignedGrant, bool) {
+	grant, ok := ctx.Value(presignedGrantKey{}).(presignedGrant)
+	return grant, ok
+}
+
+func writePresignedGrantToCtx(ctx context.Context, grant presignedGrant) context.Context {
+	return context.WithValue(ctx, presignedGrantKey{}, grant)
+}
+
+// Presigner mints and verifies HMAC signed urls granting one operation
+// on one key until they expire, without a bearer token.
+type Presigner struct {
+	secret     []byte
+	basePath   string
+	maxExpiry  time.Duration
+	nonces     nonceStore
+	keyFromCtx func(context.Context) string
+	now        func() time.Time
+}
+
+func NewPresigner(
+	secret []byte,
+	basePath string,
+	maxExpiry time.Duration,
+	nonces nonceStore,
+	keyFromCtx func(context.Context) string,
+) (*Presigner, error) {
+	if len(secret) < minPresignSecretLength {
+		return nil, fmt.Errorf("presign secret must have at least %d bytes", minPresignSecretLength)
+	}
+
+	if maxExpiry == 0 {
+		maxExpiry = defaultPresignMaxExpiry
+	}
+
+	return &Presigner{
+		secret:     secret,
+		basePath:   strings.TrimSuffix(basePath, "/"),
+		maxExpiry:  maxExpiry,
+		nonces:     nonces,
+		keyFromCtx: keyFromCtx,
+		now:        time.Now,
+	}, nil
+}
+
+func (p *Presigner) signature(operation, key string, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	fmt.Fprintf(mac, "v1\n%s\n%s\n%d\n%s", operation, key, expires, nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the path and query of a url granting operation on key until expires.
+func (p *Presigner) Sign(operation, key string, expires time.Time, nonce string) (string, error) {
+	path := fmt.Sprintf("%s/%s", p.basePath, url.PathEscape(key))
+
+	routed, err := p.routedKey(path)
+	if err != nil {
+		return "", err
+	}
+
+	exp := expires.Unix()
+
+	query := url.Values{}
+	query.Set(presignParamOperation, operation)
+	query.Set(presignParamExpires, strconv.FormatInt(exp, 10))
+	if nonce != "" {
+		query.Set(presignParamNonce, nonce)
+	}
+	query.Set(presignParamSignature, p.signature(operation, routed, exp, nonce))
+
+	return path + "?" + query.Encode(), nil
+}
+
+// RoutedKey returns key as seen by the router once requested.
+func (p *Presigner) RoutedKey(key string) (string, error) {
+	return p.routedKey(fmt.Sprintf("%s/%s", p.basePath, url.PathEscape(key)))
+}
+
+func (p *Presigner) routedKey(path string) (string, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := p.keyFromURL(u)
+	if !ok {
+		return "", fmt.Errorf("invalid key")
+	}
+
+	return key, nil
+}
+
+// keyFromURL extracts the key from a url path the same way the router does.
+func (p *Presigner) keyFromURL(u *url.URL) (string, bool) {
+	path := u.RawPath
+	if path == "" {
+		path = u.Path
+	}
+
+	key := strings.TrimSuffix(strings.TrimPrefix(path, p.basePath+"/"), "/")
+	if key == path || key == "" || strings.Contains(key, "/") {
+		return "", false
+	}
+
+	return key, true
+}
+
+// verify checks the signature of a request, returning the access it grants.
+func (p *Presigner) verify(r *http.Request) (presignedGrant, error) {
+	query := r.URL.Query()
+	operation := query.Get(presignParamOperation)
+	nonce := query.Get(presignParamNonce)
+
+	expires, err := strconv.ParseInt(query.Get(presignParamExpires), 10, 64)
+	if err != nil {
+		return presignedGrant{}, fmt.Errorf("invalid expiry")
+	}
+
+	key, ok := p.keyFromURL(r.URL)
+	if !ok {
+		return presignedGrant{}, fmt.Errorf("path is not a key")
+	}
+
+	expected := p.signature(operation, key, expires, nonce)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(presignParamSignature))) {
+		return presignedGrant{}, fmt.Errorf("invalid signature")
+	}
+
+	if p.now().Unix() > expires {
+		return presignedGrant{}, fmt.Errorf("url expired")
+	}
+
+	if method, ok := presignMethods[operation]; !ok || r.Method != method {
+		return presignedGrant{}, fmt.Errorf("method not allowed by url")
+	}
+
+	if nonce != "" {
+		ok, err := p.nonces.Consume(r.Context(), nonce)
+		if err != nil {
+			return presignedGrant{}, err
+		}
+		if !ok {
+			return presignedGrant{}, fmt.Errorf("url already used")
+		}
+	}
+
+	return presignedGrant{operation: operation, key: key}, nil
+}
+
+// Handler verifies pre-signed requests, it must be placed before the AuthMiddleware.
+// Requests without a signature are passed on unchanged.
+func (p *Presigner) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.Query().Has(presignParamSignature) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		grant, err := p.verify(r)
+		if err != nil {
+			loggerFromCtx(r.Context()).Warn("rejected pre-signed url", "reason", err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(writePresignedGrantToCtx(r.Context(), grant)))
+	})
+}
+
+// SkipIfPresigned bypasses middleware, such as the AuthMiddleware, for pre-signed requests.
+func (p *Presigner) SkipIfPresigned(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		handler := middleware(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := readPresignedGrantFromCtx(r.Context()); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Authorize replaces the permission check of pre-signed requests by the access
+// granted in the url, delegating the remaining requests to middleware.
+func (p *Presigner) Authorize(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		handler := middleware(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			grant, ok := readPresignedGrantFromCtx(r.Context())
+			if !ok {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			if grant.key != p.keyFromCtx(r.Context()) || r.Method != presignMethods[grant.operation] {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PresignHandler mints pre-signed urls for authenticated callers.
+type PresignHandler struct {
+	presigner   *Presigner
+	permissions PermissionMiddleware
+}
+
+func NewPresignHandler(presigner *Presigner, permissions PermissionMiddleware) *PresignHandler {
+	return &PresignHandler{
+		presigner:   presigner,
+		permissions: permissions,
+	}
+}
+
+type presignRequest struct {
+	Key       string `json:"key"`
+	Operation string `json:"operation"`
+	// ExpiresIn is a duration such as "10m"
+	ExpiresIn string `json:"expires_in"`
+	SingleUse bool   `json:"single_use"`
+}
+
+type presignResponse struct {
+	Url       string    `json:"url"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Mint creates a pre-signed url, the caller must be allowed the operation on the key.
+func (h *PresignHandler) Mint(w http.ResponseWriter, r *http.Request) {
+	var req presignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Operation != operationRead && req.Operation != operationWrite {
+		http.Error(w, "operation must be read or write", http.StatusBadRequest)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "key must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	expiresIn, err := time.ParseDuration(req.ExpiresIn)
+	if err != nil || expiresIn <= 0 {
+		http.Error(w, "expires_in must be a positive duration", http.StatusBadRequest)
+		return
+	}
+
+	if expiresIn > h.presigner.maxExpiry {
+		http.Error(w, fmt.Sprintf("expires_in must not exceed %s", h.presigner.maxExpiry), http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.presigner.RoutedKey(req.Key)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	if !h.permissions.Allowed(r.Context(), req.Operation, key) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var nonce string
+	if req.SingleUse {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			loggerFromCtx(r.Context()).Error("error generating nonce", err)
+			return
+		}
+		nonce = base64.RawURLEncoding.EncodeToString(buf)
+
+		// keep the nonce slightly longer than the url is valid
+		if err := h.presigner.nonces.Add(r.Context(), nonce, expiresIn+time.Minute); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			loggerFromCtx(r.Context()).Error("error storing nonce", err)
+			return
+		}
+	}
+
+	expiresAt := h.presigner.now().Add(expiresIn).Truncate(time.Second)
+	path, err := h.presigner.Sign(req.Operation, req.Key, expiresAt, nonce)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(w).Encode(presignResponse{
+		Url:       fmt.Sprintf("%s://%s%s", scheme, r.Host, path),
+		Path:      path,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+type memoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]bool
+}
+
+func (s *memoryNonceStore) Add(ctx context.Context, nonce string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonces[nonce] = true
+	return nil
+}
+
+func (s *memoryNonceStore) Consume(ctx context.Context, nonce string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok, nil
+}
+
+// newPresignTestRouter mirrors the routes of a server with presign enabled,
+// with an auth middleware rejecting every request.
+func newPresignTestRouter(presigner *Presigner, permissions []string) http.Handler {
+	pm := NewPermissionMiddleware(
+		"kave:",
+		policy.SyntaxGlob,
+		readKeyFromCtx,
+		func(ctx context.Context) []string {
+			return permissions
+		},
+		readClaimsFromCtx,
+	)
+
+	rejectAll := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+
+	router := chi.NewRouter()
+	router.Use(presigner.Handler)
+	router.Use(presigner.SkipIfPresigned(rejectAll))
+	router.Route(defaultRouterBasePath, func(r chi.Router) {
+		r.Route("/{key}", func(r chi.Router) {
+			r.Use(injectKeyInCtx)
+			r.Use(presigner.Authorize(pm.Handler))
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(readKeyFromCtx(r.Context())))
+			})
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+			})
+			r.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+		})
+	})
+
+	return router
+}
+
+func newTestPresigner(t *testing.T) *Presigner {
+	presigner, err := NewPresigner(
+		[]byte(strings.Repeat("s", minPresignSecretLength)),
+		defaultRouterBasePath,
+		0,
+		&memoryNonceStore{nonces: make(map[string]bool)},
+		readKeyFromCtx,
+	)
+	assert.NoError(t, err)
+	return presigner
+}
+
+func TestPresigner(t *testing.T) {
+	presigner := newTestPresigner(t)
+	router := newPresignTestRouter(presigner, nil)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	expires := time.Now().Add(10 * time.Minute)
+
+	// read a key with a pre-signed url
+	{
+		path, err := presigner.Sign(operationRead, "foo", expires, "")
+		assert.NoError(t, err)
+
+		recorder := serve(http.MethodGet, path)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "foo", recorder.Body.String())
+
+		// url can be reused without a nonce
+		assert.Equal(t, http.StatusOK, serve(http.MethodGet, path).Code)
+
+		// url does not grant writes
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, path).Code)
+	}
+
+	// keys are signed as seen by the router
+	{
+		path, err := presigner.Sign(operationRead, "a/b c", expires, "")
+		assert.NoError(t, err)
+
+		recorder := serve(http.MethodGet, path)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "a%2Fb%20c", recorder.Body.String())
+	}
+
+	// url is bound to its key
+	{
+		path, err := presigner.Sign(operationRead, "foo", expires, "")
+		assert.NoError(t, err)
+
+		other := strings.Replace(path, "/foo?", "/bar?", 1)
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, other).Code)
+	}
+
+	// tampered expiry
+	{
+		path, err := presigner.Sign(operationRead, "foo", expires, "")
+		assert.NoError(t, err)
+
+		tampered := strings.Replace(path, presignParamExpires+"=", presignParamExpires+"=9", 1)
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, tampered).Code)
+	}
+
+	// expired url
+	{
+		path, err := presigner.Sign(operationRead, "foo", time.Now().Add(-time.Minute), "")
+		assert.NoError(t, err)
+
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, path).Code)
+	}
+
+	// single use url
+	{
+		assert.NoError(t, presigner.nonces.Add(context.Background(), "nonce", time.Minute))
+
+		path, err := presigner.Sign(operationWrite, "foo", expires, "nonce")
+		assert.NoError(t, err)
+
+		assert.Equal(t, http.StatusCreated, serve(http.MethodPost, path).Code)
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, path).Code)
+	}
+
+	// urls to write a key do not delete it, although deletes require the write permission
+	{
+		path, err := presigner.Sign(operationWrite, "foo", expires, "")
+		assert.NoError(t, err)
+
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodDelete, path).Code)
+		assert.Equal(t, http.StatusCreated, serve(http.MethodPost, path).Code)
+
+		path, err = presigner.Sign(operationRead, "foo", expires, "")
+		assert.NoError(t, err)
+
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodDelete, path).Code)
+	}
+
+	// requests without signature go through auth
+	{
+		assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, defaultRouterBasePath+"/foo").Code)
+	}
+
+	// signatures outside of keys are rejected
+	{
+		path, err := presigner.Sign(operationRead, "foo", expires, "")
+		assert.NoError(t, err)
+
+		query := path[strings.Index(path, "?"):]
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, defaultHealthPath+query).Code)
+	}
+}
+
+func TestNewPresignerShortSecret(t *testing.T) {
+	_, err := NewPresigner([]byte("short"), defaultRouterBasePath, 0, nil, readKeyFromCtx)
+	assert.Error(t, err)
+}
+
+func TestPresignHandlerMint(t *testing.T) {
+	presigner := newTestPresigner(t)
+
+	pm := NewPermissionMiddleware(
+		"kave:",
+		policy.SyntaxGlob,
+		readKeyFromCtx,
+		func(ctx context.Context) []string {
+			return []string{"read:kave:ci:*"}
+		},
+		readClaimsFromCtx,
+	)
+
+	handler := NewPresignHandler(presigner, pm)
+
+	mint := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, presignPath, bytes.NewBufferString(body))
+		recorder := httptest.NewRecorder()
+		handler.Mint(recorder, request)
+		return recorder
+	}
+
+	// mint a single use url for an allowed key
+	{
+		recorder := mint(`{"key":"ci:artifact","operation":"read","expires_in":"10m","single_use":true}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var response presignResponse
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+		assert.True(t, strings.HasPrefix(response.Path, defaultRouterBasePath+"/ci:artifact?"))
+		assert.Contains(t, response.Path, presignParamNonce+"=")
+		assert.Equal(t, "http://example.com"+response.Path, response.Url)
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), response.ExpiresAt, 2*time.Second)
+
+		// the url is valid
+		router := newPresignTestRouter(presigner, nil)
+		served := httptest.NewRecorder()
+		router.ServeHTTP(served, httptest.NewRequest(http.MethodGet, response.Path, nil))
+		assert.Equal(t, http.StatusOK, served.Code)
+	}
+
+	// caller is not allowed the operation
+	{
+		recorder := mint(`{"key":"ci:artifact","operation":"write","expires_in":"10m"}`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	}
+
+	// expiry above the maximum
+	{
+		recorder := mint(`{"key":"ci:artifact","operation":"read","expires_in":"2h"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+
+	// invalid expiry
+	{
+		recorder := mint(`{"key":"ci:artifact","operation":"read","expires_in":"soon"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	quotaPath            = "/_quota"
+	adminQuotasPath      = "/_admin/quotas"
+	permissionAdminQuota = "admin:quotas"
+
+	defaultQuotaRefresh = 5 * time.Second
+
+	quotaSourceConfig = "config"
+	quotaSourceAdmin  = "admin"
+
+	quotaResourceKeys  = "keys"
+	quotaResourceBytes = "bytes"
+)
+
+// Quota caps the number of keys and the total bytes of the values under a key prefix.
+// A zero maximum is unlimited.
+type Quota struct {
+	Prefix   string `toml:"prefix" json:"prefix"`
+	MaxKeys  int64  `toml:"max_keys" json:"max_keys"`
+	MaxBytes int64  `toml:"max_bytes" json:"max_bytes"`
+}
+
+func (q Quota) validate() error {
+	if q.Prefix == "" {
+		return fmt.Errorf("quota prefix must not be empty")
+	}
+
+	if q.MaxKeys < 0 || q.MaxBytes < 0 {
+		return fmt.Errorf("quota of '%s' must not be negative", q.Prefix)
+	}
+
+	return nil
+}
+
+// QuotaUsage is the usage of a quota.
+type QuotaUsage struct {
+	Quota
+	Source string `json:"source"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// QuotaExceededError is returned by writes exceeding a quota.
+type QuotaExceededError struct {
+	Quota    Quota
+	Resource string
+	// TooLarge is set when the value alone exceeds the quota
+	TooLarge bool
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.TooLarge {
+		return fmt.Sprintf("value exceeds quota of '%s': %d bytes", e.Quota.Prefix, e.Quota.MaxBytes)
+	}
+
+	limit := e.Quota.MaxKeys
+	if e.Resource == quotaResourceBytes {
+		limit = e.Quota.MaxBytes
+	}
+
+	return fmt.Sprintf("quota of '%s' exceeded: %d %s", e.Quota.Prefix, limit, e.Resource)
+}
+
+// StatusCode returns 413 when the value can never fit in the quota, 507 otherwise.
+func (e *QuotaExceededError) StatusCode() int {
+	if e.TooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInsufficientStorage
+}
+
+// quotaStore tracks quota usage alongside the keys, and keeps the quotas set through the admin API.
+type quotaStore interface {
+	// Set writes a key if it fits in every quota, returning the exceeded one otherwise
+	Set(ctx context.Context, key string, value []byte, quotas []Quota) (*QuotaExceededError, error)
+	// Delete deletes a key, returning whether it existed
+	Delete(ctx context.Context, key string, quotas []Quota) (bool, error)
+	Usage(ctx context.Context, quotas []Quota) ([]QuotaUsage, error)
+	// Recount corrects the usage of a quota from the keys it holds
+	Recount(ctx context.Context, quota Quota) error
+	Limits(ctx context.Context) ([]Quota, error)
+	SaveLimit(ctx context.Context, quota Quota) error
+	DeleteLimit(ctx context.Context, prefix string) (bool, error)
+}
+
+// Quotas enforces the quotas from the config, overridden by the ones set through
+// the admin API, which are refreshed from the store every now and then.
+type Quotas struct {
+	store     quotaStore
+	keyPrefix string
+	config    []Quota
+	refresh   time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	admin     []Quota
+	refreshed time.Time
+}
+
+func NewQuotas(store quotaStore, keyPrefix string, config []Quota, refresh time.Duration) (*Quotas, error) {
+	for _, quota := range config {
+		if err := quota.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if refresh == 0 {
+		refresh = defaultQuotaRefresh
+	}
+
+	return &Quotas{
+		store:     store,
+		keyPrefix: keyPrefix,
+		config:    config,
+		refresh:   refresh,
+		now:       time.Now,
+	}, nil
+}
+
+// Recount corrects the usage of every quota, to account for keys written while it was not enforced.
+func (q *Quotas) Recount(ctx context.Context) error {
+	quotas, err := q.all(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, quota := range quotas {
+		if err := q.store.Recount(ctx, quota.Quota); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// all returns every quota, sorted by prefix.
+func (q *Quotas) all(ctx context.Context) ([]QuotaUsage, error) {
+	admin, err := q.adminQuotas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byPrefix := make(map[string]QuotaUsage)
+	for _, quota := range q.config {
+		byPrefix[quota.Prefix] = QuotaUsage{Quota: quota, Source: quotaSourceConfig}
+	}
+	for _, quota := range admin {
+		byPrefix[quota.Prefix] = QuotaUsage{Quota: quota, Source: quotaSourceAdmin}
+	}
+
+	quotas := make([]QuotaUsage, 0, len(byPrefix))
+	for _, quota := range byPrefix {
+		quotas = append(quotas, quota)
+	}
+
+	sort.Slice(quotas, func(i, j int) bool {
+		return quotas[i].Prefix < quotas[j].Prefix
+	})
+
+	return quotas, nil
+}
+
+func (q *Quotas) adminQuotas(ctx context.Context) ([]Quota, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.now().Sub(q.refreshed) < q.refresh {
+		return q.admin, nil
+	}
+
+	admin, err := q.store.Limits(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q.admin = admin
+	q.refreshed = q.now()
+
+	return admin, nil
+}
+
+// matching returns the quotas applying to a key, without the key prefix.
+func (q *Quotas) matching(ctx context.Context, key string) ([]Quota, error) {
+	quotas, err := q.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Quota
+	for _, quota := range quotas {
+		if strings.HasPrefix(key, quota.Prefix) {
+			matching = append(matching, quota.Quota)
+		}
+	}
+
+	return matching, nil
+}
+
+// Usage returns the usage of the quotas accepted by filter.
+func (q *Quotas) Usage(ctx context.Context, filter func(Quota) bool) ([]QuotaUsage, error) {
+	quotas, err := q.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []Quota
+	var sources []string
+	for _, quota := range quotas {
+		if filter(quota.Quota) {
+			filtered = append(filtered, quota.Quota)
+			sources = append(sources, quota.Source)
+		}
+	}
+
+	usage, err := q.store.Usage(ctx, filtered)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range usage {
+		usage[i].Source = sources[i]
+	}
+
+	return usage, nil
+}
+
+// Save sets a quota through the admin API, counting the keys it already holds.
+func (q *Quotas) Save(ctx context.Context, quota Quota) error {
+	if err := quota.validate(); err != nil {
+		return err
+	}
+
+	if err := q.store.SaveLimit(ctx, quota); err != nil {
+		return err
+	}
+
+	q.expire()
+
+	return q.store.Recount(ctx, quota)
+}
+
+// Delete removes a quota set through the admin API, a quota from the config applies again.
+func (q *Quotas) Delete(ctx context.Context, prefix string) (bool, error) {
+	deleted, err := q.store.DeleteLimit(ctx, prefix)
+	if err != nil {
+		return false, err
+	}
+
+	q.expire()
+
+	return deleted, nil
+}
+
+// expire forces the admin quotas to be refreshed on next use.
+func (q *Quotas) expire() {
+	q.mu.Lock()
+	q.refreshed = time.Time{}
+	q.mu.Unlock()
+}
+
+// KeyValue wraps kv so writes are checked against quotas and tracked.
+func (q *Quotas) KeyValue(kv KeyValue) KeyValue {
+	return &quotaKeyValue{KeyValue: kv, quotas: q}
+}
+
+// quotaKeyValue enforces quotas on the writes of a KeyValue, and releases
+// the usage of deleted keys.
+type quotaKeyValue struct {
+	KeyValue
+	quotas *Quotas
+}
+
+func (kv *quotaKeyValue) Set(ctx context.Context, key string, value []byte) error {
+	matching, err := kv.quotas.matching(ctx, strings.TrimPrefix(key, kv.quotas.keyPrefix))
+	if err != nil {
+		return err
+	}
+
+	if len(matching) == 0 {
+		return kv.KeyValue.Set(ctx, key, value)
+	}
+
+	for _, quota := range matching {
+		if quota.MaxBytes > 0 && int64(len(value)) > quota.MaxBytes {
+			return &QuotaExceededError{Quota: quota, Resource: quotaResourceBytes, TooLarge: true}
+		}
+	}
+
+	exceeded, err := kv.quotas.store.Set(ctx, key, value, matching)
+	if err != nil {
+		return err
+	}
+
+	if exceeded != nil {
+		return exceeded
+	}
+
+	return nil
+}
+
+func (kv *quotaKeyValue) Delete(ctx context.Context, key string) error {
+	matching, err := kv.quotas.matching(ctx, strings.TrimPrefix(key, kv.quotas.keyPrefix))
+	if err != nil {
+		return err
+	}
+
+	if len(matching) == 0 {
+		return kv.KeyValue.Delete(ctx, key)
+	}
+
+	deleted, err := kv.quotas.store.Delete(ctx, key, matching)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return ErrorKeyNotFound{}
+	}
+
+	return nil
+}
+
+// QuotaHandler reports quota usage, and manages quotas for admins.
+type QuotaHandler struct {
+	quotas      *Quotas
+	permissions *PermissionMiddleware
+}
+
+// NewQuotaHandler creates a QuotaHandler, usage is only reported to callers allowed
+// to read the prefix of a quota when permissions is not nil.
+func NewQuotaHandler(quotas *Quotas, permissions *PermissionMiddleware) *QuotaHandler {
+	return &QuotaHandler{
+		quotas:      quotas,
+		permissions: permissions,
+	}
+}
+
+func writeQuotaUsage(w http.ResponseWriter, usage []QuotaUsage) {
+	if usage == nil {
+		usage = []QuotaUsage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(usage)
+	if err != nil {
+		slog.Error("error writing response", err)
+		return
+	}
+}
+
+// Usage responds with the usage of the quotas the caller may read,
+// restricted to the quotas applying to a key if given as query parameter.
+func (h *QuotaHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	key, filterByKey := r.URL.Query()["key"]
+
+	usage, err := h.quotas.Usage(r.Context(), func(quota Quota) bool {
+		if filterByKey && !strings.HasPrefix(key[0], quota.Prefix) {
+			return false
+		}
+
+		return h.permissions == nil || h.permissions.Allowed(r.Context(), operationRead, quota.Prefix)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error getting quota usage", err)
+		return
+	}
+
+	writeQuotaUsage(w, usage)
+}
+
+// List responds with the usage of every quota.
+func (h *QuotaHandler) List(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.quotas.Usage(r.Context(), func(Quota) bool { return true })
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error getting quota usage", err)
+		return
+	}
+
+	writeQuotaUsage(w, usage)
+}
+
+// Save creates or replaces a quota.
+func (h *QuotaHandler) Save(w http.ResponseWriter, r *http.Request) {
+	var quota Quota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := quota.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.quotas.Save(r.Context(), quota); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error saving quota", err)
+		return
+	}
+
+	loggerFromCtx(r.Context()).Info("set quota", "prefix", quota.Prefix, "max_keys", quota.MaxKeys, "max_bytes", quota.MaxBytes)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete removes a quota, given as query parameter.
+func (h *QuotaHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "prefix must be set", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.quotas.Delete(r.Context(), prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error deleting quota", err)
+		return
+	}
+
+	if !deleted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	loggerFromCtx(r.Context()).Info("deleted quota", "prefix", prefix)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+// memoryQuotaStore implements the quota tracking of the Redis store in memory.
+type memoryQuotaStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	usage  map[string]*QuotaUsage
+	limits map[string]Quota
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{
+		values: make(map[string][]byte),
+		usage:  make(map[string]*QuotaUsage),
+		limits: make(map[string]Quota),
+	}
+}
+
+func (s *memoryQuotaStore) usageOf(prefix string) *QuotaUsage {
+	usage, ok := s.usage[prefix]
+	if !ok {
+		usage = &QuotaUsage{}
+		s.usage[prefix] = usage
+	}
+	return usage
+}
+
+func (s *memoryQuotaStore) Set(ctx context.Context, key string, value []byte, quotas []Quota) (*QuotaExceededError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.values[key]
+
+	var dkeys int64
+	if !exists {
+		dkeys = 1
+	}
+	dbytes := int64(len(value) - len(old))
+
+	for _, quota := range quotas {
+		usage := s.usageOf(quota.Prefix)
+		if quota.MaxKeys > 0 && dkeys > 0 && usage.Keys+dkeys > quota.MaxKeys {
+			return &QuotaExceededError{Quota: quota, Resource: quotaResourceKeys}, nil
+		}
+		if quota.MaxBytes > 0 && dbytes > 0 && usage.Bytes+dbytes > quota.MaxBytes {
+			return &QuotaExceededError{Quota: quota, Resource: quotaResourceBytes}, nil
+		}
+	}
+
+	s.values[key] = value
+	for _, quota := range quotas {
+		usage := s.usageOf(quota.Prefix)
+		usage.Keys += dkeys
+		usage.Bytes += dbytes
+	}
+
+	return nil, nil
+}
+
+func (s *memoryQuotaStore) Delete(ctx context.Context, key string, quotas []Quota) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.values[key]
+	if !exists {
+		return false, nil
+	}
+
+	delete(s.values, key)
+	for _, quota := range quotas {
+		usage := s.usageOf(quota.Prefix)
+		usage.Keys--
+		usage.Bytes -= int64(len(old))
+	}
+
+	return true, nil
+}
+
+func (s *memoryQuotaStore) Usage(ctx context.Context, quotas []Quota) ([]QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := make([]QuotaUsage, len(quotas))
+	for i, quota := range quotas {
+		usage[i] = *s.usageOf(quota.Prefix)
+		usage[i].Quota = quota
+	}
+	return usage, nil
+}
+
+func (s *memoryQuotaStore) Recount(ctx context.Context, quota Quota) error {
+	return nil
+}
+
+func (s *memoryQuotaStore) Limits(ctx context.Context) ([]Quota, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var quotas []Quota
+	for _, quota := range s.limits {
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+func (s *memoryQuotaStore) SaveLimit(ctx context.Context, quota Quota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits[quota.Prefix] = quota
+	return nil
+}
+
+func (s *memoryQuotaStore) DeleteLimit(ctx context.Context, prefix string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.limits[prefix]
+	delete(s.limits, prefix)
+	return ok, nil
+}
+
+// memoryKeyValue is a KeyValue which must not be written to when quotas apply.
+type memoryKeyValue struct {
+	values map[string][]byte
+}
+
+func (kv *memoryKeyValue) Get(ctx context.Context, key string) (string, error) {
+	value, ok := kv.values[key]
+	if !ok {
+		return "", ErrorKeyNotFound{}
+	}
+	return string(value), nil
+}
+
+func (kv *memoryKeyValue) Set(ctx context.Context, key string, value []byte) error {
+	kv.values[key] = value
+	return nil
+}
+
+func (kv *memoryKeyValue) Delete(ctx context.Context, key string) error {
+	if _, ok := kv.values[key]; !ok {
+		return ErrorKeyNotFound{}
+	}
+	delete(kv.values, key)
+	return nil
+}
+
+func TestQuotasKeyValue(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryQuotaStore()
+
+	quotas, err := NewQuotas(store, "kave:", []Quota{
+		{Prefix: "team-a:", MaxKeys: 2, MaxBytes: 10},
+		{Prefix: "team-a:logs:", MaxBytes: 4},
+	}, time.Minute)
+	assert.NoError(t, err)
+
+	plain := &memoryKeyValue{values: make(map[string][]byte)}
+	kv := quotas.KeyValue(plain)
+
+	// keys outside quotas are written as usual
+	{
+		assert.NoError(t, kv.Set(ctx, "kave:team-b:foo", []byte("0123456789abcdef")))
+		assert.Contains(t, plain.values, "kave:team-b:foo")
+	}
+
+	// keys within quotas
+	{
+		assert.NoError(t, kv.Set(ctx, "kave:team-a:foo", []byte("12345")))
+		assert.NoError(t, kv.Set(ctx, "kave:team-a:bar", []byte("123")))
+		assert.NotContains(t, plain.values, "kave:team-a:foo")
+
+		// overwriting a key does not count as a new key
+		assert.NoError(t, kv.Set(ctx, "kave:team-a:foo", []byte("1234567")))
+	}
+
+	// too many keys
+	{
+		err := kv.Set(ctx, "kave:team-a:baz", []byte("1"))
+		assert.EqualError(t, err, "quota of 'team-a:' exceeded: 2 keys")
+		assert.Equal(t, http.StatusInsufficientStorage, err.(*QuotaExceededError).StatusCode())
+	}
+
+	// too many bytes
+	{
+		err := kv.Set(ctx, "kave:team-a:foo", []byte("12345678"))
+		assert.EqualError(t, err, "quota of 'team-a:' exceeded: 10 bytes")
+	}
+
+	// value larger than a nested quota
+	{
+		err := kv.Set(ctx, "kave:team-a:logs:1", []byte("12345"))
+		assert.EqualError(t, err, "value exceeds quota of 'team-a:logs:': 4 bytes")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, err.(*QuotaExceededError).StatusCode())
+	}
+
+	// admin quotas override the config
+	{
+		assert.NoError(t, quotas.Save(ctx, Quota{Prefix: "team-a:", MaxKeys: 3, MaxBytes: 100}))
+		assert.NoError(t, kv.Set(ctx, "kave:team-a:baz", []byte("1")))
+
+		usage, err := quotas.Usage(ctx, func(q Quota) bool { return q.Prefix == "team-a:" })
+		assert.NoError(t, err)
+		assert.Equal(t, []QuotaUsage{{
+			Quota:  Quota{Prefix: "team-a:", MaxKeys: 3, MaxBytes: 100},
+			Source: quotaSourceAdmin,
+			Keys:   3,
+			Bytes:  11,
+		}}, usage)
+
+		deleted, err := quotas.Delete(ctx, "team-a:")
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+
+		err = kv.Set(ctx, "kave:team-a:qux", []byte("1"))
+		assert.EqualError(t, err, "quota of 'team-a:' exceeded: 2 keys")
+	}
+
+	// deleted keys release their usage
+	{
+		assert.NoError(t, kv.Delete(ctx, "kave:team-a:baz"))
+		assert.NoError(t, kv.Delete(ctx, "kave:team-a:bar"))
+		assert.ErrorIs(t, kv.Delete(ctx, "kave:team-a:baz"), ErrorKeyNotFound{})
+
+		usage, err := quotas.Usage(ctx, func(q Quota) bool { return q.Prefix == "team-a:" })
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), usage[0].Keys)
+		assert.Equal(t, int64(7), usage[0].Bytes)
+
+		assert.NoError(t, kv.Set(ctx, "kave:team-a:qux", []byte("")))
+	}
+
+	// invalid quotas
+	{
+		_, err := NewQuotas(store, "kave:", []Quota{{Prefix: ""}}, 0)
+		assert.Error(t, err)
+
+		assert.Error(t, quotas.Save(ctx, Quota{Prefix: "team-c:", MaxKeys: -1}))
+	}
+}
+
+func TestQuotaHandler(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryQuotaStore()
+
+	quotas, err := NewQuotas(store, "kave:", []Quota{
+		{Prefix: "team-a:", MaxKeys: 10},
+		{Prefix: "team-b:", MaxKeys: 10},
+	}, time.Minute)
+	assert.NoError(t, err)
+
+	assert.NoError(t, quotas.KeyValue(nil).Set(ctx, "kave:team-a:foo", []byte("bar")))
+
+	var permissions []string
+	pm := NewPermissionMiddleware(
+		"kave:",
+		policy.SyntaxGlob,
+		readKeyFromCtx,
+		func(ctx context.Context) []string {
+			return permissions
+		},
+		readClaimsFromCtx,
+	)
+
+	handler := NewQuotaHandler(quotas, &pm)
+
+	router := chi.NewRouter()
+	router.Get(quotaPath, handler.Usage)
+	router.Route(adminQuotasPath, func(r chi.Router) {
+		r.Use(pm.Require(permissionAdminQuota))
+		r.Get("/", handler.List)
+		r.Put("/", handler.Save)
+		r.Delete("/", handler.Delete)
+	})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return recorder
+	}
+
+	usageOf := func(recorder *httptest.ResponseRecorder) []QuotaUsage {
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var usage []QuotaUsage
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&usage))
+		return usage
+	}
+
+	// usage of the quotas the caller may read
+	{
+		permissions = []string{"read:kave:team-a:**"}
+
+		usage := usageOf(serve(http.MethodGet, quotaPath, ""))
+		assert.Len(t, usage, 1)
+		assert.Equal(t, "team-a:", usage[0].Prefix)
+		assert.Equal(t, int64(1), usage[0].Keys)
+		assert.Equal(t, int64(3), usage[0].Bytes)
+		assert.Equal(t, quotaSourceConfig, usage[0].Source)
+	}
+
+	// usage of the quotas applying to a key
+	{
+		permissions = []string{"read:kave:**"}
+
+		usage := usageOf(serve(http.MethodGet, quotaPath+"?key=team-b:foo", ""))
+		assert.Len(t, usage, 1)
+		assert.Equal(t, "team-b:", usage[0].Prefix)
+
+		usage = usageOf(serve(http.MethodGet, quotaPath+"?key=team-c:foo", ""))
+		assert.Len(t, usage, 0)
+	}
+
+	// admin permission is required to manage quotas
+	{
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, adminQuotasPath, "").Code)
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodPut, adminQuotasPath, `{"prefix":"team-c:"}`).Code)
+	}
+
+	permissions = []string{"admin:quotas"}
+
+	// manage quotas
+	{
+		assert.Equal(t, http.StatusNoContent, serve(http.MethodPut, adminQuotasPath, `{"prefix":"team-c:","max_keys":5}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, adminQuotasPath, `{"max_keys":5}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, adminQuotasPath, `{`).Code)
+
+		usage := usageOf(serve(http.MethodGet, adminQuotasPath, ""))
+		assert.Len(t, usage, 3)
+		assert.Equal(t, "team-c:", usage[2].Prefix)
+		assert.Equal(t, int64(5), usage[2].MaxKeys)
+		assert.Equal(t, quotaSourceAdmin, usage[2].Source)
+
+		assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, adminQuotasPath+"?prefix=team-c:", "").Code)
+		assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, adminQuotasPath+"?prefix=team-c:", "").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodDelete, adminQuotasPath, "").Code)
+	}
+}
+
+func TestKeyValueHandlerSetQuotaExceeded(t *testing.T) {
+	quotas, err := NewQuotas(newMemoryQuotaStore(), "kave:", []Quota{{Prefix: "team-a:", MaxBytes: 4}}, 0)
+	assert.NoError(t, err)
+
+	handler := NewKeyValueHandler(quotas.KeyValue(nil), "kave:", func(ctx context.Context) string {
+		return "team-a:foo"
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.Set(recorder, httptest.NewRequest(http.MethodPost, "/redis/team-a:foo", bytes.NewBufferString("12345")))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, "value exceeds quota of 'team-a:': 4 bytes\n", recorder.Body.String())
+}
+
+func TestRedisQuotaStore(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer client.Close()
+
+	// isolate runs of the test
+	keyPrefix := fmt.Sprintf("test-quota-%d:", time.Now().UnixNano())
+	store := newRedisQuotaStore(client, keyPrefix, keyPrefix+"internal:")
+
+	quota := Quota{Prefix: "team-a:", MaxKeys: 2, MaxBytes: 10}
+	quotas := []Quota{quota}
+
+	// count keys written before the quota
+	{
+		assert.NoError(t, client.Set(ctx, keyPrefix+"team-a:old", "123", 0).Err())
+		assert.NoError(t, client.Set(ctx, keyPrefix+"team-b:old", "123", 0).Err())
+		assert.NoError(t, store.Recount(ctx, quota))
+
+		usage, err := store.Usage(ctx, quotas)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), usage[0].Keys)
+		assert.Equal(t, int64(3), usage[0].Bytes)
+	}
+
+	// usage drifting from the keys is corrected
+	{
+		assert.NoError(t, client.HSet(ctx, store.usageKey(quota.Prefix), quotaResourceKeys, 5, quotaResourceBytes, 50).Err())
+		assert.NoError(t, store.Recount(ctx, quota))
+
+		usage, err := store.Usage(ctx, quotas)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), usage[0].Keys)
+		assert.Equal(t, int64(3), usage[0].Bytes)
+	}
+
+	// writes are tracked
+	{
+		exceeded, err := store.Set(ctx, keyPrefix+"team-a:new", []byte("12345"), quotas)
+		assert.NoError(t, err)
+		assert.Nil(t, exceeded)
+
+		exceeded, err = store.Set(ctx, keyPrefix+"team-a:new", []byte("1"), quotas)
+		assert.NoError(t, err)
+		assert.Nil(t, exceeded)
+
+		usage, err := store.Usage(ctx, quotas)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), usage[0].Keys)
+		assert.Equal(t, int64(4), usage[0].Bytes)
+
+		value, err := client.Get(ctx, keyPrefix+"team-a:new").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, "1", value)
+	}
+
+	// writes exceeding the quota are rejected
+	{
+		exceeded, err := store.Set(ctx, keyPrefix+"team-a:other", []byte("1"), quotas)
+		assert.NoError(t, err)
+		assert.Equal(t, &QuotaExceededError{Quota: quota, Resource: quotaResourceKeys}, exceeded)
+
+		exceeded, err = store.Set(ctx, keyPrefix+"team-a:new", []byte("12345678"), quotas)
+		assert.NoError(t, err)
+		assert.Equal(t, &QuotaExceededError{Quota: quota, Resource: quotaResourceBytes}, exceeded)
+
+		// shrinking values is allowed
+		exceeded, err = store.Set(ctx, keyPrefix+"team-a:old", []byte(""), quotas)
+		assert.NoError(t, err)
+		assert.Nil(t, exceeded)
+	}
+
+	// deletes are tracked
+	{
+		deleted, err := store.Delete(ctx, keyPrefix+"team-a:new", quotas)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+
+		deleted, err = store.Delete(ctx, keyPrefix+"team-a:new", quotas)
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+
+		usage, err := store.Usage(ctx, quotas)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), usage[0].Keys)
+		assert.Equal(t, int64(0), usage[0].Bytes)
+	}
+
+	// admin quotas
+	{
+		assert.NoError(t, store.SaveLimit(ctx, quota))
+
+		limits, err := store.Limits(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, quotas, limits)
+
+		deleted, err := store.DeleteLimit(ctx, quota.Prefix)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	}
+
+	keys, err := client.Keys(ctx, escapeGlob(keyPrefix)+"*").Result()
+	assert.NoError(t, err)
+	assert.NoError(t, client.Del(ctx, keys...).Err())
+}
+
+func TestEscapeGlob(t *testing.T) {
+	assert.Equal(t, `a\*b\?c\[d\]e\\f`, escapeGlob(`a*b?c[d]e\f`))
+	assert.False(t, strings.Contains(escapeGlob("team-a:"), `\`))
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+const (
+	rateLimitIdentitySubject = "sub:"
+	rateLimitIdentityIP      = "ip:"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second, holding up to Burst tokens.
+type RateLimit struct {
+	Rate      float64 `toml:"rate"`
+	Burst     int     `toml:"burst"`
+	Unlimited bool    `toml:"unlimited"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Unlimited {
+		return nil
+	}
+
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+
+	if l.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+
+	return nil
+}
+
+// RateLimitOverride replaces the default limit of the callers matching Pattern,
+// a glob on "sub:<subject>" or "ip:<address>", or a network such as "ip:10.0.0.0/8".
+type RateLimitOverride struct {
+	Pattern string `toml:"pattern"`
+	RateLimit
+}
+
+// rateLimitResult is the state of a bucket after taking a token.
+type rateLimitResult struct {
+	Allowed bool
+	// Tokens left in the bucket, may be fractional
+	Tokens float64
+}
+
+// rateLimitStore keeps the token buckets shared by every server.
+type rateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (rateLimitResult, error)
+	// Peek returns whether a token could be taken, without taking it
+	Peek(ctx context.Context, key string, limit RateLimit) (rateLimitResult, error)
+}
+
+type rateLimitRule struct {
+	pattern *policy.Policy
+	// network is matched instead of pattern when set, by IPv4 and IPv6 addresses alike
+	network *net.IPNet
+	limit   RateLimit
+}
+
+func (r rateLimitRule) matches(identity string) bool {
+	if r.network == nil {
+		return r.pattern.Allowed(identity)
+	}
+
+	ip := net.ParseIP(strings.TrimPrefix(identity, rateLimitIdentityIP))
+	return strings.HasPrefix(identity, rateLimitIdentityIP) && ip != nil && r.network.Contains(ip)
+}
+
+// RateLimiter limits the requests of each caller, identified by the token
+// subject or by the client address when there is none.
+type RateLimiter struct {
+	store         rateLimitStore
+	limit         RateLimit
+	rules         []rateLimitRule
+	claimsFromCtx func(context.Context) *Claims
+}
+
+func NewRateLimiter(
+	store rateLimitStore,
+	limit RateLimit,
+	overrides []RateLimitOverride,
+	claimsFromCtx func(context.Context) *Claims,
+) (*RateLimiter, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+
+	rules := make([]rateLimitRule, 0, len(overrides))
+	for _, override := range overrides {
+		if err := override.validate(); err != nil {
+			return nil, fmt.Errorf("rate limit override '%s': %w", override.Pattern, err)
+		}
+
+		if !strings.HasPrefix(override.Pattern, rateLimitIdentitySubject) &&
+			!strings.HasPrefix(override.Pattern, rateLimitIdentityIP) {
+			return nil, fmt.Errorf("rate limit pattern '%s' must start with '%s' or '%s'",
+				override.Pattern, rateLimitIdentitySubject, rateLimitIdentityIP)
+		}
+
+		if _, network, err := net.ParseCIDR(strings.TrimPrefix(override.Pattern, rateLimitIdentityIP)); err == nil {
+			rules = append(rules, rateLimitRule{network: network, limit: override.RateLimit})
+			continue
+		}
+
+		pattern := policy.Compile(policy.SyntaxGlob, []string{override.Pattern})
+		if len(pattern.Invalid()) > 0 {
+			return nil, fmt.Errorf("invalid rate limit pattern '%s'", override.Pattern)
+		}
+
+		rules = append(rules, rateLimitRule{pattern: pattern, limit: override.RateLimit})
+	}
+
+	return &RateLimiter{
+		store:         store,
+		limit:         limit,
+		rules:         rules,
+		claimsFromCtx: claimsFromCtx,
+	}, nil
+}
+
+// identity returns who a request from remoteAddr is limited as, e.g. "sub:auth0|123" or "ip:10.0.0.1".
+func (l *RateLimiter) identity(ctx context.Context, remoteAddr string) string {
+	if subject := l.claimsFromCtx(ctx).Subject; subject != "" {
+		return rateLimitIdentitySubject + subject
+	}
+
+	return addressIdentity(remoteAddr)
+}
+
+// addressIdentity returns who a caller from remoteAddr is limited as, e.g. "ip:10.0.0.1".
+func addressIdentity(remoteAddr string) string {
+	// RemoteAddr has no port once set by the RealIP middleware
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	return rateLimitIdentityIP + ip
+}
+
+// limitFor returns the limit of an identity, from the first matching override.
+func (l *RateLimiter) limitFor(identity string) RateLimit {
+	for _, rule := range l.rules {
+		if rule.matches(identity) {
+			return rule.limit
+		}
+	}
+	return l.limit
+}
+
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, limit, limited := l.allow(r.Context(), r.RemoteAddr)
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !writeRateLimitHeaders(w, result, limit) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Failures limits by address the callers failing auth, so that they cannot
+// flood auth with attempts, while authenticated callers are only limited by
+// subject. It must be placed before auth: addresses having failed too often
+// are refused before their credentials are checked, and each failure takes
+// a token from the bucket of the address.
+func (l *RateLimiter) Failures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if result, limit, limited := l.peekAddress(r.Context(), r.RemoteAddr); limited && !result.Allowed {
+			writeRateLimitHeaders(w, result, limit)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		if ww.Status() == http.StatusUnauthorized {
+			l.failed(r.Context(), r.RemoteAddr)
+		}
+	})
+}
+
+// writeRateLimitHeaders writes the state of the bucket of a caller, and
+// the response of a denied request. It returns whether it was allowed.
+func writeRateLimitHeaders(w http.ResponseWriter, result rateLimitResult, limit RateLimit) bool {
+	// seconds until the bucket is full again
+	reset := math.Ceil((float64(limit.Burst) - result.Tokens) / limit.Rate)
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(result.Tokens))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(result, limit)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// allow takes a token from the bucket of the caller in ctx, calling from
+// remoteAddr. It returns the bucket once taken from and its limit, unless
+// the caller is not limited, being unlimited or its bucket unavailable.
+func (l *RateLimiter) allow(ctx context.Context, remoteAddr string) (rateLimitResult, RateLimit, bool) {
+	identity := l.identity(ctx, remoteAddr)
+
+	limit := l.limitFor(identity)
+	if limit.Unlimited {
+		return rateLimitResult{Allowed: true}, limit, false
+	}
+
+	result, err := l.store.Take(ctx, identity, limit)
+	if err != nil {
+		// do not turn a rate limiter failure into an outage
+		loggerFromCtx(ctx).Error("error taking rate limit token", err)
+		return rateLimitResult{Allowed: true}, limit, false
+	}
+
+	return result, limit, true
+}
+
+// peekAddress returns whether a caller from remoteAddr, yet to authenticate,
+// has not failed auth too often, without taking a token. It returns the
+// bucket and its limit, unless the address is not limited.
+func (l *RateLimiter) peekAddress(ctx context.Context, remoteAddr string) (rateLimitResult, RateLimit, bool) {
+	identity := addressIdentity(remoteAddr)
+
+	limit := l.limitFor(identity)
+	if limit.Unlimited {
+		return rateLimitResult{Allowed: true}, limit, false
+	}
+
+	result, err := l.store.Peek(ctx, identity, limit)
+	if err != nil {
+		// do not turn a rate limiter failure into an outage
+		loggerFromCtx(ctx).Error("error peeking at rate limit tokens", err)
+		return rateLimitResult{Allowed: true}, limit, false
+	}
+
+	return result, limit, true
+}
+
+// failed takes a token from the bucket of remoteAddr, for a caller failing auth.
+func (l *RateLimiter) failed(ctx context.Context, remoteAddr string) {
+	identity := addressIdentity(remoteAddr)
+
+	limit := l.limitFor(identity)
+	if limit.Unlimited {
+		return
+	}
+
+	if _, err := l.store.Take(ctx, identity, limit); err != nil {
+		loggerFromCtx(ctx).Error("error taking rate limit token", err)
+	}
+}
+
+// retryAfter returns the seconds until a request denied by limit is allowed.
+func retryAfter(result rateLimitResult, limit RateLimit) int {
+	return int(math.Ceil((1 - result.Tokens) / limit.Rate))
+}
+
+// bucketTTL is how long an untouched bucket takes to be full again, after which it can be dropped.
+func bucketTTL(limit RateLimit) time.Duration {
+	return time.Duration(math.Ceil(float64(limit.Burst)/limit.Rate*1000)) * time.Millisecond
+}
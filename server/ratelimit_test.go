@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// memoryRateLimitStore implements the token bucket of the Redis store in memory.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	now     time.Time
+	buckets map[string]*memoryBucket
+	fail    bool
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		now:     time.Now(),
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (rateLimitResult, error) {
+	return s.take(key, limit, false)
+}
+
+func (s *memoryRateLimitStore) Peek(ctx context.Context, key string, limit RateLimit) (rateLimitResult, error) {
+	return s.take(key, limit, true)
+}
+
+func (s *memoryRateLimitStore) take(key string, limit RateLimit, peek bool) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		return rateLimitResult{}, fmt.Errorf("store is down")
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), ts: s.now}
+		s.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+s.now.Sub(bucket.ts).Seconds()*limit.Rate)
+	bucket.ts = s.now
+
+	if bucket.tokens < 1 {
+		return rateLimitResult{Allowed: false, Tokens: bucket.tokens}, nil
+	}
+
+	if peek {
+		return rateLimitResult{Allowed: true, Tokens: bucket.tokens}, nil
+	}
+
+	bucket.tokens--
+	return rateLimitResult{Allowed: true, Tokens: bucket.tokens}, nil
+}
+
+func TestRateLimiter(t *testing.T) {
+	store := newMemoryRateLimitStore()
+
+	limiter, err := NewRateLimiter(
+		store,
+		RateLimit{Rate: 1, Burst: 2},
+		[]RateLimitOverride{
+			{Pattern: "sub:*@clients", RateLimit: RateLimit{Rate: 10, Burst: 5}},
+			{Pattern: "ip:10.0.*", RateLimit: RateLimit{Unlimited: true}},
+			{Pattern: "ip:2001:db8::/32", RateLimit: RateLimit{Unlimited: true}},
+			{Pattern: "ip:172.16.0.0/12", RateLimit: RateLimit{Rate: 10, Burst: 5}},
+		},
+		readClaimsFromCtx,
+	)
+	assert.NoError(t, err)
+
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(subject, remoteAddr string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/redis/foo", nil)
+		request.RemoteAddr = remoteAddr
+		if subject != "" {
+			claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: subject}}
+			request = request.WithContext(writeClaimsToCtx(request.Context(), claims))
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// burst is allowed, then limited
+	{
+		recorder := serve("alice", "192.168.0.1:1234")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "2", recorder.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "1", recorder.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "1", recorder.Header().Get("RateLimit-Reset"))
+
+		recorder = serve("alice", "192.168.0.1:1234")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "0", recorder.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "2", recorder.Header().Get("RateLimit-Reset"))
+
+		recorder = serve("alice", "192.168.0.1:1234")
+		assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	}
+
+	// callers are limited by subject, not by address
+	{
+		assert.Equal(t, http.StatusOK, serve("bob", "192.168.0.1:1234").Code)
+	}
+
+	// bucket refills over time
+	{
+		store.now = store.now.Add(1500 * time.Millisecond)
+
+		recorder := serve("alice", "192.168.0.1:1234")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "0", recorder.Header().Get("RateLimit-Remaining"))
+	}
+
+	// callers without a token are limited by address
+	{
+		assert.Equal(t, http.StatusOK, serve("", "192.168.0.2:1234").Code)
+		assert.Equal(t, http.StatusOK, serve("", "192.168.0.2:5678").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve("", "192.168.0.2:1234").Code)
+
+		// address set by the RealIP middleware
+		assert.Equal(t, http.StatusTooManyRequests, serve("", "192.168.0.2").Code)
+	}
+
+	// overrides by subject
+	{
+		for i := 0; i < 5; i++ {
+			recorder := serve("ci@clients", "192.168.0.1:1234")
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "5", recorder.Header().Get("RateLimit-Limit"))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, serve("ci@clients", "192.168.0.1:1234").Code)
+	}
+
+	// unlimited addresses
+	{
+		for i := 0; i < 10; i++ {
+			recorder := serve("", "10.0.0.1:1234")
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Empty(t, recorder.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	// networks match IPv4 and IPv6 addresses
+	{
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, http.StatusOK, serve("", "[2001:db8::1]:1234").Code)
+		}
+
+		assert.Equal(t, "5", serve("", "172.31.0.1:1234").Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "2", serve("", "172.32.0.1:1234").Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "2", serve("", "[2001:db9::1]:1234").Header().Get("RateLimit-Limit"))
+
+		// subjects are not matched by networks
+		assert.Equal(t, "2", serve("172.16.0.1", "192.168.0.3:1234").Header().Get("RateLimit-Limit"))
+	}
+
+	// requests go through when the store fails
+	{
+		store.fail = true
+		assert.Equal(t, http.StatusOK, serve("alice", "192.168.0.1:1234").Code)
+	}
+}
+
+func TestRateLimitFailures(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer rdb.Close()
+
+	parse := func(token string) (*Claims, error) {
+		if token != "alice" && token != "ci@clients" {
+			return nil, assert.AnError
+		}
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: token},
+			Permissions:      []string{"read:kave:*"},
+		}, nil
+	}
+
+	// buckets are kept in Redis, under a prefix unique to each run
+	var config Config
+	_, err := toml.Decode(fmt.Sprintf(`
+internal_key_prefix = "kave-ratelimit-test:%d:"
+
+[auth]
+enabled = true
+
+[rate_limit]
+enabled = true
+rate = 1
+burst = 2
+
+[[rate_limit.overrides]]
+pattern = "sub:*@clients"
+rate = 1
+burst = 5
+`, time.Now().UnixNano()), &config)
+	assert.NoError(t, err)
+
+	s, err := New(ctx, config, WithRedisClient(rdb), WithTokenParser(parse),
+		WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	serve := func(token, remoteAddr string) int {
+		request := httptest.NewRequest(http.MethodGet, "/redis/foo", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", "Bearer "+token)
+
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// failed attempts are limited by address
+	{
+		assert.Equal(t, http.StatusUnauthorized, serve("mallory", "198.51.100.1:1234"))
+		assert.Equal(t, http.StatusUnauthorized, serve("mallory", "198.51.100.1:1234"))
+		assert.Equal(t, http.StatusTooManyRequests, serve("mallory", "198.51.100.1:1234"))
+
+		// even with a valid token
+		assert.Equal(t, http.StatusTooManyRequests, serve("alice", "198.51.100.1:1234"))
+	}
+
+	// authenticated callers are limited by subject only, beyond the limit of their address
+	{
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusNotFound, serve("ci@clients", "198.51.100.2:1234"))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, serve("ci@clients", "198.51.100.2:1234"))
+
+		// callers sharing an address have buckets of their own
+		assert.Equal(t, http.StatusNotFound, serve("alice", "198.51.100.2:1234"))
+		assert.Equal(t, http.StatusNotFound, serve("alice", "198.51.100.2:1234"))
+		assert.Equal(t, http.StatusTooManyRequests, serve("alice", "198.51.100.2:1234"))
+	}
+}
+
+func TestNewRateLimiterInvalid(t *testing.T) {
+	_, err := NewRateLimiter(nil, RateLimit{Rate: 0, Burst: 1}, nil, readClaimsFromCtx)
+	assert.Error(t, err)
+
+	_, err = NewRateLimiter(nil, RateLimit{Rate: 1, Burst: 0}, nil, readClaimsFromCtx)
+	assert.Error(t, err)
+
+	_, err = NewRateLimiter(nil, RateLimit{Unlimited: true}, []RateLimitOverride{
+		{Pattern: "alice", RateLimit: RateLimit{Rate: 1, Burst: 1}},
+	}, readClaimsFromCtx)
+	assert.Error(t, err)
+
+	_, err = NewRateLimiter(nil, RateLimit{Unlimited: true}, []RateLimitOverride{
+		{Pattern: "sub:alice", RateLimit: RateLimit{Rate: -1, Burst: 1}},
+	}, readClaimsFromCtx)
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisClient struct {
+	inner *redis.Client
+}
+
+func NewRedisClient(
+	ctx context.Context,
+	options *redis.Options,
+) (*RedisClient, error) {
+	client := redis.NewClient(options)
+	_, err := client.Ping(ctx).Result()
+	if err != nil {
+		return nil, err
+	}
+	return &RedisClient{
+		inner: client,
+	}, nil
+}
+
+func (c *RedisClient) Get(ctx context.Context, key string) (string, error) {
+	value, err := c.inner.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrorKeyNotFound{}
+	}
+
+	return value, err
+}
+
+func (c *RedisClient) Set(ctx context.Context, key string, value []byte) error {
+	return c.inner.Set(ctx, key, value, 0).Err()
+}
+
+func (c *RedisClient) Delete(ctx context.Context, key string) error {
+	deleted, err := c.inner.Del(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return ErrorKeyNotFound{}
+	}
+
+	return nil
+}
+
+// SetArgs sets key, expiring after ttl unless zero, and only if it does not
+// exist when nx is set. It returns whether key was set.
+func (c *RedisClient) SetArgs(ctx context.Context, key string, value []byte, ttl time.Duration, nx bool) (bool, error) {
+	args := redis.SetArgs{TTL: ttl}
+	if nx {
+		args.Mode = "NX"
+	}
+
+	err := c.inner.SetArgs(ctx, key, value, args).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Incr increments the integer value of key, returning the new value.
+func (c *RedisClient) Incr(ctx context.Context, key string) (int64, error) {
+	return c.inner.Incr(ctx, key).Result()
+}
+
+// List scans a page of the keys starting with prefix, along with their TTL.
+func (c *RedisClient) List(ctx context.Context, prefix string, cursor uint64, count int64) ([]KeyInfo, uint64, error) {
+	keys, next, err := c.inner.Scan(ctx, cursor, escapeGlob(prefix)+"*", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(keys) == 0 {
+		return nil, next, nil
+	}
+
+	pipe := c.inner.Pipeline()
+	cmds := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	infos := make([]KeyInfo, 0, len(keys))
+	for i, key := range keys {
+		ttl := cmds[i].Val()
+		// expired since scanned
+		if ttl == -2 {
+			continue
+		}
+
+		info := KeyInfo{Key: key}
+		if ttl > 0 {
+			info.TTLMs = ttl.Milliseconds()
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, next, nil
+}
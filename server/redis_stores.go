@@ -0,0 +1,667 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisNonceStore keeps single-use nonces in Redis until they are consumed or expire.
+type redisNonceStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisNonceStore(client *redis.Client, prefix string) *redisNonceStore {
+	return &redisNonceStore{
+		client: client,
+		prefix: prefix + "nonce:",
+	}
+}
+
+func (s *redisNonceStore) Add(ctx context.Context, nonce string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+nonce, 1, ttl).Err()
+}
+
+// Consume removes a nonce, reporting whether it existed.
+func (s *redisNonceStore) Consume(ctx context.Context, nonce string) (bool, error) {
+	removed, err := s.client.Del(ctx, s.prefix+nonce).Result()
+	return removed == 1, err
+}
+
+// redisSessionStore keeps pending logins and sessions in Redis until they expire.
+// Sessions are stored by the hash of their ID, which is only known to browsers.
+type redisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisSessionStore(client *redis.Client, prefix string) *redisSessionStore {
+	return &redisSessionStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (s *redisSessionStore) loginKey(state string) string {
+	return s.prefix + "login:" + state
+}
+
+func (s *redisSessionStore) sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return s.prefix + "session:" + hex.EncodeToString(sum[:])
+}
+
+func (s *redisSessionStore) SaveLogin(ctx context.Context, state string, login pendingLogin, ttl time.Duration) error {
+	value, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(ctx, s.loginKey(state), value, ttl).Err()
+}
+
+func (s *redisSessionStore) TakeLogin(ctx context.Context, state string) (pendingLogin, bool, error) {
+	var login pendingLogin
+
+	value, err := s.client.GetDel(ctx, s.loginKey(state)).Bytes()
+	if err == redis.Nil {
+		return login, false, nil
+	}
+	if err != nil {
+		return login, false, err
+	}
+
+	if err := json.Unmarshal(value, &login); err != nil {
+		return login, false, err
+	}
+
+	return login, true, nil
+}
+
+func (s *redisSessionStore) SaveSession(ctx context.Context, id string, token string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.sessionKey(id), token, ttl).Err()
+}
+
+func (s *redisSessionStore) LoadSession(ctx context.Context, id string) (string, bool, error) {
+	token, err := s.client.Get(ctx, s.sessionKey(id)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return token, true, nil
+}
+
+func (s *redisSessionStore) DeleteSession(ctx context.Context, id string) error {
+	return s.client.Del(ctx, s.sessionKey(id)).Err()
+}
+
+// redisRevocationStore keeps revocations in Redis, each expiring with the tokens it denies.
+type redisRevocationStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisRevocationStore(client *redis.Client, prefix string) *redisRevocationStore {
+	return &redisRevocationStore{
+		client: client,
+		prefix: prefix + "revoked:",
+	}
+}
+
+func (s *redisRevocationStore) Add(ctx context.Context, revocation Revocation) error {
+	value, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(ctx, s.prefix+revocation.key(), value, time.Until(revocation.ExpiresAt)).Err()
+}
+
+func (s *redisRevocationStore) Lookup(ctx context.Context, keys []string) ([]*Revocation, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+
+	values, err := s.client.MGet(ctx, prefixed...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	revocations := make([]*Revocation, len(values))
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var revocation Revocation
+		if err := json.Unmarshal([]byte(str), &revocation); err != nil {
+			return nil, err
+		}
+		revocations[i] = &revocation
+	}
+
+	return revocations, nil
+}
+
+func (s *redisRevocationStore) List(ctx context.Context) ([]Revocation, error) {
+	var keys []string
+
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), s.prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	found, err := s.Lookup(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// keys may expire between scanning and reading them
+	var revocations []Revocation
+	for _, revocation := range found {
+		if revocation != nil {
+			revocations = append(revocations, *revocation)
+		}
+	}
+
+	return revocations, nil
+}
+
+func (s *redisRevocationStore) Delete(ctx context.Context, key string) (bool, error) {
+	removed, err := s.client.Del(ctx, s.prefix+key).Result()
+	return removed == 1, err
+}
+
+// takeTokenScript refills a token bucket for the time elapsed since it was
+// last used, by the Redis clock, and takes a token if there is one. The
+// bucket is left untouched when only peeking at it.
+var takeTokenScript = redis.NewScript(`
+redis.replicate_commands()
+
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local peek = ARGV[4] == '1'
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	allowed = 1
+	if not peek then
+		tokens = tokens - 1
+	end
+end
+
+if not peek then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+
+-- numbers returned by scripts are truncated to integers
+return {allowed, tostring(tokens)}
+`)
+
+// redisRateLimitStore keeps token buckets in Redis, shared by every server.
+type redisRateLimitStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisRateLimitStore(client *redis.Client, prefix string) *redisRateLimitStore {
+	return &redisRateLimitStore{
+		client: client,
+		prefix: prefix + "ratelimit:",
+	}
+}
+
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (rateLimitResult, error) {
+	return s.run(ctx, key, limit, false)
+}
+
+func (s *redisRateLimitStore) Peek(ctx context.Context, key string, limit RateLimit) (rateLimitResult, error) {
+	return s.run(ctx, key, limit, true)
+}
+
+func (s *redisRateLimitStore) run(ctx context.Context, key string, limit RateLimit, peek bool) (rateLimitResult, error) {
+	peekArg := 0
+	if peek {
+		peekArg = 1
+	}
+
+	values, err := takeTokenScript.Run(
+		ctx,
+		s.client,
+		[]string{s.prefix + key},
+		limit.Rate,
+		limit.Burst,
+		bucketTTL(limit).Milliseconds(),
+		peekArg,
+	).Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	if len(values) != 2 {
+		return rateLimitResult{}, fmt.Errorf("unexpected rate limit script result: %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+	tokens, err := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	return rateLimitResult{Allowed: allowed == 1, Tokens: tokens}, nil
+}
+
+// setWithQuotaScript sets a key if the change in keys and bytes fits in every
+// quota given, and tracks the change in their usage.
+var setWithQuotaScript = redis.NewScript(`
+local exists = redis.call('EXISTS', KEYS[1])
+local old = 0
+if exists == 1 then
+	old = redis.call('STRLEN', KEYS[1])
+end
+
+local dkeys = 1 - exists
+local dbytes = string.len(ARGV[1]) - old
+
+for i = 2, #KEYS do
+	local maxKeys = tonumber(ARGV[2 * i - 2])
+	local maxBytes = tonumber(ARGV[2 * i - 1])
+	local usage = redis.call('HMGET', KEYS[i], 'keys', 'bytes')
+	local keys = tonumber(usage[1]) or 0
+	local bytes = tonumber(usage[2]) or 0
+
+	if maxKeys > 0 and dkeys > 0 and keys + dkeys > maxKeys then
+		return {1, i - 1}
+	end
+	if maxBytes > 0 and dbytes > 0 and bytes + dbytes > maxBytes then
+		return {2, i - 1}
+	end
+end
+
+redis.call('SET', KEYS[1], ARGV[1])
+
+for i = 2, #KEYS do
+	redis.call('HINCRBY', KEYS[i], 'keys', dkeys)
+	redis.call('HINCRBY', KEYS[i], 'bytes', dbytes)
+end
+
+return {0, 0}
+`)
+
+// deleteWithQuotaScript deletes a key, releasing its usage of the quotas given.
+var deleteWithQuotaScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+
+local bytes = redis.call('STRLEN', KEYS[1])
+redis.call('DEL', KEYS[1])
+
+for i = 2, #KEYS do
+	redis.call('HINCRBY', KEYS[i], 'keys', -1)
+	redis.call('HINCRBY', KEYS[i], 'bytes', -bytes)
+end
+
+return 1
+`)
+
+// redisQuotaStore tracks the usage of each quota in a hash next to the keys.
+type redisQuotaStore struct {
+	client    *redis.Client
+	keyPrefix string
+	prefix    string
+}
+
+func newRedisQuotaStore(client *redis.Client, keyPrefix string, prefix string) *redisQuotaStore {
+	return &redisQuotaStore{
+		client:    client,
+		keyPrefix: keyPrefix,
+		prefix:    prefix + "quota:",
+	}
+}
+
+func (s *redisQuotaStore) usageKey(prefix string) string {
+	return s.prefix + "usage:" + prefix
+}
+
+func (s *redisQuotaStore) limitsKey() string {
+	return s.prefix + "limits"
+}
+
+func (s *redisQuotaStore) Set(ctx context.Context, key string, value []byte, quotas []Quota) (*QuotaExceededError, error) {
+	keys := []string{key}
+	args := []interface{}{value}
+	for _, quota := range quotas {
+		keys = append(keys, s.usageKey(quota.Prefix))
+		args = append(args, quota.MaxKeys, quota.MaxBytes)
+	}
+
+	result, err := setWithQuotaScript.Run(ctx, s.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) != 2 {
+		return nil, fmt.Errorf("unexpected quota script result: %v", result)
+	}
+
+	switch result[0] {
+	case 0:
+		return nil, nil
+	case 1:
+		return &QuotaExceededError{Quota: quotas[result[1]-1], Resource: quotaResourceKeys}, nil
+	default:
+		return &QuotaExceededError{Quota: quotas[result[1]-1], Resource: quotaResourceBytes}, nil
+	}
+}
+
+func (s *redisQuotaStore) Delete(ctx context.Context, key string, quotas []Quota) (bool, error) {
+	keys := []string{key}
+	for _, quota := range quotas {
+		keys = append(keys, s.usageKey(quota.Prefix))
+	}
+
+	deleted, err := deleteWithQuotaScript.Run(ctx, s.client, keys).Int64()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted == 1, nil
+}
+
+func (s *redisQuotaStore) Usage(ctx context.Context, quotas []Quota) ([]QuotaUsage, error) {
+	pipe := s.client.Pipeline()
+
+	cmds := make([]*redis.SliceCmd, len(quotas))
+	for i, quota := range quotas {
+		cmds[i] = pipe.HMGet(ctx, s.usageKey(quota.Prefix), quotaResourceKeys, quotaResourceBytes)
+	}
+
+	if len(quotas) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	usage := make([]QuotaUsage, len(quotas))
+	for i, quota := range quotas {
+		usage[i].Quota = quota
+
+		values := cmds[i].Val()
+		usage[i].Keys, _ = strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+		usage[i].Bytes, _ = strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	}
+
+	return usage, nil
+}
+
+// Recount corrects the usage of a quota by the difference between the keys
+// it holds and its usage before counting. Writes tracked while counting are
+// kept rather than overwritten, at worst counted twice until the next recount.
+func (s *redisQuotaStore) Recount(ctx context.Context, quota Quota) error {
+	before, err := s.Usage(ctx, []Quota{quota})
+	if err != nil {
+		return err
+	}
+
+	var keys, bytes int64
+
+	iter := s.client.Scan(ctx, 0, escapeGlob(s.keyPrefix+quota.Prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		length, err := s.client.StrLen(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+
+		keys++
+		bytes += length
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, s.usageKey(quota.Prefix), quotaResourceKeys, keys-before[0].Keys)
+		pipe.HIncrBy(ctx, s.usageKey(quota.Prefix), quotaResourceBytes, bytes-before[0].Bytes)
+		return nil
+	})
+	return err
+}
+
+func (s *redisQuotaStore) Limits(ctx context.Context) ([]Quota, error) {
+	values, err := s.client.HGetAll(ctx, s.limitsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := make([]Quota, 0, len(values))
+	for _, value := range values {
+		var quota Quota
+		if err := json.Unmarshal([]byte(value), &quota); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+
+	return quotas, nil
+}
+
+func (s *redisQuotaStore) SaveLimit(ctx context.Context, quota Quota) error {
+	value, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+
+	return s.client.HSet(ctx, s.limitsKey(), quota.Prefix, value).Err()
+}
+
+func (s *redisQuotaStore) DeleteLimit(ctx context.Context, prefix string) (bool, error) {
+	removed, err := s.client.HDel(ctx, s.limitsKey(), prefix).Result()
+	return removed == 1, err
+}
+
+// escapeGlob escapes the special characters of a Redis glob pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// redisAuditStream appends audit events to a Redis stream, trimmed to about maxLen events.
+type redisAuditStream struct {
+	client *redis.Client
+	key    string
+	maxLen int64
+}
+
+func newRedisAuditStream(client *redis.Client, prefix string, maxLen int64) *redisAuditStream {
+	return &redisAuditStream{
+		client: client,
+		key:    prefix + "audit",
+		maxLen: maxLen,
+	}
+}
+
+// auditStreamPageSize is the number of stream entries read at once while querying.
+const auditStreamPageSize = 100
+
+func (s *redisAuditStream) Write(ctx context.Context, event AuditEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.key,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: []interface{}{"event", value},
+	}).Err()
+}
+
+// Query pages backwards from the end of the stream, or forwards from since.
+func (s *redisAuditStream) Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	forward := !query.Since.IsZero()
+
+	start := "+"
+	if forward {
+		start = strconv.FormatInt(query.Since.UnixMilli(), 10)
+	}
+
+	var events []AuditEvent
+	for len(events) < query.Limit {
+		var messages []redis.XMessage
+		var err error
+		if forward {
+			messages, err = s.client.XRangeN(ctx, s.key, start, "+", auditStreamPageSize).Result()
+		} else {
+			messages, err = s.client.XRevRangeN(ctx, s.key, start, "-", auditStreamPageSize).Result()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			value, ok := message.Values["event"].(string)
+			if !ok {
+				return nil, fmt.Errorf("audit stream entry %s has no event", message.ID)
+			}
+
+			var event AuditEvent
+			if err := json.Unmarshal([]byte(value), &event); err != nil {
+				return nil, err
+			}
+
+			if query.matches(event) {
+				events = append(events, event)
+			}
+
+			if len(events) == query.Limit {
+				break
+			}
+		}
+
+		if len(messages) < auditStreamPageSize {
+			break
+		}
+
+		// continue after the last entry read
+		start = "(" + messages[len(messages)-1].ID
+	}
+
+	if !forward {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+
+	return events, nil
+}
+
+// redisKeyEventBus publishes key events on a Redis channel, received by the
+// watchers of every server subscribed at the time.
+type redisKeyEventBus struct {
+	client  *redis.Client
+	channel string
+}
+
+func newRedisKeyEventBus(client *redis.Client, prefix string) *redisKeyEventBus {
+	return &redisKeyEventBus{
+		client:  client,
+		channel: prefix + "events",
+	}
+}
+
+func (b *redisKeyEventBus) Publish(ctx context.Context, event KeyEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return b.client.Publish(ctx, b.channel, message).Err()
+}
+
+// Subscribe returns once subscribed, so that no event published afterwards is missed.
+func (b *redisKeyEventBus) Subscribe(ctx context.Context) (<-chan KeyEvent, error) {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+
+	// wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	events := make(chan KeyEvent)
+
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				var event KeyEvent
+				if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+					loggerFromCtx(ctx).Error("error decoding key event", err)
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,801 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+const (
+	defaultRESPIdleTimeout    = 5 * time.Minute
+	defaultRESPMaxConnections = 10000
+)
+
+// RESPOptions configures the RESP API, served apart from the HTTP API.
+type RESPOptions struct {
+	Enabled bool   `toml:"enabled"`
+	Address string `toml:"address"`
+	// IdleTimeoutMs closes connections not sending a command for as long, 5 minutes by default
+	IdleTimeoutMs int `toml:"idle_timeout_ms"`
+	// MaxConnections refuses clients beyond as many connections, 10000 by default
+	MaxConnections int `toml:"max_connections"`
+}
+
+// keyCommander runs the commands of the RESP API beyond those of KeyValue.
+type keyCommander interface {
+	// SetArgs sets key, expiring after ttl unless zero, and only if it does
+	// not exist when nx is set. It returns whether key was set.
+	SetArgs(ctx context.Context, key string, value []byte, ttl time.Duration, nx bool) (bool, error)
+	// Incr increments the integer value of key, returning the new value.
+	Incr(ctx context.Context, key string) (int64, error)
+}
+
+// respError is an error replied to clients as is, its first word being its kind.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+var (
+	errRESPNoAuth    = respError("NOAUTH Authentication required.")
+	errRESPWrongPass = respError("WRONGPASS invalid token")
+	errRESPSyntax    = respError("ERR syntax error")
+	errRESPEmptyKey  = respError("ERR key must not be empty")
+	errRESPReserved  = respError("ERR key is reserved")
+	// tokens could not be checked, such as when the introspection endpoint is down
+	errRESPAuthUnavailable = respError("ERR failed to check token")
+)
+
+// respCommand is a command of the RESP API.
+type respCommand struct {
+	// arity counts the name and arguments, or is their minimum when negative, as in Redis
+	arity int
+	run   func(s *respService, ctx context.Context, c *respConn, args []string) error
+}
+
+var respCommands = map[string]respCommand{
+	"AUTH": {arity: -2, run: (*respService).authenticate},
+	"PING": {arity: -1, run: (*respService).ping},
+	"QUIT": {arity: 1, run: (*respService).quit},
+	"GET":  {arity: 2, run: (*respService).get},
+	"MGET": {arity: -2, run: (*respService).mget},
+	"SET":  {arity: -3, run: (*respService).set},
+	"INCR": {arity: 2, run: (*respService).incr},
+	"DEL":  {arity: -2, run: (*respService).del},
+	"SCAN": {arity: -2, run: (*respService).scan},
+}
+
+// respService runs the commands of the RESP API on the same backend as the HTTP API.
+type respService struct {
+	keyValue KeyValue
+	// commander is nil when the backend cannot run commands beyond KeyValue,
+	// or when quotas are enforced
+	commander         keyCommander
+	keyPrefix         string
+	internalKeyPrefix string
+	keys              *KeyListHandler
+	events            keyEventBus
+	auth              *AuthMiddleware
+	permissions       *PermissionMiddleware
+	rateLimiter       *RateLimiter
+	auditor           *Auditor
+	timeout           time.Duration
+}
+
+// respConn is the state of a client connection.
+type respConn struct {
+	reader     *respReader
+	writer     *respWriter
+	remoteAddr string
+	// token of the last successful AUTH, validated again by every command
+	token string
+	quit  bool
+}
+
+// RESPServer serves a subset of the Redis protocol, so that Redis clients
+// get and set keys with the same auth as the HTTP API.
+type RESPServer struct {
+	service     *respService
+	idleTimeout time.Duration
+	// slots holds a value per connection served, up to its capacity
+	slots chan struct{}
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+func newRESPServer(service *respService, idleTimeout time.Duration, maxConnections int) *RESPServer {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultRESPIdleTimeout
+	}
+	if maxConnections <= 0 {
+		maxConnections = defaultRESPMaxConnections
+	}
+
+	return &RESPServer{
+		service:     service,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, maxConnections),
+		listeners:   map[net.Listener]struct{}{},
+		conns:       map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections on listener until it fails, or returns nil
+// once the server is closed.
+func (s *RESPServer) Serve(listener net.Listener) error {
+	if !s.track(listener) {
+		return nil
+	}
+	defer s.untrack(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			go refuseConn(conn)
+			continue
+		}
+
+		if !s.track(conn) {
+			<-s.slots
+			return nil
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// refuseConn replies to a client beyond the connections allowed, as Redis does.
+func refuseConn(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte("-ERR max number of clients reached\r\n"))
+}
+
+// Close closes the listeners being served and the connections of clients.
+func (s *RESPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// track keeps c, a listener or connection, to be closed with the server.
+// It closes c instead if the server is already closed.
+func (s *RESPServer) track(c interface{ Close() error }) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		c.Close()
+		return false
+	}
+
+	switch c := c.(type) {
+	case net.Listener:
+		s.listeners[c] = struct{}{}
+	case net.Conn:
+		s.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (s *RESPServer) untrack(c interface{ Close() error }) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch c := c.(type) {
+	case net.Listener:
+		delete(s.listeners, c)
+	case net.Conn:
+		delete(s.conns, c)
+	}
+	c.Close()
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	defer func() { <-s.slots }()
+	defer s.untrack(conn)
+
+	c := &respConn{
+		reader:     newRESPReader(conn),
+		writer:     newRESPWriter(conn),
+		remoteAddr: conn.RemoteAddr().String(),
+	}
+
+	for !c.quit {
+		maxArgs, maxBulkLength := respMaxArgs, respMaxBulkLength
+		if s.service.auth != nil && c.token == "" {
+			maxArgs, maxBulkLength = respMaxArgsUnauthenticated, respMaxBulkLengthUnauthenticated
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			return
+		}
+
+		args, err := c.reader.readCommand(maxArgs, maxBulkLength)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				c.writer.writeError("ERR " + err.Error())
+				_ = c.writer.flush()
+			}
+			return
+		}
+
+		s.service.run(c, args)
+
+		// reply to pipelined commands at once
+		if !c.reader.buffered() || c.quit {
+			if err := c.writer.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run runs a command, replying its errors, and logs it once replied.
+func (s *respService) run(c *respConn, args []string) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	fields := &logFields{}
+	ctx = writeLogFieldsToCtx(ctx, fields)
+
+	name := strings.ToUpper(args[0])
+
+	err := s.runCommand(ctx, c, name, args[1:])
+
+	level := slog.LevelInfo
+	if err != nil {
+		var replied respError
+		if !errors.As(err, &replied) {
+			loggerFromCtx(ctx).Error("error running command", err)
+			replied = "ERR internal error"
+			level = slog.LevelError
+		}
+		c.writer.writeError(string(replied))
+	}
+
+	loggerFromCtx(ctx).Log(level, "command",
+		"command", name,
+		"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		"remote_addr", c.remoteAddr,
+	)
+}
+
+// runCommand authenticates and rate limits the caller before running a command.
+func (s *respService) runCommand(ctx context.Context, c *respConn, name string, args []string) error {
+	command, ok := respCommands[name]
+	if !ok {
+		return respError(fmt.Sprintf("ERR unknown command '%s'", name))
+	}
+
+	if arity := len(args) + 1; (command.arity > 0 && arity != command.arity) || arity < -command.arity {
+		return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+
+	// limit callers failing auth by address, so that AUTH attempts are limited
+	// too, while authenticated callers are only limited by subject
+	if s.auth != nil && s.rateLimiter != nil {
+		if result, limit, limited := s.rateLimiter.peekAddress(ctx, c.remoteAddr); limited && !result.Allowed {
+			return respRateLimited(result, limit)
+		}
+	}
+
+	// tokens expire and are revoked while connections are open
+	if s.auth != nil && name != "AUTH" && name != "QUIT" {
+		if c.token == "" {
+			s.failedAuth(ctx, c)
+			return errRESPNoAuth
+		}
+
+		authenticated, err := s.authenticateToken(ctx, c.token)
+		if err != nil {
+			if err != errRESPAuthUnavailable {
+				c.token = ""
+				s.failedAuth(ctx, c)
+			}
+			return err
+		}
+		ctx = authenticated
+	}
+
+	if s.rateLimiter != nil && (s.auth == nil || (name != "AUTH" && name != "QUIT")) {
+		if result, limit, _ := s.rateLimiter.allow(ctx, c.remoteAddr); !result.Allowed {
+			return respRateLimited(result, limit)
+		}
+	}
+
+	err := command.run(s, ctx, c, args)
+	if err == errRESPWrongPass {
+		s.failedAuth(ctx, c)
+	}
+
+	return err
+}
+
+// failedAuth takes a token from the bucket of the address of a caller failing auth.
+func (s *respService) failedAuth(ctx context.Context, c *respConn) {
+	if s.rateLimiter != nil {
+		s.rateLimiter.failed(ctx, c.remoteAddr)
+	}
+}
+
+func respRateLimited(result rateLimitResult, limit RateLimit) error {
+	return respError(fmt.Sprintf("ERR rate limit exceeded, retry after %d seconds", retryAfter(result, limit)))
+}
+
+// authenticateToken writes the claims of token to the context, as the
+// bearer tokens of the HTTP API are.
+func (s *respService) authenticateToken(ctx context.Context, token string) (context.Context, error) {
+	claims, code := s.auth.authenticateToken(ctx, token)
+	switch code {
+	case 0:
+		return s.auth.claimsToCtx(ctx, claims), nil
+	case http.StatusServiceUnavailable:
+		return nil, errRESPAuthUnavailable
+	default:
+		return nil, errRESPWrongPass
+	}
+}
+
+// authenticate runs AUTH [username] token, the username being ignored.
+func (s *respService) authenticate(ctx context.Context, c *respConn, args []string) error {
+	if s.auth == nil {
+		return respError("ERR AUTH called without auth enabled")
+	}
+
+	if len(args) > 2 {
+		return errRESPSyntax
+	}
+
+	token := args[len(args)-1]
+	if _, err := s.authenticateToken(ctx, token); err != nil {
+		return err
+	}
+
+	c.token = token
+	c.writer.writeSimple("OK")
+	return nil
+}
+
+func (s *respService) ping(ctx context.Context, c *respConn, args []string) error {
+	switch len(args) {
+	case 0:
+		c.writer.writeSimple("PONG")
+	case 1:
+		c.writer.writeBulk([]byte(args[0]))
+	default:
+		return respError("ERR wrong number of arguments for 'ping' command")
+	}
+	return nil
+}
+
+func (s *respService) quit(ctx context.Context, c *respConn, args []string) error {
+	c.quit = true
+	c.writer.writeSimple("OK")
+	return nil
+}
+
+func (s *respService) get(ctx context.Context, c *respConn, args []string) error {
+	if err := s.authorize(ctx, operationRead, args...); err != nil {
+		return err
+	}
+
+	value, err := s.getValue(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		c.writer.writeNull()
+	} else {
+		c.writer.writeBulk(value)
+	}
+	return nil
+}
+
+// mget gets every key or none, if any key is denied.
+func (s *respService) mget(ctx context.Context, c *respConn, args []string) error {
+	if err := s.authorize(ctx, operationRead, args...); err != nil {
+		return err
+	}
+
+	values := make([][]byte, len(args))
+	for i, key := range args {
+		var err error
+		if values[i], err = s.getValue(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	c.writer.writeArray(len(values))
+	for _, value := range values {
+		if value == nil {
+			c.writer.writeNull()
+		} else {
+			c.writer.writeBulk(value)
+		}
+	}
+	return nil
+}
+
+// getValue returns the value of key, nil if it does not exist.
+func (s *respService) getValue(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.do(ctx, operationRead, key, func(ctx context.Context, key string) ([]byte, error) {
+		value, err := s.keyValue.Get(ctx, key)
+		return []byte(value), err
+	})
+	if (ErrorKeyNotFound{}).Is(err) {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+// set runs SET key value [EX seconds] [NX].
+func (s *respService) set(ctx context.Context, c *respConn, args []string) error {
+	key, value := args[0], []byte(args[1])
+
+	var ttl time.Duration
+	var nx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "EX":
+			if i+1 == len(args) || ttl != 0 {
+				return errRESPSyntax
+			}
+			i++
+
+			seconds, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || seconds <= 0 || seconds > int64(time.Duration(1<<63-1)/time.Second) {
+				return respError("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(seconds) * time.Second
+		default:
+			return errRESPSyntax
+		}
+	}
+
+	if (ttl != 0 || nx) && s.commander == nil {
+		return respError("ERR EX and NX are not supported by this server")
+	}
+
+	if err := s.authorize(ctx, operationWrite, key); err != nil {
+		return err
+	}
+
+	set := true
+	_, err := s.do(ctx, operationWrite, key, func(ctx context.Context, key string) ([]byte, error) {
+		if ttl == 0 && !nx {
+			return value, s.keyValue.Set(ctx, key, value)
+		}
+
+		var err error
+		if set, err = s.commander.SetArgs(ctx, key, value, ttl, nx); err == nil && set {
+			s.publish(ctx, KeyEvent{Type: keyEventSet, Key: key, Value: value})
+		}
+		return value, err
+	})
+	if err != nil {
+		return err
+	}
+
+	if set {
+		c.writer.writeSimple("OK")
+	} else {
+		c.writer.writeNull()
+	}
+	return nil
+}
+
+func (s *respService) incr(ctx context.Context, c *respConn, args []string) error {
+	if s.commander == nil {
+		return respError("ERR INCR is not supported by this server")
+	}
+
+	if err := s.authorize(ctx, operationWrite, args...); err != nil {
+		return err
+	}
+
+	var n int64
+	_, err := s.do(ctx, operationWrite, args[0], func(ctx context.Context, key string) ([]byte, error) {
+		var err error
+		if n, err = s.commander.Incr(ctx, key); err != nil {
+			return nil, err
+		}
+
+		value := []byte(strconv.FormatInt(n, 10))
+		s.publish(ctx, KeyEvent{Type: keyEventSet, Key: key, Value: value})
+		return value, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.writer.writeInt(n)
+	return nil
+}
+
+// del deletes every key or none, if any key is denied.
+func (s *respService) del(ctx context.Context, c *respConn, args []string) error {
+	if err := s.authorize(ctx, operationWrite, args...); err != nil {
+		return err
+	}
+
+	var deleted int64
+	for _, key := range args {
+		_, err := s.do(ctx, auditDelete, key, func(ctx context.Context, key string) ([]byte, error) {
+			return nil, s.keyValue.Delete(ctx, key)
+		})
+		if err == nil {
+			deleted++
+		} else if !(ErrorKeyNotFound{}).Is(err) {
+			return err
+		}
+	}
+
+	c.writer.writeInt(deleted)
+	return nil
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count], over the keys the
+// caller may read.
+func (s *respService) scan(ctx context.Context, c *respConn, args []string) error {
+	if s.keys == nil {
+		return respError("ERR SCAN is not supported by this server")
+	}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return respError("ERR invalid cursor")
+	}
+
+	pattern := "*"
+	limit := defaultKeyListLimit
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errRESPSyntax
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			limit, err = strconv.Atoi(args[i+1])
+			if err != nil || limit < 1 {
+				return errRESPSyntax
+			}
+			if limit > maxKeyListLimit {
+				limit = maxKeyListLimit
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+
+	// scan the keys of the literal prefix of the pattern
+	prefix := globPrefix(pattern)
+
+	page, err := s.keys.list(ctx, prefix, cursor, limit)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, info := range page.Keys {
+		if pattern == prefix+"*" || matchGlob(pattern, info.Key) {
+			keys = append(keys, info.Key)
+		}
+	}
+
+	next := page.Cursor
+	if next == "" {
+		next = "0"
+	}
+
+	c.writer.writeArray(2)
+	c.writer.writeBulk([]byte(next))
+	c.writer.writeArray(len(keys))
+	for _, key := range keys {
+		c.writer.writeBulk([]byte(key))
+	}
+	return nil
+}
+
+// authorize checks the caller in ctx may perform operation on every key,
+// recording the first key denied.
+func (s *respService) authorize(ctx context.Context, operation string, keys ...string) error {
+	var compiled *policy.Policy
+	if s.permissions != nil {
+		compiled, _ = s.permissions.callerPolicy(ctx)
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			return errRESPEmptyKey
+		}
+
+		if isInternalKey(s.keyPrefix, s.internalKeyPrefix, key) {
+			return errRESPReserved
+		}
+
+		if s.permissions == nil {
+			continue
+		}
+
+		required := s.permissions.requiredPermission(operation, key)
+		if !s.permissions.decide(ctx, compiled, operation, required) {
+			if s.auditor != nil {
+				s.auditor.recordValue(ctx, operation, key, http.StatusForbidden, nil)
+			}
+			return respError(fmt.Sprintf("NOPERM %s is not allowed", required))
+		}
+	}
+
+	return nil
+}
+
+// do runs an operation on key, prefixed when given to run, and records it.
+// run returns the value read or written.
+func (s *respService) do(ctx context.Context, operation string, key string, run func(ctx context.Context, key string) ([]byte, error)) ([]byte, error) {
+	value, err := run(ctx, s.keyPrefix+key)
+
+	status := http.StatusOK
+	var quotaErr *QuotaExceededError
+	var redisErr redis.Error
+	switch {
+	case err == nil:
+	case (ErrorKeyNotFound{}).Is(err):
+		status = http.StatusNotFound
+	case errors.As(err, &quotaErr):
+		status = http.StatusInsufficientStorage
+		err = respError("ERR " + quotaErr.Error())
+	case errors.As(err, &redisErr):
+		// such as incrementing a value which is not an integer
+		status = http.StatusBadRequest
+		err = respError(redisErr.Error())
+	default:
+		status = http.StatusInternalServerError
+	}
+
+	if s.auditor != nil {
+		s.auditor.recordValue(ctx, operation, key, status, value)
+	}
+
+	return value, err
+}
+
+// publish tells watchers of a change made beyond KeyValue, if watched.
+func (s *respService) publish(ctx context.Context, event KeyEvent) {
+	if s.events != nil {
+		publishKeyEvent(ctx, s.events, event)
+	}
+}
+
+// globPrefix returns the literal prefix of a Redis glob pattern.
+func globPrefix(pattern string) string {
+	var prefix strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return prefix.String()
+		case '\\':
+			if i+1 == len(pattern) {
+				return prefix.String()
+			}
+			i++
+		}
+		prefix.WriteByte(pattern[i])
+	}
+	return prefix.String()
+}
+
+// matchGlob matches s against a Redis glob pattern, supporting '*', '?',
+// character classes such as "[a-z]" or "[^0-9]", and '\' escapes.
+func matchGlob(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || len(s) == 0 || !matchClass(pattern[1:end+1], s[0]) {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
+
+// matchClass matches c against the characters of a class, without its brackets.
+func matchClass(class string, c byte) bool {
+	negated := strings.HasPrefix(class, "^")
+	if negated {
+		class = class[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				matched = true
+			}
+			i += 2
+		} else if class[i] == c {
+			matched = true
+		}
+	}
+
+	return matched != negated
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// respMaxArgs bounds the arguments of a command, such as the keys of MGET
+	respMaxArgs = 1024
+	// respMaxBulkLength bounds each argument, such as the value of SET
+	respMaxBulkLength = 16 << 20
+	// respMaxLineLength bounds inline commands and the headers of arguments
+	respMaxLineLength = 64 << 10
+
+	// commands of clients yet to authenticate are bounded as in Redis, so
+	// that anyone reaching the server cannot make it allocate much memory
+	respMaxArgsUnauthenticated       = 10
+	respMaxBulkLengthUnauthenticated = 16 << 10
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// respReader reads the commands sent by Redis clients.
+type respReader struct {
+	r *bufio.Reader
+}
+
+func newRESPReader(r io.Reader) *respReader {
+	return &respReader{r: bufio.NewReaderSize(r, respMaxLineLength)}
+}
+
+// buffered returns whether more commands were sent, pipelined, than read.
+func (r *respReader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// readCommand reads the arguments of a command, sent as an array of bulk
+// strings as clients do, or inline as space separated words. Arrays are
+// refused beyond maxArgs arguments, or arguments of maxBulkLength bytes.
+func (r *respReader) readCommand(maxArgs, maxBulkLength int) ([]string, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		// empty lines and arrays are ignored, as Redis does
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] != '*' {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxArgs {
+			return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+		}
+
+		if n <= 0 {
+			continue
+		}
+
+		args := make([]string, n)
+		for i := range args {
+			if args[i], err = r.readBulk(maxBulkLength); err != nil {
+				return nil, err
+			}
+		}
+
+		return args, nil
+	}
+}
+
+func (r *respReader) readBulk(maxLength int) (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return "", fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 || length > maxLength {
+		return "", fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+	}
+
+	buf := make([]byte, length+2)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return "", err
+	}
+
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return "", fmt.Errorf("%w: invalid bulk terminator", errRESPProtocol)
+	}
+
+	return string(buf[:length]), nil
+}
+
+// readLine reads a line without its "\r\n" terminator.
+func (r *respReader) readLine() (string, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: too big inline request", errRESPProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// respWriter writes replies to Redis clients, buffered until flushed.
+// Errors are kept until flushed.
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func newRESPWriter(w io.Writer) *respWriter {
+	return &respWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *respWriter) writeSimple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+// writeError writes an error, its first word being its kind such as "ERR".
+func (w *respWriter) writeError(s string) {
+	s = strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	w.w.WriteString("-" + s + "\r\n")
+}
+
+func (w *respWriter) writeInt(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) writeBulk(b []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+// writeNull writes the null bulk string, such as the value of a missing key.
+func (w *respWriter) writeNull() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// writeArray starts an array of n elements, written next.
+func (w *respWriter) writeArray(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *respWriter) flush() error {
+	return w.w.Flush()
+}
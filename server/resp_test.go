@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRESP(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer rdb.Close()
+
+	// tokens are the subject of the caller, holding the permissions below
+	permissions := map[string][]string{
+		"alice": {"read:kave:team-a:*", "write:kave:team-a:*", "read:kave-resp-test:team-a:*", "write:kave-resp-test:team-a:*"},
+		"bob":   {"read:kave:team-a:*"},
+	}
+	parse := func(token string) (*Claims, error) {
+		if _, ok := permissions[token]; !ok {
+			return nil, assert.AnError
+		}
+
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: token},
+			Permissions:      permissions[token],
+		}, nil
+	}
+
+	// serve returns the address of the RESP API of a new server
+	serve := func(configStr string, opts ...Option) string {
+		var config Config
+		_, err := toml.Decode(configStr, &config)
+		assert.NoError(t, err)
+
+		s, err := New(ctx, config, append([]Option{WithRedisClient(rdb), WithTokenParser(parse)}, opts...)...)
+		assert.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() { _ = s.RESPServer().Serve(listener) }()
+
+		return listener.Addr().String()
+	}
+
+	newTestClient := func(addr string, token string) *redis.Client {
+		client := redis.NewClient(&redis.Options{Addr: addr, Password: token, MaxRetries: -1})
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	// the RESP API is only served when enabled
+	{
+		var config Config
+		s, err := New(ctx, config, WithRedisClient(rdb), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+		assert.NoError(t, err)
+		assert.Nil(t, s.RESPServer())
+		s.Close()
+	}
+
+	addr := serve(`
+[auth]
+enabled = true
+
+[resp]
+enabled = true
+`, WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+	// commands require a valid token
+	{
+		err := newTestClient(addr, "").Get(ctx, "team-a:foo").Err()
+		assert.EqualError(t, err, "NOAUTH Authentication required.")
+
+		err = newTestClient(addr, "mallory").Ping(ctx).Err()
+		assert.EqualError(t, err, "WRONGPASS invalid token")
+
+		assert.NoError(t, newTestClient(addr, "alice").Ping(ctx).Err())
+	}
+
+	alice := newTestClient(addr, "alice")
+	bob := newTestClient(addr, "bob")
+
+	// keys are set, got and deleted with the permissions of the caller
+	{
+		assert.NoError(t, alice.Set(ctx, "team-a:foo", "bar", 0).Err())
+
+		value, err := bob.Get(ctx, "team-a:foo").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", value)
+
+		err = bob.Set(ctx, "team-a:foo", "baz", 0).Err()
+		assert.EqualError(t, err, "NOPERM write:kave:team-a:foo is not allowed")
+
+		err = alice.Get(ctx, "team-b:foo").Err()
+		assert.EqualError(t, err, "NOPERM read:kave:team-b:foo is not allowed")
+
+		err = alice.Get(ctx, "team-a:missing").Err()
+		assert.Equal(t, redis.Nil, err)
+
+		values, err := alice.MGet(ctx, "team-a:foo", "team-a:missing").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{"bar", nil}, values)
+
+		// keys are read all or none
+		err = alice.MGet(ctx, "team-a:foo", "team-b:foo").Err()
+		assert.EqualError(t, err, "NOPERM read:kave:team-b:foo is not allowed")
+
+		err = bob.Del(ctx, "team-a:foo").Err()
+		assert.EqualError(t, err, "NOPERM write:kave:team-a:foo is not allowed")
+
+		deleted, err := alice.Del(ctx, "team-a:foo", "team-a:missing").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted)
+	}
+
+	// commands are pipelined
+	{
+		pipe := alice.Pipeline()
+		set := pipe.Set(ctx, "team-a:pipelined", "bar", 0)
+		get := pipe.Get(ctx, "team-a:pipelined")
+		denied := pipe.Get(ctx, "team-b:pipelined")
+		_, _ = pipe.Exec(ctx)
+
+		assert.NoError(t, set.Err())
+		assert.Equal(t, "bar", get.Val())
+		assert.Error(t, denied.Err())
+	}
+
+	// commands beyond the backend are refused
+	{
+		err := alice.Incr(ctx, "team-a:counter").Err()
+		assert.EqualError(t, err, "ERR INCR is not supported by this server")
+
+		err = alice.SetArgs(ctx, "team-a:foo", "bar", redis.SetArgs{Mode: "NX"}).Err()
+		assert.EqualError(t, err, "ERR EX and NX are not supported by this server")
+
+		err = alice.Scan(ctx, 0, "", 0).Err()
+		assert.EqualError(t, err, "ERR SCAN is not supported by this server")
+
+		err = alice.Keys(ctx, "*").Err()
+		assert.EqualError(t, err, "ERR unknown command 'KEYS'")
+	}
+
+	// keys are kept in Redis under the key prefix
+	{
+		keyPrefix := "kave-resp-test:"
+		keys := []string{"team-a:foo", "team-a:bar", "team-a:counter", "team-b:foo"}
+		for _, key := range keys {
+			assert.NoError(t, rdb.Del(ctx, keyPrefix+key).Err())
+		}
+		assert.NoError(t, rdb.Set(ctx, keyPrefix+"team-b:foo", "bar", 0).Err())
+
+		addr := serve(`
+redis_key_prefix = "kave-resp-test:"
+
+[auth]
+enabled = true
+
+[resp]
+enabled = true
+`)
+		alice := newTestClient(addr, "alice")
+
+		set, err := alice.SetNX(ctx, "team-a:foo", "bar", time.Minute).Result()
+		assert.NoError(t, err)
+		assert.True(t, set)
+
+		set, err = alice.SetNX(ctx, "team-a:foo", "baz", time.Minute).Result()
+		assert.NoError(t, err)
+		assert.False(t, set)
+
+		ttl, err := rdb.TTL(ctx, keyPrefix+"team-a:foo").Result()
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Minute, ttl, float64(5*time.Second))
+
+		n, err := alice.Incr(ctx, "team-a:counter").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		err = alice.Incr(ctx, "team-a:foo").Err()
+		assert.EqualError(t, err, "ERR value is not an integer or out of range")
+
+		// only the keys the caller may read are scanned
+		var scanned []string
+		iter := alice.Scan(ctx, 0, "team-*:f?o", 0).Iterator()
+		for iter.Next(ctx) {
+			scanned = append(scanned, iter.Val())
+		}
+		assert.NoError(t, iter.Err())
+		assert.Equal(t, []string{"team-a:foo"}, scanned)
+
+		for _, key := range keys {
+			assert.NoError(t, rdb.Del(ctx, keyPrefix+key).Err())
+		}
+	}
+
+	// failed AUTH attempts are rate limited
+	{
+		// buckets are kept in Redis, under a prefix unique to each run
+		addr := serve(fmt.Sprintf(`
+internal_key_prefix = "kave-resp-test:%d:"
+
+[auth]
+enabled = true
+
+[resp]
+enabled = true
+
+[rate_limit]
+enabled = true
+rate = 1
+burst = 2
+`, time.Now().UnixNano()), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+		client := newTestClient(addr, "")
+		for i := 0; i < 2; i++ {
+			err := client.Do(ctx, "AUTH", "mallory").Err()
+			assert.EqualError(t, err, "WRONGPASS invalid token")
+		}
+
+		err := client.Do(ctx, "AUTH", "mallory").Err()
+		assert.EqualError(t, err, "ERR rate limit exceeded, retry after 1 seconds")
+	}
+
+	// authenticated callers are limited by subject only, beyond the limit of their address
+	{
+		addr := serve(fmt.Sprintf(`
+internal_key_prefix = "kave-resp-test:%d:"
+
+[auth]
+enabled = true
+
+[resp]
+enabled = true
+
+[rate_limit]
+enabled = true
+rate = 1
+burst = 2
+
+[[rate_limit.overrides]]
+pattern = "sub:alice"
+rate = 1
+burst = 4
+`, time.Now().UnixNano()), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+		alice := newTestClient(addr, "alice")
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, redis.Nil, alice.Get(ctx, "team-a:foo").Err())
+		}
+
+		err := alice.Get(ctx, "team-a:foo").Err()
+		assert.EqualError(t, err, "ERR rate limit exceeded, retry after 1 seconds")
+	}
+
+	// exceeded quotas are replied as errors, and expiring keys are refused
+	{
+		keyPrefix := "kave-resp-test:"
+		assert.NoError(t, rdb.Del(ctx, keyPrefix+"team-a:quota").Err())
+
+		addr := serve(`
+redis_key_prefix = "kave-resp-test:"
+
+[resp]
+enabled = true
+
+[quotas]
+enabled = true
+
+[[quotas.limits]]
+prefix = "team-a:"
+max_bytes = 3
+`)
+		client := newTestClient(addr, "")
+
+		err := client.Set(ctx, "team-a:quota", "toolarge", 0).Err()
+		assert.EqualError(t, err, "ERR value exceeds quota of 'team-a:': 3 bytes")
+
+		assert.NoError(t, client.Set(ctx, "team-a:quota", "ok", 0).Err())
+
+		err = client.Set(ctx, "team-a:quota", "ok", time.Minute).Err()
+		assert.EqualError(t, err, "ERR EX and NX are not supported by this server")
+
+		assert.NoError(t, client.Del(ctx, "team-a:quota").Err())
+	}
+
+	// malformed commands are refused
+	{
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+
+		_, err = conn.Write([]byte("PING\r\n"))
+		assert.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "-NOAUTH Authentication required.\r\n", line)
+
+		_, err = conn.Write([]byte("*1\r\n+PING\r\n"))
+		assert.NoError(t, err)
+		line, err = reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "-ERR Protocol error: expected '$', got '+'\r\n", line)
+
+		// the connection is closed
+		_, err = reader.ReadString('\n')
+		assert.Error(t, err)
+	}
+
+	// commands of clients yet to authenticate are bounded
+	{
+		for _, command := range []string{
+			"*2\r\n$4\r\nAUTH\r\n$16385\r\n",
+			"*11\r\n",
+		} {
+			conn, err := net.Dial("tcp", addr)
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte(command))
+			assert.NoError(t, err)
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			assert.NoError(t, err)
+			assert.Contains(t, line, "-ERR Protocol error: invalid")
+		}
+
+		// but not once authenticated
+		value := strings.Repeat("a", respMaxBulkLengthUnauthenticated+1)
+		assert.NoError(t, alice.Set(ctx, "team-a:large", value, 0).Err())
+		assert.NoError(t, alice.Del(ctx, "team-a:large").Err())
+	}
+
+	// idle connections are closed, and clients beyond the connections allowed are refused
+	{
+		addr := serve(`
+[resp]
+enabled = true
+idle_timeout_ms = 100
+max_connections = 1
+`, WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("PING\r\n"))
+		assert.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "+PONG\r\n", line)
+
+		refused, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer refused.Close()
+
+		line, err = bufio.NewReader(refused).ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "-ERR max number of clients reached\r\n", line)
+
+		// the connection is closed once idle
+		_, err = reader.ReadString('\n')
+		assert.Error(t, err)
+
+		// making room for other clients
+		assert.Eventually(t, func() bool {
+			return newTestClient(addr, "").Ping(ctx).Err() == nil
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		matched bool
+	}{
+		{"*", "", true},
+		{"team-a:*", "team-a:foo", true},
+		{"team-a:*", "team-b:foo", false},
+		{"*:foo", "team-a:foo", true},
+		{"team-?:foo", "team-a:foo", true},
+		{"team-?:foo", "team-ab:foo", false},
+		{"team-[ab]:*", "team-b:foo", true},
+		{"team-[^ab]:*", "team-b:foo", false},
+		{"team-[a-c]:*", "team-c:foo", true},
+		{"team-[a-c]:*", "team-d:foo", false},
+		{`team\*`, "team*", true},
+		{`team\*`, "teams", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.matched, matchGlob(c.pattern, c.s), "%s %s", c.pattern, c.s)
+	}
+
+	assert.Equal(t, "team-", globPrefix("team-?:*"))
+	assert.Equal(t, "team*", globPrefix(`team\**`))
+	assert.Equal(t, "team-a:foo", globPrefix("team-a:foo"))
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	revocationsPath            = "/_admin/revocations"
+	permissionAdminRevocations = "admin:revocations"
+
+	defaultRevocationCacheTTL = 5 * time.Second
+	defaultMaxTokenTTL        = 24 * time.Hour
+
+	revocationKindJTI    = "jti"
+	revocationKindClient = "client"
+)
+
+// Revocation denies a single token by its jti, or every token issued to a
+// client up to RevokedAt. It is dropped once the tokens it denies have expired.
+type Revocation struct {
+	Kind      string    `json:"kind"`
+	ID        string    `json:"id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (r Revocation) key() string {
+	return revocationKey(r.Kind, r.ID)
+}
+
+func revocationKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+// revocationStore keeps revocations shared by every server.
+type revocationStore interface {
+	Add(ctx context.Context, revocation Revocation) error
+	// Lookup returns the revocations of keys, nil where a key is not revoked.
+	Lookup(ctx context.Context, keys []string) ([]*Revocation, error)
+	List(ctx context.Context) ([]Revocation, error)
+	Delete(ctx context.Context, key string) (bool, error)
+}
+
+type revocationCacheEntry struct {
+	revocation *Revocation
+	checked    time.Time
+}
+
+// Revocations checks tokens against the revocation denylist, caching lookups
+// for a short while to avoid a store round trip on every request.
+type Revocations struct {
+	store       revocationStore
+	cacheTTL    time.Duration
+	maxTokenTTL time.Duration
+	now         func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]revocationCacheEntry
+}
+
+// NewRevocations creates Revocations, client revocations are kept for
+// maxTokenTTL, the longest lifetime of a token.
+func NewRevocations(store revocationStore, cacheTTL time.Duration, maxTokenTTL time.Duration) *Revocations {
+	if cacheTTL == 0 {
+		cacheTTL = defaultRevocationCacheTTL
+	}
+
+	if maxTokenTTL == 0 {
+		maxTokenTTL = defaultMaxTokenTTL
+	}
+
+	return &Revocations{
+		store:       store,
+		cacheTTL:    cacheTTL,
+		maxTokenTTL: maxTokenTTL,
+		now:         time.Now,
+		cache:       make(map[string]revocationCacheEntry),
+	}
+}
+
+// IsRevoked reports whether the token of claims was revoked, by its jti or
+// by its client, matched against both azp (or client_id) and sub.
+func (r *Revocations) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	var keys []string
+	if claims.ID != "" {
+		keys = append(keys, revocationKey(revocationKindJTI, claims.ID))
+	}
+	if client := claims.Client(); client != "" {
+		keys = append(keys, revocationKey(revocationKindClient, client))
+	}
+	if claims.Subject != "" && claims.Subject != claims.Client() {
+		keys = append(keys, revocationKey(revocationKindClient, claims.Subject))
+	}
+
+	revocations, err := r.lookup(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+
+	for _, revocation := range revocations {
+		if revocation == nil {
+			continue
+		}
+
+		if revocation.Kind == revocationKindJTI {
+			return true, nil
+		}
+
+		// tokens issued after a client was revoked are valid
+		if claims.IssuedAt == nil || !claims.IssuedAt.After(revocation.RevokedAt) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// lookup returns the revocations of keys, from the cache when fresh.
+func (r *Revocations) lookup(ctx context.Context, keys []string) ([]*Revocation, error) {
+	now := r.now()
+	revocations := make([]*Revocation, len(keys))
+
+	var missing []string
+	var missingIdx []int
+
+	r.mu.Lock()
+	for i, key := range keys {
+		entry, ok := r.cache[key]
+		if ok && now.Sub(entry.checked) < r.cacheTTL {
+			revocations[i] = entry.revocation
+			continue
+		}
+		missing = append(missing, key)
+		missingIdx = append(missingIdx, i)
+	}
+	r.mu.Unlock()
+
+	if len(missing) == 0 {
+		return revocations, nil
+	}
+
+	found, err := r.store.Lookup(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// drop stale entries every now and then, instead of tracking their age
+	if len(r.cache) > 10000 {
+		for key, entry := range r.cache {
+			if now.Sub(entry.checked) >= r.cacheTTL {
+				delete(r.cache, key)
+			}
+		}
+	}
+
+	for i, revocation := range found {
+		revocations[missingIdx[i]] = revocation
+		r.cache[missing[i]] = revocationCacheEntry{revocation: revocation, checked: now}
+	}
+
+	return revocations, nil
+}
+
+// Revoke adds a revocation to the denylist. A jti revocation expires at
+// expiresAt, or after the longest token lifetime if zero.
+func (r *Revocations) Revoke(ctx context.Context, kind string, id string, expiresAt time.Time) (Revocation, error) {
+	if id == "" {
+		return Revocation{}, fmt.Errorf("%s must not be empty", kind)
+	}
+
+	now := r.now().Truncate(time.Second)
+
+	revocation := Revocation{
+		Kind:      kind,
+		ID:        id,
+		RevokedAt: now,
+		ExpiresAt: now.Add(r.maxTokenTTL),
+	}
+
+	switch kind {
+	case revocationKindJTI:
+		if !expiresAt.IsZero() {
+			revocation.ExpiresAt = expiresAt
+		}
+	case revocationKindClient:
+	default:
+		return Revocation{}, fmt.Errorf("unknown revocation kind: %s", kind)
+	}
+
+	if !revocation.ExpiresAt.After(now) {
+		return Revocation{}, fmt.Errorf("token already expired")
+	}
+
+	if err := r.store.Add(ctx, revocation); err != nil {
+		return Revocation{}, err
+	}
+
+	r.mu.Lock()
+	r.cache[revocation.key()] = revocationCacheEntry{revocation: &revocation, checked: r.now()}
+	r.mu.Unlock()
+
+	return revocation, nil
+}
+
+// Unrevoke removes a revocation, reporting whether it existed.
+func (r *Revocations) Unrevoke(ctx context.Context, kind string, id string) (bool, error) {
+	key := revocationKey(kind, id)
+
+	deleted, err := r.store.Delete(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	delete(r.cache, key)
+	r.mu.Unlock()
+
+	return deleted, nil
+}
+
+// List returns the revocations in the denylist.
+func (r *Revocations) List(ctx context.Context) ([]Revocation, error) {
+	return r.store.List(ctx)
+}
+
+// RevocationsHandler manages the revocation denylist.
+type RevocationsHandler struct {
+	revocations *Revocations
+}
+
+func NewRevocationsHandler(revocations *Revocations) *RevocationsHandler {
+	return &RevocationsHandler{
+		revocations: revocations,
+	}
+}
+
+type revokeRequest struct {
+	JTI    string `json:"jti,omitempty"`
+	Client string `json:"client,omitempty"`
+	// Exp is the expiry of the revoked token, in seconds since epoch
+	Exp int64 `json:"exp,omitempty"`
+}
+
+// kindAndID returns the kind and id of a revocation request.
+func (req revokeRequest) kindAndID() (string, string, error) {
+	switch {
+	case req.JTI != "" && req.Client != "":
+		return "", "", fmt.Errorf("only one of jti or client must be set")
+	case req.JTI != "":
+		return revocationKindJTI, req.JTI, nil
+	case req.Client != "":
+		return revocationKindClient, req.Client, nil
+	default:
+		return "", "", fmt.Errorf("jti or client must be set")
+	}
+}
+
+// List responds with every revocation in the denylist.
+func (h *RevocationsHandler) List(w http.ResponseWriter, r *http.Request) {
+	revocations, err := h.revocations.List(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error listing revocations", err)
+		return
+	}
+
+	if revocations == nil {
+		revocations = []Revocation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(revocations)
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+// Revoke adds a token or client to the denylist.
+func (h *RevocationsHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	var req revokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	kind, id, err := req.kindAndID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt time.Time
+	if req.Exp != 0 {
+		expiresAt = time.Unix(req.Exp, 0)
+	}
+
+	revocation, err := h.revocations.Revoke(r.Context(), kind, id, expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loggerFromCtx(r.Context()).Info("revoked", "kind", kind, "id", id, "until", revocation.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(revocation)
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+// Unrevoke removes a token or client from the denylist, given as query parameter.
+func (h *RevocationsHandler) Unrevoke(w http.ResponseWriter, r *http.Request) {
+	req := revokeRequest{
+		JTI:    r.URL.Query().Get(revocationKindJTI),
+		Client: r.URL.Query().Get(revocationKindClient),
+	}
+
+	kind, id, err := req.kindAndID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.revocations.Unrevoke(r.Context(), kind, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error deleting revocation", err)
+		return
+	}
+
+	if !deleted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	loggerFromCtx(r.Context()).Info("unrevoked", "kind", kind, "id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
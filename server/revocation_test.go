@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+type memoryRevocationStore struct {
+	mu          sync.Mutex
+	revocations map[string]Revocation
+	lookups     int
+}
+
+func newMemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{revocations: make(map[string]Revocation)}
+}
+
+func (s *memoryRevocationStore) Add(ctx context.Context, revocation Revocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revocations[revocation.key()] = revocation
+	return nil
+}
+
+func (s *memoryRevocationStore) Lookup(ctx context.Context, keys []string) ([]*Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lookups++
+
+	revocations := make([]*Revocation, len(keys))
+	for i, key := range keys {
+		if revocation, ok := s.revocations[key]; ok {
+			revocations[i] = &revocation
+		}
+	}
+	return revocations, nil
+}
+
+func (s *memoryRevocationStore) List(ctx context.Context) ([]Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revocations []Revocation
+	for _, revocation := range s.revocations {
+		revocations = append(revocations, revocation)
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].key() < revocations[j].key()
+	})
+	return revocations, nil
+}
+
+func (s *memoryRevocationStore) Delete(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revocations[key]
+	delete(s.revocations, key)
+	return ok, nil
+}
+
+func TestRevocations(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryRevocationStore()
+	revocations := NewRevocations(store, time.Minute, time.Hour)
+
+	now := time.Now()
+	issuedBefore := jwt.NewNumericDate(now.Add(-time.Minute))
+
+	tokenOf := func(jti, azp, sub string, iat *jwt.NumericDate) *Claims {
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{ID: jti, Subject: sub, IssuedAt: iat},
+			AuthorizedParty:  azp,
+		}
+	}
+
+	// nothing revoked
+	{
+		revoked, err := revocations.IsRevoked(ctx, tokenOf("1", "ci", "ci@clients", issuedBefore))
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	}
+
+	// revoke a single token
+	{
+		revocation, err := revocations.Revoke(ctx, revocationKindJTI, "1", now.Add(10*time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, now.Add(10*time.Minute).Unix(), revocation.ExpiresAt.Unix())
+
+		revoked, err := revocations.IsRevoked(ctx, tokenOf("1", "ci", "ci@clients", issuedBefore))
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		revoked, err = revocations.IsRevoked(ctx, tokenOf("2", "ci", "ci@clients", issuedBefore))
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	}
+
+	// revoke every token of a client, by azp
+	{
+		revocation, err := revocations.Revoke(ctx, revocationKindClient, "ci", time.Time{})
+		assert.NoError(t, err)
+		assert.Equal(t, revocation.RevokedAt.Add(time.Hour), revocation.ExpiresAt)
+
+		revoked, err := revocations.IsRevoked(ctx, tokenOf("2", "ci", "ci@clients", issuedBefore))
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		// tokens without iat
+		revoked, err = revocations.IsRevoked(ctx, tokenOf("3", "ci", "", nil))
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		// tokens issued after revocation are valid
+		revoked, err = revocations.IsRevoked(ctx, tokenOf("4", "ci", "ci@clients", jwt.NewNumericDate(now.Add(time.Minute))))
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	}
+
+	// revoke a client by sub
+	{
+		_, err := revocations.Revoke(ctx, revocationKindClient, "deploy@clients", time.Time{})
+		assert.NoError(t, err)
+
+		revoked, err := revocations.IsRevoked(ctx, tokenOf("", "deploy", "deploy@clients", issuedBefore))
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+	}
+
+	// invalid revocations
+	{
+		_, err := revocations.Revoke(ctx, revocationKindJTI, "", time.Time{})
+		assert.Error(t, err)
+
+		_, err = revocations.Revoke(ctx, revocationKindJTI, "5", now.Add(-time.Minute))
+		assert.Error(t, err)
+
+		_, err = revocations.Revoke(ctx, "sub", "alice", time.Time{})
+		assert.Error(t, err)
+	}
+
+	// unrevoke
+	{
+		deleted, err := revocations.Unrevoke(ctx, revocationKindClient, "ci")
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+
+		revoked, err := revocations.IsRevoked(ctx, tokenOf("2", "ci", "ci@clients", issuedBefore))
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		deleted, err = revocations.Unrevoke(ctx, revocationKindClient, "ci")
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+	}
+}
+
+func TestRevocationsCache(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryRevocationStore()
+	revocations := NewRevocations(store, time.Minute, time.Hour)
+
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{ID: "1", IssuedAt: jwt.NewNumericDate(time.Now())},
+		AuthorizedParty:  "ci",
+	}
+
+	// lookups are cached
+	{
+		_, err := revocations.IsRevoked(ctx, claims)
+		assert.NoError(t, err)
+		_, err = revocations.IsRevoked(ctx, claims)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, store.lookups)
+	}
+
+	// revocations made by another server are seen once the cache expires
+	{
+		assert.NoError(t, store.Add(ctx, Revocation{Kind: revocationKindJTI, ID: "1"}))
+
+		revoked, err := revocations.IsRevoked(ctx, claims)
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		revocations.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		revoked, err = revocations.IsRevoked(ctx, claims)
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+		assert.Equal(t, 2, store.lookups)
+	}
+}
+
+func TestAuthMiddlewareRevoked(t *testing.T) {
+	revocations := NewRevocations(newMemoryRevocationStore(), 0, 0)
+
+	_, err := revocations.Revoke(context.Background(), revocationKindJTI, "leaked", time.Time{})
+	assert.NoError(t, err)
+
+	parser := func(token string) (*Claims, error) {
+		return &Claims{RegisteredClaims: jwt.RegisteredClaims{ID: token}}, nil
+	}
+
+	handler := NewAuthMiddleware(parser, writeClaimsToCtx, revocations.IsRevoked).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	serve := func(token string) int {
+		request := httptest.NewRequest(http.MethodGet, "/redis/foo", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("leaked"))
+	assert.Equal(t, http.StatusOK, serve("other"))
+}
+
+func TestRevocationsHandler(t *testing.T) {
+	revocations := NewRevocations(newMemoryRevocationStore(), 0, 0)
+
+	var permissions []string
+	pm := NewPermissionMiddleware(
+		"kave:",
+		policy.SyntaxGlob,
+		readKeyFromCtx,
+		func(ctx context.Context) []string {
+			return permissions
+		},
+		readClaimsFromCtx,
+	)
+
+	handler := NewRevocationsHandler(revocations)
+
+	router := chi.NewRouter()
+	router.Route(revocationsPath, func(r chi.Router) {
+		r.Use(pm.Require(permissionAdminRevocations))
+		r.Get("/", handler.List)
+		r.Post("/", handler.Revoke)
+		r.Delete("/", handler.Unrevoke)
+	})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return recorder
+	}
+
+	// admin permission is required
+	{
+		permissions = []string{"read:kave:**", "write:kave:**"}
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, revocationsPath, "").Code)
+		assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, revocationsPath, `{"client":"ci"}`).Code)
+	}
+
+	permissions = []string{"admin:*"}
+
+	// revoke
+	{
+		exp := time.Now().Add(time.Hour).Unix()
+		body, _ := json.Marshal(revokeRequest{JTI: "abc", Exp: exp})
+
+		recorder := serve(http.MethodPost, revocationsPath, string(body))
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+
+		var revocation Revocation
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&revocation))
+		assert.Equal(t, revocationKindJTI, revocation.Kind)
+		assert.Equal(t, "abc", revocation.ID)
+		assert.Equal(t, exp, revocation.ExpiresAt.Unix())
+
+		assert.Equal(t, http.StatusCreated, serve(http.MethodPost, revocationsPath, `{"client":"ci"}`).Code)
+	}
+
+	// invalid requests
+	{
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, revocationsPath, `{}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, revocationsPath, `{"jti":"a","client":"b"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, revocationsPath, `{"jti":"a","exp":1}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, revocationsPath, `{`).Code)
+	}
+
+	// list
+	{
+		recorder := serve(http.MethodGet, revocationsPath, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var listed []Revocation
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&listed))
+		assert.Len(t, listed, 2)
+		assert.Equal(t, "client:ci", listed[0].key())
+		assert.Equal(t, "jti:abc", listed[1].key())
+	}
+
+	// unrevoke
+	{
+		assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, revocationsPath+"?client=ci", "").Code)
+		assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, revocationsPath+"?client=ci", "").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodDelete, revocationsPath, "").Code)
+	}
+}
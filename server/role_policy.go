@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	defaultGroupsClaim        = "groups"
+	defaultPolicyReloadPeriod = 10 * time.Second
+)
+
+// rolePolicyFile is the format of the role policy file.
+type rolePolicyFile struct {
+	Roles map[string]struct {
+		Permissions []string `toml:"permissions"`
+	} `toml:"roles"`
+	Bindings []struct {
+		Roles    []string `toml:"roles"`
+		Subjects []string `toml:"subjects"`
+		Groups   []string `toml:"groups"`
+		Clients  []string `toml:"clients"`
+	} `toml:"bindings"`
+}
+
+// roleIndex maps subjects, groups and clients to the permissions of their roles.
+type roleIndex struct {
+	subjects map[string][]string
+	groups   map[string][]string
+	clients  map[string][]string
+}
+
+// RolePolicy resolves permissions granted locally to a token, through roles
+// bound to its subject, groups or client. The policy file can be reloaded
+// while serving requests.
+type RolePolicy struct {
+	path        string
+	groupsClaim string
+
+	mu      sync.RWMutex
+	index   *roleIndex
+	modTime time.Time
+}
+
+func NewRolePolicy(path string, groupsClaim string) (*RolePolicy, error) {
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+
+	rp := &RolePolicy{
+		path:        path,
+		groupsClaim: groupsClaim,
+	}
+
+	if err := rp.Reload(); err != nil {
+		return nil, err
+	}
+
+	return rp, nil
+}
+
+// Reload reads the policy file again. On failure the current roles are kept.
+func (rp *RolePolicy) Reload() error {
+	info, err := os.Stat(rp.path)
+	if err != nil {
+		return err
+	}
+
+	var file rolePolicyFile
+	if _, err := toml.DecodeFile(rp.path, &file); err != nil {
+		return fmt.Errorf("failed to decode policy file: %w", err)
+	}
+
+	index, err := buildRoleIndex(&file)
+	if err != nil {
+		return err
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	rp.index = index
+	rp.modTime = info.ModTime()
+
+	return nil
+}
+
+func buildRoleIndex(file *rolePolicyFile) (*roleIndex, error) {
+	index := &roleIndex{
+		subjects: make(map[string][]string),
+		groups:   make(map[string][]string),
+		clients:  make(map[string][]string),
+	}
+
+	for i, binding := range file.Bindings {
+		var permissions []string
+		for _, name := range binding.Roles {
+			role, ok := file.Roles[name]
+			if !ok {
+				return nil, fmt.Errorf("binding %d refers to unknown role '%s'", i, name)
+			}
+			permissions = append(permissions, role.Permissions...)
+		}
+
+		for _, subject := range binding.Subjects {
+			index.subjects[subject] = append(index.subjects[subject], permissions...)
+		}
+		for _, group := range binding.Groups {
+			index.groups[group] = append(index.groups[group], permissions...)
+		}
+		for _, client := range binding.Clients {
+			index.clients[client] = append(index.clients[client], permissions...)
+		}
+	}
+
+	return index, nil
+}
+
+// Resolve returns the permissions bound to the token claims through roles.
+func (rp *RolePolicy) Resolve(claims *Claims) []string {
+	rp.mu.RLock()
+	index := rp.index
+	rp.mu.RUnlock()
+
+	var permissions []string
+
+	if claims.Subject != "" {
+		permissions = append(permissions, index.subjects[claims.Subject]...)
+	}
+
+	if client := claims.Client(); client != "" {
+		permissions = append(permissions, index.clients[client]...)
+	}
+
+	for _, group := range rp.groupsOf(claims) {
+		permissions = append(permissions, index.groups[group]...)
+	}
+
+	return permissions
+}
+
+// Permissions returns the token permissions together with the ones granted by roles.
+func (rp *RolePolicy) Permissions(claims *Claims) []string {
+	resolved := rp.Resolve(claims)
+	if len(resolved) == 0 {
+		return claims.Permissions
+	}
+
+	permissions := make([]string, 0, len(claims.Permissions)+len(resolved))
+	permissions = append(permissions, claims.Permissions...)
+	return append(permissions, resolved...)
+}
+
+// groupsOf reads the groups claim, either a list of strings or a single string.
+func (rp *RolePolicy) groupsOf(claims *Claims) []string {
+	value, ok := claims.Claim(rp.groupsClaim)
+	if !ok {
+		return nil
+	}
+
+	switch groups := value.(type) {
+	case string:
+		return []string{groups}
+	case []interface{}:
+		result := make([]string, 0, len(groups))
+		for _, group := range groups {
+			if s, ok := group.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// changed reports whether the policy file was modified since last loaded.
+func (rp *RolePolicy) changed() bool {
+	info, err := os.Stat(rp.path)
+	if err != nil {
+		return false
+	}
+
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return !info.ModTime().Equal(rp.modTime)
+}
+
+// Watch reloads the policy file when it changes or when reload receives,
+// until ctx is done. reload may be nil.
+func (rp *RolePolicy) Watch(ctx context.Context, period time.Duration, reload <-chan struct{}) {
+	if period == 0 {
+		period = defaultPolicyReloadPeriod
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !rp.changed() {
+				continue
+			}
+		case <-reload:
+		}
+
+		if err := rp.Reload(); err != nil {
+			slog.Error("failed to reload policy file", err, "path", rp.path)
+			continue
+		}
+
+		slog.Info("reloaded policy file", "path", rp.path)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRolePolicy = `
+[roles.reader]
+permissions = ["read:kave:shared:**"]
+
+[roles.ci]
+permissions = ["read:kave:ci:**", "write:kave:ci:**", "deny:write:kave:ci:locked"]
+
+[[bindings]]
+roles = ["reader"]
+groups = ["engineering"]
+
+[[bindings]]
+roles = ["reader", "ci"]
+clients = ["ci-client"]
+
+[[bindings]]
+roles = ["ci"]
+subjects = ["auth0|alice"]
+`
+
+func parseTestClaims(t *testing.T, raw string) *Claims {
+	claims := &Claims{}
+	assert.NoError(t, json.Unmarshal([]byte(raw), claims))
+	return claims
+}
+
+func TestRolePolicy(t *testing.T) {
+	policyFile := path.Join(t.TempDir(), "policy.toml")
+	assert.NoError(t, os.WriteFile(policyFile, []byte(testRolePolicy), 0600))
+
+	rp, err := NewRolePolicy(policyFile, "https://kave/groups")
+	assert.NoError(t, err)
+
+	// roles bound to groups, token permissions come first
+	{
+		claims := parseTestClaims(t, `{"sub":"auth0|bob","permissions":["read:kave:bob"],"https://kave/groups":["engineering","sales"]}`)
+		assert.Equal(t, []string{"read:kave:bob", "read:kave:shared:**"}, rp.Permissions(claims))
+	}
+
+	// groups claim as a single string
+	{
+		claims := parseTestClaims(t, `{"sub":"auth0|bob","https://kave/groups":"engineering"}`)
+		assert.Equal(t, []string{"read:kave:shared:**"}, rp.Permissions(claims))
+	}
+
+	// roles bound to clients through azp
+	{
+		claims := parseTestClaims(t, `{"sub":"ci-client@clients","azp":"ci-client"}`)
+		assert.Equal(
+			t,
+			[]string{"read:kave:shared:**", "read:kave:ci:**", "write:kave:ci:**", "deny:write:kave:ci:locked"},
+			rp.Permissions(claims),
+		)
+	}
+
+	// roles bound to subjects
+	{
+		claims := parseTestClaims(t, `{"sub":"auth0|alice"}`)
+		assert.Equal(t, []string{"read:kave:ci:**", "write:kave:ci:**", "deny:write:kave:ci:locked"}, rp.Permissions(claims))
+	}
+
+	// no bindings
+	{
+		claims := parseTestClaims(t, `{"sub":"auth0|carol","permissions":["read:kave:carol"]}`)
+		assert.Equal(t, []string{"read:kave:carol"}, rp.Permissions(claims))
+	}
+}
+
+func TestRolePolicyReload(t *testing.T) {
+	policyFile := path.Join(t.TempDir(), "policy.toml")
+	assert.NoError(t, os.WriteFile(policyFile, []byte(testRolePolicy), 0600))
+
+	rp, err := NewRolePolicy(policyFile, "")
+	assert.NoError(t, err)
+
+	claims := parseTestClaims(t, `{"sub":"auth0|alice"}`)
+
+	// file is reloaded once changed
+	updated := `
+[roles.admin]
+permissions = ["*:kave:**"]
+
+[[bindings]]
+roles = ["admin"]
+subjects = ["auth0|alice"]
+`
+	assert.NoError(t, os.WriteFile(policyFile, []byte(updated), 0600))
+	assert.NoError(t, os.Chtimes(policyFile, time.Now(), time.Now().Add(time.Second)))
+
+	assert.True(t, rp.changed())
+	assert.NoError(t, rp.Reload())
+	assert.False(t, rp.changed())
+	assert.Equal(t, []string{"*:kave:**"}, rp.Permissions(claims))
+
+	// an invalid file keeps the current roles
+	invalid := `
+[[bindings]]
+roles = ["missing"]
+subjects = ["auth0|alice"]
+`
+	assert.NoError(t, os.WriteFile(policyFile, []byte(invalid), 0600))
+	assert.Error(t, rp.Reload())
+	assert.Equal(t, []string{"*:kave:**"}, rp.Permissions(claims))
+}
+
+func TestRolePolicyWatch(t *testing.T) {
+	policyFile := path.Join(t.TempDir(), "policy.toml")
+	assert.NoError(t, os.WriteFile(policyFile, []byte(testRolePolicy), 0600))
+
+	rp, err := NewRolePolicy(policyFile, "")
+	assert.NoError(t, err)
+
+	claims := parseTestClaims(t, `{"sub":"auth0|alice"}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rp.Watch(ctx, time.Hour, reload)
+		close(done)
+	}()
+
+	// the file is reloaded when asked, before the period elapses
+	updated := `
+[roles.admin]
+permissions = ["*:kave:**"]
+
+[[bindings]]
+roles = ["admin"]
+subjects = ["auth0|alice"]
+`
+	assert.NoError(t, os.WriteFile(policyFile, []byte(updated), 0600))
+	reload <- struct{}{}
+
+	assert.Eventually(t, func() bool {
+		permissions := rp.Permissions(claims)
+		return len(permissions) == 1 && permissions[0] == "*:kave:**"
+	}, time.Second, 10*time.Millisecond)
+
+	// watching stops with ctx
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
+
+func TestNewRolePolicyMissingFile(t *testing.T) {
+	_, err := NewRolePolicy(path.Join(t.TempDir(), "missing.toml"), "")
+	assert.Error(t, err)
+}
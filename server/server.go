@@ -0,0 +1,1038 @@
+// Package server serves the HTTP API of kave, and optionally its gRPC and
+// RESP APIs, getting and setting keys in Redis with auth. Run serves it as kave-server does, while New creates a
+// Server to embed in other services, with custom routes and middleware:
+//
+//	s, err := server.New(ctx, config,
+//		server.WithRedisClient(rdb),
+//		server.WithRoutes(func(r chi.Router) {
+//			r.Get("/whoami", whoami)
+//		}),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//
+//	http.ListenAndServe(":8000", s)
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+const (
+	envRedisPassword      = "REDIS_PASSWORD"
+	defaultRouterBasePath = "/redis"
+	defaultRedisKeyPrefix = "kave:"
+	jwksUrlFormat         = "https://%s/.well-known/jwks.json"
+	issuerUrlFormat       = "https://%s/"
+	defaultHealthPath     = "/health"
+	envPresignSecret      = "KAVE_PRESIGN_SECRET"
+
+	defaultAuditMaxStreamLength = 1000000
+	defaultJWKSRefresh          = time.Hour
+	jwksRefreshRateLimit        = 5 * time.Minute
+
+	defaultInternalKeyPrefix = "kave-internal:"
+)
+
+// Config holds application configuration
+type Config struct {
+	Address        string  `toml:"address"`
+	RedisAddress   string  `toml:"redis_address"`
+	RouterBasePath string  `toml:"router_base_path"`
+	RedisKeyPrefix *string `toml:"redis_key_prefix"`
+	TimeoutMs      int     `toml:"timeout_ms"`
+	RedisUsername  string  `toml:"redis_username"`
+	// InternalKeyPrefix prefixes the redis keys kept by the server itself
+	InternalKeyPrefix *string `toml:"internal_key_prefix"`
+	// OpsAddress serves health, readiness, metrics and diagnostics, apart from the API and its auth
+	OpsAddress string     `toml:"ops_address"`
+	Ops        OpsOptions `toml:"ops"`
+	Auth       struct {
+		Enabled          bool   `toml:"enabled"`
+		Domain           string `toml:"domain"`
+		PermissionSyntax string `toml:"permission_syntax"`
+		PolicyFile       string `toml:"policy_file"`
+		PolicyReloadMs   int    `toml:"policy_reload_ms"`
+		GroupsClaim      string `toml:"groups_claim"`
+		JWKSRefreshMs    int    `toml:"jwks_refresh_ms"`
+		Issuer           struct {
+			Enabled    bool           `toml:"enabled"`
+			KeyFile    string         `toml:"key_file"`
+			Audience   string         `toml:"audience"`
+			TokenTTLMs int            `toml:"token_ttl_ms"`
+			Clients    []IssuerClient `toml:"clients"`
+		} `toml:"issuer"`
+		OIDC          OIDCOptions `toml:"oidc"`
+		Introspection struct {
+			Enabled    bool   `toml:"enabled"`
+			Url        string `toml:"url"`
+			ClientID   string `toml:"client_id"`
+			MaxCacheMs int    `toml:"max_cache_ms"`
+		} `toml:"introspection"`
+		Revocation struct {
+			Enabled       bool `toml:"enabled"`
+			CacheMs       int  `toml:"cache_ms"`
+			MaxTokenTTLMs int  `toml:"max_token_ttl_ms"`
+		} `toml:"revocation"`
+	} `toml:"auth"`
+	RateLimit struct {
+		Enabled   bool                `toml:"enabled"`
+		Overrides []RateLimitOverride `toml:"overrides"`
+		RateLimit
+	} `toml:"rate_limit"`
+	Quotas struct {
+		Enabled   bool    `toml:"enabled"`
+		RefreshMs int     `toml:"refresh_ms"`
+		Limits    []Quota `toml:"limits"`
+	} `toml:"quotas"`
+	Presign struct {
+		Enabled     bool `toml:"enabled"`
+		MaxExpiryMs int  `toml:"max_expiry_ms"`
+	} `toml:"presign"`
+	GRPC    GRPCOptions    `toml:"grpc"`
+	RESP    RESPOptions    `toml:"resp"`
+	Tracing TracingOptions `toml:"tracing"`
+	CORS    CORSOptions    `toml:"cors"`
+	Audit   struct {
+		Enabled         bool   `toml:"enabled"`
+		File            string `toml:"file"`
+		RedisStream     bool   `toml:"redis_stream"`
+		MaxStreamLength int64  `toml:"max_stream_length"`
+	} `toml:"audit"`
+	UI struct {
+		Enabled bool `toml:"enabled"`
+	} `toml:"ui"`
+	Log struct {
+		// Level is one of "debug", "info" (default), "warn" or "error"
+		Level string `toml:"level"`
+		// Format is one of "json" (default) or "text"
+		Format string `toml:"format"`
+	} `toml:"log"`
+}
+
+// Run serves the API, and the ops listener if configured, as kave-server does.
+// It returns when either listener fails.
+func Run(ctx context.Context, config Config, opts ...Option) error {
+	// Set up logging first, for everything after to be logged alike
+	logger, err := NewLogger(os.Stderr, config.Log.Level, config.Log.Format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	// Connect to Redis
+	client, err := NewRedisClient(ctx, redisOptions(config))
+	if err != nil {
+		return err
+	}
+	defer client.inner.Close()
+
+	// Export traces if enabled
+	if config.Tracing.Enabled {
+		provider, err := NewTracerProvider(ctx, config.Tracing)
+		if err != nil {
+			return err
+		}
+
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		client.inner.AddHook(redisTracingHook{})
+	}
+
+	// Collect metrics if they can be served
+	var metrics *Metrics
+	if config.OpsAddress != "" {
+		metrics = NewMetrics()
+		client.inner.AddHook(metrics.RedisHook())
+	}
+
+	// Create the server of the API
+	server, err := New(ctx, config, append([]Option{WithRedisClient(client.inner), WithMetrics(metrics)}, opts...)...)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	errs := make(chan error, 4)
+
+	// Start the ops server
+	if config.OpsAddress != "" {
+		opsRouter, err := NewOpsRouter(config.Ops, metrics, func(ctx context.Context) error {
+			return client.inner.Ping(ctx).Err()
+		}, config)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			errs <- http.ListenAndServe(config.OpsAddress, opsRouter)
+		}()
+	}
+
+	// Start the gRPC server
+	if config.GRPC.Enabled {
+		if config.GRPC.Address == "" {
+			return errors.New("grpc requires an address")
+		}
+
+		listener, err := net.Listen("tcp", config.GRPC.Address)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			errs <- server.GRPCServer().Serve(listener)
+		}()
+	}
+
+	// Start the RESP server
+	if config.RESP.Enabled {
+		if config.RESP.Address == "" {
+			return errors.New("resp requires an address")
+		}
+
+		listener, err := net.Listen("tcp", config.RESP.Address)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			errs <- server.RESPServer().Serve(listener)
+		}()
+	}
+
+	// Start the server
+	go func() {
+		errs <- http.ListenAndServe(config.Address, server)
+	}()
+
+	return <-errs
+}
+
+// redisOptions returns the options connecting to the Redis of the config,
+// its password being read from the environment
+func redisOptions(config Config) *redis.Options {
+	return &redis.Options{
+		Addr:     config.RedisAddress,
+		Username: config.RedisUsername,
+		Password: os.Getenv(envRedisPassword),
+	}
+}
+
+// Server serves the HTTP API of kave.
+type Server struct {
+	routers    *routers
+	client     *RedisClient
+	ownsClient bool
+}
+
+// routers serve the APIs of a Server, from the same keys and auth.
+type routers struct {
+	http *chi.Mux
+	// grpc is nil unless enabled
+	grpc *grpc.Server
+	// resp is nil unless enabled
+	resp *RESPServer
+	// close releases what the routers hold, such as the audit log file,
+	// and stops reloading the role policy file
+	close func()
+}
+
+// New creates a Server from its config, connecting to Redis unless
+// WithRedisClient is given. Routes are added under config.RouterBasePath,
+// so the server can be mounted along other routes of a service.
+// The server must be closed once it stops serving.
+func New(ctx context.Context, config Config, opts ...Option) (*Server, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	server := &Server{}
+
+	if o.redis != nil {
+		server.client = &RedisClient{inner: o.redis}
+	} else {
+		client, err := NewRedisClient(ctx, redisOptions(config))
+		if err != nil {
+			return nil, err
+		}
+
+		server.client = client
+		server.ownsClient = true
+	}
+
+	routers, err := newRouter(ctx, config, server.client, o)
+	if err != nil {
+		if server.ownsClient {
+			server.client.inner.Close()
+		}
+		return nil, err
+	}
+
+	server.routers = routers
+
+	return server, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.routers.http.ServeHTTP(w, r)
+}
+
+// GRPCServer returns the server of the gRPC API, or nil unless it is
+// enabled by config.GRPC. It serves the same keys as the HTTP API, with the
+// same auth, and is served on listeners of the caller with its Serve method.
+func (s *Server) GRPCServer() *grpc.Server {
+	return s.routers.grpc
+}
+
+// RESPServer returns the server of the RESP API, or nil unless it is
+// enabled by config.RESP. It serves the same keys as the HTTP API to Redis
+// clients, with the same auth, and is served on listeners of the caller
+// with its Serve method.
+func (s *Server) RESPServer() *RESPServer {
+	return s.routers.resp
+}
+
+// Close stops the gRPC and RESP servers and releases the audit log file,
+// and the Redis client unless it was given with WithRedisClient.
+func (s *Server) Close() error {
+	if s.routers.grpc != nil {
+		s.routers.grpc.Stop()
+	}
+
+	if s.routers.resp != nil {
+		s.routers.resp.Close()
+	}
+
+	s.routers.close()
+
+	if s.ownsClient {
+		return s.client.inner.Close()
+	}
+	return nil
+}
+
+// newRouter creates the routers serving the APIs. The routers must be
+// closed once the server stops.
+func newRouter(ctx context.Context, config Config, client *RedisClient, o options) (_ *routers, err error) {
+	var closers []func()
+	closeRouter := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeRouter()
+		}
+	}()
+
+	metrics := o.metrics
+
+	// Set base path
+	routerBasePath := config.RouterBasePath
+	if routerBasePath == "" {
+		routerBasePath = defaultRouterBasePath
+	}
+
+	// Set redis key prefix
+	redisKeyPrefix := defaultRedisKeyPrefix
+	if config.RedisKeyPrefix != nil {
+		redisKeyPrefix = *config.RedisKeyPrefix
+	}
+
+	// Set prefix of keys kept by the server
+	internalKeyPrefix := defaultInternalKeyPrefix
+	if config.InternalKeyPrefix != nil {
+		internalKeyPrefix = *config.InternalKeyPrefix
+	}
+
+	// Keys of clients must never resolve to keys kept by the server
+	if strings.HasPrefix(internalKeyPrefix, redisKeyPrefix) || strings.HasPrefix(redisKeyPrefix, internalKeyPrefix) {
+		return nil, fmt.Errorf("redis_key_prefix %q and internal_key_prefix %q must not be prefixes of one another", redisKeyPrefix, internalKeyPrefix)
+	}
+
+	// Set how permission patterns are matched
+	permissionSyntax, err := policy.ParseSyntax(config.Auth.PermissionSyntax)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set requests timeout
+	timeout := time.Duration(config.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+
+	// Keep keys in Redis unless another backend is given
+	var keyValue KeyValue = client
+	var keyLister KeyLister = client
+	var commander keyCommander = client
+	if o.keyValue != nil {
+		keyValue = o.keyValue
+		keyLister, _ = o.keyValue.(KeyLister)
+		commander, _ = o.keyValue.(keyCommander)
+	}
+
+	// Enforce quotas on writes if enabled
+	var quotas *Quotas
+	if config.Quotas.Enabled {
+		if o.keyValue != nil {
+			return nil, errors.New("quotas require keys to be kept in Redis")
+		}
+
+		quotas, err = NewQuotas(
+			newRedisQuotaStore(client.inner, redisKeyPrefix, internalKeyPrefix),
+			redisKeyPrefix,
+			config.Quotas.Limits,
+			time.Duration(config.Quotas.RefreshMs)*time.Millisecond,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// account for keys written while quotas were not enforced
+		if err := quotas.Recount(ctx); err != nil {
+			return nil, err
+		}
+
+		keyValue = quotas.KeyValue(keyValue)
+
+		// quotas do not account for keys expiring or incremented through RESP
+		commander = nil
+	}
+
+	// Publish changes of keys to their gRPC watchers if enabled
+	var keyEvents keyEventBus
+	if config.GRPC.Enabled {
+		keyEvents = newRedisKeyEventBus(client.inner, internalKeyPrefix)
+		keyValue = newNotifyingKeyValue(keyValue, keyEvents)
+	}
+
+	// Create a new KeyValue kvHandler
+	kvHandler := NewKeyValueHandler(keyValue, redisKeyPrefix, readKeyFromCtx)
+
+	// Resolve permissions of each request, adding roles from the policy file if set
+	permissionsFromCtx := readPermissionsFromCtx
+	if config.Auth.Enabled && config.Auth.PolicyFile != "" {
+		rolePolicy, err := NewRolePolicy(config.Auth.PolicyFile, config.Auth.GroupsClaim)
+		if err != nil {
+			return nil, err
+		}
+
+		// stop reloading once the routers are closed
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		closers = append(closers, stopWatching)
+
+		go rolePolicy.Watch(watchCtx, time.Duration(config.Auth.PolicyReloadMs)*time.Millisecond, o.reload)
+
+		permissionsFromCtx = func(ctx context.Context) []string {
+			return rolePolicy.Permissions(readClaimsFromCtx(ctx))
+		}
+	}
+
+	// Create the permission check middleware
+	permissionMiddleware := NewPermissionMiddleware(redisKeyPrefix, permissionSyntax, readKeyFromCtx, permissionsFromCtx, readClaimsFromCtx)
+	if metrics != nil {
+		permissionMiddleware.ObserveDecisions(metrics.ObserveAuthz)
+	}
+
+	// Create the pre-signed urls signer if enabled
+	var presigner *Presigner
+	if config.Presign.Enabled {
+		if !config.Auth.Enabled {
+			return nil, errors.New("presign requires auth to be enabled")
+		}
+
+		presigner, err = NewPresigner(
+			[]byte(os.Getenv(envPresignSecret)),
+			routerBasePath,
+			time.Duration(config.Presign.MaxExpiryMs)*time.Millisecond,
+			newRedisNonceStore(client.inner, internalKeyPrefix),
+			readKeyFromCtx,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the token issuer if enabled
+	var issuer *TokenIssuer
+	if config.Auth.Issuer.Enabled {
+		issuer, err = createTokenIssuer(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the introspection client for opaque tokens if enabled
+	var introspector *Introspector
+	if config.Auth.Introspection.Enabled {
+		introspector, err = NewIntrospector(
+			config.Auth.Introspection.Url,
+			config.Auth.Introspection.ClientID,
+			os.Getenv(envIntrospectionClientSecret),
+			time.Duration(config.Auth.Introspection.MaxCacheMs)*time.Millisecond,
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the token revocation denylist if enabled
+	var revocations *Revocations
+	if config.Auth.Enabled && config.Auth.Revocation.Enabled {
+		revocations = NewRevocations(
+			newRedisRevocationStore(client.inner, internalKeyPrefix),
+			time.Duration(config.Auth.Revocation.CacheMs)*time.Millisecond,
+			time.Duration(config.Auth.Revocation.MaxTokenTTLMs)*time.Millisecond,
+		)
+	}
+
+	// Create the rate limiter if enabled
+	var rateLimiter *RateLimiter
+	if config.RateLimit.Enabled {
+		rateLimiter, err = NewRateLimiter(
+			newRedisRateLimitStore(client.inner, internalKeyPrefix),
+			config.RateLimit.RateLimit,
+			config.RateLimit.Overrides,
+			readClaimsFromCtx,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the audit log if enabled
+	var auditor *Auditor
+	var auditQueries auditQuerier
+	if config.Audit.Enabled {
+		var sinks []auditSink
+
+		if config.Audit.File != "" {
+			auditLog, err := OpenFileAuditLog(config.Audit.File)
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, func() { auditLog.Close() })
+
+			sinks = append(sinks, auditLog)
+			auditQueries = auditLog
+		}
+
+		// prefer querying the stream, it does not scan the whole log
+		if config.Audit.RedisStream {
+			maxLen := config.Audit.MaxStreamLength
+			if maxLen == 0 {
+				maxLen = defaultAuditMaxStreamLength
+			}
+
+			auditStream := newRedisAuditStream(client.inner, internalKeyPrefix, maxLen)
+			sinks = append(sinks, auditStream)
+			auditQueries = auditStream
+		}
+
+		if len(sinks) == 0 {
+			return nil, errors.New("audit requires a file or redis_stream")
+		}
+
+		auditor = NewAuditor(sinks, readKeyFromCtx, readClaimsFromCtx)
+	}
+
+	// List the keys the caller may read, if the backend can
+	var keyListHandler *KeyListHandler
+	if keyLister != nil {
+		var listPermissions *PermissionMiddleware
+		if config.Auth.Enabled {
+			listPermissions = &permissionMiddleware
+		}
+		keyListHandler = NewKeyListHandler(keyLister, redisKeyPrefix, internalKeyPrefix, listPermissions)
+	}
+
+	// Create a new router
+	router := chi.NewRouter()
+
+	// Add middleware
+	router.Use(middleware.RequestID)
+	router.Use(middleware.RealIP)
+	if config.Tracing.Enabled {
+		router.Use(tracingMiddleware)
+	}
+	router.Use(requestLogger)
+	if metrics != nil {
+		router.Use(metrics.Handler)
+	}
+
+	// Answer browsers before the auth of any route
+	if config.CORS.Enabled {
+		cors, err := NewCORS(config.CORS)
+		if err != nil {
+			return nil, err
+		}
+		router.Use(cors.Handler)
+	}
+
+	// Validate tokens if auth is enabled
+	parseToken := o.parseToken
+	if config.Auth.Enabled && parseToken == nil {
+		var jwks *keyfunc.JWKS
+		if issuer != nil {
+			jwks, err = keyfunc.NewJSON(issuer.JWKSJSON())
+			if err != nil {
+				return nil, err
+			}
+		} else if introspector == nil || config.Auth.Domain != "" {
+			refresh := time.Duration(config.Auth.JWKSRefreshMs) * time.Millisecond
+			if refresh == 0 {
+				refresh = defaultJWKSRefresh
+			}
+
+			var observeRefresh func(error)
+			if metrics != nil {
+				observeRefresh = metrics.ObserveJWKSRefresh
+			}
+
+			jwks, err = fetchJWKS(config.Auth.Domain, refresh, observeRefresh)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		parseToken = createTokenParser(jwks, introspector)
+	}
+
+	// Log users in with the OIDC provider if enabled
+	var oidc *OIDC
+	if config.Auth.Enabled && config.Auth.OIDC.Enabled {
+		oidc, err = NewOIDC(
+			ctx,
+			config.Auth.OIDC,
+			os.Getenv(envOIDCClientSecret),
+			newRedisSessionStore(client.inner, internalKeyPrefix),
+			parseToken,
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Add token issuer routes, reachable without a token
+	if issuer != nil {
+		router.Group(func(r chi.Router) {
+			// limit callers by address, as they have no token
+			if rateLimiter != nil {
+				r.Use(rateLimiter.Handler)
+			}
+
+			r.Use(middleware.Recoverer)
+			r.Use(middleware.Timeout(timeout))
+
+			r.Post(issuerTokenPath, issuer.Token)
+			r.Get(issuerJWKSPath, issuer.JWKS)
+		})
+	}
+
+	// Add login routes, reachable without a token
+	if oidc != nil {
+		router.Group(func(r chi.Router) {
+			// limit callers by address, as they have no token
+			if rateLimiter != nil {
+				r.Use(rateLimiter.Handler)
+			}
+
+			r.Use(middleware.Recoverer)
+			r.Use(middleware.Timeout(timeout))
+
+			r.Get(oidcLoginPath, oidc.Login)
+			r.Get(oidcCallbackPath, oidc.Callback)
+			r.Post(oidcLogoutPath, oidc.Logout)
+		})
+	}
+
+	// Add web UI, its files are public while the API it calls is not
+	if config.UI.Enabled {
+		ui := uiConfig{BasePath: routerBasePath, Auth: config.Auth.Enabled}
+		if config.Auth.Enabled {
+			ui.AuthzPath = authzCheckPath
+		}
+		if auditor != nil {
+			ui.AuditPath = auditPath
+		}
+		if oidc != nil {
+			ui.LoginPath = oidcLoginPath
+			ui.LogoutPath = oidcLogoutPath
+		}
+
+		uiHandler, err := NewUIHandler(ui)
+		if err != nil {
+			return nil, err
+		}
+		router.Mount(uiPath, uiHandler)
+	}
+
+	router.Group(func(router chi.Router) {
+		// limit callers failing auth by address, so that failed attempts and
+		// the token checks they cost are limited too
+		if rateLimiter != nil && config.Auth.Enabled {
+			router.Use(rateLimiter.Failures)
+		}
+
+		// record the operations on keys of callers failing auth
+		if auditor != nil && config.Auth.Enabled {
+			router.Use(auditor.Attempts(keyFromPath(routerBasePath)))
+		}
+
+		// add auth middleware if enabled
+		if config.Auth.Enabled {
+			authMiddleware := createAuthMiddleware(parseToken, revocations)
+
+			// browsers send the session cookie instead of a bearer token
+			if oidc != nil {
+				authMiddleware.AcceptSessions(oidc.SessionToken)
+			}
+
+			// pre-signed urls replace the bearer token
+			if presigner != nil {
+				router.Use(presigner.Handler)
+				router.Use(presigner.SkipIfPresigned(authMiddleware.Handler))
+			} else {
+				router.Use(authMiddleware.Handler)
+			}
+		}
+
+		// then limit callers once identified by their token
+		if rateLimiter != nil {
+			router.Use(rateLimiter.Handler)
+		}
+
+		router.Use(middleware.Recoverer)
+		router.Use(middleware.Timeout(timeout))
+
+		// Add middleware of the embedding service
+		router.Use(o.middlewares...)
+
+		// Add health route
+		router.Get(defaultHealthPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, err := w.Write([]byte(`{"status":"ok"}`))
+			if err != nil {
+				loggerFromCtx(r.Context()).Error("error writing response", err)
+				return
+			}
+		})
+
+		// Add authorization debugging route
+		if config.Auth.Enabled {
+			authzHandler := NewAuthzHandler(permissionMiddleware, readClaimsFromCtx)
+			router.Post(authzCheckPath, authzHandler.Check)
+		}
+
+		// Add revocation denylist admin routes
+		if revocations != nil {
+			revocationsHandler := NewRevocationsHandler(revocations)
+			router.Route(revocationsPath, func(r chi.Router) {
+				r.Use(permissionMiddleware.Require(permissionAdminRevocations))
+
+				r.Get("/", revocationsHandler.List)
+				r.Post("/", revocationsHandler.Revoke)
+				r.Delete("/", revocationsHandler.Unrevoke)
+			})
+		}
+
+		// Add quota routes
+		if quotas != nil {
+			var quotaPermissions *PermissionMiddleware
+			if config.Auth.Enabled {
+				quotaPermissions = &permissionMiddleware
+			}
+
+			quotaHandler := NewQuotaHandler(quotas, quotaPermissions)
+			router.Get(quotaPath, quotaHandler.Usage)
+
+			// quotas can only be managed by admins
+			if config.Auth.Enabled {
+				router.Route(adminQuotasPath, func(r chi.Router) {
+					r.Use(permissionMiddleware.Require(permissionAdminQuota))
+
+					r.Get("/", quotaHandler.List)
+					r.Put("/", quotaHandler.Save)
+					r.Delete("/", quotaHandler.Delete)
+				})
+			}
+		}
+
+		// Add audit query route, only for admins when auth is enabled
+		if auditor != nil {
+			auditHandler := NewAuditHandler(auditQueries)
+			router.Group(func(r chi.Router) {
+				if config.Auth.Enabled {
+					r.Use(permissionMiddleware.Require(permissionAdminAudit))
+				}
+
+				r.Get(auditPath, auditHandler.Query)
+			})
+		}
+
+		// Add pre-signed urls route
+		if presigner != nil {
+			presignHandler := NewPresignHandler(presigner, permissionMiddleware)
+			router.Post(presignPath, presignHandler.Mint)
+		}
+
+		// Add redis routes
+		router.Route(routerBasePath, func(r chi.Router) {
+			if keyListHandler != nil {
+				r.Get("/", keyListHandler.List)
+			}
+
+			r.Route("/{key}", func(r chi.Router) {
+				// Add redis key to context
+				r.Use(injectKeyInCtx)
+				r.Use(rejectInternalKeys(redisKeyPrefix, internalKeyPrefix))
+
+				// Record operations, including denied ones
+				if auditor != nil {
+					r.Use(auditor.Handler)
+				}
+
+				// Add permission check middleware
+				if presigner != nil {
+					r.Use(presigner.Authorize(permissionMiddleware.Handler))
+				} else if config.Auth.Enabled {
+					r.Use(permissionMiddleware.Handler)
+				}
+
+				r.Get("/", kvHandler.Get)
+				r.Post("/", kvHandler.Set)
+				r.Delete("/", kvHandler.Delete)
+			})
+		})
+
+		// Add routes of the embedding service
+		for _, routes := range o.routes {
+			routes(router)
+		}
+	})
+
+	// Describe the routes added above, reachable without a token
+	openAPIHandler, err := NewOpenAPIHandler(router, openAPIConfig{
+		BasePath:  routerBasePath,
+		Auth:      config.Auth.Enabled,
+		Sessions:  oidc != nil,
+		Presign:   presigner != nil,
+		RateLimit: rateLimiter != nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+	router.Method(http.MethodGet, openAPIPath, openAPIHandler)
+
+	// Serve the same keys over gRPC if enabled
+	var grpcServer *grpc.Server
+	if config.GRPC.Enabled {
+		service := &grpcService{
+			keyValue:          keyValue,
+			keyPrefix:         redisKeyPrefix,
+			internalKeyPrefix: internalKeyPrefix,
+			keys:              keyListHandler,
+			events:            keyEvents,
+			auditor:           auditor,
+		}
+
+		var grpcAuth *AuthMiddleware
+		if config.Auth.Enabled {
+			auth := createAuthMiddleware(parseToken, revocations)
+			grpcAuth = &auth
+			service.auth = grpcAuth
+			service.permissions = &permissionMiddleware
+		}
+
+		grpcServer = newGRPCServer(service, grpcAuth, rateLimiter)
+	}
+
+	// Serve the same keys to Redis clients if enabled
+	var respServer *RESPServer
+	if config.RESP.Enabled {
+		service := &respService{
+			keyValue:          keyValue,
+			commander:         commander,
+			keyPrefix:         redisKeyPrefix,
+			internalKeyPrefix: internalKeyPrefix,
+			keys:              keyListHandler,
+			events:            keyEvents,
+			rateLimiter:       rateLimiter,
+			auditor:           auditor,
+			timeout:           timeout,
+		}
+
+		if config.Auth.Enabled {
+			auth := createAuthMiddleware(parseToken, revocations)
+			service.auth = &auth
+			service.permissions = &permissionMiddleware
+		}
+
+		respServer = newRESPServer(
+			service,
+			time.Duration(config.RESP.IdleTimeoutMs)*time.Millisecond,
+			config.RESP.MaxConnections,
+		)
+	}
+
+	return &routers{
+		http:  router,
+		grpc:  grpcServer,
+		resp:  respServer,
+		close: closeRouter,
+	}, nil
+}
+
+func createTokenIssuer(config *Config) (*TokenIssuer, error) {
+	// a key generated by each process would invalidate tokens on restart,
+	// and tokens issued by one replica would be refused by the others
+	if config.Auth.Issuer.KeyFile == "" {
+		return nil, errors.New("issuer requires a key_file")
+	}
+
+	key, err := loadOrGenerateSigningKey(config.Auth.Issuer.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTokenIssuer(
+		fmt.Sprintf(issuerUrlFormat, config.Auth.Domain),
+		config.Auth.Issuer.Audience,
+		time.Duration(config.Auth.Issuer.TokenTTLMs)*time.Millisecond,
+		key,
+		config.Auth.Issuer.Clients,
+	)
+}
+
+// fetchJWKS fetches the keys of the auth domain, refreshing them in the
+// background and when a token is signed by an unknown key.
+// observe, if not nil, is called with the result of every refresh.
+func fetchJWKS(domain string, refresh time.Duration, observe func(error)) (*keyfunc.JWKS, error) {
+	urlStr := fmt.Sprintf(jwksUrlFormat, domain)
+
+	return keyfunc.Get(urlStr, keyfunc.Options{
+		RefreshInterval:   refresh,
+		RefreshRateLimit:  jwksRefreshRateLimit,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			slog.Error("error refreshing JWKS", err)
+			if observe != nil {
+				observe(err)
+			}
+		},
+		// only called when the keys could be fetched
+		ResponseExtractor: func(ctx context.Context, resp *http.Response) (json.RawMessage, error) {
+			buf, err := keyfunc.ResponseExtractorStatusOK(ctx, resp)
+			if err == nil && observe != nil {
+				observe(nil)
+			}
+			return buf, err
+		},
+	})
+}
+
+// createTokenParser validates JWTs with jwks and, when an introspector is
+// given, opaque tokens with its introspection endpoint.
+// Either jwks or introspector may be nil.
+func createTokenParser(jwks *keyfunc.JWKS, introspector *Introspector) ParseTokenFunc {
+	return func(token string) (*Claims, error) {
+		if introspector != nil && (jwks == nil || !isJWT(token)) {
+			return introspector.Parse(token)
+		}
+
+		options := jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()})
+
+		claims := &Claims{}
+		_, err := jwt.ParseWithClaims(token, claims, jwks.Keyfunc, options)
+		return claims, err
+	}
+}
+
+// createAuthMiddleware accepts the tokens accepted by parse, unless they are
+// revoked when revocations is not nil.
+func createAuthMiddleware(parse ParseTokenFunc, revocations *Revocations) AuthMiddleware {
+	var isRevoked revokedFunc
+	if revocations != nil {
+		isRevoked = revocations.IsRevoked
+	}
+
+	return NewAuthMiddleware(parse, writeClaimsToCtx, isRevoked)
+}
+
+// keyFromPath returns the key of requests on the key routes under basePath,
+// before they are routed, as injectKeyInCtx reads it once routed.
+func keyFromPath(basePath string) func(r *http.Request) (string, bool) {
+	prefix := strings.TrimSuffix(basePath, "/") + "/"
+
+	return func(r *http.Request) (string, bool) {
+		// routes are matched on the escaped path
+		path := r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
+		}
+
+		if !strings.HasPrefix(path, prefix) {
+			return "", false
+		}
+
+		key := strings.TrimSuffix(strings.TrimPrefix(path, prefix), "/")
+		return key, key != "" && !strings.Contains(key, "/")
+	}
+}
+
+// isInternalKey tells whether key, once prefixed, resolves to a key kept by the server.
+func isInternalKey(keyPrefix string, internalKeyPrefix string, key string) bool {
+	return strings.HasPrefix(keyPrefix+key, internalKeyPrefix)
+}
+
+// rejectInternalKeys refuses requests on keys kept by the server.
+func rejectInternalKeys(keyPrefix string, internalKeyPrefix string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isInternalKey(keyPrefix, internalKeyPrefix, chi.URLParam(r, "key")) {
+				http.Error(w, "key is reserved", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func injectKeyInCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "key")
+
+		newContext := writeKeyToCtx(r.Context(), key)
+
+		next.ServeHTTP(w, r.WithContext(newContext))
+	})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	kavev1 "github.com/pdcalado/kave/proto/kave/v1"
+)
+
+const (
+	testAddress = "http://localhost:8000"
+)
+
+func waitUntilHealthy(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		res, err := http.Get(testAddress + defaultHealthPath)
+		if err != nil || res.StatusCode/100 != 2 {
+			time.Sleep(time.Millisecond * 50)
+			continue
+		}
+		return
+	}
+
+	t.Fatalf("failed to start server")
+}
+
+func TestRun(t *testing.T) {
+	// start the server
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	var config Config
+	_, err := toml.Decode(fmt.Sprintf(`
+address = "%s"
+redis_address = "%s:6379"
+
+[ui]
+enabled = true
+	`, strings.TrimPrefix(testAddress, "http://"), redisHost), &config)
+	assert.NoError(t, err)
+
+	go func() {
+		// only returns if the server fails to start
+		assert.NoError(t, Run(context.Background(), config))
+	}()
+
+	waitUntilHealthy(t)
+
+	testKey := "foo"
+
+	// set a key
+	res, err := http.Post(
+		testAddress+defaultRouterBasePath+"/"+testKey,
+		"application/json",
+		bytes.NewBufferString(`{}`),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	// get the key
+	res, err = http.Get(testAddress + defaultRouterBasePath + "/" + testKey)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	buf, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(buf))
+
+	// get a non existing key
+	res, err = http.Get(testAddress + defaultRouterBasePath + "/notfound")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// list keys by prefix
+	res, err = http.Get(testAddress + defaultRouterBasePath + "/?prefix=fo")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	buf, err = io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `{"key":"foo"}`)
+
+	// delete the key
+	req, err := http.NewRequest(http.MethodDelete, testAddress+defaultRouterBasePath+"/"+testKey, nil)
+	assert.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// get the web UI
+	res, err = http.Get(testAddress + uiPath + "/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestInternalKeys(t *testing.T) {
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	defer rdb.Close()
+
+	// prefixes covering one another are refused at startup
+	for _, prefixes := range [][2]string{
+		{"", "kave-internal:"},
+		{"kave:", "kave:internal:"},
+		{"kave-internal:keys:", "kave-internal:"},
+	} {
+		var config Config
+		config.RedisKeyPrefix = &prefixes[0]
+		config.InternalKeyPrefix = &prefixes[1]
+
+		_, err := New(ctx, config, WithRedisClient(rdb), WithKeyValue(&memoryKeyValue{values: map[string][]byte{}}))
+		assert.ErrorContains(t, err, "must not be prefixes of one another", prefixes)
+	}
+
+	// keys resolving under the internal prefix are refused by every front-end
+	{
+		kv := &memoryKeyValue{values: map[string][]byte{"kave-internal:session:1": []byte("secret")}}
+
+		router := chi.NewRouter()
+		router.Route("/{key}", func(r chi.Router) {
+			r.Use(injectKeyInCtx)
+			r.Use(rejectInternalKeys("", "kave-internal:"))
+			r.Get("/", NewKeyValueHandler(kv, "", readKeyFromCtx).Get)
+		})
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/kave-internal:session:1", nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/kave-internal", nil))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+		grpcService := &grpcService{keyValue: kv, internalKeyPrefix: "kave-internal:"}
+
+		_, err := grpcService.Get(ctx, &kavev1.GetRequest{Key: "kave-internal:session:1"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = grpcService.Set(ctx, &kavev1.SetRequest{Key: "kave-internal:session:1"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = grpcService.Delete(ctx, &kavev1.DeleteRequest{Key: "kave-internal:session:1"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		respService := &respService{keyValue: kv, internalKeyPrefix: "kave-internal:"}
+
+		err = respService.authorize(ctx, operationRead, "foo", "kave-internal:session:1")
+		assert.Equal(t, errRESPReserved, err)
+
+		assert.Equal(t, []byte("secret"), kv.values["kave-internal:session:1"])
+	}
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	issuerTokenPath        = "/oauth/token"
+	issuerJWKSPath         = "/.well-known/jwks.json"
+	issuerKeyBits          = 2048
+	defaultIssuerTokenTTL  = 24 * time.Hour
+	grantTypeClientCreds   = "client_credentials"
+	oauthErrInvalidRequest = "invalid_request"
+	oauthErrInvalidClient  = "invalid_client"
+	oauthErrUnsupported    = "unsupported_grant_type"
+)
+
+// IssuerClient is an M2M client allowed to obtain tokens from the TokenIssuer.
+type IssuerClient struct {
+	ClientID    string   `toml:"client_id"`
+	SecretHash  string   `toml:"secret_hash"`
+	Permissions []string `toml:"permissions"`
+}
+
+// TokenIssuer issues RS256 access tokens using the OAuth2 client credentials grant,
+// so kave-server can run without an external identity provider.
+type TokenIssuer struct {
+	issuer   string
+	audience string
+	ttl      time.Duration
+	key      *rsa.PrivateKey
+	keyID    string
+	clients  map[string]IssuerClient
+	now      func() time.Time
+}
+
+func NewTokenIssuer(
+	issuer string,
+	audience string,
+	ttl time.Duration,
+	key *rsa.PrivateKey,
+	clients []IssuerClient,
+) (*TokenIssuer, error) {
+	if ttl == 0 {
+		ttl = defaultIssuerTokenTTL
+	}
+
+	byID := make(map[string]IssuerClient, len(clients))
+	for _, client := range clients {
+		if client.ClientID == "" {
+			return nil, fmt.Errorf("issuer client with empty client_id")
+		}
+		if _, err := bcrypt.Cost([]byte(client.SecretHash)); err != nil {
+			return nil, fmt.Errorf("invalid secret_hash for client '%s': %w", client.ClientID, err)
+		}
+		if _, exists := byID[client.ClientID]; exists {
+			return nil, fmt.Errorf("duplicate issuer client '%s'", client.ClientID)
+		}
+		byID[client.ClientID] = client
+	}
+
+	return &TokenIssuer{
+		issuer:   issuer,
+		audience: audience,
+		ttl:      ttl,
+		key:      key,
+		keyID:    thumbprint(&key.PublicKey),
+		clients:  byID,
+		now:      time.Now,
+	}, nil
+}
+
+// HashClientSecret returns the hash to be set as secret_hash of an IssuerClient.
+func HashClientSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// loadOrGenerateSigningKey reads a PEM encoded RSA key from path.
+// If path does not exist a new key is generated and written to it.
+func loadOrGenerateSigningKey(path string) (*rsa.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		return parseSigningKey(buf)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, issuerKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	return key, os.WriteFile(path, buf, 0600)
+}
+
+func parseSigningKey(buf []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in signing key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func newJSONWebKey(key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// thumbprint computes the RFC 7638 thumbprint of a key, used as key ID.
+func thumbprint(key *rsa.PublicKey) string {
+	jwk := newJSONWebKey(key)
+	// members must be in lexicographic order
+	buf := fmt.Sprintf(`{"e":"%s","kty":"%s","n":"%s"}`, jwk.E, jwk.Kty, jwk.N)
+	sum := sha256.Sum256([]byte(buf))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKSJSON returns the JSON Web Key Set holding the issuer public key.
+func (ti *TokenIssuer) JWKSJSON() []byte {
+	jwk := newJSONWebKey(&ti.key.PublicKey)
+	jwk.Use = "sig"
+	jwk.Alg = jwt.SigningMethodRS256.Alg()
+	jwk.Kid = ti.keyID
+
+	buf, _ := json.Marshal(struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{
+		Keys: []jsonWebKey{jwk},
+	})
+	return buf
+}
+
+func (ti *TokenIssuer) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(ti.JWKSJSON())
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+type tokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Audience     string `json:"audience"`
+}
+
+// parseTokenRequest accepts both JSON bodies (as sent by the kave cli)
+// and form encoded bodies (as specified by RFC 6749).
+// Client credentials may also be sent using HTTP basic auth.
+func parseTokenRequest(r *http.Request) (tokenRequest, error) {
+	var req tokenRequest
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return req, err
+		}
+		req.GrantType = r.PostForm.Get("grant_type")
+		req.ClientID = r.PostForm.Get("client_id")
+		req.ClientSecret = r.PostForm.Get("client_secret")
+		req.Audience = r.PostForm.Get("audience")
+	}
+
+	if id, secret, ok := r.BasicAuth(); ok {
+		req.ClientID = id
+		req.ClientSecret = secret
+	}
+
+	return req, nil
+}
+
+// dummySecretHash is compared against when the client is unknown,
+// so that response times do not reveal which clients exist.
+var dummySecretHash = []byte("$2a$10$CcdRgMu/Ft3jcqFd7dVRK.HSMerwlt9wXXeb5nwOIB/97rftHZDhm")
+
+func (ti *TokenIssuer) authenticate(clientID, secret string) (IssuerClient, bool) {
+	client, ok := ti.clients[clientID]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummySecretHash, []byte(secret))
+		return IssuerClient{}, false
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret))
+	return client, err == nil
+}
+
+func (ti *TokenIssuer) Token(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTokenRequest(r)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidRequest)
+		return
+	}
+
+	if req.GrantType != grantTypeClientCreds {
+		writeOAuthError(w, http.StatusBadRequest, oauthErrUnsupported)
+		return
+	}
+
+	if ti.audience != "" && req.Audience != "" && req.Audience != ti.audience {
+		writeOAuthError(w, http.StatusBadRequest, oauthErrInvalidRequest)
+		return
+	}
+
+	client, ok := ti.authenticate(req.ClientID, req.ClientSecret)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, oauthErrInvalidClient)
+		return
+	}
+
+	token, err := ti.issue(client)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFromCtx(r.Context()).Error("error signing token", err, "client", client.ClientID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(w).Encode(struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Scope       string `json:"scope,omitempty"`
+	}{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ti.ttl.Seconds()),
+		Scope:       strings.Join(client.Permissions, " "),
+	})
+	if err != nil {
+		loggerFromCtx(r.Context()).Error("error writing response", err)
+		return
+	}
+}
+
+func (ti *TokenIssuer) issue(client IssuerClient) (string, error) {
+	now := ti.now()
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ti.issuer,
+			Subject:   client.ClientID + "@clients",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ti.ttl)),
+			ID:        base64.RawURLEncoding.EncodeToString(jti),
+		},
+		Permissions:     client.Permissions,
+		AuthorizedParty: client.ClientID,
+	}
+	if ti.audience != "" {
+		claims.Audience = jwt.ClaimStrings{ti.audience}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = ti.keyID
+
+	return token.SignedString(ti.key)
+}
+
+func writeOAuthError(w http.ResponseWriter, code int, oauthErr string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kave"`)
+	}
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(map[string]string{"error": oauthErr})
+	if err != nil {
+		slog.Error("error writing response", err)
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestTokenIssuer(t *testing.T) *TokenIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, issuerKeyBits)
+	assert.NoError(t, err)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	issuer, err := NewTokenIssuer(
+		"https://kave.local/",
+		"https://kave.local/api",
+		0,
+		key,
+		[]IssuerClient{
+			{
+				ClientID:    "ci",
+				SecretHash:  string(hash),
+				Permissions: []string{"read:kave:foo", "write:kave:bar"},
+			},
+		},
+	)
+	assert.NoError(t, err)
+
+	return issuer
+}
+
+func TestTokenIssuer(t *testing.T) {
+	issuer := newTestTokenIssuer(t)
+
+	jwks, err := keyfunc.NewJSON(issuer.JWKSJSON())
+	assert.NoError(t, err)
+
+	// obtain a token with a json body, as the kave cli does
+	{
+		body, _ := json.Marshal(map[string]string{
+			"client_id":     "ci",
+			"client_secret": "secret",
+			"audience":      "https://kave.local/api",
+			"grant_type":    "client_credentials",
+		})
+
+		request := httptest.NewRequest(http.MethodPost, issuerTokenPath, bytes.NewBuffer(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+
+		issuer.Token(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		response := struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}{}
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+		assert.Equal(t, "Bearer", response.TokenType)
+		assert.Equal(t, int64(defaultIssuerTokenTTL.Seconds()), response.ExpiresIn)
+
+		claims := &Claims{}
+		_, err := jwt.ParseWithClaims(response.AccessToken, claims, jwks.Keyfunc)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"read:kave:foo", "write:kave:bar"}, claims.Permissions)
+		assert.Equal(t, "ci@clients", claims.Subject)
+		assert.Equal(t, "ci", claims.Client())
+		assert.Equal(t, "https://kave.local/", claims.Issuer)
+		assert.NotEmpty(t, claims.ID)
+	}
+
+	// obtain a token with a form body and basic auth
+	{
+		form := url.Values{"grant_type": {"client_credentials"}}
+
+		request := httptest.NewRequest(http.MethodPost, issuerTokenPath, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("ci", "secret")
+		recorder := httptest.NewRecorder()
+
+		issuer.Token(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+
+	// wrong secret
+	{
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {"ci"},
+			"client_secret": {"wrong"},
+		}
+
+		request := httptest.NewRequest(http.MethodPost, issuerTokenPath, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+
+		issuer.Token(recorder, request)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), oauthErrInvalidClient)
+	}
+
+	// unknown client
+	{
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {"unknown"},
+			"client_secret": {"secret"},
+		}
+
+		request := httptest.NewRequest(http.MethodPost, issuerTokenPath, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+
+		issuer.Token(recorder, request)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+
+	// unsupported grant type
+	{
+		form := url.Values{"grant_type": {"password"}}
+
+		request := httptest.NewRequest(http.MethodPost, issuerTokenPath, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("ci", "secret")
+		recorder := httptest.NewRecorder()
+
+		issuer.Token(recorder, request)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), oauthErrUnsupported)
+	}
+
+	// wrong audience
+	{
+		form := url.Values{
+			"grant_type": {"client_credentials"},
+			"audience":   {"https://elsewhere"},
+		}
+
+		request := httptest.NewRequest(http.MethodPost, issuerTokenPath, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("ci", "secret")
+		recorder := httptest.NewRecorder()
+
+		issuer.Token(recorder, request)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestNewTokenIssuerInvalidClients(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, issuerKeyBits)
+	assert.NoError(t, err)
+
+	// secret is not hashed
+	_, err = NewTokenIssuer("", "", 0, key, []IssuerClient{{ClientID: "ci", SecretHash: "secret"}})
+	assert.Error(t, err)
+
+	// missing client id
+	_, err = NewTokenIssuer("", "", 0, key, []IssuerClient{{SecretHash: string(dummySecretHash)}})
+	assert.Error(t, err)
+}
+
+func TestLoadOrGenerateSigningKey(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "issuer.pem")
+
+	// key is generated and persisted
+	key, err := loadOrGenerateSigningKey(keyFile)
+	assert.NoError(t, err)
+
+	info, err := os.Stat(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the same key is loaded afterwards
+	loaded, err := loadOrGenerateSigningKey(keyFile)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(loaded))
+}
+
+func TestCreateTokenIssuer(t *testing.T) {
+	var config Config
+	config.Auth.Issuer.Enabled = true
+
+	// keys are never ephemeral
+	_, err := createTokenIssuer(&config)
+	assert.Error(t, err)
+
+	config.Auth.Issuer.KeyFile = path.Join(t.TempDir(), "issuer.pem")
+	_, err = createTokenIssuer(&config)
+	assert.NoError(t, err)
+}
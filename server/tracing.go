@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pdcalado/kave/internal/version"
+)
+
+const (
+	tracerName = "github.com/pdcalado/kave/server"
+
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+	tracingExporterFile   = "file"
+
+	defaultTracingServiceName = "kave-server"
+)
+
+// tracer starts the spans of the server, they are dropped unless a tracer provider is set.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// TracingOptions configures how spans are sampled and exported.
+type TracingOptions struct {
+	Enabled bool `toml:"enabled"`
+	// Exporter is one of "otlp" (default), "stdout" or "file"
+	Exporter string `toml:"exporter"`
+	// Endpoint is the host:port of the OTLP/HTTP collector, the OTEL_EXPORTER_OTLP_* variables apply when empty
+	Endpoint string `toml:"endpoint"`
+	Insecure bool   `toml:"insecure"`
+	// File receives the spans of the file exporter, one JSON object each
+	File string `toml:"file"`
+	// SampleRatio of the traces started by the server, callers decide for the traces they propagate
+	SampleRatio *float64 `toml:"sample_ratio"`
+	ServiceName string   `toml:"service_name"`
+}
+
+// NewTracerProvider creates a tracer provider exporting spans as configured.
+func NewTracerProvider(ctx context.Context, options TracingOptions) (*sdktrace.TracerProvider, error) {
+	var exportOption sdktrace.TracerProviderOption
+
+	switch options.Exporter {
+	case "", tracingExporterOTLP:
+		var clientOptions []otlptracehttp.Option
+		if options.Endpoint != "" {
+			clientOptions = append(clientOptions, otlptracehttp.WithEndpoint(options.Endpoint))
+		}
+		if options.Insecure {
+			clientOptions = append(clientOptions, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err := otlptracehttp.New(ctx, clientOptions...)
+		if err != nil {
+			return nil, err
+		}
+		exportOption = sdktrace.WithBatcher(exporter)
+	case tracingExporterStdout, tracingExporterFile:
+		writer := os.Stdout
+		if options.Exporter == tracingExporterFile {
+			if options.File == "" {
+				return nil, fmt.Errorf("the file exporter requires a file")
+			}
+
+			file, err := os.OpenFile(options.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			writer = file
+		}
+
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(writer))
+		if err != nil {
+			return nil, err
+		}
+		// spans are written as they end, these exporters are meant for local testing
+		exportOption = sdktrace.WithSyncer(exporter)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter '%s'", options.Exporter)
+	}
+
+	ratio := 1.0
+	if options.SampleRatio != nil {
+		ratio = *options.SampleRatio
+	}
+
+	serviceName := options.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+
+	return sdktrace.NewTracerProvider(
+		exportOption,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(version.Version),
+		)),
+	), nil
+}
+
+// tracingMiddleware starts a span for each request, continuing the trace of
+// the caller from its traceparent header. It must be used on the root router
+// for the span to be named after the complete route pattern.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		// the query is left out, it may hold the signature of a pre-signed url
+		ctx, span := tracer().Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPTargetKey.String(r.URL.Path),
+				attribute.String("kave.request_id", middleware.GetReqID(r.Context())),
+			),
+		)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		if route := readRoutePatternFromCtx(r.Context()); route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRouteKey.String(route))
+		}
+	})
+}
+
+// redisTracingHook is a go-redis hook starting a span for each command.
+// Arguments are not recorded, they may hold values.
+type redisTracingHook struct{}
+
+func (h redisTracingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h redisTracingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := h.start(ctx, cmd.Name())
+		defer span.End()
+
+		err := next(ctx, cmd)
+		h.end(span, err)
+		return err
+	}
+}
+
+func (h redisTracingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := h.start(ctx, "pipeline")
+		defer span.End()
+
+		span.SetAttributes(attribute.Int("db.redis.num_cmd", len(cmds)))
+
+		err := next(ctx, cmds)
+		h.end(span, err)
+		return err
+	}
+}
+
+func (h redisTracingHook) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "redis "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemRedis,
+			semconv.DBOperationKey.String(operation),
+		),
+	)
+}
+
+func (h redisTracingHook) end(span trace.Span, err error) {
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pdcalado/kave/internal/policy"
+)
+
+// recordSpans sets a global tracer provider recording every span until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+
+	authMiddleware := NewAuthMiddleware(
+		func(token string) (*Claims, error) {
+			claims := &Claims{Permissions: []string{"read:foo"}}
+			claims.Subject = token
+			return claims, nil
+		},
+		writeClaimsToCtx,
+		nil,
+	)
+
+	permissionMiddleware := NewPermissionMiddleware("", policy.SyntaxGlob, readKeyFromCtx, readPermissionsFromCtx, readClaimsFromCtx)
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(tracingMiddleware)
+	router.Use(authMiddleware.Handler)
+	router.Route("/redis/{key}", func(r chi.Router) {
+		r.Use(injectKeyInCtx)
+		r.Use(permissionMiddleware.Handler)
+
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID := "00f067aa0ba902b7"
+
+	serve := func(method string, path string) {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer alice")
+		request.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", traceID, parentID))
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// requests continue the trace of the caller
+	{
+		serve(http.MethodGet, "/redis/foo")
+
+		spans := recorder.Ended()
+		assert.Len(t, spans, 3)
+
+		byName := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range spans {
+			assert.Equal(t, traceID, span.SpanContext().TraceID().String())
+			byName[span.Name()] = span
+		}
+
+		server := byName["GET /redis/{key}"]
+		assert.NotNil(t, server)
+		assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+		assert.Equal(t, parentID, server.Parent().SpanID().String())
+		assert.True(t, server.Parent().IsRemote())
+		assert.Equal(t, int64(http.StatusOK), spanAttribute(server, semconv.HTTPStatusCodeKey).AsInt64())
+		assert.Equal(t, "/redis/foo", spanAttribute(server, semconv.HTTPTargetKey).AsString())
+
+		auth := byName["AuthMiddleware"]
+		assert.NotNil(t, auth)
+		assert.Equal(t, server.SpanContext().SpanID(), auth.Parent().SpanID())
+		assert.Equal(t, "alice", spanAttribute(auth, semconv.EnduserIDKey).AsString())
+
+		permission := byName["PermissionMiddleware"]
+		assert.NotNil(t, permission)
+		assert.Equal(t, server.SpanContext().SpanID(), permission.Parent().SpanID())
+		assert.Equal(t, "read:foo", spanAttribute(permission, "kave.permission").AsString())
+		assert.True(t, spanAttribute(permission, "kave.allowed").AsBool())
+	}
+
+	// denied requests are traced
+	{
+		serve(http.MethodPost, "/redis/foo")
+
+		spans := recorder.Ended()[3:]
+		assert.Len(t, spans, 3)
+
+		for _, span := range spans {
+			if span.Name() == "PermissionMiddleware" {
+				assert.False(t, spanAttribute(span, "kave.allowed").AsBool())
+			}
+			if span.SpanKind() == trace.SpanKindServer {
+				assert.Equal(t, "POST /redis/{key}", span.Name())
+				assert.Equal(t, int64(http.StatusForbidden), spanAttribute(span, semconv.HTTPStatusCodeKey).AsInt64())
+			}
+		}
+	}
+}
+
+func TestRedisTracingHook(t *testing.T) {
+	recorder := recordSpans(t)
+
+	ctx := context.Background()
+
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		redisHost = "localhost"
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: redisHost + ":6379"})
+	client.AddHook(redisTracingHook{})
+	defer client.Close()
+
+	key := fmt.Sprintf("test-tracing-%d", time.Now().UnixNano())
+
+	ctx, parent := tracer().Start(ctx, "parent")
+	assert.Equal(t, redis.Nil, client.Get(ctx, key).Err())
+	parent.End()
+
+	var span sdktrace.ReadOnlySpan
+	for _, ended := range recorder.Ended() {
+		if ended.Name() == "redis get" {
+			span = ended
+		}
+	}
+
+	assert.NotNil(t, span)
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Equal(t, "redis", spanAttribute(span, semconv.DBSystemKey).AsString())
+	assert.Equal(t, "get", spanAttribute(span, semconv.DBOperationKey).AsString())
+	// missing keys are not errors
+	assert.Empty(t, span.Events())
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	ctx := context.Background()
+
+	// spans are written to the file as they end
+	{
+		path := filepath.Join(t.TempDir(), "spans.json")
+
+		provider, err := NewTracerProvider(ctx, TracingOptions{Exporter: tracingExporterFile, File: path})
+		assert.NoError(t, err)
+
+		_, span := provider.Tracer(tracerName).Start(ctx, "test span")
+		span.End()
+
+		buf, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Contains(t, string(buf), `"Name":"test span"`)
+		assert.Contains(t, string(buf), defaultTracingServiceName)
+	}
+
+	// the file exporter requires a file
+	{
+		_, err := NewTracerProvider(ctx, TracingOptions{Exporter: tracingExporterFile})
+		assert.Error(t, err)
+	}
+
+	// unknown exporters are rejected
+	{
+		_, err := NewTracerProvider(ctx, TracingOptions{Exporter: "jaeger"})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+const (
+	uiPath       = "/ui"
+	uiConfigPath = "/config.json"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiConfig tells the web UI where the API it uses is served, paths are empty
+// for the routes which are not enabled.
+type uiConfig struct {
+	BasePath  string `json:"base_path"`
+	Auth      bool   `json:"auth"`
+	AuthzPath string `json:"authz_path"`
+	AuditPath string `json:"audit_path"`
+	// LoginPath and LogoutPath start and end sessions, instead of tokens pasted by users
+	LoginPath  string `json:"login_path"`
+	LogoutPath string `json:"logout_path"`
+}
+
+// NewUIHandler serves the web UI, it must be mounted at uiPath. The UI is
+// static, it calls the API with the token of its user.
+func NewUIHandler(config uiConfig) (http.Handler, error) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		return nil, err
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	fileServer := http.StripPrefix(uiPath, http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, uiPath)
+
+		switch path {
+		case "":
+			http.Redirect(w, r, uiPath+"/", http.StatusMovedPermanently)
+			return
+		case uiConfigPath:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-cache")
+			_, err := w.Write(configJSON)
+			if err != nil {
+				loggerFromCtx(r.Context()).Error("error writing response", err)
+			}
+			return
+		}
+
+		// the files change with the server, browsers must check for new ones
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,341 @@
+"use strict";
+
+// The UI only uses the HTTP API of the server, as any other client would.
+(function () {
+  const tokenStorageKey = "kave-token";
+  const historyLimit = 20;
+
+  const $ = (id) => document.getElementById(id);
+
+  let config = { base_path: "/redis", auth: false, authz_path: "", audit_path: "", login_path: "", logout_path: "" };
+  let cursor = "";
+  let selected = null;
+  let selectedValue = "";
+
+  function setStatus(message, isError) {
+    $("status").textContent = message;
+    $("status").className = isError ? "error" : "";
+  }
+
+  function token() {
+    return sessionStorage.getItem(tokenStorageKey) || "";
+  }
+
+  async function api(path, options) {
+    options = options || {};
+    options.headers = options.headers || {};
+    if (config.auth && token()) {
+      options.headers["Authorization"] = "Bearer " + token();
+    }
+    // sent along for the sessions of the server, if any
+    options.credentials = "same-origin";
+    return fetch(path, options);
+  }
+
+  function keyPath(key) {
+    return config.base_path + "/" + encodeURIComponent(key);
+  }
+
+  function formatTTL(ms) {
+    if (!ms) {
+      return "";
+    }
+    const seconds = Math.round(ms / 1000);
+    if (seconds < 60) {
+      return seconds + "s";
+    }
+    if (seconds < 3600) {
+      return Math.round(seconds / 60) + "m";
+    }
+    if (seconds < 86400) {
+      return Math.round(seconds / 3600) + "h";
+    }
+    return Math.round(seconds / 86400) + "d";
+  }
+
+  function escapeHTML(s) {
+    return s.replace(/[&<>"']/g, (c) => ({
+      "&": "&amp;",
+      "<": "&lt;",
+      ">": "&gt;",
+      '"': "&quot;",
+      "'": "&#39;",
+    })[c]);
+  }
+
+  // highlightJSON returns the HTML of a JSON value, with its tokens styled.
+  function highlightJSON(text) {
+    const pattern = /("(?:\\.|[^"\\])*")(\s*:)?|\b(true|false|null)\b|(-?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?)/g;
+    let html = "";
+    let last = 0;
+    let match;
+    while ((match = pattern.exec(text)) !== null) {
+      html += escapeHTML(text.slice(last, match.index));
+      if (match[1] !== undefined) {
+        const cls = match[2] ? "json-key" : "json-string";
+        html += '<span class="' + cls + '">' + escapeHTML(match[1]) + "</span>" + escapeHTML(match[2] || "");
+      } else if (match[3] !== undefined) {
+        html += '<span class="json-literal">' + match[3] + "</span>";
+      } else {
+        html += '<span class="json-number">' + match[4] + "</span>";
+      }
+      last = pattern.lastIndex;
+    }
+    return html + escapeHTML(text.slice(last));
+  }
+
+  function renderValue(value) {
+    try {
+      const pretty = JSON.stringify(JSON.parse(value), null, 2);
+      $("value").innerHTML = highlightJSON(pretty);
+    } catch (e) {
+      $("value").textContent = value;
+    }
+  }
+
+  async function listKeys(reset) {
+    if (reset) {
+      cursor = "";
+      $("keys").replaceChildren();
+    }
+
+    const params = new URLSearchParams({ prefix: $("prefix").value });
+    if (cursor) {
+      params.set("cursor", cursor);
+    }
+
+    const response = await api(config.base_path + "/?" + params);
+    if (response.status === 401 && config.login_path) {
+      setStatus("sign in to list keys", true);
+      return;
+    }
+    if (!response.ok) {
+      setStatus("listing keys failed: " + response.status + " " + response.statusText, true);
+      return;
+    }
+
+    const page = await response.json();
+    for (const info of page.keys) {
+      const item = document.createElement("li");
+      item.dataset.key = info.key;
+
+      const name = document.createElement("span");
+      name.textContent = info.key;
+      item.append(name);
+
+      if (info.ttl_ms) {
+        const ttl = document.createElement("span");
+        ttl.className = "ttl";
+        ttl.textContent = formatTTL(info.ttl_ms);
+        item.append(ttl);
+      }
+
+      item.addEventListener("click", () => openKey(info.key, info.ttl_ms));
+      $("keys").append(item);
+    }
+
+    cursor = page.cursor || "";
+    $("more").hidden = !cursor;
+    setStatus($("keys").children.length + " keys", false);
+  }
+
+  async function checkPermissions(key) {
+    // every action is permitted without auth
+    if (!config.authz_path) {
+      return { read: { allowed: true }, write: { allowed: true } };
+    }
+
+    const checks = {};
+    for (const operation of ["read", "write"]) {
+      const response = await api(config.authz_path, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ key: key, operation: operation }),
+      });
+      checks[operation] = response.ok ? await response.json() : { allowed: false, reason: response.statusText };
+    }
+    return checks;
+  }
+
+  function renderPermissions(checks) {
+    $("permissions").replaceChildren();
+    for (const operation of ["read", "write"]) {
+      const badge = document.createElement("span");
+      badge.className = checks[operation].allowed ? "allowed" : "denied";
+      badge.textContent = operation + (checks[operation].allowed ? " allowed" : " denied");
+      if (checks[operation].reason) {
+        badge.title = checks[operation].reason;
+      }
+      $("permissions").append(badge);
+    }
+    $("edit").disabled = !checks.write.allowed;
+  }
+
+  async function loadHistory(key) {
+    const tbody = $("history").querySelector("tbody");
+    tbody.replaceChildren();
+    $("history").hidden = true;
+
+    if (!config.audit_path) {
+      $("history-note").textContent = "The audit log is not enabled.";
+      return;
+    }
+
+    const params = new URLSearchParams({ key: key, limit: historyLimit });
+    const response = await api(config.audit_path + "?" + params);
+    if (response.status === 403) {
+      $("history-note").textContent = "History requires the admin:audit permission.";
+      return;
+    }
+    if (!response.ok) {
+      $("history-note").textContent = "Loading history failed: " + response.status + " " + response.statusText;
+      return;
+    }
+
+    const events = await response.json();
+    $("history-note").textContent = events.length ? "" : "No recorded operations.";
+
+    for (const event of events.reverse()) {
+      const row = document.createElement("tr");
+      for (const cell of [event.time, event.operation, event.outcome, event.subject || "", event.client || ""]) {
+        const td = document.createElement("td");
+        td.textContent = cell;
+        row.append(td);
+      }
+      tbody.append(row);
+    }
+    $("history").hidden = events.length === 0;
+  }
+
+  async function openKey(key, ttlMs) {
+    selected = key;
+    selectedValue = "";
+
+    for (const item of $("keys").children) {
+      item.classList.toggle("selected", item.dataset.key === key);
+    }
+
+    $("detail").hidden = false;
+    $("editor").hidden = true;
+    $("viewer").hidden = false;
+    $("key-name").textContent = key;
+    $("key-ttl").textContent = ttlMs ? "Expires in " + formatTTL(ttlMs) : "";
+
+    const checks = await checkPermissions(key);
+    renderPermissions(checks);
+
+    if (checks.read.allowed) {
+      const response = await api(keyPath(key));
+      if (response.ok) {
+        selectedValue = await response.text();
+        renderValue(selectedValue);
+      } else if (response.status === 404) {
+        $("value").textContent = "This key has no value yet.";
+      } else {
+        $("value").textContent = "";
+        setStatus("reading " + key + " failed: " + response.status + " " + response.statusText, true);
+      }
+    } else {
+      $("value").textContent = "You may not read this key.";
+    }
+
+    await loadHistory(key);
+  }
+
+  async function saveKey(event) {
+    event.preventDefault();
+
+    const response = await api(keyPath(selected), {
+      method: "POST",
+      body: $("value-input").value,
+    });
+    if (!response.ok) {
+      setStatus("saving " + selected + " failed: " + response.status + " " + (await response.text()), true);
+      return;
+    }
+
+    setStatus("saved " + selected, false);
+    await openKey(selected);
+  }
+
+  function init() {
+    if (config.auth) {
+      $("token-form").hidden = false;
+      $("token").value = token();
+    }
+
+    // the session cookie is sent along with every request once signed in
+    if (config.login_path) {
+      $("session").hidden = false;
+      $("login").href = config.login_path + "?" + new URLSearchParams({ return_to: location.pathname });
+    }
+
+    $("logout").addEventListener("click", async () => {
+      await fetch(config.logout_path, { method: "POST", credentials: "same-origin" });
+      $("detail").hidden = true;
+      $("keys").replaceChildren();
+      setStatus("signed out", false);
+    });
+
+    $("token-form").addEventListener("submit", (event) => {
+      event.preventDefault();
+      sessionStorage.setItem(tokenStorageKey, $("token").value.trim());
+      listKeys(true);
+    });
+
+    $("forget-token").addEventListener("click", () => {
+      sessionStorage.removeItem(tokenStorageKey);
+      $("token").value = "";
+      $("detail").hidden = true;
+      $("keys").replaceChildren();
+    });
+
+    $("prefix-form").addEventListener("submit", (event) => {
+      event.preventDefault();
+      listKeys(true);
+    });
+
+    $("more").addEventListener("click", () => listKeys(false));
+
+    $("new-key-form").addEventListener("submit", (event) => {
+      event.preventDefault();
+      const key = $("new-key").value.trim();
+      if (key) {
+        openKey(key);
+      }
+    });
+
+    $("edit").addEventListener("click", () => {
+      $("value-input").value = selectedValue;
+      $("viewer").hidden = true;
+      $("editor").hidden = false;
+    });
+
+    $("cancel").addEventListener("click", () => {
+      $("viewer").hidden = false;
+      $("editor").hidden = true;
+    });
+
+    $("format").addEventListener("click", () => {
+      try {
+        $("value-input").value = JSON.stringify(JSON.parse($("value-input").value), null, 2);
+      } catch (e) {
+        setStatus("not valid JSON: " + e.message, true);
+      }
+    });
+
+    $("editor").addEventListener("submit", saveKey);
+
+    if (!config.auth || token() || config.login_path) {
+      listKeys(true);
+    }
+  }
+
+  fetch("config.json")
+    .then((response) => response.json())
+    .then((loaded) => {
+      config = loaded;
+      init();
+    })
+    .catch((e) => setStatus("loading config failed: " + e.message, true));
+})();
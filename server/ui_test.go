@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUIHandler(t *testing.T) {
+	handler, err := NewUIHandler(uiConfig{BasePath: "/redis", Auth: true, AuthzPath: authzCheckPath})
+	assert.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Mount(uiPath, handler)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	// the UI is served from its directory
+	{
+		recorder := serve(uiPath)
+		assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+		assert.Equal(t, uiPath+"/", recorder.Header().Get("Location"))
+
+		recorder = serve(uiPath + "/")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), `<script src="app.js">`)
+
+		recorder = serve(uiPath + "/app.js")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Header().Get("Content-Type"), "javascript")
+	}
+
+	// the UI is told where the API is
+	{
+		recorder := serve(uiPath + uiConfigPath)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.JSONEq(t, `{"base_path":"/redis","auth":true,"authz_path":"/_authz/check","audit_path":"","login_path":"","logout_path":""}`, recorder.Body.String())
+	}
+
+	// unknown files are not found
+	{
+		recorder := serve(uiPath + "/nope.js")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+)
+
+const (
+	keyEventSet    = "set"
+	keyEventDelete = "delete"
+)
+
+// KeyEvent is a change of a key made through the server.
+type KeyEvent struct {
+	// Type is "set" or "delete"
+	Type string `json:"type"`
+	// Key including the key prefix
+	Key string `json:"key"`
+	// Value set, empty for deletes
+	Value []byte `json:"value,omitempty"`
+}
+
+// keyEventBus delivers the key events published by every server to their watchers.
+type keyEventBus interface {
+	Publish(ctx context.Context, event KeyEvent) error
+	// Subscribe returns the events published from now on, until ctx is done
+	Subscribe(ctx context.Context) (<-chan KeyEvent, error)
+}
+
+// notifyingKeyValue publishes the changes made to the keys of a KeyValue.
+type notifyingKeyValue struct {
+	KeyValue
+	bus keyEventBus
+}
+
+// newNotifyingKeyValue wraps keyValue, publishing its changes to bus.
+// Keys changed in Redis by other means are not seen.
+func newNotifyingKeyValue(keyValue KeyValue, bus keyEventBus) *notifyingKeyValue {
+	return &notifyingKeyValue{
+		KeyValue: keyValue,
+		bus:      bus,
+	}
+}
+
+func (kv *notifyingKeyValue) Set(ctx context.Context, key string, value []byte) error {
+	if err := kv.KeyValue.Set(ctx, key, value); err != nil {
+		return err
+	}
+
+	kv.publish(ctx, KeyEvent{Type: keyEventSet, Key: key, Value: value})
+	return nil
+}
+
+func (kv *notifyingKeyValue) Delete(ctx context.Context, key string) error {
+	if err := kv.KeyValue.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	kv.publish(ctx, KeyEvent{Type: keyEventDelete, Key: key})
+	return nil
+}
+
+func (kv *notifyingKeyValue) publish(ctx context.Context, event KeyEvent) {
+	publishKeyEvent(ctx, kv.bus, event)
+}
+
+// publishKeyEvent does not fail the change already made, watchers miss it instead.
+func publishKeyEvent(ctx context.Context, bus keyEventBus, event KeyEvent) {
+	if err := bus.Publish(ctx, event); err != nil {
+		loggerFromCtx(ctx).Error("error publishing key event", err)
+	}
+}